@@ -0,0 +1,192 @@
+package caching
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminSecretDir is the directory of the secret file of EnableAdmin in the Varnish container, which is a volume
+// for copyPrivateFiles.
+const adminSecretDir = "/etc/varnish-admin"
+
+// adminSecretFile is the secret file of EnableAdmin in the Varnish container.
+const adminSecretFile = adminSecretDir + "/secret"
+
+// adminTimeout limits how long a command of an AdminClient may take, including authentication.
+const adminTimeout = 30 * time.Second
+
+// newAdminSecret creates a random secret for the CLI of Varnish and a directory on the host with a secret file
+// containing it, which only the current user can read. It returns the directory, the file and the secret, which is
+// copied into the container for the varnish user only (see copyPrivateFiles) rather than mounted from the host.
+func newAdminSecret() (string, string, string, error) {
+	// MkdirTemp creates the directory for the current user only
+	dir, err := os.MkdirTemp("", "varnish-admin")
+	if err != nil {
+		return "", "", "", err
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", "", err
+	}
+	secret := hex.EncodeToString(random) + "\n"
+	secretFile := filepath.Join(dir, "secret")
+	err = os.WriteFile(secretFile, []byte(secret), 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", "", err
+	}
+	return dir, secretFile, secret, nil
+}
+
+// AdminError is a response of the CLI of Varnish whose status is not 200, e.g. 106 for a syntax error in
+// a ban expression, 300 for an unknown command or 500 if authentication failed, which closes the connection.
+type AdminError struct {
+	Command string
+	Status  int
+	Output  string
+}
+
+func (e *AdminError) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.Command, e.Status, strings.TrimSpace(e.Output))
+}
+
+// AdminClient is a connection to the CLI of Varnish, authenticated with the secret file like varnishadm -T -S,
+// the way operators administer Varnish remotely, e.g. to ban objects. It must not be used concurrently.
+type AdminClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// DialAdmin connects to the CLI of Varnish at the given port of localhost and authenticates with the secret in
+// the given file, e.g. the AdminPort and the AdminSecretFile of a VarnishInstance.
+func DialAdmin(port string, secretFile string) (*AdminClient, error) {
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", "localhost:"+port, adminTimeout)
+	if err != nil {
+		return nil, err
+	}
+	a := &AdminClient{conn: conn, reader: bufio.NewReader(conn)}
+	err = a.authenticate(secret)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// authenticate answers the challenge Varnish greets the client with, unless Varnish requires no authentication:
+// the answer is the SHA-256 of the challenge, the secret and the challenge again, each challenge followed by
+// a newline.
+func (a *AdminClient) authenticate(secret []byte) error {
+	err := a.conn.SetDeadline(time.Now().Add(adminTimeout))
+	if err != nil {
+		return err
+	}
+	status, output, err := a.readResponse()
+	if err != nil {
+		return err
+	}
+	if status == 200 {
+		return nil
+	}
+	if status != 107 {
+		return &AdminError{Command: "connect", Status: status, Output: output}
+	}
+	challenge, _, _ := strings.Cut(output, "\n")
+	hash := sha256.New()
+	hash.Write([]byte(challenge + "\n"))
+	hash.Write(secret)
+	hash.Write([]byte(challenge + "\n"))
+	_, err = a.Run("auth", hex.EncodeToString(hash.Sum(nil)))
+	return err
+}
+
+// Run sends the given command with the given arguments, which are quoted as needed, and returns the output
+// of the command. A status other than 200 is reported as an AdminError.
+func (a *AdminClient) Run(command string, args ...string) (string, error) {
+	err := a.conn.SetDeadline(time.Now().Add(adminTimeout))
+	if err != nil {
+		return "", err
+	}
+	line := command
+	for _, arg := range args {
+		line += " " + quoteCliArg(arg)
+	}
+	_, err = io.WriteString(a.conn, line+"\n")
+	if err != nil {
+		return "", err
+	}
+	status, output, err := a.readResponse()
+	if err != nil {
+		return "", err
+	}
+	if status != 200 {
+		return output, &AdminError{Command: command, Status: status, Output: output}
+	}
+	return output, nil
+}
+
+// Close closes the connection to the CLI.
+func (a *AdminClient) Close() error {
+	return a.conn.Close()
+}
+
+// readResponse reads a response of the CLI, which starts with a line of the status and the length of the output,
+// e.g. "200 12      ", followed by the output and a newline.
+func (a *AdminClient) readResponse() (int, string, error) {
+	header, err := a.reader.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("unexpected response of the CLI: %q", header)
+	}
+	status, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("unexpected status of the CLI: %q", header)
+	}
+	length, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, "", fmt.Errorf("unexpected length of the CLI: %q", header)
+	}
+	output := make([]byte, length+1)
+	_, err = io.ReadFull(a.reader, output)
+	if err != nil {
+		return 0, "", err
+	}
+	return status, string(output[:length]), nil
+}
+
+// quoteCliArg quotes the given argument of a CLI command if it is empty or contains whitespace, quotes
+// or backslashes, which the CLI would otherwise split or unescape.
+func quoteCliArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n\"\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(arg) + `"`
+}
+
+// Admin connects to the CLI of the instance, which requires VarnishConfig.EnableAdmin.
+// The caller closes the client.
+func (v *VarnishInstance) Admin() (*AdminClient, error) {
+	if v.AdminPort == "" {
+		return nil, fmt.Errorf("the CLI of Varnish is not exposed, see VarnishConfig.EnableAdmin")
+	}
+	return DialAdmin(v.AdminPort, v.AdminSecretFile)
+}
@@ -0,0 +1,156 @@
+// Contains tests for the CLI of Varnish exposed to the host
+package caching_test
+
+import (
+	"bufio"
+	"caching"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAdminBan tests banning objects through the exposed CLI the way operators do with varnishadm -T -S:
+// the banned objects are fetched again, while the others stay cached, and the ban is listed by ban.list.
+func TestAdminBan(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start test server
+	port, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with the CLI exposed
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: port,
+		EnableAdmin: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+	admin, err := instance.Admin()
+	require.NoError(t, err)
+	defer admin.Close()
+	status, err := admin.Run("status")
+	require.NoError(t, err)
+	assert.Contains(t, status, "running")
+
+	// send requests for a product and another page, which are cached
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "1", withPath("/products/1"), withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "2", withPath("/about"), withXCacheControl(cacheControl)))
+
+	// ban the products and expect the ban to be listed
+	_, err = admin.Run("ban", "req.url", "~", "^/products/")
+	require.NoError(t, err)
+	bans, err := admin.Run("ban.list")
+	require.NoError(t, err)
+	assert.Contains(t, bans, "req.url ~ ^/products/")
+
+	// send requests again, of which only the one for the product is a miss
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "3", withPath("/products/1"), withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "4", withPath("/about"), withXCacheControl(cacheControl)))
+
+	// expect an invalid ban to be rejected with a syntax error
+	_, err = admin.Run("ban", "req.url", "~~", "^/")
+	var adminError *caching.AdminError
+	require.ErrorAs(t, err, &adminError)
+	assert.Equal(t, 106, adminError.Status)
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestAdminWrongSecret tests that the exposed CLI rejects clients which do not know the secret.
+func TestAdminWrongSecret(t *testing.T) {
+	t.Parallel()
+
+	// start varnish container with the CLI exposed
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: "8080",
+		EnableAdmin: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// connect with another secret and expect authentication to fail, which closes the connection
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("wrong\n"), 0600))
+	_, err = caching.DialAdmin(instance.AdminPort, secretFile)
+	var adminError *caching.AdminError
+	require.ErrorAs(t, err, &adminError)
+	assert.Equal(t, "auth", adminError.Command)
+	assert.Equal(t, 500, adminError.Status)
+}
+
+// TestAdminClient tests the CLI protocol of the AdminClient against a fake CLI, which requires authentication
+// and responds with the command lines it receives.
+func TestAdminClient(t *testing.T) {
+	t.Parallel()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cr3t\n"), 0600))
+	challenge := strings.Repeat("abcdefgh", 4)
+	hash := sha256.Sum256([]byte(challenge + "\ns3cr3t\n" + challenge + "\n"))
+
+	// start a fake CLI for a single connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		respond := func(status int, output string) {
+			_, _ = fmt.Fprintf(conn, "%03d %-8d\n%s\n", status, len(output), output)
+		}
+		respond(107, challenge+"\n\nAuthentication required.\n")
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "auth "+hex.EncodeToString(hash[:]):
+				respond(200, "Varnish Cache CLI 1.0")
+			case strings.HasPrefix(line, "unknown"):
+				respond(300, "Unknown request.")
+			default:
+				respond(200, line)
+			}
+		}
+	}()
+
+	// connect and expect arguments to be quoted as needed
+	admin, err := caching.DialAdmin(fmt.Sprint(l.Addr().(*net.TCPAddr).Port), secretFile)
+	require.NoError(t, err)
+	defer admin.Close()
+	output, err := admin.Run("ban", "req.url", "~", `^/a b"c\d$`)
+	require.NoError(t, err)
+	assert.Equal(t, `ban req.url ~ "^/a b\"c\\d$"`, output)
+	output, err = admin.Run("param.set", "feature", "")
+	require.NoError(t, err)
+	assert.Equal(t, `param.set feature ""`, output)
+
+	// expect a status other than 200 to be reported as an error
+	_, err = admin.Run("unknown")
+	var adminError *caching.AdminError
+	require.ErrorAs(t, err, &adminError)
+	assert.Equal(t, 300, adminError.Status)
+	assert.EqualError(t, err, "unknown failed with status 300: Unknown request.")
+}
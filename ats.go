@@ -0,0 +1,140 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const atsImage = "trafficserver/trafficserver:9.2.4"
+
+// atsConfigDir is where the image expects the configuration files.
+const atsConfigDir = "/opt/etc/trafficserver"
+
+// AtsCacheConfig is the Apache Traffic Server equivalent of VarnishConfig.
+type AtsCacheConfig struct {
+	BackendPort string
+	// DefaultTtl is rendered as the heuristic lifetime, which ATS applies to
+	// responses without explicit expiration like the default TTL of Varnish.
+	DefaultTtl string
+	// MaxStaleAge is the time ATS serves stale responses when the backend is unavailable.
+	// Note that this is closer to stale-if-error than to the grace period of Varnish.
+	MaxStaleAge string
+	// NegativeCachingTtl enables caching of error responses (like 404) without explicit
+	// expiration, which Varnish does by default but ATS does not.
+	NegativeCachingTtl string
+	// Records are additional lines added to records.config.
+	Records []string
+}
+
+// renderAtsRecords renders records.config for the given config. All state paths point
+// to /tmp, because the container runs with a read-only root filesystem.
+func renderAtsRecords(config AtsCacheConfig) (string, error) {
+	ttl, err := durationSeconds(config.DefaultTtl)
+	if err != nil {
+		return "", err
+	}
+	maxStaleAge, err := durationSeconds(config.MaxStaleAge)
+	if err != nil {
+		return "", err
+	}
+	negativeTtl, err := durationSeconds(config.NegativeCachingTtl)
+	if err != nil {
+		return "", err
+	}
+	records := []string{
+		"CONFIG proxy.config.http.server_ports STRING 8080",
+		"CONFIG proxy.config.local_state_dir STRING /tmp",
+		"CONFIG proxy.config.log.logfile_dir STRING /tmp",
+		"CONFIG proxy.config.http.cache.http INT 1",
+		"CONFIG proxy.config.url_remap.remap_required INT 1",
+		// do not require Last-Modified or explicit expiration to cache a response
+		"CONFIG proxy.config.http.cache.required_headers INT 0",
+		fmt.Sprintf("CONFIG proxy.config.http.cache.heuristic_min_lifetime INT %d", ttl),
+		fmt.Sprintf("CONFIG proxy.config.http.cache.heuristic_max_lifetime INT %d", ttl),
+		fmt.Sprintf("CONFIG proxy.config.http.cache.max_stale_age INT %d", maxStaleAge),
+	}
+	if negativeTtl > 0 {
+		records = append(records,
+			"CONFIG proxy.config.http.negative_caching_enabled INT 1",
+			fmt.Sprintf("CONFIG proxy.config.http.negative_caching_lifetime INT %d", negativeTtl))
+	}
+	records = append(records, config.Records...)
+	return strings.Join(records, "\n") + "\n", nil
+}
+
+// durationSeconds converts an optional duration like "1s" to whole seconds.
+func durationSeconds(s string) (int, error) {
+	d, err := time.ParseDuration(withDefault(s, "0s"))
+	if err != nil {
+		return 0, err
+	}
+	return int(d / time.Second), nil
+}
+
+// StartAtsInDocker starts Apache Traffic Server as a caching reverse proxy in front of the backend
+// in the same way StartVarnishInDocker does for Varnish. It only returns once ATS is healthy,
+// because ATS takes considerably longer to start up than Varnish.
+func StartAtsInDocker(config AtsCacheConfig) (string, func() error, error) {
+	err := pullImage(context.Background(), atsImage, "", "", nil)
+	if err != nil {
+		return "", nil, err
+	}
+	records, err := renderAtsRecords(config)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// write the config files in a temporary directory
+	tmpDir, err := os.MkdirTemp("", "ats")
+	if err != nil {
+		return "", nil, err
+	}
+	// the temporary directory is kept until the container is stopped
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	files := map[string]string{
+		"records.config": records,
+		// map every request to the backend regardless of the Host header
+		"remap.config": "regex_map http://(.*)/ http://host.docker.internal:" + config.BackendPort + "/\n",
+		// use a small cache file in the tmpfs
+		"storage.config": "/tmp 16M\n",
+	}
+	var binds []string
+	for name, content := range files {
+		fileName := path.Join(tmpDir, name)
+		err = os.WriteFile(fileName, []byte(content), 0644)
+		if err != nil {
+			return "", nil, err
+		}
+		binds = append(binds, fileName+":"+path.Join(atsConfigDir, name))
+	}
+
+	// create and start an ATS container
+	port, stopFunc, err := startContainer(&container.Config{
+		Image: atsImage,
+		User:  "1000:1000",
+		Cmd:   []string{"traffic_server"},
+		ExposedPorts: nat.PortSet{
+			"8080/tcp": struct{}{},
+		},
+	}, newHostConfig("8080/tcp", binds...), "8080/tcp")
+	if err != nil {
+		return "", nil, err
+	}
+	err = waitUntilHealthy(port, 30*time.Second)
+	if err != nil {
+		stopFunc()
+		return "", nil, err
+	}
+	return port, removeOnStop(tmpDir, stopFunc), nil
+}
@@ -0,0 +1,111 @@
+// Contains tests running scenarios of the Varnish tests against Apache Traffic Server to document behavioural differences
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestAtsCacheControlMaxAge1 is the ATS equivalent of TestCacheControlMaxAge1.
+func TestAtsCacheControlMaxAge1(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start ATS container
+	port, stopFunc, err := caching.StartAtsInDocker(caching.AtsCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+
+	// send request to ATS
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).xResponse)
+
+	// send another request and expect to receive a cached response
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).xResponse)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestAtsDoesNotCache404ByDefault tests a difference to Varnish (see TestCachingOf404): ATS does not
+// cache a 404 response without explicit expiration unless negative caching is enabled.
+func TestAtsDoesNotCache404ByDefault(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		xStatusCode, err := strconv.Atoi(r.Header.Get("X-Status-Code"))
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		assert.NoError(t, err)
+		w.WriteHeader(xStatusCode)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start ATS container
+	port, stopFunc, err := caching.StartAtsInDocker(caching.AtsCacheConfig{
+		BackendPort: testServerPort,
+		DefaultTtl:  "10s",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+
+	// send request and expect the backend to respond with 404
+	assert.Equal(t, "foo", mkReq(t, port, "foo", withXStatusCode(http.StatusNotFound)).xResponse)
+
+	// wait a bit
+	time.Sleep(100 * time.Millisecond)
+
+	// send another request and expect the backend to be asked again
+	assert.Equal(t, "bar", mkReq(t, port, "bar", withXStatusCode(http.StatusNotFound)).xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestAtsNegativeCachingOf404 tests that enabling negative caching makes ATS cache a 404 response
+// like Varnish does by default.
+func TestAtsNegativeCachingOf404(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		xStatusCode, err := strconv.Atoi(r.Header.Get("X-Status-Code"))
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		assert.NoError(t, err)
+		w.WriteHeader(xStatusCode)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start ATS container
+	port, stopFunc, err := caching.StartAtsInDocker(caching.AtsCacheConfig{
+		BackendPort:        testServerPort,
+		NegativeCachingTtl: "10s",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+
+	// send request and expect the backend to respond with 404
+	assert.Equal(t, "foo", mkReq(t, port, "foo", withXStatusCode(http.StatusNotFound)).xResponse)
+
+	// send another request which the backend would respond with 200 but expect the previous cached 404 response
+	resp := mkReq(t, port, "bar", withXStatusCode(http.StatusOK))
+	assert.Equal(t, http.StatusNotFound, resp.statusCode)
+	assert.Equal(t, "foo", resp.xResponse)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
@@ -0,0 +1,86 @@
+// Contains tests for the requests Varnish sends to the backend
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestBackendRequestHeaders tests that BackendRequestHeaders are set on or removed from both
+// cacheable and passed backend requests.
+func TestBackendRequestHeaders(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		BackendRequestHeaders: map[string]string{
+			"Accept-Encoding": "gzip",
+			"X-Origin-Secret": "s3cret",
+			"X-Debug":         "",
+		},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a cacheable and a passed request
+	assert.Equal(t, mkResp(http.StatusOK, "1"),
+		mkReq(t, port, "1", withAcceptEncoding("identity"), withRequestHeader("X-Debug", "1")))
+	assert.Equal(t, mkResp(http.StatusOK, "2", withAcceptRanges("")),
+		mkReq(t, port, "2", withMethod(http.MethodPost), withAcceptEncoding("identity"), withRequestHeader("X-Debug", "1")))
+
+	// expect 2 backend requests with the configured headers
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"gzip", "gzip"}, recorder.Headers("Accept-Encoding"))
+	assert.Equal(t, []string{"s3cret", "s3cret"}, recorder.Headers("X-Origin-Secret"))
+	assert.Equal(t, []string{"", ""}, recorder.Headers("X-Debug"))
+}
+
+// TestBackendRequestHeadersNotSent tests that without BackendRequestHeaders, client request headers
+// are passed on to the backend.
+func TestBackendRequestHeadersNotSent(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a passed request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withAcceptRanges("")),
+		mkReq(t, port, "1", withMethod(http.MethodPost), withAcceptEncoding("identity"), withRequestHeader("X-Debug", "1")))
+
+	// expect 1 backend request with the headers of the client
+	assert.Equal(t, 1, backendRequests)
+	assert.Equal(t, []string{"identity"}, recorder.Headers("Accept-Encoding"))
+	assert.Equal(t, []string{"1"}, recorder.Headers("X-Debug"))
+}
+
+// TestInvalidBackendRequestHeaders tests that header names and values which cannot be rendered as VCL are rejected.
+func TestInvalidBackendRequestHeaders(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.BackendRequestHeaders = map[string]string{"Accept-Encoding": "gzip", "X Forwarded": "1", "X-Value": `"}`}
+	}))
+	assert.EqualError(t, err, `BackendRequestHeaders must map header names, not "X Forwarded"
+BackendRequestHeaders[X-Value] must not contain "}`)
+}
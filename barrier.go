@@ -0,0 +1,98 @@
+package caching
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Barriers are named synchronization points between a test and its backend, like the barriers of varnishtest.
+// A backend handler wrapped by Wait blocks at the barrier of the given name until the test releases it,
+// such that tests can deterministically send further client requests while a backend fetch is still in progress.
+// The zero value is ready to use. It is safe for concurrent use.
+type Barriers struct {
+	mutex    sync.Mutex
+	barriers map[string]*barrier
+}
+
+type barrier struct {
+	arrivals int
+	// arrived is closed and replaced on every arrival, to wake up AwaitArrivals.
+	arrived  chan struct{}
+	released chan struct{}
+}
+
+// barrier returns the barrier of the given name, creating it if needed. The mutex must be held.
+func (b *Barriers) barrier(name string) *barrier {
+	if b.barriers == nil {
+		b.barriers = map[string]*barrier{}
+	}
+	br, ok := b.barriers[name]
+	if !ok {
+		br = &barrier{arrived: make(chan struct{}), released: make(chan struct{})}
+		b.barriers[name] = br
+	}
+	return br
+}
+
+// Wait returns a backend handler which blocks each request at the barrier of the given name until
+// it is released, before passing it on to next. Requests arriving after the release pass right through,
+// and requests whose client (Varnish) gives up while blocked are dropped without a response.
+func (b *Barriers) Wait(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b.mutex.Lock()
+		br := b.barrier(name)
+		br.arrivals++
+		close(br.arrived)
+		br.arrived = make(chan struct{})
+		released := br.released
+		b.mutex.Unlock()
+		select {
+		case <-released:
+			next(w, r)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// Release releases all requests blocked at the barrier of the given name and all requests arriving later on.
+// Releasing a barrier twice has no effect.
+func (b *Barriers) Release(name string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	br := b.barrier(name)
+	select {
+	case <-br.released:
+	default:
+		close(br.released)
+	}
+}
+
+// AwaitArrivals waits until n requests in total have arrived at the barrier of the given name,
+// whether they are still blocked or not. It fails if they did not arrive within the given timeout.
+func (b *Barriers) AwaitArrivals(name string, n int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		b.mutex.Lock()
+		br := b.barrier(name)
+		arrivals, arrived := br.arrivals, br.arrived
+		b.mutex.Unlock()
+		if arrivals >= n {
+			return nil
+		}
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return fmt.Errorf("only %d of %d requests arrived at barrier %s within %s", arrivals, n, name, timeout)
+		}
+	}
+}
+
+// Arrivals returns the number of requests which have arrived at the barrier of the given name so far.
+func (b *Barriers) Arrivals(name string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.barrier(name).arrivals
+}
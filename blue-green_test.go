@@ -0,0 +1,126 @@
+// Contains tests for switching Varnish from one backend to another, like a blue/green deployment
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// startBlueGreen starts a blue and a green test server and Varnish in front of the blue one.
+// The test servers count their requests in the given variables.
+func startBlueGreen(t *testing.T, blueRequests *atomic.Int32, greenRequests *atomic.Int32) (*caching.VarnishInstance, string) {
+	bluePort, blueServer := startTestServer(countingEchoCacheControlHandler(blueRequests))
+	t.Cleanup(blueServer.Close)
+	greenPort, greenServer := startTestServer(countingEchoCacheControlHandler(greenRequests))
+	t.Cleanup(greenServer.Close)
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: bluePort,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, instance.Stop())
+	})
+	waitForHealthy(t, instance.Port)
+	return instance, greenPort
+}
+
+// TestSwitchBackendKeepObjects tests that after switching to the green backend with KeepObjects, the objects
+// of the blue backend are still delivered, while new objects and reloaded VCLs use the green backend.
+func TestSwitchBackendKeepObjects(t *testing.T) {
+	t.Parallel()
+	var blueRequests, greenRequests atomic.Int32
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+	instance, greenPort := startBlueGreen(t, &blueRequests, &greenRequests)
+
+	// send request to the blue backend
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withPath("/old"), withXCacheControl(cacheControl)).xResponse)
+
+	// switch to the green backend
+	require.NoError(t, instance.SwitchBackend(greenPort, caching.KeepObjects))
+
+	// send requests and expect the object of the blue backend, and a new object from the green backend
+	assert.Equal(t, "1", mkReq(t, instance.Port, "2", withPath("/old"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "3", mkReq(t, instance.Port, "3", withPath("/new"), withXCacheControl(cacheControl)).xResponse)
+
+	// reload the VCL and expect it to keep the green backend
+	require.NoError(t, instance.ReloadVCL(""))
+	assert.Equal(t, "4", mkReq(t, instance.Port, "4", withPath("/newer"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect 1 request to the blue and 2 requests to the green backend
+	assert.Equal(t, int32(1), blueRequests.Load())
+	assert.Equal(t, int32(2), greenRequests.Load())
+}
+
+// TestSwitchBackendExpireObjects tests that after switching to the green backend with ExpireObjects, the objects
+// of the blue backend are served stale within their grace while the green backend is asked in the background,
+// and are fetched from the green backend right away without grace.
+func TestSwitchBackendExpireObjects(t *testing.T) {
+	t.Parallel()
+	var blueRequests, greenRequests atomic.Int32
+	graceful := caching.CacheControl{MaxAge: caching.Seconds(60), SWR: caching.Seconds(60)}
+	graceless := caching.CacheControl{MaxAge: caching.Seconds(60)}
+	instance, greenPort := startBlueGreen(t, &blueRequests, &greenRequests)
+
+	// send requests to the blue backend
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withPath("/graceful"), withXCacheControl(graceful)).xResponse)
+	assert.Equal(t, "2", mkReq(t, instance.Port, "2", withPath("/graceless"), withXCacheControl(graceless)).xResponse)
+
+	// switch to the green backend
+	require.NoError(t, instance.SwitchBackend(greenPort, caching.ExpireObjects))
+
+	// send request and expect the stale object of the blue backend, refreshed from the green backend
+	assert.Equal(t, "1", mkReq(t, instance.Port, "3", withPath("/graceful"), withXCacheControl(graceful)).xResponse)
+	eventuallyBackendRequests(t, &greenRequests, 1)
+	assert.Equal(t, "3", mkReq(t, instance.Port, "4", withPath("/graceful"), withXCacheControl(graceful)).xResponse)
+
+	// send requests and expect the object without grace to be fetched from the green backend, and then cached
+	assert.Equal(t, "5", mkReq(t, instance.Port, "5", withPath("/graceless"), withXCacheControl(graceless)).xResponse)
+	assert.Equal(t, "5", mkReq(t, instance.Port, "6", withPath("/graceless"), withXCacheControl(graceless)).xResponse)
+
+	// expect 2 requests to the blue and 2 requests to the green backend
+	assert.Equal(t, int32(2), blueRequests.Load())
+	assert.Equal(t, int32(2), greenRequests.Load())
+}
+
+// TestSwitchBackendPurgeObjects tests that after switching to the green backend with PurgeObjects,
+// no object of the blue backend is delivered anymore.
+func TestSwitchBackendPurgeObjects(t *testing.T) {
+	t.Parallel()
+	var blueRequests, greenRequests atomic.Int32
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60), SWR: caching.Seconds(60)}
+	instance, greenPort := startBlueGreen(t, &blueRequests, &greenRequests)
+
+	// send request to the blue backend
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)).xResponse)
+
+	// switch to the green backend
+	require.NoError(t, instance.SwitchBackend(greenPort, caching.PurgeObjects))
+
+	// send requests and expect the object to be fetched from the green backend, and then cached
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)))
+	assert.Equal(t, "2", mkReq(t, instance.Port, "3", withXCacheControl(cacheControl)).xResponse)
+
+	// expect 1 request to the blue and 1 request to the green backend
+	assert.Equal(t, int32(1), blueRequests.Load())
+	assert.Equal(t, int32(1), greenRequests.Load())
+}
+
+// TestSwitchBackendInvalid tests that an invalid port or policy is rejected without switching.
+func TestSwitchBackendInvalid(t *testing.T) {
+	t.Parallel()
+	var blueRequests, greenRequests atomic.Int32
+	instance, greenPort := startBlueGreen(t, &blueRequests, &greenRequests)
+
+	assert.EqualError(t, instance.SwitchBackend("green", caching.KeepObjects), `BackendPort must be a port number, not "green"`)
+	assert.EqualError(t, instance.SwitchBackend(greenPort, "flush"), `unknown switch policy "flush"`)
+
+	// send request and expect it to reach the blue backend
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, instance.Port, "1"))
+	assert.Equal(t, int32(1), blueRequests.Load())
+	assert.Equal(t, int32(0), greenRequests.Load())
+}
@@ -0,0 +1,237 @@
+// Contains tests verifying the integrity of response bodies delivered by Varnish
+package caching_test
+
+import (
+	"bytes"
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestRandomBodyIntegrity tests that Varnish delivers an incompressible body unchanged,
+// both when fetching it from the backend and when delivering it from the cache.
+func TestRandomBodyIntegrity(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	body := caching.RandomBody(256*1024, 1)
+
+	// start a test server
+	bodyHandler := caching.BodyHandler(body)
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		bodyHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// send two requests and expect the body to match the digest each time
+	for _, xRequest := range []string{"1", "2"} {
+		resp := mkReq(t, port, xRequest, withXCacheControl(cacheControl), withDigestBody())
+		assert.Equal(t, "1", resp.xResponse)
+		assertBodyDigest(t, body, resp)
+		assert.Equal(t, int64(len(body)), resp.bodySize)
+	}
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestRandomBodyRange tests that Varnish delivers the requested range of a cached incompressible body.
+func TestRandomBodyRange(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	body := caching.RandomBody(64*1024, 2)
+
+	// start a test server
+	bodyHandler := caching.BodyHandler(body)
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		bodyHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// send request to cache the complete body
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl)).xResponse)
+
+	// send a range request and expect the range of the cached body
+	resp := mkReq(t, port, "2", withXCacheControl(cacheControl), withRange("bytes=1000-1999"), withStoreBody())
+	assert.Equal(t, http.StatusPartialContent, resp.statusCode)
+	assert.Equal(t, "bytes 1000-1999/65536", resp.contentRange)
+	assertBody(t, body[1000:2000], resp.body)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestCompressibleBodyGzip tests that Varnish compresses a compressible body with beresp.do_gzip
+// and that the decompressed body matches the digest of the backend's body.
+func TestCompressibleBodyGzip(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	body := caching.CompressibleBody(256 * 1024)
+
+	// start a test server
+	bodyHandler := caching.BodyHandler(body)
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		bodyHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DoGzip:      true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request accepting gzip and expect a much smaller compressed response
+	resp := mkReq(t, port, "1", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(10)}),
+		withAcceptEncoding("gzip"), withDigestBody())
+	assert.Equal(t, "gzip", resp.contentEncoding)
+	assert.Less(t, resp.bodySize, int64(len(body)/10))
+
+	// expect the decompressed body to match the digest of the backend's body
+	assertBodyDigest(t, body, resp)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestReaderDigest tests that the digest of a reader matches the digest of the body read from it.
+func TestReaderDigest(t *testing.T) {
+	t.Parallel()
+	body := caching.RandomBody(1024*1024, 3)
+	digest, n, err := caching.ReaderDigest(bytes.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, caching.ContentDigest(body), digest)
+	assert.Equal(t, int64(len(body)), n)
+}
+
+// TestLargeBodyGunzipIntegrity tests that a large body which Varnish compressed with beresp.do_gzip and cached
+// is decompressed byte for byte for a client not accepting gzip.
+func TestLargeBodyGunzipIntegrity(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	body := caching.CompressibleBody(8 * 1024 * 1024)
+
+	// start a test server
+	bodyHandler := caching.BodyHandler(body)
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		bodyHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container with enough storage for the compressed body
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DoGzip:      true,
+		StorageSize: "16M",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// send request accepting gzip, which caches the compressed body
+	resp := mkReq(t, port, "1", withXCacheControl(cacheControl), withAcceptEncoding("gzip"), withDigestBody())
+	assert.Equal(t, "gzip", resp.contentEncoding)
+	assertBodyDigest(t, body, resp)
+
+	// send request not accepting gzip and expect the body decompressed by varnish
+	resp = mkReq(t, port, "2", withXCacheControl(cacheControl), withAcceptEncoding("identity"), withDigestBody())
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Empty(t, resp.contentEncoding)
+	assertBodyDigest(t, body, resp)
+	assert.Equal(t, int64(len(body)), resp.bodySize)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestDiffBodies tests that differing bodies are reported as the ranges of bytes which differ.
+func TestDiffBodies(t *testing.T) {
+	t.Parallel()
+	body := caching.RandomBody(1000, testSeed(t))
+	assert.Nil(t, caching.DiffBodies(body, bytes.Clone(body)))
+
+	// corrupt two ranges
+	corrupted := bytes.Clone(body)
+	for _, i := range []int{10, 11, 12, 500} {
+		corrupted[i] ^= 0xff
+	}
+	assert.Equal(t, []caching.ByteRange{{First: 10, Last: 12}, {First: 500, Last: 500}}, caching.DiffBodies(body, corrupted))
+
+	// truncate and extend
+	assert.Equal(t, []caching.ByteRange{{First: 900, Last: 999}}, caching.DiffBodies(body, body[:900]))
+	assert.Equal(t, "1000-1001", caching.DiffBodies(body, append(bytes.Clone(body), 1, 2))[0].String())
+}
+
+// TestSeed tests that the seed of a test is the same in every run, but differs between tests.
+func TestSeed(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, caching.Seed("TestA"), caching.Seed("TestA"))
+	assert.NotEqual(t, caching.Seed("TestA"), caching.Seed("TestB"))
+}
+
+// TestSeededBodies tests that Varnish delivers the random bodies of a seeded backend unchanged,
+// where each URL has a body of its own.
+func TestSeededBodies(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	const bodySize = 128 * 1024
+	seed := testSeed(t)
+
+	// start a test server
+	bodyHandler := caching.RandomBodyHandler(bodySize, seed)
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		bodyHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		StorageSize: "16M",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// send a miss and a hit for each of two URLs and expect their bodies each time
+	for _, path := range []string{"/a", "/b"} {
+		for _, xRequest := range []string{"1", "2"} {
+			resp := mkReq(t, port, xRequest, withPath(path), withXCacheControl(cacheControl), withStoreBody())
+			assert.Equal(t, "1", resp.xResponse)
+			assertBody(t, caching.PathBody(bodySize, seed, path), resp.body)
+		}
+	}
+	assert.NotEqual(t, caching.PathBody(bodySize, seed, "/a"), caching.PathBody(bodySize, seed, "/b"))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
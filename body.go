@@ -0,0 +1,131 @@
+package caching
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// compressibleLine is repeated by CompressibleBody.
+const compressibleLine = "The quick brown fox jumps over the lazy dog.\n"
+
+// CompressibleBody returns a body of the given size consisting of repeated text, which compresses very well.
+func CompressibleBody(size int) []byte {
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = compressibleLine[i%len(compressibleLine)]
+	}
+	return body
+}
+
+// RandomBody returns a body of the given size consisting of random bytes generated from the given seed,
+// which does not compress at all. The same seed always yields the same body.
+func RandomBody(size int, seed int64) []byte {
+	body := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(body)
+	return body
+}
+
+// ContentDigest returns the value of a Content-Digest header (RFC 9530) with the SHA-256 digest of the given body.
+func ContentDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest[:]) + ":"
+}
+
+// ReaderDigest returns the value of a Content-Digest header like ContentDigest for everything read from the given
+// reader until EOF, together with the number of bytes read, without keeping them in memory. This allows to verify
+// large bodies byte for byte.
+func ReaderDigest(r io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return "", n, err
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(hash.Sum(nil)) + ":", n, nil
+}
+
+// BodyHandler returns a backend handler which echoes the X-Request header as X-Response and the X-Cache-Control
+// header as Cache-Control, and responds with the given body together with its Content-Length and Content-Digest.
+func BodyHandler(body []byte) http.HandlerFunc {
+	contentDigest := ContentDigest(body)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cacheControl := r.Header.Get("X-Cache-Control"); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Content-Digest", contentDigest)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+// SeedEnv is the environment variable fixing the seed returned by Seed for all tests, e.g. CACHING_SEED=42,
+// to check whether a failure depends on the content of the bodies.
+const SeedEnv = "CACHING_SEED"
+
+// Seed returns the seed for the random bodies of the test with the given name. It is derived from the name,
+// such that each test has bodies of its own, which are the same in every run, so that a failure involving
+// a corrupted body can be reproduced exactly. SeedEnv overrides it.
+func Seed(testName string) int64 {
+	if seed := os.Getenv(SeedEnv); seed != "" {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid %s %q", SeedEnv, seed))
+		}
+		return value
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(testName))
+	return int64(hash.Sum64())
+}
+
+// RandomBodyHandler returns a backend handler like BodyHandler, which responds with a random body of the given size
+// generated from the given seed and the path of the request (see PathBody), such that each URL has a body of its own.
+func RandomBodyHandler(size int, seed int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		BodyHandler(PathBody(size, seed, r.URL.Path))(w, r)
+	}
+}
+
+// PathBody returns the body of RandomBodyHandler for the given path, i.e. a RandomBody of the given size
+// generated from the given seed combined with the path.
+func PathBody(size int, seed int64, path string) []byte {
+	hash := fnv.New64a()
+	hash.Write([]byte(path))
+	return RandomBody(size, seed^int64(hash.Sum64()))
+}
+
+// ByteRange is a range of bytes of a body from First to Last, both inclusive like in a Content-Range header.
+type ByteRange struct {
+	First int
+	Last  int
+}
+
+func (r ByteRange) String() string {
+	return strconv.Itoa(r.First) + "-" + strconv.Itoa(r.Last)
+}
+
+// DiffBodies returns the ranges of bytes in which the actual body differs from the expected one, such that a test
+// can report where a body was corrupted instead of printing both bodies. Bytes missing at the end of a truncated
+// body and bytes in excess of the expected body count as differing. It returns nil if the bodies are equal.
+func DiffBodies(expected []byte, actual []byte) []ByteRange {
+	var ranges []ByteRange
+	for i := 0; i < max(len(expected), len(actual)); i++ {
+		if i < len(expected) && i < len(actual) && expected[i] == actual[i] {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1].Last == i-1 {
+			ranges[len(ranges)-1].Last = i
+		} else {
+			ranges = append(ranges, ByteRange{First: i, Last: i})
+		}
+	}
+	return ranges
+}
@@ -31,7 +31,7 @@ func TestNoCacheControl(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -41,13 +41,13 @@ func TestNoCacheControl(t *testing.T) {
 	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
 
 	// wait half a second
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(caching.Scaled(500 * time.Millisecond))
 
 	// send another request and expect the previous cached return
 	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
 
 	// wait for 600 ms
-	time.Sleep(600 * time.Millisecond)
+	time.Sleep(caching.Scaled(600 * time.Millisecond))
 
 	// send another request and expect no cached return
 	assert.Equal(t, "baz", mkReq(t, port, "baz").xResponse)
@@ -75,7 +75,7 @@ func TestCachingOf404(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -85,7 +85,7 @@ func TestCachingOf404(t *testing.T) {
 	assert.Equal(t, mkResp(http.StatusNotFound, "foo"), mkReq(t, port, "foo", withXStatusCode(http.StatusNotFound)))
 
 	// wait half a second
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(caching.Scaled(500 * time.Millisecond))
 
 	// send another request which the backend would respond with 200 but expect the previous cached 404 response
 	assert.Equal(t, mkResp(http.StatusNotFound, "foo"), mkReq(t, port, "bar", withXStatusCode(http.StatusOK)))
@@ -110,7 +110,7 @@ func TestNoCachingOfPost(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -120,7 +120,7 @@ func TestNoCachingOfPost(t *testing.T) {
 	assert.Equal(t, mkResp(http.StatusOK, "foo", withAcceptRanges("")), mkReq(t, port, "foo", withMethod(http.MethodPost)))
 
 	// wait half a second
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(caching.Scaled(500 * time.Millisecond))
 
 	// send another request and expect an uncached response
 	assert.Equal(t, mkResp(http.StatusOK, "bar", withAcceptRanges("")), mkReq(t, port, "bar", withMethod(http.MethodPost)))
@@ -150,7 +150,7 @@ func TestNoCachingOf500ErrorOnFirstRequest(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -160,7 +160,7 @@ func TestNoCachingOf500ErrorOnFirstRequest(t *testing.T) {
 	assert.Equal(t, mkResp(http.StatusInternalServerError, "1"), mkReq(t, port, "1", withXStatusCode(http.StatusInternalServerError)))
 
 	// wait half a second
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(caching.Scaled(500 * time.Millisecond))
 
 	// send another request and expect the previous cached error
 	assert.Equal(t, mkResp(http.StatusOK, "2"), mkReq(t, port, "2", withXStatusCode(http.StatusOK)))
@@ -186,37 +186,37 @@ func TestNoCachingOf500ErrorInGracePeriodAfter200Request(t *testing.T) {
 	defer testServer.Close()
 
 	// start varnish container
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort:  testServerPort,
-		DefaultTtl:   "1s",
-		DefaultGrace: "5s",
+		DefaultTtl:   caching.Scaled(1 * time.Second),
+		DefaultGrace: caching.Scaled(5 * time.Second),
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// send request resulting in 200
-	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, port, "1", withXStatusCode(http.StatusOK)))
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, instance.Port, "1", withXStatusCode(http.StatusOK)))
 
 	// wait 1.1 seconds to let the response expire
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send another request which would result in 500 but still expect the previous cached 200 response
 	// because we are still in the grace period and within that Varnish will perform background revalidation
 	// asynchronous to the client's request.
-	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, port, "2", withXStatusCode(http.StatusInternalServerError)))
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, instance.Port, "2", withXStatusCode(http.StatusInternalServerError)))
 
-	// wait a bit for Varnish to revalidate the cached response. After this, Varnish will have
+	// wait for Varnish to revalidate the cached response. After this, Varnish will have
 	// abandoned the cached 200 response and will also not have cached the 500 response resulting
 	// in subsequent requests to always hit the backend.
-	time.Sleep(50 * time.Millisecond)
+	waitForBackgroundFetch(t, instance)
 
 	// send another request which will result in a backend fetch returning 500.
-	assert.Equal(t, mkResp(http.StatusInternalServerError, "3"), mkReq(t, port, "3", withXStatusCode(http.StatusInternalServerError)))
+	assert.Equal(t, mkResp(http.StatusInternalServerError, "3"), mkReq(t, instance.Port, "3", withXStatusCode(http.StatusInternalServerError)))
 
 	// send yet another request which will also result in a backend fetch returning 500
 	// indicating that the previous response has not been cached.
-	assert.Equal(t, mkResp(http.StatusInternalServerError, "4"), mkReq(t, port, "4", withXStatusCode(http.StatusInternalServerError)))
+	assert.Equal(t, mkResp(http.StatusInternalServerError, "4"), mkReq(t, instance.Port, "4", withXStatusCode(http.StatusInternalServerError)))
 
 	// expect four backend requests
 	assert.Equal(t, 4, backendRequests)
@@ -270,7 +270,7 @@ func TestCacheControlMaxAge1(t *testing.T) {
 
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("Cache-Control", scaledCacheControl("max-age=1"))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
 		w.WriteHeader(http.StatusOK)
 		backendRequests++
@@ -306,9 +306,9 @@ func TestStaleWhileRevalidate(t *testing.T) {
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		xRequest := r.Header.Get("X-Request")
 		if xRequest == "2" {
-			time.Sleep(500 * time.Millisecond)
+			time.Sleep(caching.Scaled(500 * time.Millisecond))
 		}
-		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=10")
+		w.Header().Set("Cache-Control", scaledCacheControl("max-age=1, stale-while-revalidate=10"))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
 		w.WriteHeader(http.StatusOK)
 		backendRequests++
@@ -327,17 +327,17 @@ func TestStaleWhileRevalidate(t *testing.T) {
 	assert.Equal(t, "1", mkReq(t, port, "1").xResponse)
 
 	// sleep for 1.1 seconds to make the cached response stale
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send another request and expect to receive a cached response
 	time1 := time.Now()
 	assert.Equal(t, "1", mkReq(t, port, "2").xResponse)
 	time2 := time.Now()
 	// expect the response to have come back very fast
-	assert.Less(t, time2.Sub(time1), 100*time.Millisecond)
+	assert.Less(t, time2.Sub(time1), caching.Scaled(100*time.Millisecond))
 
 	// sleep for 600 ms to let Varnish revalidate the cached response
-	time.Sleep(600 * time.Millisecond)
+	time.Sleep(caching.Scaled(600 * time.Millisecond))
 
 	// send yet another request and expect to receive the second cached response
 	assert.Equal(t, "2", mkReq(t, port, "3").xResponse)
@@ -356,7 +356,7 @@ func TestStaleWhileRevalidateWithoutTtlOrExpiresAndZeroDefaultTtl(t *testing.T)
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		w.Header().Set("Cache-Control", "stale-while-revalidate=1")
+		w.Header().Set("Cache-Control", scaledCacheControl("stale-while-revalidate=1"))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
 		w.WriteHeader(http.StatusOK)
 	})
@@ -371,14 +371,14 @@ func TestStaleWhileRevalidateWithoutTtlOrExpiresAndZeroDefaultTtl(t *testing.T)
 	waitForHealthy(t, port)
 
 	// send first request which should get a grace of only 1s
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("stale-while-revalidate=1")), mkReq(t, port, "foo"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("stale-while-revalidate=1"))), mkReq(t, port, "foo"))
 
 	// with a non-existing max-age/TTL/Expires or 0, the behaviour of Varnish is to not cache the response
 	// at all, also not for the grace period. So, every request will essentially be a pass.
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(caching.Scaled(500 * time.Millisecond))
 
 	// send another request and expect a new synchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "bar", withResponseCacheControl("stale-while-revalidate=1")), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "bar", withResponseCacheControlValue(scaledCacheControl("stale-while-revalidate=1"))), mkReq(t, port, "bar"))
 
 	// expect two backend requests
 	assert.Equal(t, 2, backendRequests)
@@ -393,7 +393,7 @@ func TestStaleWhileRevalidateWithoutTtlOrExpiresAndZeroDefaultTtl(t *testing.T)
 func TestHitForMissAndNoRequestCoalescingWhenNoStore(t *testing.T) {
 	t.Parallel()
 	var backendRequests int
-	sleepTime := 1 * time.Second
+	sleepTime := caching.Scaled(1 * time.Second)
 
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
@@ -443,8 +443,8 @@ func TestHitForMissAndNoRequestCoalescingWhenNoStore(t *testing.T) {
 	// the following N-1 requests in parallel, which will all take sleepTime
 	// together to respond.
 	// Therefore, the whole test case is completed after about 2 * sleepTime.
-	assert.Less(t, time2.Sub(time1), 2*sleepTime+100*time.Millisecond)
-	assert.Greater(t, time2.Sub(time1), 2*sleepTime-100*time.Millisecond)
+	assert.Less(t, time2.Sub(time1), 2*sleepTime+caching.Scaled(100*time.Millisecond))
+	assert.Greater(t, time2.Sub(time1), 2*sleepTime-caching.Scaled(100*time.Millisecond))
 
 	// expect N backend requests
 	assert.Equal(t, N, backendRequests)
@@ -474,7 +474,7 @@ func TestNoCachingWhenRequestHasAuthorizationHeader(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -484,7 +484,7 @@ func TestNoCachingWhenRequestHasAuthorizationHeader(t *testing.T) {
 	assert.Equal(t, "foo", mkReq(t, port, "foo", withAuthorization("Test 12345")).xResponse)
 
 	// wait a bit
-	time.Sleep(50 * time.Millisecond)
+	time.Sleep(caching.Scaled(50 * time.Millisecond))
 
 	// send another request and expect uncached response
 	assert.Equal(t, "bar", mkReq(t, port, "bar", withAuthorization("Test 67890")).xResponse)
@@ -517,7 +517,7 @@ func TestNoCachingWhenRequestHasCookieHeader(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -527,7 +527,7 @@ func TestNoCachingWhenRequestHasCookieHeader(t *testing.T) {
 	assert.Equal(t, "foo", mkReq(t, port, "foo", withCookie("test=12345")).xResponse)
 
 	// wait a bit
-	time.Sleep(50 * time.Millisecond)
+	time.Sleep(caching.Scaled(50 * time.Millisecond))
 
 	// send another request and expect uncached response
 	assert.Equal(t, "bar", mkReq(t, port, "bar", withCookie("test=67890")).xResponse)
@@ -553,7 +553,7 @@ func TestBackendRespondsWith304WhenUnconditionalRequest(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -602,8 +602,8 @@ func TestConditionalRequestWhenRevalidatingWithEtag(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
-		DefaultKeep: "5s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
+		DefaultKeep: caching.Scaled(5 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -616,7 +616,7 @@ func TestConditionalRequestWhenRevalidatingWithEtag(t *testing.T) {
 
 	// wait a bit for the response to become stale and enter the "keep" interval
 	// in which Varnish will still keep the cached object around but only for synchronous revalidation
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send the second request which will be answered with 304 by the backend
 	// and Varnish will respond with 200 to the client, still with the response body
@@ -627,7 +627,7 @@ func TestConditionalRequestWhenRevalidatingWithEtag(t *testing.T) {
 	assert.Equal(t, mkResp(http.StatusOK, "2", withBody("foo")), mkReq(t, port, "2", withStoreBody()))
 
 	// wait a tiny bit to see if we have the response still cached
-	time.Sleep(200 * time.Millisecond)
+	time.Sleep(caching.Scaled(200 * time.Millisecond))
 
 	// send the third request which will be answered directly from the cache
 	// because the once stale response became fresh again after the second request,
@@ -674,8 +674,8 @@ func TestConditionalRequestWhenRevalidatingWithLastModified(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
-		DefaultKeep: "5s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
+		DefaultKeep: caching.Scaled(5 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -688,7 +688,7 @@ func TestConditionalRequestWhenRevalidatingWithLastModified(t *testing.T) {
 
 	// wait a bit for the response to become stale and enter the "keep" interval
 	// in which Varnish will still keep the cached object around but only for synchronous revalidation
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send the second request which will be answered with 304 by the backend
 	// and Varnish will respond with 200 to the client, still with the response body
@@ -699,7 +699,7 @@ func TestConditionalRequestWhenRevalidatingWithLastModified(t *testing.T) {
 	assert.Equal(t, mkResp(http.StatusOK, "2", withBody("foo")), mkReq(t, port, "2", withStoreBody()))
 
 	// wait a tiny bit to see if we have the response still cached
-	time.Sleep(200 * time.Millisecond)
+	time.Sleep(caching.Scaled(200 * time.Millisecond))
 
 	// send the third request which will be answered directly from the cache
 	// because the once stale response became fresh again after the second request,
@@ -727,7 +727,7 @@ func TestMaxAge0AndNoCacheInRequest(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -737,7 +737,7 @@ func TestMaxAge0AndNoCacheInRequest(t *testing.T) {
 	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
 
 	// wait a bit
-	time.Sleep(100 * time.Millisecond)
+	time.Sleep(caching.Scaled(100 * time.Millisecond))
 
 	// send another request with "Cache-Control: max-age=0, no-cache" and expect the previous cached return
 	// because by default Varnish cannot be forced to revalidate with the backend based on the client's
@@ -769,7 +769,7 @@ func TestClientConditionalRequestWithEtag(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -779,7 +779,7 @@ func TestClientConditionalRequestWithEtag(t *testing.T) {
 	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
 
 	// wait a bit
-	time.Sleep(100 * time.Millisecond)
+	time.Sleep(caching.Scaled(100 * time.Millisecond))
 
 	// send another request with "If-None-Match: 12345" header and expect the previous cached return
 	// together with a 304 response code and no body.
@@ -802,9 +802,9 @@ func TestStaleWhileRevalidateWithoutDurationWhenZeroDefaultGrace(t *testing.T) {
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		time.Sleep(500 * time.Millisecond)
+		time.Sleep(caching.Scaled(500 * time.Millisecond))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
-		w.Header().Set("Cache-Control", "s-maxage=1, stale-while-revalidate")
+		w.Header().Set("Cache-Control", scaledCacheControl("s-maxage=1, stale-while-revalidate"))
 		w.WriteHeader(http.StatusOK)
 	})
 	defer testServer.Close()
@@ -821,16 +821,16 @@ func TestStaleWhileRevalidateWithoutDurationWhenZeroDefaultGrace(t *testing.T) {
 	time1 := time.Now()
 	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
 	time2 := time.Now()
-	assert.Greater(t, time2.Sub(time1), 400*time.Millisecond)
+	assert.Greater(t, time2.Sub(time1), caching.Scaled(400*time.Millisecond))
 
 	// wait a bit for the response to become stale
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send another request which should also hit the backend synchronously
 	time1 = time.Now()
 	assert.Equal(t, "bar", mkReq(t, port, "bar").xResponse)
 	time2 = time.Now()
-	assert.Greater(t, time2.Sub(time1), 400*time.Millisecond)
+	assert.Greater(t, time2.Sub(time1), caching.Scaled(400*time.Millisecond))
 
 	// expect two backend requests
 	assert.Equal(t, 2, backendRequests)
@@ -847,9 +847,9 @@ func TestStaleWhileRevalidateWithoutDurationWhenNonZeroDefaultGrace(t *testing.T
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		time.Sleep(500 * time.Millisecond)
+		time.Sleep(caching.Scaled(500 * time.Millisecond))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
-		w.Header().Set("Cache-Control", "s-maxage=1, stale-while-revalidate")
+		w.Header().Set("Cache-Control", scaledCacheControl("s-maxage=1, stale-while-revalidate"))
 		w.WriteHeader(http.StatusOK)
 	})
 	defer testServer.Close()
@@ -857,7 +857,7 @@ func TestStaleWhileRevalidateWithoutDurationWhenNonZeroDefaultGrace(t *testing.T
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort:  testServerPort,
-		DefaultGrace: "10s",
+		DefaultGrace: caching.Scaled(10 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -867,20 +867,20 @@ func TestStaleWhileRevalidateWithoutDurationWhenNonZeroDefaultGrace(t *testing.T
 	time1 := time.Now()
 	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
 	time2 := time.Now()
-	assert.Greater(t, time2.Sub(time1), 400*time.Millisecond)
+	assert.Greater(t, time2.Sub(time1), caching.Scaled(400*time.Millisecond))
 
 	// wait a bit for the response to become stale
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send another request which should respond immediately with the previously cached response
 	// and trigger an asynchronous revalidation due to the non-zero default grace which will be applied here.
 	time1 = time.Now()
 	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
 	time2 = time.Now()
-	assert.Less(t, time2.Sub(time1), 100*time.Millisecond)
+	assert.Less(t, time2.Sub(time1), caching.Scaled(100*time.Millisecond))
 
 	// wait a bit for the asynchronous revalidation to complete
-	time.Sleep(100 * time.Millisecond)
+	time.Sleep(caching.Scaled(100 * time.Millisecond))
 
 	// expect two backend requests
 	assert.Equal(t, 2, backendRequests)
@@ -898,9 +898,9 @@ func TestStaleWhileRevalidateZeroDoesNotMeanDefaultGrace(t *testing.T) {
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		time.Sleep(500 * time.Millisecond)
+		time.Sleep(caching.Scaled(500 * time.Millisecond))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
-		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=0")
+		w.Header().Set("Cache-Control", scaledCacheControl("max-age=1, stale-while-revalidate=0"))
 		w.WriteHeader(http.StatusOK)
 	})
 	defer testServer.Close()
@@ -908,7 +908,7 @@ func TestStaleWhileRevalidateZeroDoesNotMeanDefaultGrace(t *testing.T) {
 	// start varnish container
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort:  testServerPort,
-		DefaultGrace: "10s",
+		DefaultGrace: caching.Scaled(10 * time.Second),
 	})
 	require.NoError(t, err)
 	defer stopFunc()
@@ -918,16 +918,16 @@ func TestStaleWhileRevalidateZeroDoesNotMeanDefaultGrace(t *testing.T) {
 	time1 := time.Now()
 	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
 	time2 := time.Now()
-	assert.Greater(t, time2.Sub(time1), 400*time.Millisecond)
+	assert.Greater(t, time2.Sub(time1), caching.Scaled(400*time.Millisecond))
 
 	// wait a bit for the response to become stale
-	time.Sleep(1100 * time.Millisecond)
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
 
 	// send another request which should also hit the backend synchronously
 	time1 = time.Now()
 	assert.Equal(t, "bar", mkReq(t, port, "bar").xResponse)
 	time2 = time.Now()
-	assert.Greater(t, time2.Sub(time1), 400*time.Millisecond)
+	assert.Greater(t, time2.Sub(time1), caching.Scaled(400*time.Millisecond))
 
 	// expect two backend requests
 	assert.Equal(t, 2, backendRequests)
@@ -967,3 +967,48 @@ func TestRangeRequestIsAlwaysNonRangedForBackend(t *testing.T) {
 	// expect one backend request
 	assert.Equal(t, 1, backendRequests)
 }
+
+// TestCachingPerPath tests that Varnish caches the responses for different paths independently,
+// each according to its own Cache-Control header.
+func TestCachingPerPath(t *testing.T) {
+	t.Parallel()
+	var cachedRequests, uncachedRequests int
+
+	// start a test server with a cacheable and an uncacheable path
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/cached": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.ScaledSeconds(10)}.String())
+			w.Header().Set("X-Response", r.Header.Get("X-Request"))
+			w.WriteHeader(http.StatusOK)
+			cachedRequests++
+		},
+		"/uncached": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", caching.CacheControl{NoStore: true}.String())
+			w.Header().Set("X-Response", r.Header.Get("X-Request"))
+			w.WriteHeader(http.StatusOK)
+			uncachedRequests++
+		},
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send two requests to each path
+	assert.Equal(t, "1", mkReq(t, port, "1", withPath("/cached")).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "2", withPath("/uncached")).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "3", withPath("/cached")).xResponse)
+	assert.Equal(t, "4", mkReq(t, port, "4", withPath("/uncached")).xResponse)
+
+	// send a request to an unknown path and expect a 404 response from the test server
+	assert.Equal(t, http.StatusNotFound, mkReq(t, port, "5", withPath("/unknown")).statusCode)
+
+	// expect one backend request for the cached path and two for the uncached path
+	assert.Equal(t, 1, cachedRequests)
+	assert.Equal(t, 2, uncachedRequests)
+}
@@ -0,0 +1,439 @@
+// Contains tests for the handling of individual Cache-Control directives, both by the built-in VCL
+// and by the VCL snippets which can be enabled via VarnishConfig
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMustRevalidateIsIgnoredByDefault tests that the built-in VCL does not honor the
+// "must-revalidate" directive of a backend response, such that Varnish will still serve the
+// stale response within the default grace period while revalidating asynchronously.
+// According to https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.2 a cache must not
+// serve a stale response with "must-revalidate" without successful revalidation.
+func TestMustRevalidateIsIgnoredByDefault(t *testing.T) {
+	t.Parallel()
+	var backendRequests atomic.Int32
+	cacheControl := caching.CacheControl{MaxAge: caching.ScaledSeconds(1), MustRevalidate: true}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(countingEchoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:  testServerPort,
+		DefaultGrace: caching.Scaled(10 * time.Second),
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request which will be cached for a second
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "foo", withXCacheControl(cacheControl)))
+
+	// wait for the response to become stale
+	eventuallyStale(t, instance, "/")
+
+	// send another request and expect the stale response, because the default grace still applies
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "bar", withXCacheControl(cacheControl)))
+
+	// expect two backend requests, once the asynchronous revalidation has reached the backend
+	eventuallyBackendRequests(t, &backendRequests, 2)
+}
+
+// TestEnforceMustRevalidateDisablesDefaultGrace tests that enabling EnforceMustRevalidate
+// makes Varnish revalidate synchronously once a response with "must-revalidate" became stale,
+// even though a non-zero default grace period is configured.
+func TestEnforceMustRevalidateDisablesDefaultGrace(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.ScaledSeconds(1), MustRevalidate: true}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:           testServerPort,
+		DefaultGrace:          caching.Scaled(10 * time.Second),
+		EnforceMustRevalidate: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request which will be cached for a second
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "foo", withXCacheControl(cacheControl)))
+
+	// send another request and expect the cached response
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "bar", withXCacheControl(cacheControl)))
+
+	// wait for the response to become stale, which is not cached anymore without grace
+	eventuallyOutOfGrace(t, instance, "/")
+
+	// send another request and expect a synchronous backend request instead of the stale response
+	assert.Equal(t, mkResp(http.StatusOK, "baz", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "baz", withXCacheControl(cacheControl)))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestEnforceMustRevalidateOverridesStaleWhileRevalidate tests that "must-revalidate" takes precedence
+// over a "stale-while-revalidate" directive in the same response when EnforceMustRevalidate is enabled.
+func TestEnforceMustRevalidateOverridesStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.ScaledSeconds(1), SWR: caching.ScaledSeconds(10), MustRevalidate: true}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:           testServerPort,
+		EnforceMustRevalidate: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request which will be cached for a second
+	assert.Equal(t, "foo", mkReq(t, instance.Port, "foo", withXCacheControl(cacheControl)).xResponse)
+
+	// wait for the response to become stale, which is not cached anymore without grace
+	eventuallyOutOfGrace(t, instance, "/")
+
+	// send another request and expect a synchronous backend request
+	assert.Equal(t, "bar", mkReq(t, instance.Port, "bar", withXCacheControl(cacheControl)).xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestEnforceMustRevalidateHonorsProxyRevalidate tests that EnforceMustRevalidate treats "proxy-revalidate"
+// like "must-revalidate", since Varnish is a shared cache, while responses without either directive still
+// get the default grace period.
+func TestEnforceMustRevalidateHonorsProxyRevalidate(t *testing.T) {
+	t.Parallel()
+	var backendRequests atomic.Int32
+
+	// start a test server
+	testServerPort, testServer := startTestServer(countingEchoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:           testServerPort,
+		DefaultGrace:          caching.Scaled(10 * time.Second),
+		EnforceMustRevalidate: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests for two different objects, only the first of which has "proxy-revalidate"
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withPath("/1"), withXCacheControl(caching.CacheControl{MaxAge: caching.ScaledSeconds(1), ProxyRevalidate: true})).xResponse)
+	assert.Equal(t, "2", mkReq(t, instance.Port, "2", withPath("/2"), withXCacheControl(caching.CacheControl{MaxAge: caching.ScaledSeconds(1)})).xResponse)
+
+	// wait for both responses to become stale (the first one without grace is not cached anymore by then)
+	eventuallyStale(t, instance, "/2")
+
+	// expect a synchronous backend request for the first object
+	assert.Equal(t, "3", mkReq(t, instance.Port, "3", withPath("/1"), withXCacheControl(caching.CacheControl{MaxAge: caching.ScaledSeconds(1), ProxyRevalidate: true})).xResponse)
+
+	// and the stale response for the second object, which is still within the default grace period
+	assert.Equal(t, "2", mkReq(t, instance.Port, "4", withPath("/2"), withXCacheControl(caching.CacheControl{MaxAge: caching.ScaledSeconds(1)})).xResponse)
+
+	// expect four backend requests, once the asynchronous revalidation has reached the backend
+	eventuallyBackendRequests(t, &backendRequests, 4)
+}
+
+// TestImmutableIsServedFromCacheOnForcedRevalidation tests that Varnish serves a fresh "immutable" response
+// from the cache when a client forces a revalidation (like a browser reload does) and that a conditional
+// client request is answered with a 304 directly from the cache.
+// Note that the built-in VCL does this for any fresh response, because it ignores the request's Cache-Control.
+func TestImmutableIsServedFromCacheOnForcedRevalidation(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(100), Immutable: true}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request which will be cached
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "foo", withXCacheControl(cacheControl), withXEtag("1234")))
+
+	// send a forced revalidation and expect the cached response
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "bar", withXCacheControl(cacheControl), withXEtag("1234"), withForcedRevalidation()))
+
+	// send a conditional forced revalidation and expect a 304 from the cache
+	assert.Equal(t, mkResp(http.StatusNotModified, "foo", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "baz", withXCacheControl(cacheControl), withXEtag("1234"), withForcedRevalidation(), withIfNoneMatch("1234")))
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// forcedRevalidationVcl honors a client's forced revalidation by restarting the request
+// with a forced cache miss, which replaces the cached object with a fresh backend response.
+const forcedRevalidationVcl = `
+sub vcl_hit {
+  if (req.http.Cache-Control ~ "no-cache" && req.restarts == 0) {
+    set req.hash_always_miss = true;
+    return (restart);
+  }
+}
+`
+
+// TestHonorImmutableIgnoresForcedRevalidationWithinTtl tests that enabling HonorImmutable delivers
+// fresh "immutable" objects from the cache even though the custom VCL honors a client's forced revalidation,
+// while objects without "immutable" still get refreshed.
+func TestHonorImmutableIgnoresForcedRevalidationWithinTtl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:    testServerPort,
+		HonorImmutable: true,
+		Vcl:            forcedRevalidationVcl,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for two different objects, only the first of which is immutable
+	assert.Equal(t, "1", mkReq(t, port, "1", withPath("/1"), withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(100), Immutable: true})).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "2", withPath("/2"), withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(100)})).xResponse)
+
+	// force revalidation of the immutable object and expect the cached response
+	assert.Equal(t, "1", mkReq(t, port, "3", withPath("/1"), withForcedRevalidation()).xResponse)
+
+	// force revalidation of the other object and expect a fresh response
+	assert.Equal(t, "4", mkReq(t, port, "4", withPath("/2"), withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(100)}), withForcedRevalidation()).xResponse)
+
+	// expect three backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestDoGzipIgnoresNoTransform tests that Varnish compresses a backend response with beresp.do_gzip even
+// though the response has a "no-transform" Cache-Control directive, which forbids intermediaries to
+// transform the content. The decompressed body is still identical to the backend's body though.
+func TestDoGzipIgnoresNoTransform(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{NoTransform: true, MaxAge: caching.Seconds(100)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.Header().Set("Cache-Control", cacheControl.String())
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("hello world"))
+	})
+	defer testServer.Close()
+
+	// start varnish container compressing all responses
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DoGzip:      true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request accepting gzip and expect a compressed response
+	resp := mkReq(t, port, "foo", withAcceptEncoding("gzip"), withStoreBody())
+	assert.Equal(t, http.StatusOK, resp.statusCode)
+	assert.Equal(t, "gzip", resp.contentEncoding)
+	assert.Equal(t, "hello world", gunzip(t, resp.body))
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestRespectNoTransformSkipsDoGzip tests that enabling RespectNoTransform keeps Varnish from compressing
+// a backend response with a "no-transform" Cache-Control directive, while other responses still get compressed.
+func TestRespectNoTransformSkipsDoGzip(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.Header().Set("Cache-Control", r.Header.Get("X-Cache-Control"))
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("hello world"))
+	})
+	defer testServer.Close()
+
+	// start varnish container compressing all responses
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:        testServerPort,
+		RespectNoTransform: true,
+		DoGzip:             true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request for a "no-transform" response and expect the body as sent by the backend
+	cacheControl := caching.CacheControl{NoTransform: true, MaxAge: caching.Seconds(100)}
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withBody("hello world")),
+		mkReq(t, port, "1", withPath("/1"), withXCacheControl(cacheControl), withAcceptEncoding("gzip"), withStoreBody()))
+
+	// send request for another response and expect it to be compressed
+	resp := mkReq(t, port, "2", withPath("/2"), withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(100)}), withAcceptEncoding("gzip"), withStoreBody())
+	assert.Equal(t, "gzip", resp.contentEncoding)
+	assert.Equal(t, "hello world", gunzip(t, resp.body))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// qualifiedFieldsHandler returns a backend handler which responds with a cookie and a secret header
+// and with the Cache-Control header requested via the X-Cache-Control header.
+func qualifiedFieldsHandler(backendRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		w.Header().Set("Cache-Control", r.Header.Get("X-Cache-Control"))
+		w.Header().Set("Set-Cookie", "session=1234")
+		w.Header().Set("X-Secret", "secret")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// TestQualifiedNoCacheMakesResponseUncacheableByDefault tests that the built-in VCL treats the qualified form
+// no-cache="X-Secret" like an unqualified no-cache and does not cache the response at all, although RFC 9111
+// would allow to store it and only requires revalidation before reusing the listed header.
+func TestQualifiedNoCacheMakesResponseUncacheableByDefault(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{NoCacheFields: []string{"X-Secret"}, MaxAge: caching.Seconds(100)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.Header().Set("Cache-Control", cacheControl.String())
+		w.Header().Set("X-Secret", "secret")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send two requests and expect both to be answered by the backend, including the secret header
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl(cacheControl), withHeader("X-Secret", "secret")),
+		mkReq(t, port, "foo", withCaptureHeaders("X-Secret")))
+	assert.Equal(t, mkResp(http.StatusOK, "bar", withResponseCacheControl(cacheControl), withHeader("X-Secret", "secret")),
+		mkReq(t, port, "bar", withCaptureHeaders("X-Secret")))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestStripQualifiedFields tests that enabling StripQualifiedFields removes the headers listed in the qualified
+// forms of private and no-cache before storing the response, which then becomes cacheable.
+func TestStripQualifiedFields(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(qualifiedFieldsHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:          testServerPort,
+		StripQualifiedFields: []string{"Set-Cookie", "X-Secret"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// private="Set-Cookie" strips only the cookie, which would otherwise make the response uncacheable
+	cacheControl := caching.CacheControl{PrivateFields: []string{"Set-Cookie"}, MaxAge: caching.Seconds(100)}
+	expected := mkResp(http.StatusOK, "1", withResponseCacheControl(caching.CacheControl{MaxAge: caching.Seconds(100)}),
+		withHeader("Set-Cookie", ""), withHeader("X-Secret", "secret"))
+	assert.Equal(t, expected, mkReq(t, port, "1", withPath("/1"), withXCacheControl(cacheControl), withCaptureHeaders("Set-Cookie", "X-Secret")))
+	assert.Equal(t, expected, mkReq(t, port, "2", withPath("/1"), withXCacheControl(cacheControl), withCaptureHeaders("Set-Cookie", "X-Secret")))
+
+	// no-cache="Set-Cookie, X-Secret" strips both headers while retaining the other directives
+	cacheControl = caching.CacheControl{Public: true, NoCacheFields: []string{"Set-Cookie", "X-Secret"}, MaxAge: caching.Seconds(100)}
+	expected = mkResp(http.StatusOK, "3", withResponseCacheControl(caching.CacheControl{Public: true, MaxAge: caching.Seconds(100)}),
+		withHeader("Set-Cookie", ""), withHeader("X-Secret", ""))
+	assert.Equal(t, expected, mkReq(t, port, "3", withPath("/2"), withXCacheControl(cacheControl), withCaptureHeaders("Set-Cookie", "X-Secret")))
+	assert.Equal(t, expected, mkReq(t, port, "4", withPath("/2"), withXCacheControl(cacheControl), withCaptureHeaders("Set-Cookie", "X-Secret")))
+
+	// a qualified directive listing an unknown header is left to the built-in VCL
+	cacheControl = caching.CacheControl{NoCacheFields: []string{"X-Other"}, MaxAge: caching.Seconds(100)}
+	assert.Equal(t, "5", mkReq(t, port, "5", withPath("/3"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "6", mkReq(t, port, "6", withPath("/3"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect four backend requests
+	assert.Equal(t, 4, backendRequests)
+}
+
+// TestCacheControlString tests that CacheControl renders present directives only, in a fixed order, with
+// qualified field lists and extensions verbatim at the end.
+func TestCacheControlString(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		cacheControl caching.CacheControl
+		expected     string
+	}{
+		{"empty", caching.CacheControl{}, ""},
+		{"flags", caching.CacheControl{Public: true, NoStore: true, NoTransform: true, MustRevalidate: true, ProxyRevalidate: true, Immutable: true},
+			"public, no-store, no-transform, must-revalidate, proxy-revalidate, immutable"},
+		{"deltas", caching.CacheControl{MaxAge: caching.Seconds(60), SMaxAge: caching.Seconds(120), SWR: caching.Seconds(30)},
+			"max-age=60, s-maxage=120, stale-while-revalidate=30"},
+		{"zero deltas", caching.CacheControl{MaxAge: caching.Seconds(0), SWR: caching.Seconds(0)}, "max-age=0, stale-while-revalidate=0"},
+		{"unset deltas", caching.CacheControl{MaxAge: caching.DeltaSeconds{Seconds: 60}, NoCache: true}, "no-cache"},
+		{"fixed order", caching.CacheControl{Immutable: true, SWR: caching.Seconds(10), NoCache: true, Private: true}, "private, no-cache, stale-while-revalidate=10, immutable"},
+		{"qualified fields", caching.CacheControl{PrivateFields: []string{"Set-Cookie"}, NoCacheFields: []string{"Set-Cookie", "X-Token"}},
+			`private="Set-Cookie", no-cache="Set-Cookie, X-Token"`},
+		{"qualified fields override flags", caching.CacheControl{Private: true, PrivateFields: []string{"Set-Cookie"}}, `private="Set-Cookie"`},
+		{"extensions", caching.CacheControl{MaxAge: caching.Seconds(1), Extensions: []string{"stale-while-revalidate", "community=\"UCI\""}},
+			`max-age=1, stale-while-revalidate, community="UCI"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.cacheControl.String())
+		})
+	}
+}
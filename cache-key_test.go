@@ -0,0 +1,242 @@
+// Contains tests for customizations of the cache key
+package caching_test
+
+import (
+	"caching"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestHashOnHeader tests that requests differing in a request header of HashOn.Headers
+// are served by different objects, while requests with the same value share one object.
+func TestHashOnHeader(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		HashOn:      caching.HashOn{Headers: []string{"X-Tenant"}},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for two tenants and expect separate objects
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl), withRequestHeader("X-Tenant", "a")).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "2", withXCacheControl(cacheControl), withRequestHeader("X-Tenant", "b")).xResponse)
+
+	// send requests for both tenants again and expect the cached responses
+	assert.Equal(t, "1", mkReq(t, port, "3", withXCacheControl(cacheControl), withRequestHeader("X-Tenant", "a")).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "4", withXCacheControl(cacheControl), withRequestHeader("X-Tenant", "b")).xResponse)
+
+	// send a request without tenant and expect yet another object
+	assert.Equal(t, "5", mkReq(t, port, "5", withXCacheControl(cacheControl)).xResponse)
+
+	// expect three backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestHashOnCookie tests that requests differing in a cookie of HashOn.Cookies are served by
+// different objects, while requests differing only in other cookies share one object.
+func TestHashOnCookie(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL caching requests with cookies
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		HashOn:      caching.HashOn{Cookies: []string{"lang"}},
+		Vcl: `
+sub vcl_recv {
+  if (req.http.Cookie) {
+    return (hash);
+  }
+}
+`,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests with two languages and expect separate objects
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl), withCookie("lang=de; session=1")).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "2", withXCacheControl(cacheControl), withCookie("session=1; lang=en")).xResponse)
+
+	// send requests with other sessions and expect the cached responses
+	assert.Equal(t, "1", mkReq(t, port, "3", withXCacheControl(cacheControl), withCookie("session=2; lang=de")).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "4", withXCacheControl(cacheControl), withCookie("lang=en")).xResponse)
+
+	// send a request with a cookie merely ending with the name and expect yet another object
+	assert.Equal(t, "5", mkReq(t, port, "5", withXCacheControl(cacheControl), withCookie("xlang=de")).xResponse)
+
+	// expect three backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestHashOnProtocol tests that requests differing in their protocol version are served by different objects.
+func TestHashOnProtocol(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		HashOn:      caching.HashOn{Protocol: true},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send an HTTP/1.1 request
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl)).xResponse)
+
+	// send an HTTP/1.0 request with the same Host header and expect a separate object
+	resp := rawReq(t, port, fmt.Sprintf("GET / HTTP/1.0\r\nHost: localhost:%s\r\nX-Request: 2\r\nX-Cache-Control: %s\r\n\r\n", port, cacheControl))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Response"))
+
+	// send another HTTP/1.1 request and expect the cached response
+	assert.Equal(t, "1", mkReq(t, port, "3", withXCacheControl(cacheControl)).xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestIgnoredQueryParams tests that requests differing only in ignored query parameters share one object,
+// and that the backend receives the URL without them.
+func TestIgnoredQueryParams(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var backendUrls []string
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(10)}.String())
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+		backendUrls = append(backendUrls, r.URL.RequestURI())
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:        testServerPort,
+		IgnoredQueryParams: []string{"utm_*", "gclid"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests differing only in ignored parameters and expect them to share one object
+	assert.Equal(t, "1", mkReq(t, port, "1", withPath("/page?utm_source=a&id=1&gclid=x")).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "2", withPath("/page?id=1&utm_medium=b&utm_source=c")).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "3", withPath("/page?id=1")).xResponse)
+
+	// send requests differing in other parameters and expect separate objects
+	assert.Equal(t, "4", mkReq(t, port, "4", withPath("/page?id=2&gclid=y")).xResponse)
+	assert.Equal(t, "5", mkReq(t, port, "5", withPath("/page?gclid_extra=z&id=1")).xResponse)
+	assert.Equal(t, "6", mkReq(t, port, "6", withPath("/page?utm_campaign=d")).xResponse)
+
+	// expect four backend requests without the ignored parameters
+	assert.Equal(t, 4, backendRequests)
+	assert.Equal(t, []string{"/page?id=1", "/page?id=2", "/page?gclid_extra=z&id=1", "/page"}, backendUrls)
+}
+
+// TestHostWithPortIsSeparateObject tests that the built-in VCL hashes the Host header as is,
+// such that requests for the same host with and without port or in different case are served by different objects.
+func TestHostWithPortIsSeparateObject(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for the same host in different notations and expect separate objects
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl), withHost("example.com")).xResponse)
+	assert.Equal(t, "2", mkReq(t, port, "2", withXCacheControl(cacheControl), withHost("example.com:8080")).xResponse)
+	assert.Equal(t, "3", mkReq(t, port, "3", withXCacheControl(cacheControl), withHost("EXAMPLE.COM")).xResponse)
+
+	// send a request for another host and expect a separate object
+	assert.Equal(t, "4", mkReq(t, port, "4", withXCacheControl(cacheControl), withHost("example.org")).xResponse)
+
+	// expect four backend requests
+	assert.Equal(t, 4, backendRequests)
+}
+
+// TestNormalizeHost tests that with NormalizeHost, requests for the same host with and without port
+// or in different case share one object, and that the backend receives the normalized Host header.
+func TestNormalizeHost(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var backendHosts []string
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	echoHandler := echoCacheControlHandler(&backendRequests)
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendHosts = append(backendHosts, r.Host)
+		echoHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		NormalizeHost: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for the same host in different notations and expect them to share one object
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl), withHost("example.com")).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(cacheControl), withHost("example.com:8080")).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "3", withXCacheControl(cacheControl), withHost("EXAMPLE.COM")).xResponse)
+
+	// send a request for another host and expect a separate object
+	assert.Equal(t, "4", mkReq(t, port, "4", withXCacheControl(cacheControl), withHost("example.org:8080")).xResponse)
+
+	// expect two backend requests with normalized Host headers
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"example.com", "example.org"}, backendHosts)
+}
+
+// TestInvalidHashOn tests that header and cookie names which cannot be rendered as VCL are rejected.
+func TestInvalidHashOn(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.HashOn = caching.HashOn{Headers: []string{"X-Tenant", "X Tenant"}, Cookies: []string{"session", `a"b`}}
+	}))
+	assert.EqualError(t, err, `HashOn.Headers must be header names, not "X Tenant"
+HashOn.Cookies must be cookie names, not "a\"b"`)
+}
@@ -0,0 +1,75 @@
+package caching
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DeltaSeconds is the optional argument of a Cache-Control directive like max-age.
+// The zero value means that the directive is absent, use Seconds to create a present one.
+type DeltaSeconds struct {
+	Seconds int
+	Set     bool
+}
+
+// Seconds returns a present DeltaSeconds of the given number of seconds (including zero).
+func Seconds(seconds int) DeltaSeconds {
+	return DeltaSeconds{Seconds: seconds, Set: true}
+}
+
+// CacheControl is a typed representation of a Cache-Control header of a request or a response.
+// Its String method always renders the directives in the same order, so that rendered headers
+// can be compared with the header values received by the backend or the client.
+type CacheControl struct {
+	Public          bool
+	Private         bool
+	PrivateFields   []string // rendered as the qualified form private="..." instead of private
+	NoCache         bool
+	NoCacheFields   []string // rendered as the qualified form no-cache="..." instead of no-cache
+	NoStore         bool
+	NoTransform     bool
+	MaxAge          DeltaSeconds
+	SMaxAge         DeltaSeconds
+	SWR             DeltaSeconds // stale-while-revalidate
+	MustRevalidate  bool
+	ProxyRevalidate bool
+	Immutable       bool
+	// Extensions are rendered verbatim after all other directives.
+	// They can also be used to render directives with invalid syntax.
+	Extensions []string
+}
+
+// String renders the Cache-Control header value, which is empty when no directive is present.
+func (c CacheControl) String() string {
+	var directives []string
+	flag := func(present bool, name string) {
+		if present {
+			directives = append(directives, name)
+		}
+	}
+	delta := func(d DeltaSeconds, name string) {
+		if d.Set {
+			directives = append(directives, name+"="+strconv.Itoa(d.Seconds))
+		}
+	}
+	fields := func(present bool, names []string, name string) {
+		if len(names) > 0 {
+			directives = append(directives, name+`="`+strings.Join(names, ", ")+`"`)
+		} else {
+			flag(present, name)
+		}
+	}
+	flag(c.Public, "public")
+	fields(c.Private, c.PrivateFields, "private")
+	fields(c.NoCache, c.NoCacheFields, "no-cache")
+	flag(c.NoStore, "no-store")
+	flag(c.NoTransform, "no-transform")
+	delta(c.MaxAge, "max-age")
+	delta(c.SMaxAge, "s-maxage")
+	delta(c.SWR, "stale-while-revalidate")
+	flag(c.MustRevalidate, "must-revalidate")
+	flag(c.ProxyRevalidate, "proxy-revalidate")
+	flag(c.Immutable, "immutable")
+	directives = append(directives, c.Extensions...)
+	return strings.Join(directives, ", ")
+}
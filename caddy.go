@@ -0,0 +1,111 @@
+package caching
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path"
+	"strings"
+)
+
+const caddyVersion = "2.8.4"
+
+// caddyImage is built locally, because there is no official Caddy image containing the cache-handler module.
+const caddyImage = "http-caching-tests/caddy-cache-handler:" + caddyVersion
+
+// caddyDockerfile builds Caddy with the cache-handler module, which is based on Souin.
+// See: https://github.com/caddyserver/cache-handler
+const caddyDockerfile = `FROM caddy:` + caddyVersion + `-builder AS builder
+RUN xcaddy build --with github.com/caddyserver/cache-handler
+FROM caddy:` + caddyVersion + `
+COPY --from=builder /usr/bin/caddy /usr/bin/caddy
+`
+
+// CaddyCacheConfig is the Caddy (cache-handler/Souin) equivalent of VarnishConfig.
+type CaddyCacheConfig struct {
+	BackendPort string
+	// DefaultTtl is rendered as the ttl of the cache directive.
+	DefaultTtl string
+	// DefaultStale is rendered as the stale duration of the cache directive,
+	// which is the equivalent to the default grace period of Varnish.
+	DefaultStale string
+	// CacheConfig is added to the global cache directive.
+	CacheConfig string
+}
+
+// renderCaddyfile renders the Caddyfile for the given config.
+func renderCaddyfile(config CaddyCacheConfig) string {
+	var sb strings.Builder
+	sb.WriteString(`{
+  admin off
+  cache {
+`)
+	if config.DefaultTtl != "" {
+		sb.WriteString("    ttl " + config.DefaultTtl + "\n")
+	}
+	if config.DefaultStale != "" {
+		sb.WriteString("    stale " + config.DefaultStale + "\n")
+	}
+	sb.WriteString(config.CacheConfig)
+	sb.WriteString(`
+  }
+}
+:8080 {
+  cache
+  reverse_proxy host.docker.internal:` + config.BackendPort + `
+}
+`)
+	return sb.String()
+}
+
+// StartCaddyInDocker starts Caddy with the cache-handler module as a caching reverse proxy
+// in front of the backend in the same way StartVarnishInDocker does for Varnish.
+// The image is built on first use, which takes a while.
+func StartCaddyInDocker(config CaddyCacheConfig) (string, func() error, error) {
+	err := buildImage(context.Background(), caddyImage, "", map[string]string{"Dockerfile": caddyDockerfile})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// write the config as Caddyfile in a temporary directory
+	tmpDir, err := os.MkdirTemp("", "caddy")
+	if err != nil {
+		return "", nil, err
+	}
+	// the temporary directory is kept until the container is stopped
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	caddyfileName := path.Join(tmpDir, "Caddyfile")
+	err = os.WriteFile(caddyfileName, []byte(renderCaddyfile(config)), 0644)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// create and start a Caddy container
+	port, stopFunc, err := startContainer(&container.Config{
+		Image: caddyImage,
+		User:  "1000:1000",
+		Cmd:   []string{"caddy", "run", "--config", "/etc/caddy/Caddyfile", "--adapter", "caddyfile"},
+		Env: []string{
+			// Caddy stores its data and autosaved config there,
+			// which must be writable with the read-only root filesystem.
+			"XDG_DATA_HOME=/tmp",
+			"XDG_CONFIG_HOME=/tmp",
+		},
+		ExposedPorts: nat.PortSet{
+			"8080/tcp": struct{}{},
+		},
+	}, newHostConfig("8080/tcp",
+		// Mount the Caddyfile we created above as /etc/caddy/Caddyfile
+		caddyfileName+":/etc/caddy/Caddyfile",
+	), "8080/tcp")
+	if err != nil {
+		return "", nil, err
+	}
+	return port, removeOnStop(tmpDir, stopFunc), nil
+}
@@ -0,0 +1,85 @@
+// Contains tests running scenarios of the Varnish tests against Caddy with the cache-handler module to document behavioural differences
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCaddyNoCacheControl is the Caddy equivalent of TestNoCacheControl.
+func TestCaddyNoCacheControl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start Caddy container
+	port, stopFunc, err := caching.StartCaddyInDocker(caching.CaddyCacheConfig{
+		BackendPort: testServerPort,
+		DefaultTtl:  "1s",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
+
+	// wait half a second
+	time.Sleep(500 * time.Millisecond)
+
+	// send another request and expect the previous cached return
+	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
+
+	// wait for 600 ms
+	time.Sleep(600 * time.Millisecond)
+
+	// send another request and expect no cached return
+	assert.Equal(t, "baz", mkReq(t, port, "baz").xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestCaddyCacheStatus tests that Caddy reports hits and misses with an RFC 9211 Cache-Status header
+// out of the box, which needs custom VCL for Varnish (see TestRfc9211CacheStatusImplementation).
+func TestCaddyCacheStatus(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start Caddy container
+	port, stopFunc, err := caching.StartCaddyInDocker(caching.CaddyCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request which will be a miss
+	resp := mkReq(t, port, "1", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(10)}))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.True(t, strings.Contains(resp.cacheStatus, "fwd=uri-miss"), resp.cacheStatus)
+
+	// send another request which will be a hit
+	resp = mkReq(t, port, "2", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(10)}))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.True(t, strings.Contains(resp.cacheStatus, "hit"), resp.cacheStatus)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
@@ -0,0 +1,15 @@
+package caching
+
+import "math"
+
+// SplitWithin returns whether the given number of requests routed to the canary out of the given total is
+// consistent with VarnishConfig.Canary routing the given percentage at random, i.e. deviates from the expected
+// number by at most four standard deviations of the binomial distribution. A correct split fails this check
+// in fewer than 1 in 10000 runs, while a split ignoring the percentage fails it for a few hundred requests.
+func SplitWithin(canary int, total int, percent int) bool {
+	p := float64(percent) / 100
+	expected := float64(total) * p
+	deviation := math.Sqrt(float64(total) * p * (1 - p))
+	// half a request for the discrete count
+	return math.Abs(float64(canary)-expected) <= 4*deviation+0.5
+}
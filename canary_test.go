@@ -0,0 +1,135 @@
+// Contains tests for splitting requests between a control and a canary backend
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// variantHandler returns a backend handler which counts its requests and responds with a cacheable body
+// naming the given variant, and with the variant it was asked for in an X-Requested-Variant header.
+func variantHandler(backendRequests *int, variant string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(60)}.String())
+		w.Header().Set("X-Requested-Variant", r.Header.Get("X-Variant"))
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(variant))
+	}
+}
+
+// TestCanarySplit tests that with Canary, about the configured share of the requests is routed to the canary,
+// and that each variant is cached separately, only ever delivering the response of its own backend.
+func TestCanarySplit(t *testing.T) {
+	t.Parallel()
+	var controlRequests, canaryRequests int
+
+	// start a test server for each variant
+	controlPort, controlServer := startTestServer(variantHandler(&controlRequests, "control"))
+	defer controlServer.Close()
+	canaryPort, canaryServer := startTestServer(variantHandler(&canaryRequests, "canary"))
+	defer canaryServer.Close()
+
+	// start varnish container routing 20% to the canary
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: controlPort,
+		Canary:      &caching.Canary{BackendPort: canaryPort, Percent: 20},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests and expect the body of the backend of the variant
+	const total = 400
+	variants := map[string]int{}
+	for i := 0; i < total; i++ {
+		resp := mkReq(t, port, strconv.Itoa(i), withStoreBody(), withCaptureHeaders("X-Variant", "X-Requested-Variant"))
+		variants[resp.headers["X-Variant"]]++
+		assert.Equal(t, resp.headers["X-Variant"], resp.body)
+		assert.Equal(t, resp.headers["X-Variant"], resp.headers["X-Requested-Variant"])
+	}
+
+	// expect a split of about 20%
+	assert.Equal(t, total, variants["control"]+variants["canary"])
+	assert.True(t, caching.SplitWithin(variants["canary"], total, 20), "%d of %d requests to the canary", variants["canary"], total)
+
+	// expect 1 backend request per variant
+	assert.Equal(t, 1, controlRequests)
+	assert.Equal(t, 1, canaryRequests)
+}
+
+// TestCanarySticky tests that with Canary, randomly assigned clients receive a cookie with their variant,
+// which keeps them on it and does not prevent caching, while the header selects a variant over the cookie.
+func TestCanarySticky(t *testing.T) {
+	t.Parallel()
+	var controlRequests, canaryRequests int
+
+	// start a test server for each variant
+	controlPort, controlServer := startTestServer(variantHandler(&controlRequests, "control"))
+	defer controlServer.Close()
+	canaryPort, canaryServer := startTestServer(variantHandler(&canaryRequests, "canary"))
+	defer canaryServer.Close()
+
+	// start varnish container routing half of the requests to the canary
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: controlPort,
+		Canary:      &caching.Canary{BackendPort: canaryPort, Percent: 50, Header: "X-AB", Cookie: "ab"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request without a cookie and expect a cookie with the assigned variant
+	resp := mkReq(t, port, "1", withCaptureHeaders("X-Variant"))
+	variant := resp.headers["X-Variant"]
+	assert.Contains(t, []string{"control", "canary"}, variant)
+	assert.Equal(t, []string{"ab=" + variant + "; Path=/"}, resp.setCookies)
+
+	// send requests with the cookie and expect the same variant from the cache, without a new cookie
+	for _, xRequest := range []string{"2", "3"} {
+		resp = mkReq(t, port, xRequest, withCookie("ab="+variant), withStoreBody(), withCaptureHeaders("X-Variant"))
+		assert.Equal(t, "1", resp.xResponse)
+		assert.Equal(t, variant, resp.body)
+		assert.Empty(t, resp.setCookies)
+	}
+
+	// send requests selecting the variants by the header, which wins over the cookie
+	resp = mkReq(t, port, "4", withCookie("ab=control"), withRequestHeader("X-AB", "canary"), withStoreBody())
+	assert.Equal(t, "canary", resp.body)
+	assert.Empty(t, resp.setCookies)
+	resp = mkReq(t, port, "5", withRequestHeader("X-AB", "control"), withStoreBody())
+	assert.Equal(t, "control", resp.body)
+
+	// expect 1 backend request per variant
+	assert.Equal(t, 1, controlRequests)
+	assert.Equal(t, 1, canaryRequests)
+}
+
+// TestSplitWithin tests that splits are accepted within four standard deviations of the expected number.
+func TestSplitWithin(t *testing.T) {
+	t.Parallel()
+	assert.True(t, caching.SplitWithin(20, 100, 20))
+	assert.True(t, caching.SplitWithin(200, 1000, 20))
+	assert.True(t, caching.SplitWithin(240, 1000, 20))
+	assert.False(t, caching.SplitWithin(260, 1000, 20))
+	assert.False(t, caching.SplitWithin(50, 100, 20))
+	assert.True(t, caching.SplitWithin(0, 100, 0))
+	assert.False(t, caching.SplitWithin(1, 100, 0))
+	assert.True(t, caching.SplitWithin(100, 100, 100))
+}
+
+// TestInvalidCanary tests that an invalid canary config is rejected.
+func TestInvalidCanary(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.Canary = &caching.Canary{BackendPort: "8081", Percent: 120, Cookie: "ab"}
+		c.VaryOnCookies = map[string]string{"lang": "X-Language"}
+	}))
+	assert.EqualError(t, err, `Canary.Percent must be between 0 and 100, not 120
+Canary.Cookie and VaryOnCookies must not both be set`)
+}
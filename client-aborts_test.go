@@ -0,0 +1,107 @@
+// Contains tests for clients aborting requests while receiving the response
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// abortableBodyHandler returns a backend handler like slowBodyHandler, which writes ten "chunk" lines
+// with 200 ms between lines, and records whether all of them could be written to Varnish.
+func abortableBodyHandler(backendRequests *int, completed *bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		*completed = false
+		if cacheControl := r.Header.Get("X-Cache-Control"); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 10; i++ {
+			if i > 0 {
+				time.Sleep(200 * time.Millisecond)
+			}
+			if _, err := io.WriteString(w, "chunk\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+		*completed = true
+	}
+}
+
+// TestClientAbortCacheable tests that Varnish completes the fetch of a cacheable response in the background
+// when the client aborts the request after the first bytes, such that the object gets cached.
+// The fetch runs in a thread of its own, which reads ahead of the delivery to the client independently of it.
+func TestClientAbortCacheable(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var completed bool
+
+	// start a test server
+	testServerPort, testServer := startTestServer(abortableBodyHandler(&backendRequests, &completed))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+
+	// send request and abort it after the first chunk
+	assert.Equal(t, "chunk\n", getAndAbort(t, port, "1", cacheControl.String(), len("chunk\n")))
+
+	// wait for the backend to finish the response
+	time.Sleep(2500 * time.Millisecond)
+
+	// expect the backend to have written the complete response
+	assert.True(t, completed)
+
+	// send another request and expect the complete cached response
+	assert.Equal(t, mkResp(http.StatusOK, "1", withBody(strings.Repeat("chunk\n", 10)), withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withXCacheControl(cacheControl), withStoreBody()))
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestClientAbortUncacheable tests that an aborted request for an uncacheable response leaves nothing
+// in the cache, such that the next request goes to the backend again.
+func TestClientAbortUncacheable(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var completed bool
+
+	// start a test server
+	testServerPort, testServer := startTestServer(abortableBodyHandler(&backendRequests, &completed))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and abort it after the first chunk
+	assert.Equal(t, "chunk\n", getAndAbort(t, port, "1", caching.CacheControl{NoStore: true}.String(), len("chunk\n")))
+
+	// wait for the backend to finish or abandon the response
+	time.Sleep(2500 * time.Millisecond)
+
+	// send another request and expect a fresh response
+	assert.Equal(t, "2", mkReq(t, port, "2").xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
@@ -0,0 +1,112 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/go-connections/nat"
+	"net"
+	"strings"
+)
+
+// shardVcl renders the VCL of the given node of a self-routing cluster whose nodes listen on the given host ports.
+// Every node uses the shard director to determine the primary node for the URL of a request.
+// Requests for which another node is the primary are passed on to it uncached, with the primary
+// in the X-Shard-Primary request header, so that only the primary node caches the object.
+// Responses carry the primary node in the X-Shard-Primary response header.
+func shardVcl(node int, ports []string) string {
+	var sb strings.Builder
+	sb.WriteString("import directors;\n")
+	for i, port := range ports {
+		// The nodes reach each other via the host, because Varnish resolves backends when compiling
+		// the VCL, which is before the other nodes have been started.
+		sb.WriteString("backend " + nodeName(i) + " {\n  .host = \"host.docker.internal\";\n  .port = \"" + port + "\";\n}\n")
+	}
+	sb.WriteString("sub vcl_init {\n  new cluster = directors.shard();\n")
+	for i := range ports {
+		sb.WriteString("  cluster.add_backend(" + nodeName(i) + ");\n")
+	}
+	sb.WriteString(`  cluster.reconfigure();
+}
+sub vcl_recv {
+  if (!req.http.X-Shard-Primary) {
+    set req.http.X-Shard-Primary = cluster.backend(by=URL);
+  }
+  if (req.http.X-Shard-Primary != "` + nodeName(node) + `") {
+    set req.backend_hint = cluster.backend(by=URL);
+    return (pass);
+  }
+}
+sub vcl_deliver {
+  set resp.http.X-Shard-Primary = req.http.X-Shard-Primary;
+}
+`)
+	return sb.String()
+}
+
+func nodeName(node int) string {
+	return fmt.Sprintf("node%d", node)
+}
+
+// freePort returns a port of the host which is currently unused.
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return fmt.Sprint(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// StartVarnishClusterInDocker starts the given number of Varnish instances with the given config,
+// which form a self-routing cluster with the shard director (see shardVcl).
+// It returns the ports of all nodes, any of which can be sent requests to,
+// together with a function that will stop all nodes.
+func StartVarnishClusterInDocker(config VarnishConfig, nodes int) ([]string, func() error, error) {
+	if config.Network != nil {
+		return nil, nil, fmt.Errorf("a Varnish cluster cannot be attached to a network")
+	}
+	if config.FileStorage != "" {
+		return nil, nil, fmt.Errorf("a Varnish cluster cannot use file storage")
+	}
+	if config.BackendResolveTtl != 0 {
+		return nil, nil, fmt.Errorf("a Varnish cluster cannot resolve its backend at runtime")
+	}
+	err := config.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the nodes need each other, so they wait for their slots together
+	release, err := varnishSlots.acquire(context.Background(), nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the nodes must know the ports of each other in advance
+	ports := make([]string, nodes)
+	for i := range ports {
+		port, err := freePort()
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		ports[i] = port
+	}
+	var stopFuncs []func() error
+	stopFunc := func() error {
+		var errs []error
+		for _, stop := range stopFuncs {
+			errs = append(errs, stop())
+		}
+		release()
+		return errors.Join(errs...)
+	}
+	for i, port := range ports {
+		// bind to all interfaces like the test server, such that the other nodes can reach the node
+		instance, err := startVarnishContainer(context.Background(), config, renderVcl(config, shardVcl(i, ports)), &nat.PortBinding{HostIP: "0.0.0.0", HostPort: port}, "")
+		if err != nil {
+			return nil, nil, errors.Join(err, stopFunc())
+		}
+		stopFuncs = append(stopFuncs, instance.Stop)
+	}
+	return ports, stopFunc, nil
+}
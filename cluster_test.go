@@ -0,0 +1,57 @@
+// Contains tests for a cluster of Varnish instances routing requests with the shard director
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestShardedCluster tests that every URL is cached on exactly one primary node of the cluster,
+// regardless of which node receives the request.
+func TestShardedCluster(t *testing.T) {
+	t.Parallel()
+	backendRequests := map[string]int{}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(10)}.String())
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests[r.URL.Path]++
+	})
+	defer testServer.Close()
+
+	// start a cluster of three Varnish nodes
+	ports, stopFunc, err := caching.StartVarnishClusterInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	}, 3)
+	require.NoError(t, err)
+	defer stopFunc()
+	for _, port := range ports {
+		waitForHealthy(t, port)
+	}
+
+	primaries := map[string]bool{}
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		// send a request for the path to every node and expect all of them to deliver the cached response of the same primary
+		first := mkReq(t, ports[0], "1", withPath(path), withCaptureHeaders("X-Shard-Primary"))
+		assert.Equal(t, "1", first.xResponse)
+		primary := first.headers["X-Shard-Primary"]
+		assert.NotEmpty(t, primary)
+		for i, port := range ports {
+			resp := mkReq(t, port, "2", withPath(path), withCaptureHeaders("X-Shard-Primary"))
+			assert.Equal(t, "1", resp.xResponse, "node %d", i)
+			assert.Equal(t, primary, resp.headers["X-Shard-Primary"], "node %d", i)
+		}
+		primaries[primary] = true
+
+		// expect one backend request for the path
+		assert.Equal(t, 1, backendRequests[path], path)
+	}
+
+	// expect the paths to be distributed across more than one node
+	assert.Greater(t, len(primaries), 1)
+}
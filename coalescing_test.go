@@ -0,0 +1,187 @@
+// Contains tests for client requests arriving while a backend fetch is still in progress
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCoalescingPendingFetch tests that a request for an object whose backend fetch is still in progress
+// waits on the waiting list instead of starting another fetch, and is then served the fetched response.
+func TestCoalescingPendingFetch(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var barriers caching.Barriers
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server which blocks requests at a barrier
+	testServerPort, testServer := startTestServer(barriers.Wait("fetch", echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// send request and wait for its fetch to arrive at the backend
+	first := make(chan response)
+	go func() { first <- mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("fetch", 1, 10*time.Second))
+
+	// send another request while the fetch is still pending and wait for it to be put on the waiting list
+	second := make(chan response)
+	go func() { second <- mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)) }()
+	eventuallyCounter(t, instance, "MAIN.busy_sleep", 1)
+
+	// release the fetch and expect both requests to be served its response
+	barriers.Release("fetch")
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), <-first)
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), <-second)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, barriers.Arrivals("fetch"))
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestCoalescingPassDuringPendingFetch tests that a passed request for the same URL does not wait for
+// a backend fetch still in progress, but reaches the backend on its own.
+func TestCoalescingPassDuringPendingFetch(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var barriers caching.Barriers
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server which blocks requests at a barrier
+	testServerPort, testServer := startTestServer(barriers.Wait("fetch", echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and wait for its fetch to arrive at the backend
+	first := make(chan response)
+	go func() { first <- mkReq(t, port, "1", withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("fetch", 1, 10*time.Second))
+
+	// send a POST request, which the built-in VCL passes, and expect it to reach the backend
+	// while the fetch is still pending
+	second := make(chan response)
+	go func() { second <- mkReq(t, port, "2", withMethod(http.MethodPost), withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("fetch", 2, 10*time.Second))
+
+	// release both fetches and expect each request to be served its own response
+	barriers.Release("fetch")
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), <-first)
+	assert.Equal(t, mkResp(http.StatusOK, "2", withAcceptRanges(""), withResponseCacheControl(cacheControl)), <-second)
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestDisableCoalescing tests that with DisableCoalescing, a request for an object which is still being fetched
+// reaches the backend on its own, and that the response fetched last is delivered by later hits.
+func TestDisableCoalescing(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var barriers caching.Barriers
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server which blocks each request at a barrier of its own
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		barriers.Wait(r.Header.Get("X-Request"), echoCacheControlHandler(&backendRequests))(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:       testServerPort,
+		DisableCoalescing: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and wait for its fetch to arrive at the backend
+	first := make(chan response)
+	go func() { first <- mkReq(t, port, "1", withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("1", 1, 10*time.Second))
+
+	// send another request and expect it to reach the backend while the first fetch is still pending
+	second := make(chan response)
+	go func() { second <- mkReq(t, port, "2", withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("2", 1, 10*time.Second))
+
+	// release the second fetch before the first one and expect each request to be served its own response
+	barriers.Release("2")
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)), <-second)
+	barriers.Release("1")
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), <-first)
+
+	// send request, which is a hit on the response fetched last
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "3", withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestDisableCoalescingBurst compares a burst of concurrent requests for an uncached object with and without
+// coalescing: both take about as long as a single backend request, but without coalescing, every request
+// of the burst reaches the backend.
+func TestDisableCoalescingBurst(t *testing.T) {
+	t.Parallel()
+	sleepTime := 1 * time.Second
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+	const N = 10
+
+	for _, disableCoalescing := range []bool{false, true} {
+		var backendRequests int
+		var mutex sync.Mutex
+
+		// start a test server responding slowly
+		testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(sleepTime)
+			mutex.Lock()
+			defer mutex.Unlock()
+			echoCacheControlHandler(&backendRequests)(w, r)
+		})
+		defer testServer.Close()
+
+		// start varnish container
+		port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+			BackendPort:       testServerPort,
+			DisableCoalescing: disableCoalescing,
+		})
+		require.NoError(t, err)
+		defer stopFunc()
+		waitForHealthy(t, port)
+
+		// send N requests in parallel
+		elapsed := inParallel(N, func(i int) {
+			assert.Equal(t, http.StatusOK, mkReq(t, port, strconv.Itoa(i), withXCacheControl(cacheControl)).statusCode)
+		})
+		t.Logf("burst of %d requests with DisableCoalescing %t: %s", N, disableCoalescing, elapsed)
+		assert.Less(t, elapsed, sleepTime+500*time.Millisecond)
+
+		// expect 1 or N backend requests
+		if disableCoalescing {
+			assert.Equal(t, N, backendRequests)
+		} else {
+			assert.Equal(t, 1, backendRequests)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Contains tests for starting Varnish with a context
+package caching_test
+
+import (
+	"caching"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestStartVarnishInDockerContextCancelled tests that Varnish is not started with a context which is already done.
+func TestStartVarnishInDockerContextCancelled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := caching.StartVarnishInDockerContext(ctx, caching.VarnishConfig{
+		BackendPort: "8080",
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// TestStartVarnishInDockerContextDeadline tests that starting Varnish gives up at the deadline of the context,
+// and that Varnish started within the deadline keeps running after it.
+func TestStartVarnishInDockerContextDeadline(t *testing.T) {
+	t.Parallel()
+
+	// start varnish container with a deadline too short to start it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := caching.StartVarnishInDockerContext(ctx, caching.VarnishConfig{
+		BackendPort: "8080",
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// start a test server
+	var backendRequests int
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a sufficient deadline
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	port, stopFunc, err := caching.StartVarnishInDockerContext(ctx, caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+
+	// expect varnish to keep running when the deadline is cancelled
+	cancel()
+	waitForHealthy(t, port)
+}
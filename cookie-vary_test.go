@@ -0,0 +1,111 @@
+// Contains tests for varying cached responses on the values of single cookies
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestVaryOnCookies tests that with VaryOnCookies, the cache splits by the value of the session-language cookie,
+// while requests with other cookies are cached as well and share the objects, and a client cannot select
+// a variant by sending the extracted header itself.
+func TestVaryOnCookies(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var backendCookies []string
+
+	// start a test server which responds in the language of the X-Language header
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		backendCookies = append(backendCookies, r.Header.Values("Cookie")...)
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(60)}.String())
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("language:" + r.Header.Get("X-Language")))
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		VaryOnCookies: map[string]string{"session-language": "X-Language"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests and expect the response of the first request for the same language, whatever the other cookies
+	for _, test := range []struct {
+		xRequest  string
+		modifier  func(*request)
+		xResponse string
+		body      string
+	}{
+		{"1", withCookie("session-language=de; session=abc"), "1", "language:de"},
+		{"2", withCookie("tracking=xyz; session-language=de"), "1", "language:de"},
+		{"3", withCookie("session-language=en"), "3", "language:en"},
+		{"4", withCookie("session=abc"), "4", "language:"},
+		{"5", withRequestHeader("X-Language", "en"), "4", "language:"},
+		{"6", withCookie("session-language=en; session=def"), "3", "language:en"},
+	} {
+		resp := mkReq(t, port, test.xRequest, test.modifier, withStoreBody(), withCaptureHeaders("Vary"))
+		assert.Equal(t, test.xResponse, resp.xResponse, test.xRequest)
+		assert.Equal(t, test.body, resp.body, test.xRequest)
+		// downstream caches and browsers must vary on the cookies instead of the extracted header
+		assert.Equal(t, "Cookie", resp.headers["Vary"], test.xRequest)
+	}
+
+	// expect no cookies to reach the backend
+	assert.Empty(t, backendCookies)
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestVaryOnCookiesKeepsVary tests that VaryOnCookies adds to the Vary header of the backend instead of replacing it.
+func TestVaryOnCookiesKeepsVary(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server varying on Accept-Language
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(60)}.String())
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		VaryOnCookies: map[string]string{"session-language": "X-Language"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests differing in the cookie and then in Accept-Language, and expect both to split the cache
+	resp := mkReq(t, port, "1", withCookie("session-language=de"), withCaptureHeaders("Vary"))
+	assert.Equal(t, "Accept-Language, Cookie", resp.headers["Vary"])
+	assert.Equal(t, "2", mkReq(t, port, "2", withCookie("session-language=en")).xResponse)
+	assert.Equal(t, "3", mkReq(t, port, "3", withCookie("session-language=de"), withRequestHeader("Accept-Language", "fr")).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "4", withCookie("session-language=de")).xResponse)
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestInvalidVaryOnCookies tests that cookie and header names which cannot be rendered as VCL are rejected.
+func TestInvalidVaryOnCookies(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.VaryOnCookies = map[string]string{"a=b": "X-A", "lang": "X Language"}
+	}))
+	assert.EqualError(t, err, `VaryOnCookies must map cookie names, not "a=b"
+VaryOnCookies[lang] must be a header name, not "X Language"`)
+}
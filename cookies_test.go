@@ -0,0 +1,107 @@
+// Contains tests for responses setting cookies
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestSetCookieIsNotCached tests that the built-in VCL does not cache a response with a Set-Cookie header,
+// even if it is cacheable according to its Cache-Control header, such that every client gets its own cookie.
+func TestSetCookieIsNotCached(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests and expect each to receive its own cookie
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withSetCookies("session=1")),
+		mkReq(t, port, "1", withXCacheControl(cacheControl), withXSetCookies("session=1")))
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl), withSetCookies("session=2")),
+		mkReq(t, port, "2", withXCacheControl(cacheControl), withXSetCookies("session=2")))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestSetCookieLeaksWhenForcedIntoCache tests the risk of custom VCL caching responses regardless
+// of their Set-Cookie headers: a later client receives the cookie set for the first client.
+func TestSetCookieLeaksWhenForcedIntoCache(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL bypassing the built-in vcl_backend_response
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Vcl: `
+sub vcl_backend_response {
+  return (deliver);
+}
+`,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withSetCookies("session=1", "tracking=1")),
+		mkReq(t, port, "1", withXCacheControl(cacheControl), withXSetCookies("session=1", "tracking=1")))
+
+	// send another request and expect the cached response including the cookies of the first client
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withSetCookies("session=1", "tracking=1")),
+		mkReq(t, port, "2", withXCacheControl(cacheControl), withXSetCookies("session=2", "tracking=2")))
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestStripSetCookieOnHit tests that with StripSetCookieOnHit, Varnish caches a response with Set-Cookie headers,
+// but only the client whose request fetched the response receives the cookies.
+func TestStripSetCookieOnHit(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		StripSetCookieOnHit: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect all cookies
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withSetCookies("session=1", "tracking=1")),
+		mkReq(t, port, "1", withXCacheControl(cacheControl), withXSetCookies("session=1", "tracking=1")))
+
+	// send another request and expect the cached response without any cookies
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withXCacheControl(cacheControl), withXSetCookies("session=2", "tracking=2")))
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
@@ -0,0 +1,54 @@
+package caching
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Cors configures the CORS headers of a backend handler returned by CorsHandler.
+type Cors struct {
+	// AllowedOrigins are the origins which are allowed, or any origin if empty.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are sent in responses to preflight requests.
+	AllowedMethods []string
+	AllowedHeaders []string
+	// MaxAge is the Access-Control-Max-Age of responses to preflight requests in seconds, omitted if 0.
+	MaxAge int
+}
+
+// IsPreflight reports whether the given request is a CORS preflight request.
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// CorsHandler returns a backend handler which responds to preflight requests with 204 and the configured CORS
+// headers, and passes all other requests on to the given handler after adding Access-Control-Allow-Origin.
+// Responses to preflight requests echo the X-Request header as X-Response. All responses carry Vary: Origin,
+// and Access-Control-Allow-Origin is only added for allowed origins.
+func CorsHandler(cors Cors, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		allowed := origin != "" && (len(cors.AllowedOrigins) == 0 || slices.Contains(cors.AllowedOrigins, origin))
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if !IsPreflight(r) {
+			next(w, r)
+			return
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+			if len(cors.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			}
+			if cors.MaxAge != 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+		}
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
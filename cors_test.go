@@ -0,0 +1,156 @@
+// Contains tests for caching CORS preflight requests
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// corsHandler returns a backend handler which answers preflight requests like caching.CorsHandler
+// and counts them, and responds to all other requests with echoCacheControlHandler.
+func corsHandler(preflightRequests *int, backendRequests *int, cors caching.Cors) http.HandlerFunc {
+	handler := caching.CorsHandler(cors, echoCacheControlHandler(backendRequests))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if caching.IsPreflight(r) {
+			*preflightRequests++
+		}
+		handler(w, r)
+	}
+}
+
+// TestPreflightIsNotCachedByDefault tests that the built-in VCL passes preflight requests.
+func TestPreflightIsNotCachedByDefault(t *testing.T) {
+	t.Parallel()
+	var preflightRequests, backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(corsHandler(&preflightRequests, &backendRequests, caching.Cors{
+		AllowedMethods: []string{http.MethodPut},
+		MaxAge:         600,
+	}))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send the same preflight request twice
+	assert.Equal(t, mkResp(http.StatusNoContent, "1", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "1", withOrigin("https://a"), withPreflight(http.MethodPut)))
+	assert.Equal(t, mkResp(http.StatusNoContent, "2", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "2", withOrigin("https://a"), withPreflight(http.MethodPut)))
+
+	// expect 2 preflight requests to the backend
+	assert.Equal(t, 2, preflightRequests)
+}
+
+// TestCachePreflights tests that with CachePreflights, preflight requests are cached per Origin and requested
+// method and headers, and that they do not share objects with the actual requests.
+func TestCachePreflights(t *testing.T) {
+	t.Parallel()
+	var preflightRequests, backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(corsHandler(&preflightRequests, &backendRequests, caching.Cors{
+		AllowedOrigins: []string{"https://a", "https://b"},
+		AllowedMethods: []string{http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"X-Token"},
+		MaxAge:         600,
+	}))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:     testServerPort,
+		CachePreflights: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send preflight requests which are cached
+	assert.Equal(t, mkResp(http.StatusNoContent, "1", withAccessControlAllowOrigin("https://a"), withHeader("Access-Control-Max-Age", "600")),
+		mkReq(t, port, "1", withOrigin("https://a"), withPreflight(http.MethodPut), withCaptureHeaders("Access-Control-Max-Age")))
+	assert.Equal(t, mkResp(http.StatusNoContent, "1", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "2", withOrigin("https://a"), withPreflight(http.MethodPut)))
+
+	// send preflight requests for another origin, method and headers
+	assert.Equal(t, mkResp(http.StatusNoContent, "3", withAccessControlAllowOrigin("https://b")),
+		mkReq(t, port, "3", withOrigin("https://b"), withPreflight(http.MethodPut)))
+	assert.Equal(t, mkResp(http.StatusNoContent, "4", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "4", withOrigin("https://a"), withPreflight(http.MethodDelete)))
+	assert.Equal(t, mkResp(http.StatusNoContent, "5", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "5", withOrigin("https://a"), withPreflight(http.MethodPut, "X-Token")))
+
+	// send a preflight request for an origin which is not allowed, which is cached without the CORS headers
+	assert.Equal(t, mkResp(http.StatusNoContent, "6"),
+		mkReq(t, port, "6", withOrigin("https://evil"), withPreflight(http.MethodPut)))
+	assert.Equal(t, mkResp(http.StatusNoContent, "6"),
+		mkReq(t, port, "7", withOrigin("https://evil"), withPreflight(http.MethodPut)))
+
+	// expect 5 preflight requests to the backend
+	assert.Equal(t, 5, preflightRequests)
+
+	// send an actual request, which is not served from the cached preflight response
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+	assert.Equal(t, mkResp(http.StatusOK, "8", withAccessControlAllowOrigin("https://a"), withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "8", withOrigin("https://a"), withXCacheControl(cacheControl)))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestCachePreflightsMaxAge tests that with CachePreflights, cached preflight responses expire after
+// their Access-Control-Max-Age instead of the default TTL.
+func TestCachePreflightsMaxAge(t *testing.T) {
+	t.Parallel()
+	var preflightRequests, backendRequests int
+
+	// start a test server with a short and a long Access-Control-Max-Age
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/short": corsHandler(&preflightRequests, &backendRequests, caching.Cors{AllowedMethods: []string{http.MethodPut}, MaxAge: 1}),
+		"/long":  corsHandler(&preflightRequests, &backendRequests, caching.Cors{AllowedMethods: []string{http.MethodPut}, MaxAge: 600}),
+	})
+	defer testServer.Close()
+
+	// start varnish container without grace, such that expired preflight responses are refetched synchronously
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:     testServerPort,
+		DefaultTtl:      2 * time.Second,
+		DefaultGrace:    0,
+		CachePreflights: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send preflight requests to both paths
+	assert.Equal(t, mkResp(http.StatusNoContent, "1", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "1", withPath("/short"), withOrigin("https://a"), withPreflight(http.MethodPut)))
+	assert.Equal(t, mkResp(http.StatusNoContent, "2", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "2", withPath("/long"), withOrigin("https://a"), withPreflight(http.MethodPut)))
+
+	// wait 1.1 seconds to let the preflight response with Access-Control-Max-Age: 1 expire
+	time.Sleep(1100 * time.Millisecond)
+
+	// expect the short-lived preflight response to be refetched and the other one to be a hit
+	assert.Equal(t, mkResp(http.StatusNoContent, "3", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "3", withPath("/short"), withOrigin("https://a"), withPreflight(http.MethodPut)))
+
+	// wait for the default TTL to pass as well
+	time.Sleep(1100 * time.Millisecond)
+
+	assert.Equal(t, mkResp(http.StatusNoContent, "2", withAccessControlAllowOrigin("https://a")),
+		mkReq(t, port, "4", withPath("/long"), withOrigin("https://a"), withPreflight(http.MethodPut)))
+
+	// expect 3 preflight requests to the backend
+	assert.Equal(t, 3, preflightRequests)
+}
@@ -0,0 +1,171 @@
+package caching
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLines is the number of lines a containerLog keeps.
+const logLines = 40
+
+// containerLog keeps the last lines logged by a container and detects its crash, which is either a line
+// matching the crash pattern or the container exiting before it was stopped. It is safe for concurrent use.
+type containerLog struct {
+	crashPattern *regexp.Regexp
+	// crashed is closed on the first crash.
+	crashed chan struct{}
+
+	mutex   sync.Mutex
+	lines   []string
+	partial string
+	crash   string
+	// afterCrash are the last lines logged after the crash.
+	afterCrash []string
+	stopped    bool
+}
+
+func newContainerLog(crashPattern *regexp.Regexp) *containerLog {
+	return &containerLog{crashPattern: crashPattern, crashed: make(chan struct{})}
+}
+
+// write adds output of the container, which may end in the middle of a line.
+func (l *containerLog) write(output string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lines := strings.Split(l.partial+output, "\n")
+	l.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		l.lines = append(l.lines, line)
+		if len(l.lines) > logLines {
+			l.lines = l.lines[1:]
+		}
+		if l.crash != "" {
+			l.afterCrash = append(l.afterCrash, line)
+			if len(l.afterCrash) > logLines {
+				l.afterCrash = l.afterCrash[1:]
+			}
+		}
+		if l.crashPattern != nil && l.crashPattern.MatchString(line) {
+			l.setCrash(line)
+		}
+	}
+}
+
+// setCrash records the first crash. The mutex must be held.
+func (l *containerLog) setCrash(crash string) {
+	if l.crash != "" {
+		return
+	}
+	l.crash = crash
+	close(l.crashed)
+}
+
+// exited records that the log of the container has ended, which is a crash unless the container was stopped.
+func (l *containerLog) exited() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.stopped {
+		l.setCrash("container exited unexpectedly")
+	}
+}
+
+// stop records that the container is being stopped on purpose.
+func (l *containerLog) stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stopped = true
+}
+
+// recover clears the crash once a line matching the given pattern has been logged after it, such that
+// a deliberate crash is not reported. It returns whether the crash has been cleared.
+func (l *containerLog) recover(pattern *regexp.Regexp) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, line := range l.afterCrash {
+		if pattern.MatchString(line) {
+			l.crash = ""
+			l.afterCrash = nil
+			l.crashed = make(chan struct{})
+			return true
+		}
+	}
+	return false
+}
+
+// report returns the first crash, which is empty if the container has not crashed, and the last lines logged.
+func (l *containerLog) report() (string, []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lines := make([]string, len(l.lines))
+	copy(lines, l.lines)
+	return l.crash, lines
+}
+
+// varnishCrashPattern matches the lines which the manager process of varnishd logs when the child process,
+// which handles all requests, panicked, died or was killed for not responding.
+var varnishCrashPattern = regexp.MustCompile(`Child \(\d+\) (died|Panic)|[Cc]hild not responding`)
+
+// Crashed returns a channel which is closed once the varnishd child process has crashed or the container
+// has exited unexpectedly, such that tests can fail fast instead of running into connection errors.
+func (v *VarnishInstance) Crashed() <-chan struct{} {
+	v.log.mutex.Lock()
+	defer v.log.mutex.Unlock()
+	return v.log.crashed
+}
+
+// Crash returns an error describing the crash of the varnishd child process or the container, including the panic
+// message and the last lines logged by the container, or nil if neither has crashed.
+func (v *VarnishInstance) Crash() error {
+	crash, lines := v.log.report()
+	if crash == "" {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("varnishd crashed: " + crash + "\n")
+	// the manager process keeps the panic message of the last child, unless the container itself has exited;
+	// panic.show fails if there is none
+	panicMessage, err := execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "panic.show")
+	if err == nil {
+		sb.WriteString("panic message:\n" + panicMessage + "\n")
+	}
+	sb.WriteString("last log lines:\n" + strings.Join(lines, "\n"))
+	return errors.New(sb.String())
+}
+
+// varnishRestartPattern matches the line which the child process of varnishd logs (via the manager process)
+// once it has been started.
+var varnishRestartPattern = regexp.MustCompile(`Child \(\d+\) said Child starts`)
+
+// PanicChild deliberately panics the varnishd child process with debug.panic.worker and waits until the manager
+// process has restarted it. The restarted child starts with an empty cache, since the malloc storage does not
+// survive it, and with the counters of the child reset. The deliberate crash is not reported by Crashed and Crash;
+// instead, PanicChild returns its report. It fails if the child was not restarted within the given timeout.
+func (v *VarnishInstance) PanicChild(timeout time.Duration) (string, error) {
+	// the command fails, since the child dies before it responds
+	_, _ = execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "debug.panic.worker")
+	select {
+	case <-v.Crashed():
+	case <-time.After(timeout):
+		return "", fmt.Errorf("varnishd child did not panic within %s", timeout)
+	}
+	report := v.Crash()
+	deadline := time.Now().Add(timeout)
+	for !v.log.recover(varnishRestartPattern) {
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("varnishd child was not restarted within %s: %w", timeout, report)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// the restarted child has a new shared memory log
+	v.bgfetches = 0
+	// clear the panic message, such that panic.show only shows unexpected panics
+	_, err := execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "panic.clear")
+	if err != nil {
+		return "", err
+	}
+	return report.Error(), nil
+}
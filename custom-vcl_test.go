@@ -30,10 +30,10 @@ func TestAbandon5xxResponseInGracePeriodWhen2xxCached(t *testing.T) {
 	defer testServer.Close()
 
 	// start varnish container with a custom VCL
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort:  testServerPort,
-		DefaultTtl:   "1s",
-		DefaultGrace: "5s",
+		DefaultTtl:   caching.Scaled(1 * time.Second),
+		DefaultGrace: caching.Scaled(5 * time.Second),
 		Vcl: `
 sub vcl_backend_response {
   if (beresp.status == 500 || (beresp.status >= 502 && beresp.status <= 504)) {
@@ -44,39 +44,36 @@ sub vcl_backend_response {
 }`,
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// send request with a 200 response, which will be cached
-	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, port, "foo", withXStatusCode(http.StatusOK)))
-
-	// wait half a second
-	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, instance.Port, "foo", withXStatusCode(http.StatusOK)))
 
 	// send another request and expect the previous cached return
-	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, instance.Port, "bar"))
 
-	// wait for 600 ms to let the cached response expire and enter grace period
-	time.Sleep(600 * time.Millisecond)
+	// wait for the cached response to expire and enter grace period
+	eventuallyStale(t, instance, "/")
 
 	// send a request which will trigger a background/asynchronous revalidation
 	// request and result in a 500 response. We still get the 200 cached response here.
-	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, port, "baz", withXStatusCode(http.StatusInternalServerError)))
+	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, instance.Port, "baz", withXStatusCode(http.StatusInternalServerError)))
 
-	// wait a bit for Varnish to finish the revalidation request. Normally, if we hadn't
+	// wait for Varnish to finish the revalidation request. Normally, if we hadn't
 	// modified vcl_backend_response, this would now abandon the 200 cached response and
 	// later requests with a 500 response would also return 500.
 	// But not this time. See next request.
-	time.Sleep(50 * time.Millisecond)
+	waitForBackgroundFetch(t, instance)
 
 	// Do another request which will also respond with the cached 200 response.
 	// This is because we abandoned the background request and still have a cached 200 response.
 	// Note that this request here will _also_ trigger a background revalidation request whose
 	// 500 response will then also be abandoned.
-	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, port, "boo", withXStatusCode(http.StatusInternalServerError)))
+	assert.Equal(t, mkResp(http.StatusOK, "foo"), mkReq(t, instance.Port, "boo", withXStatusCode(http.StatusInternalServerError)))
 
-	// wait a bit for Varnish to finish the revalidation request.
-	time.Sleep(50 * time.Millisecond)
+	// wait for Varnish to finish the revalidation request.
+	waitForBackgroundFetch(t, instance)
 
 	// expect three backend requests
 	// 1. initial request with 200 response
@@ -102,28 +99,28 @@ func TestTtlOn5xxBackendResponseIsNotAutomaticallyHitForMiss(t *testing.T) {
 	defer testServer.Close()
 
 	// start varnish container with a custom VCL
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
 		Vcl: `
 sub vcl_backend_response {
   if (beresp.status == 500 || (beresp.status >= 502 && beresp.status <= 504)) {
-    set beresp.ttl = 1s;
-    set beresp.grace = 10s;
+    set beresp.ttl = ` + caching.VclDuration(caching.Scaled(1*time.Second)) + `;
+    set beresp.grace = ` + caching.VclDuration(caching.Scaled(10*time.Second)) + `;
   }
 }`,
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// send request which will become a 500 response
-	assert.Equal(t, mkResp(http.StatusInternalServerError, "foo"), mkReq(t, port, "foo"))
+	assert.Equal(t, mkResp(http.StatusInternalServerError, "foo"), mkReq(t, instance.Port, "foo"))
 
-	// wait a tiny bit
-	time.Sleep(100 * time.Millisecond)
+	// wait for the response to be cached
+	eventuallyCached(t, instance, "/")
 
 	// send another request and expect the previous cached return
-	assert.Equal(t, mkResp(http.StatusInternalServerError, "foo"), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusInternalServerError, "foo"), mkReq(t, instance.Port, "bar"))
 
 	// expect one backend request
 	// If beresp.uncacheable would have been set to true, we would have gotten a Hit-For-Miss object
@@ -166,9 +163,6 @@ sub vcl_backend_response {
 	// send request which will become a 500 response
 	assert.Equal(t, mkResp(http.StatusInternalServerError, "foo"), mkReq(t, port, "foo"))
 
-	// wait a tiny bit
-	time.Sleep(100 * time.Millisecond)
-
 	// send another request and expect a new backend request because of Hit-For-Miss
 	assert.Equal(t, mkResp(http.StatusInternalServerError, "bar"), mkReq(t, port, "bar"))
 
@@ -202,13 +196,13 @@ sub vcl_backend_response {
 	defer stopFunc()
 	waitForHealthy(t, port)
 
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("s-maxage=10")), mkReq(t, port, "s-maxage=10, stale-while-revalidate", withPath("/1")))
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("public, s-maxage=10")), mkReq(t, port, "public, s-maxage=10, stale-while-revalidate", withPath("/2")))
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("s-maxage=10, public")), mkReq(t, port, "s-maxage=10, stale-while-revalidate, public", withPath("/3")))
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("stale-while-revalidate=10, public")), mkReq(t, port, "stale-while-revalidate=10, public", withPath("/4")))
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("stale-while-revalidate=10")), mkReq(t, port, "stale-while-revalidate=10", withPath("/5")))
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("stale-while-revalidate = 10")), mkReq(t, port, "stale-while-revalidate = 10", withPath("/6")))
-	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControl("")), mkReq(t, port, "stale-while-revalidate", withPath("/7")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("s-maxage=10")), mkReq(t, port, "s-maxage=10, stale-while-revalidate", withPath("/1")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("public, s-maxage=10")), mkReq(t, port, "public, s-maxage=10, stale-while-revalidate", withPath("/2")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("s-maxage=10, public")), mkReq(t, port, "s-maxage=10, stale-while-revalidate, public", withPath("/3")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("stale-while-revalidate=10, public")), mkReq(t, port, "stale-while-revalidate=10, public", withPath("/4")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("stale-while-revalidate=10")), mkReq(t, port, "stale-while-revalidate=10", withPath("/5")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("stale-while-revalidate = 10")), mkReq(t, port, "stale-while-revalidate = 10", withPath("/6")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withResponseCacheControlValue("")), mkReq(t, port, "stale-while-revalidate", withPath("/7")))
 }
 
 // TestReturnPassInVclRecvBypassesTheCache tests that returning pass in vcl_recv bypasses the cache.
@@ -227,8 +221,8 @@ func TestReturnPassInVclRecvBypassesTheCache(t *testing.T) {
 	// start varnish container with a custom VCL
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort:  testServerPort,
-		DefaultTtl:   "1s",
-		DefaultGrace: "10s",
+		DefaultTtl:   1 * time.Second,
+		DefaultGrace: 10 * time.Second,
 		Vcl: `
 sub vcl_recv {
   if (req.http.X-Request) {
@@ -243,9 +237,6 @@ sub vcl_recv {
 	// send first request which will be passed through to the backend
 	assert.Equal(t, mkResp(http.StatusOK, "foo", withAcceptRanges("")), mkReq(t, port, "foo"))
 
-	// wait a bit (for no reason, really)
-	time.Sleep(100 * time.Millisecond)
-
 	// send another request and expect a new backend request because
 	assert.Equal(t, mkResp(http.StatusOK, "foo", withAcceptRanges("")), mkReq(t, port, "foo"))
 
@@ -270,35 +261,37 @@ func TestSettingReqGraceInVclRecvIsUpperCapForBerespGraceInVclBackendResponse(t
 	defer testServer.Close()
 
 	// start varnish container with a custom VCL
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
 		Vcl: `
 sub vcl_recv {
-  set req.grace = 1s;
+  set req.grace = ` + caching.VclDuration(caching.Scaled(1*time.Second)) + `;
 }
 sub vcl_backend_response {
-  set beresp.ttl = 100ms;
-  set beresp.grace = 10s;
+  set beresp.ttl = ` + caching.VclDuration(caching.Scaled(100*time.Millisecond)) + `;
+  set beresp.grace = ` + caching.VclDuration(caching.Scaled(10*time.Second)) + `;
 }`,
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// send first request which should get a grace of only 1s
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("")), mkReq(t, port, "foo"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue("")), mkReq(t, instance.Port, "foo"))
 
 	// wait for the response to become stale but still within grace
-	time.Sleep(200 * time.Millisecond)
+	eventuallyStale(t, instance, "/")
 
 	// send another request and expect a cached response and an asynchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("")), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue("")), mkReq(t, instance.Port, "bar"))
 
-	// wait to get outside of grace, which should only have been 1s
-	time.Sleep(1200 * time.Millisecond)
+	// wait for the asynchronous backend request and to get outside of the grace of its response,
+	// which should only be 1s
+	waitForBackgroundFetch(t, instance)
+	eventuallyOutOfGrace(t, instance, "/")
 
 	// send another request and expect a synchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControl("")), mkReq(t, port, "buzz"))
+	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControlValue("")), mkReq(t, instance.Port, "buzz"))
 
 	// expect three backend requests
 	assert.Equal(t, 3, backendRequests)
@@ -314,38 +307,40 @@ func TestSettingReqGraceInVclRecvIsUpperCapForSwrOfBackendResponse(t *testing.T)
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=10")
+		w.Header().Set("Cache-Control", scaledCacheControl("max-age=1, stale-while-revalidate=10"))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
 		w.WriteHeader(http.StatusOK)
 	})
 	defer testServer.Close()
 
 	// start varnish container with a custom VCL
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
 		Vcl: `
 sub vcl_recv {
-  set req.grace = 1s;
+  set req.grace = ` + caching.VclDuration(caching.Scaled(1*time.Second)) + `;
 }`,
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// send first request which should get a grace of only 1s
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("max-age=1, stale-while-revalidate=10")), mkReq(t, port, "foo"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=10"))), mkReq(t, instance.Port, "foo"))
 
 	// wait for the response to become stale but still within grace
-	time.Sleep(1200 * time.Millisecond)
+	eventuallyStale(t, instance, "/")
 
 	// send another request and expect a cached response and an asynchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("max-age=1, stale-while-revalidate=10")), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=10"))), mkReq(t, instance.Port, "bar"))
 
-	// wait to get outside of grace, which should only have been 1s
-	time.Sleep(2200 * time.Millisecond)
+	// wait for the asynchronous backend request and to get outside of the grace of its response,
+	// which should only be 1s
+	waitForBackgroundFetch(t, instance)
+	eventuallyOutOfGrace(t, instance, "/")
 
 	// send another request and expect a synchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControl("max-age=1, stale-while-revalidate=10")), mkReq(t, port, "buzz"))
+	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=10"))), mkReq(t, instance.Port, "buzz"))
 
 	// expect three backend requests
 	assert.Equal(t, 3, backendRequests)
@@ -381,13 +376,10 @@ sub vcl_backend_response {
 	waitForHealthy(t, port)
 
 	// send first request which should get a TTL of 10s
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("")), mkReq(t, port, "foo"))
-
-	// wait a bit
-	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue("")), mkReq(t, port, "foo"))
 
 	// send another request and expect the cached response (because req.ttl is NO upper cap for beresp.ttl)
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("")), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue("")), mkReq(t, port, "bar"))
 
 	// expect one backend request
 	assert.Equal(t, 1, backendRequests)
@@ -403,14 +395,14 @@ func TestSetBerespTtlToTinyValueAllowsForStaleWhileRevalidate(t *testing.T) {
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		w.Header().Set("Cache-Control", "stale-while-revalidate=1")
+		w.Header().Set("Cache-Control", scaledCacheControl("stale-while-revalidate=1"))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
 		w.WriteHeader(http.StatusOK)
 	})
 	defer testServer.Close()
 
 	// start varnish container with a custom VCL
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
 		Vcl: `
 sub vcl_backend_response {
@@ -425,23 +417,24 @@ sub vcl_backend_response {
 }`,
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// send first request should get a grace of 1s
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("stale-while-revalidate=1")), mkReq(t, port, "foo"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("stale-while-revalidate=1"))), mkReq(t, instance.Port, "foo"))
 
-	// wait a bit but still within grace
-	time.Sleep(200 * time.Millisecond)
+	// wait for the response to become stale but still within grace
+	eventuallyStale(t, instance, "/")
 
 	// send another request and expect a cached response and an asynchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("stale-while-revalidate=1")), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("stale-while-revalidate=1"))), mkReq(t, instance.Port, "bar"))
 
-	// wait to get outside of grace
-	time.Sleep(1100 * time.Millisecond)
+	// wait for the asynchronous backend request and to get outside of the grace of its response
+	waitForBackgroundFetch(t, instance)
+	eventuallyOutOfGrace(t, instance, "/")
 
 	// send another request and expect a synchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControl("stale-while-revalidate=1")), mkReq(t, port, "buzz"))
+	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControlValue(scaledCacheControl("stale-while-revalidate=1"))), mkReq(t, instance.Port, "buzz"))
 
 	// expect three backend requests
 	assert.Equal(t, 3, backendRequests)
@@ -482,19 +475,13 @@ sub vcl_backend_response {
 	waitForHealthy(t, port)
 
 	// send first request
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("private, stale-while-revalidate=1")), mkReq(t, port, "foo"))
-
-	// wait a bit
-	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue("private, stale-while-revalidate=1")), mkReq(t, port, "foo"))
 
 	// send another request and expect a new synchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "bar", withResponseCacheControl("private, stale-while-revalidate=1")), mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "bar", withResponseCacheControlValue("private, stale-while-revalidate=1")), mkReq(t, port, "bar"))
 
-	// wait to get outside of supposed grace period
-	time.Sleep(1100 * time.Millisecond)
-
-	// send another request and also expect a synchronous backend request
-	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControl("private, stale-while-revalidate=1")), mkReq(t, port, "buzz"))
+	// send another request and also expect a synchronous backend request, since there is no object in grace either
+	assert.Equal(t, mkResp(http.StatusOK, "buzz", withResponseCacheControlValue("private, stale-while-revalidate=1")), mkReq(t, port, "buzz"))
 
 	// expect three backend requests
 	assert.Equal(t, 3, backendRequests)
@@ -562,14 +549,14 @@ func TestSetXCacheResponseHeaderOnHitOrMiss(t *testing.T) {
 	// start a test server
 	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
 		backendRequests++
-		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=1")
+		w.Header().Set("Cache-Control", scaledCacheControl("max-age=1, stale-while-revalidate=1"))
 		w.Header().Set("X-Response", r.Header.Get("X-Request"))
 		w.WriteHeader(http.StatusOK)
 	})
 	defer testServer.Close()
 
 	// start varnish container with a custom VCL
-	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
 		Vcl: `
 sub vcl_hit {
@@ -589,34 +576,34 @@ sub vcl_deliver {
 `,
 	})
 	require.NoError(t, err)
-	defer stopFunc()
-	waitForHealthy(t, port)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
 
 	// do the first request, which will be a miss
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("max-age=1, stale-while-revalidate=1"), withXCache("miss")),
-		mkReq(t, port, "foo"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=1")), withXCache("miss")),
+		mkReq(t, instance.Port, "foo"))
 
 	// do the second request, which will be a hit due to being within TTL
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("max-age=1, stale-while-revalidate=1"), withXCache("hit")),
-		mkReq(t, port, "bar"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=1")), withXCache("hit")),
+		mkReq(t, instance.Port, "bar"))
 
 	// wait for being out of TTL
-	time.Sleep(1100 * time.Millisecond)
+	eventuallyStale(t, instance, "/")
 
 	// do the third request, which will still be considered a hit because within grace
-	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControl("max-age=1, stale-while-revalidate=1"), withXCache("hit")),
-		mkReq(t, port, "baz"))
+	assert.Equal(t, mkResp(http.StatusOK, "foo", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=1")), withXCache("hit")),
+		mkReq(t, instance.Port, "baz"))
 
-	// wait a bit for background refresh
-	time.Sleep(100 * time.Millisecond)
+	// wait for the background refresh
+	waitForBackgroundFetch(t, instance)
 
-	// now, varnish will have refreshed the object in the background and it will again have a TTL of 1
+	// now, varnish has refreshed the object in the background and it again has a TTL of 1
 	// so we must wait for being out of TTL and of grace
-	time.Sleep(2100 * time.Millisecond)
+	eventuallyOutOfGrace(t, instance, "/")
 
 	// do the fourth request, which will be a miss
-	assert.Equal(t, mkResp(http.StatusOK, "foobarbaz", withResponseCacheControl("max-age=1, stale-while-revalidate=1"), withXCache("miss")),
-		mkReq(t, port, "foobarbaz"))
+	assert.Equal(t, mkResp(http.StatusOK, "foobarbaz", withResponseCacheControlValue(scaledCacheControl("max-age=1, stale-while-revalidate=1")), withXCache("miss")),
+		mkReq(t, instance.Port, "foobarbaz"))
 }
 
 func TestRfc9211CacheStatusImplementation(t *testing.T) {
@@ -634,7 +621,7 @@ func TestRfc9211CacheStatusImplementation(t *testing.T) {
 	// start varnish container with a custom VCL
 	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
 		BackendPort: testServerPort,
-		DefaultTtl:  "1s",
+		DefaultTtl:  caching.Scaled(1 * time.Second),
 		Vcl: `
 sub vcl_hit {
   set req.http.Cache-Status = "my-cache; hit";
@@ -816,3 +803,38 @@ sub vcl_backend_response {
 
 	assert.Equal(t, 2, backendRequests)
 }
+
+// TestBakeVcl tests that with BakeVcl, Varnish runs the custom VCL baked into an image,
+// which instances started later with the same config reuse.
+func TestBakeVcl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	config := caching.VarnishConfig{
+		BackendPort: testServerPort,
+		BakeVcl:     true,
+		Vcl: `
+sub vcl_deliver {
+  set resp.http.X-Vcl = "baked";
+}`,
+	}
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+	for i, xRequest := range []string{"1", "2"} {
+		// start varnish container with the VCL baked into its image
+		instance, err := caching.StartVarnishInstanceInDocker(config)
+		require.NoError(t, err)
+		waitForHealthy(t, instance.Port)
+
+		// send request and expect the custom VCL to run
+		assert.Equal(t, mkResp(http.StatusOK, xRequest, withResponseCacheControl(cacheControl), withHeader("X-Vcl", "baked")),
+			mkReq(t, instance.Port, xRequest, withXCacheControl(cacheControl), withCaptureHeaders("X-Vcl")), "instance %d", i+1)
+		instance.Stop()
+	}
+
+	// expect 2 backend requests, one per instance
+	assert.Equal(t, 2, backendRequests)
+}
@@ -0,0 +1,58 @@
+// Contains tests for varying cached responses on the device class derived from the User-Agent
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// TestDeviceDetection tests that with DeviceDetection, requests with all User-Agents of the corpus are served
+// by one object per device class, each with the response of the backend for its class.
+func TestDeviceDetection(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server which responds with the device class of the X-Device header
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(60)}.String())
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.Header.Get("X-Device")))
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:     testServerPort,
+		DeviceDetection: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a request per User-Agent and expect the response fetched by the first request of the same class
+	first := map[string]string{}
+	for i, userAgent := range caching.UserAgentCorpus {
+		xRequest := strconv.Itoa(i + 1)
+		if _, ok := first[userAgent.Device]; !ok {
+			first[userAgent.Device] = xRequest
+		}
+		resp := mkReq(t, port, xRequest, withRequestHeader("User-Agent", userAgent.UserAgent), withStoreBody(),
+			withCaptureHeaders("Vary"))
+		assert.Equal(t, userAgent.Device, resp.body, userAgent.UserAgent)
+		assert.Equal(t, first[userAgent.Device], resp.xResponse, userAgent.UserAgent)
+		assert.Equal(t, "User-Agent", resp.headers["Vary"], userAgent.UserAgent)
+	}
+
+	// send request of a desktop client claiming to be mobile and expect the desktop response
+	assert.Equal(t, first["desktop"], mkReq(t, port, "spoofed", withRequestHeader("User-Agent", "curl/8.8.0"),
+		withRequestHeader("X-Device", "mobile")).xResponse)
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
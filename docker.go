@@ -0,0 +1,468 @@
+package caching
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cli *client.Client
+
+// pulledImages remembers the images which have already been pulled or built by this process.
+var pulledImages sync.Map
+
+func init() {
+	var err error
+	// create a Docker client
+	cli, err = client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// PullPolicy decides whether an image is pulled from its registry before a container is started from it.
+// Images are pulled lazily by the first start of a container needing them.
+type PullPolicy string
+
+const (
+	// PullAlways pulls an image once per process, which updates images whose tag has been moved.
+	PullAlways PullPolicy = "always"
+	// PullIfNotPresent only pulls an image which Docker does not have yet (for the requested platform).
+	PullIfNotPresent PullPolicy = "if-not-present"
+	// PullNever never pulls an image, such that starting a container fails if Docker does not have it,
+	// e.g. in air-gapped environments where images are loaded by other means.
+	PullNever PullPolicy = "never"
+)
+
+// PullPolicyEnv is the environment variable with the pull policy used unless a config sets one,
+// e.g. CACHING_PULL_POLICY=never. It defaults to PullIfNotPresent.
+const PullPolicyEnv = "CACHING_PULL_POLICY"
+
+// resolvePullPolicy returns the given policy, or the one of PullPolicyEnv if empty.
+func resolvePullPolicy(policy PullPolicy) (PullPolicy, error) {
+	if policy == "" {
+		policy = PullPolicy(withDefault(os.Getenv(PullPolicyEnv), string(PullIfNotPresent)))
+	}
+	switch policy {
+	case PullAlways, PullIfNotPresent, PullNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid pull policy %q, expected %q, %q or %q", policy, PullAlways, PullIfNotPresent, PullNever)
+}
+
+// imagePresent reports whether Docker has the given image for the given platform.
+// An empty platform accepts any platform.
+func imagePresent(ctx context.Context, image string, platform string) (bool, error) {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	p, err := parsePlatform(platform)
+	if err != nil || p == nil {
+		return true, err
+	}
+	return inspect.Os == p.OS && inspect.Architecture == p.Architecture && (p.Variant == "" || inspect.Variant == p.Variant), nil
+}
+
+// pullImage pulls the given image for the given platform according to the given pull policy, unless it has already
+// been pulled by this process. An empty platform leaves the choice to the Docker daemon, which usually picks its
+// native platform, and an empty policy is taken from PullPolicyEnv. The registry is accessed with the given
+// credentials, or anonymously if nil. Cancelling the context aborts the pull.
+func pullImage(ctx context.Context, image string, platform string, policy PullPolicy, auth *RegistryAuth) error {
+	key := imageKey(image, platform)
+	if _, ok := pulledImages.Load(key); ok {
+		return nil
+	}
+	policy, err := resolvePullPolicy(policy)
+	if err != nil {
+		return err
+	}
+	if policy != PullAlways {
+		present, err := imagePresent(ctx, image, platform)
+		if err != nil {
+			return err
+		}
+		if present {
+			pulledImages.Store(key, struct{}{})
+			return nil
+		}
+		if policy == PullNever {
+			return fmt.Errorf("image %s is not present and the pull policy is %q", imageKey(image, platform), policy)
+		}
+	}
+	registryAuth, err := auth.encode(image)
+	if err != nil {
+		return err
+	}
+	reader, err := cli.ImagePull(ctx, image, types.ImagePullOptions{Platform: platform, RegistryAuth: registryAuth})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// the pull only completes when its output has been read
+	_, err = io.Copy(os.Stdout, reader)
+	if err != nil {
+		return err
+	}
+	pulledImages.Store(key, struct{}{})
+	return nil
+}
+
+// imageKey returns the key of an image for the given platform in pulledImages.
+func imageKey(image string, platform string) string {
+	if platform == "" {
+		return image
+	}
+	return image + " for " + platform
+}
+
+// parsePlatform parses a platform given as os/arch or os/arch/variant, e.g. "linux/arm64",
+// and returns nil for an empty platform, which leaves the choice to the Docker daemon.
+func parsePlatform(platform string) (*ocispec.Platform, error) {
+	if platform == "" {
+		return nil, nil
+	}
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", platform)
+	}
+	p := &ocispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// buildImage builds an image for the given platform with the given tag from a build context containing the given
+// files, unless it has already been built by this process. An empty platform builds for the native platform.
+func buildImage(ctx context.Context, tag string, platform string, files map[string]string) error {
+	key := imageKey(tag, platform)
+	if _, ok := pulledImages.Load(key); ok {
+		return nil
+	}
+	var buildContext bytes.Buffer
+	tw := tar.NewWriter(&buildContext)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	response, err := cli.ImageBuild(ctx, &buildContext, types.ImageBuildOptions{
+		Tags:     []string{tag},
+		Remove:   true,
+		Platform: platform,
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// the build only fails with an error message in the output stream
+	err = jsonmessage.DisplayJSONMessagesStream(response.Body, os.Stdout, os.Stdout.Fd(), false, nil)
+	if err != nil {
+		return err
+	}
+	pulledImages.Store(key, struct{}{})
+	return nil
+}
+
+// newHostConfig returns the host config shared by all cache containers, which runs the container
+// locked down and maps the given container port to a random port on the loopback interface of the host.
+func newHostConfig(containerPort nat.Port, binds ...string) *container.HostConfig {
+	return &container.HostConfig{
+		CapDrop:        []string{"ALL"}, // <- drop all capabilities
+		Privileged:     false,           // <- run as unprivileged user
+		ReadonlyRootfs: true,            // <- mount the root filesystem as read-only
+		AutoRemove:     true,            // <- automatically remove the container when it exits
+		ExtraHosts: []string{
+			// Make the host's network available to the container
+			// via the special DNS name host.docker.internal.
+			"host.docker.internal:host-gateway",
+		},
+		Tmpfs: map[string]string{
+			// Mount a tmpfs volume to /tmp for the working directories of the cache.
+			"/tmp": "exec,mode=700,uid=1000,gid=1000",
+		},
+		Binds: binds,
+		PortBindings: nat.PortMap{
+			// Map the container's port to a random port on the host.
+			// We will later figure out the allocated host port.
+			containerPort: []nat.PortBinding{{
+				HostIP:   "127.0.0.1", // <- bind to loopback interface
+				HostPort: "0",         // <- use random host port
+			}},
+		},
+	}
+}
+
+// waitUntilHealthy polls the /health path of the test server through the cache at the given port
+// until it succeeds, for caches which take a while to start up after the container has started.
+func waitUntilHealthy(port string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get("http://localhost:" + port + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cache at port %s did not become healthy within %s", port, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// startContainer creates and starts a container, tails its logs and returns the host port
+// mapped to the given container port together with a function that will stop the container.
+func startContainer(config *container.Config, hostConfig *container.HostConfig, containerPort nat.Port) (string, func() error, error) {
+	c, err := runContainer(context.Background(), config, hostConfig, nil, nil, nil, containerPort, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.hostPort, c.stop, nil
+}
+
+// stopTimeout limits how long stopping a container may take, including the grace period of 10 seconds
+// in which Docker waits for the container to exit before killing it.
+const stopTimeout = 30 * time.Second
+
+// stopContainer stops the container with the given ID, which is removed automatically then. If stopping fails,
+// e.g. because the Docker daemon does not respond in time, it removes the container forcefully, and only reports
+// an error if that fails as well, i.e. if the container may be left behind. A container which has already
+// been removed, e.g. because it exited on its own, counts as stopped.
+func stopContainer(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	err := cli.ContainerStop(ctx, id, container.StopOptions{})
+	if err == nil || client.IsErrNotFound(err) {
+		return nil
+	}
+	removeCtx, cancelRemove := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancelRemove()
+	removeErr := cli.ContainerRemove(removeCtx, id, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	if removeErr == nil || client.IsErrNotFound(removeErr) {
+		return nil
+	}
+	return fmt.Errorf("container %s may be left behind: stopping failed: %w, removing failed: %w", id, err, removeErr)
+}
+
+// runningContainer is a container started by runContainer.
+type runningContainer struct {
+	id       string
+	hostPort string
+	log      *containerLog
+	stop     func() error
+}
+
+// removeOnStop wraps the given function stopping a container to remove the given temporary directory as well,
+// which the container mounts files from and therefore must outlive it.
+func removeOnStop(dir string, stop func() error) func() error {
+	return func() error {
+		defer os.RemoveAll(dir)
+		return stop()
+	}
+}
+
+// runContainer starts a container like startContainer, but returns its ID as well, for commands to be executed
+// in it later on, and its log, which detects crashes by the given pattern unless nil. Unless nil, the networking
+// config attaches the container to a network of its own (see Network.attach), and the platform selects the variant
+// of a multi-platform image, failing if the image has not been pulled for it. The private files are copied into the
+// container before it starts (see copyPrivateFiles). Cancelling the context aborts the start and removes the container,
+// while the started container outlives the context.
+func runContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, privateFiles map[string]string, containerPort nat.Port, crashPattern *regexp.Regexp) (_ *runningContainer, err error) {
+	// create the container
+	containerResponse, err := cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			// remove the container, which is not removed automatically unless it has been started
+			_ = cli.ContainerRemove(context.Background(), containerResponse.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		}
+	}()
+
+	err = copyPrivateFiles(ctx, containerResponse.ID, privateFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// start the container
+	err = cli.ContainerStart(ctx, containerResponse.ID, container.StartOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// tail logs of container as long as it runs
+	i, err := cli.ContainerLogs(context.Background(), containerResponse.ID, container.LogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Timestamps: false,
+		Follow:     true,
+		Tail:       "40",
+	})
+	if err != nil {
+		return nil, err
+	}
+	log := newContainerLog(crashPattern)
+	hdr := make([]byte, 8)
+	go func() {
+		fmt.Printf("Start tailing logs for container %s\n", containerResponse.ID)
+		for {
+			_, err := io.ReadFull(i, hdr)
+			if err != nil {
+				break
+			}
+			var w io.Writer
+			switch hdr[0] {
+			case 1:
+				w = os.Stdout
+			default:
+				w = os.Stderr
+			}
+			count := binary.BigEndian.Uint32(hdr[4:])
+			dat := make([]byte, count)
+			_, err = io.ReadFull(i, dat)
+			fmt.Fprint(w, string(dat))
+			log.write(string(dat))
+		}
+		log.exited()
+		fmt.Printf("Stop tailing logs for container %s\n", containerResponse.ID)
+	}()
+
+	// figure out the allocated host port (note: we used "0" as port above)
+	containerInspect, err := cli.ContainerInspect(ctx, containerResponse.ID)
+	if err != nil {
+		return nil, err
+	}
+	hostPort := containerInspect.NetworkSettings.Ports[containerPort][0].HostPort
+
+	// return a function that will stop the container
+	return &runningContainer{
+		id:       containerResponse.ID,
+		hostPort: hostPort,
+		log:      log,
+		stop: func() error {
+			log.stop()
+			return stopContainer(containerResponse.ID)
+		},
+	}, nil
+}
+
+// copyPrivateFiles copies the given files, by their absolute paths in the container, into the created container
+// with the given ID. Unlike files mounted from the host, they are owned by the user of the container and only readable
+// by it, e.g. secrets which other users of the host must not read. Since the root filesystem is read-only and a tmpfs
+// is only mounted when the container starts, their directories must be volumes (see privateVolume).
+func copyPrivateFiles(ctx context.Context, containerID string, files map[string]string) error {
+	for name, content := range files {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		err := tw.WriteHeader(&tar.Header{Name: path.Base(name), Mode: 0600, Size: int64(len(content))})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			return err
+		}
+		err = tw.Close()
+		if err != nil {
+			return err
+		}
+		// CopyUIDGID makes the user of the container own the file instead of root
+		err = cli.CopyToContainer(ctx, containerID, path.Dir(name), &archive, types.CopyToContainerOptions{CopyUIDGID: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// privateVolume returns the mount of an anonymous volume at the given directory of a container for copyPrivateFiles,
+// which Docker keeps out of the host filesystem of other users and removes together with the container.
+func privateVolume(dir string) mount.Mount {
+	return mount.Mount{Type: mount.TypeVolume, Target: dir}
+}
+
+// execInContainer runs the given command in the running container with the given ID
+// and returns its standard output. It fails if the command exits with a non-zero exit code.
+func execInContainer(containerID string, cmd ...string) (string, error) {
+	return execInContainerWithInput(containerID, "", cmd...)
+}
+
+// execInContainerWithInput runs the given command like execInContainer, with the given input as standard input,
+// e.g. to write files into the container, whose root filesystem is read-only and whose /tmp is a tmpfs.
+// If the command fails, the error contains its standard output as well, where varnishadm reports errors.
+func execInContainerWithInput(containerID string, input string, cmd ...string) (string, error) {
+	execResponse, err := cli.ContainerExecCreate(context.Background(), containerID, types.ExecConfig{
+		AttachStdin:  input != "",
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", err
+	}
+	attachResponse, err := cli.ContainerExecAttach(context.Background(), execResponse.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", err
+	}
+	defer attachResponse.Close()
+	if input != "" {
+		_, err = io.WriteString(attachResponse.Conn, input)
+		if err != nil {
+			return "", err
+		}
+		err = attachResponse.CloseWrite()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// the output is multiplexed like the logs of the container
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, attachResponse.Reader)
+	if err != nil {
+		return "", err
+	}
+	execInspect, err := cli.ContainerExecInspect(context.Background(), execResponse.ID)
+	if err != nil {
+		return "", err
+	}
+	if execInspect.ExitCode != 0 {
+		return "", fmt.Errorf("%v exited with code %d: %s%s", cmd, execInspect.ExitCode, stderr.String(), stdout.String())
+	}
+	return stdout.String(), nil
+}
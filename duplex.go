@@ -0,0 +1,106 @@
+package caching
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// This file contains a long-lived bidirectional stream over HTTP/1.1, where the client sends its messages as chunks
+// of the request body and the backend echoes each of them as a chunk of the response body while the request is still
+// being sent. It stands in for gRPC streams, which cannot pass Varnish, since Varnish only speaks HTTP/1.1 to backends.
+
+// DuplexEchoHandler is a backend handler which responds right away and then echoes each line of the request body
+// as a line of the response body, prefixed with "echo: ", until the request body ends.
+func DuplexEchoHandler(w http.ResponseWriter, r *http.Request) {
+	controller := http.NewResponseController(w)
+	if err := controller.EnableFullDuplex(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Response", r.Header.Get("X-Request"))
+	w.WriteHeader(http.StatusOK)
+	if controller.Flush() != nil {
+		return
+	}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		_, err := fmt.Fprintf(w, "echo: %s\n", scanner.Text())
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// DuplexStream is the client side of a bidirectional stream to a DuplexEchoHandler.
+type DuplexStream struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	response *http.Response
+	body     *bufio.Reader
+}
+
+// OpenDuplexStream sends the header of a POST request with a chunked body for the given path to localhost
+// at the given port, with the given X-Request header. It does not wait for the response, since a cache
+// which does not pipe the request only forwards the response after the request body has ended.
+func OpenDuplexStream(port string, path string, xRequest string) (*DuplexStream, error) {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: localhost:%s\r\nX-Request: %s\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n", path, port, xRequest)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &DuplexStream{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Send sends the message followed by a newline as a chunk of the request body.
+func (s *DuplexStream) Send(message string) error {
+	_, err := fmt.Fprintf(s.conn, "%x\r\n%s\n\r\n", len(message)+1, message)
+	return err
+}
+
+// CloseSend ends the request body, after which no more messages can be sent.
+func (s *DuplexStream) CloseSend() error {
+	_, err := s.conn.Write([]byte("0\r\n\r\n"))
+	return err
+}
+
+// Response waits for the header of the response and returns it. Its body must not be read directly.
+func (s *DuplexStream) Response() (*http.Response, error) {
+	if s.response == nil {
+		response, err := http.ReadResponse(s.reader, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.response = response
+		s.body = bufio.NewReader(response.Body)
+	}
+	return s.response, nil
+}
+
+// Receive waits for the response header if necessary, and then for the next line of the response body,
+// which it returns without the trailing newline.
+func (s *DuplexStream) Receive() (string, error) {
+	_, err := s.Response()
+	if err != nil {
+		return "", err
+	}
+	line, err := s.body.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// Close closes the connection.
+func (s *DuplexStream) Close() error {
+	return s.conn.Close()
+}
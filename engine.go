@@ -0,0 +1,284 @@
+package caching
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EngineConfig is the configuration shared by all cache engines.
+// Each engine maps it to its own configuration as closely as possible.
+type EngineConfig struct {
+	BackendPort  string
+	DefaultTtl   time.Duration
+	DefaultGrace time.Duration
+}
+
+// Endpoint is where a started cache engine accepts client requests.
+type Endpoint struct {
+	Port string
+}
+
+// URL returns the base URL of the endpoint.
+func (e Endpoint) URL() string {
+	return "http://localhost:" + e.Port
+}
+
+// Capabilities tell which parts of the shared scenarios a cache engine supports,
+// such that scenarios can skip engines which cannot express them.
+type Capabilities struct {
+	// DefaultTtl is true if the engine can apply EngineConfig.DefaultTtl.
+	DefaultTtl bool
+	// DefaultGrace is true if the engine can apply EngineConfig.DefaultGrace.
+	DefaultGrace bool
+	// StaleWhileRevalidate is true if the engine serves stale responses within
+	// the stale-while-revalidate directive of the response.
+	StaleWhileRevalidate bool
+	// DebugHitMiss is true if DebugHitMiss can tell hits from misses.
+	DebugHitMiss bool
+}
+
+// HitMiss is whether a response was served from the cache.
+type HitMiss int
+
+const (
+	Unknown HitMiss = iota
+	Hit
+	Miss
+)
+
+func (h HitMiss) String() string {
+	switch h {
+	case Hit:
+		return "hit"
+	case Miss:
+		return "miss"
+	default:
+		return "unknown"
+	}
+}
+
+// CacheEngine is a cache which can be started in front of a test server.
+type CacheEngine interface {
+	// Name returns a short name of the engine, usable as a subtest name.
+	Name() string
+	// Start starts the engine and returns its endpoint together with a function that will stop it,
+	// which reports an error if the engine may have been left running.
+	Start(config EngineConfig) (Endpoint, func() error, error)
+	// Capabilities returns which parts of EngineConfig and of the shared scenarios the engine supports.
+	Capabilities() Capabilities
+	// DebugHitMiss tells from the response headers whether the response was a cache hit.
+	// Stale responses count as hits.
+	DebugHitMiss(header http.Header) HitMiss
+}
+
+// Engines returns all available cache engines.
+func Engines() []CacheEngine {
+	return []CacheEngine{VarnishEngine{}, NginxEngine{}, AtsEngine{}, SquidEngine{}, CaddyEngine{}, EnvoyEngine{}}
+}
+
+// unsupported returns an error for a non-zero setting of the config which an engine cannot apply.
+func unsupported(engine CacheEngine, setting string, value time.Duration) error {
+	if value == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s does not support %s", engine.Name(), setting)
+}
+
+// engineDuration renders a duration of the config for the config of an engine, e.g. "500ms" or "10s",
+// which is empty if 0.
+func engineDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return VclDuration(d)
+}
+
+// VarnishEngine runs Varnish with the built-in VCL and reports hits and misses in an X-Cache header.
+type VarnishEngine struct{}
+
+func (e VarnishEngine) Name() string {
+	return "varnish"
+}
+
+func (e VarnishEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	port, stopFunc, err := StartVarnishInDocker(VarnishConfig{
+		BackendPort:        config.BackendPort,
+		DefaultTtl:         config.DefaultTtl,
+		DefaultGrace:       config.DefaultGrace,
+		EnableXCacheHeader: true,
+	})
+	return Endpoint{Port: port}, stopFunc, err
+}
+
+func (e VarnishEngine) Capabilities() Capabilities {
+	return Capabilities{DefaultTtl: true, DefaultGrace: true, StaleWhileRevalidate: true, DebugHitMiss: true}
+}
+
+func (e VarnishEngine) DebugHitMiss(header http.Header) HitMiss {
+	switch header.Get("X-Cache") {
+	case "hit":
+		return Hit
+	case "miss":
+		return Miss
+	default:
+		return Unknown
+	}
+}
+
+// NginxEngine runs nginx with proxy_cache.
+type NginxEngine struct{}
+
+func (e NginxEngine) Name() string {
+	return "nginx"
+}
+
+func (e NginxEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	// proxy_cache_use_stale is unbounded, which is not what a default grace means
+	if err := unsupported(e, "DefaultGrace", config.DefaultGrace); err != nil {
+		return Endpoint{}, nil, err
+	}
+	port, stopFunc, err := StartNginxInDocker(NginxCacheConfig{
+		BackendPort: config.BackendPort,
+		DefaultTtl:  engineDuration(config.DefaultTtl),
+	})
+	return Endpoint{Port: port}, stopFunc, err
+}
+
+func (e NginxEngine) Capabilities() Capabilities {
+	return Capabilities{DefaultTtl: true, StaleWhileRevalidate: true, DebugHitMiss: true}
+}
+
+func (e NginxEngine) DebugHitMiss(header http.Header) HitMiss {
+	switch header.Get("X-Cache") {
+	case "HIT", "STALE", "UPDATING", "REVALIDATED":
+		return Hit
+	case "MISS", "EXPIRED", "BYPASS":
+		return Miss
+	default:
+		return Unknown
+	}
+}
+
+// AtsEngine runs Apache Traffic Server.
+type AtsEngine struct{}
+
+func (e AtsEngine) Name() string {
+	return "ats"
+}
+
+func (e AtsEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	if err := unsupported(e, "DefaultGrace", config.DefaultGrace); err != nil {
+		return Endpoint{}, nil, err
+	}
+	port, stopFunc, err := StartAtsInDocker(AtsCacheConfig{
+		BackendPort: config.BackendPort,
+		DefaultTtl:  engineDuration(config.DefaultTtl),
+	})
+	return Endpoint{Port: port}, stopFunc, err
+}
+
+func (e AtsEngine) Capabilities() Capabilities {
+	return Capabilities{DefaultTtl: true}
+}
+
+func (e AtsEngine) DebugHitMiss(header http.Header) HitMiss {
+	return Unknown
+}
+
+// SquidEngine runs Squid with its default refresh_pattern.
+type SquidEngine struct{}
+
+func (e SquidEngine) Name() string {
+	return "squid"
+}
+
+func (e SquidEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	if err := unsupported(e, "DefaultTtl", config.DefaultTtl); err != nil {
+		return Endpoint{}, nil, err
+	}
+	if err := unsupported(e, "DefaultGrace", config.DefaultGrace); err != nil {
+		return Endpoint{}, nil, err
+	}
+	port, stopFunc, err := StartSquidInDocker(SquidCacheConfig{
+		BackendPort: config.BackendPort,
+	})
+	return Endpoint{Port: port}, stopFunc, err
+}
+
+func (e SquidEngine) Capabilities() Capabilities {
+	return Capabilities{DebugHitMiss: true}
+}
+
+func (e SquidEngine) DebugHitMiss(header http.Header) HitMiss {
+	xCache := header.Get("X-Cache")
+	switch {
+	case strings.HasPrefix(xCache, "HIT"):
+		return Hit
+	case strings.HasPrefix(xCache, "MISS"):
+		return Miss
+	default:
+		return Unknown
+	}
+}
+
+// CaddyEngine runs Caddy with the cache-handler module.
+type CaddyEngine struct{}
+
+func (e CaddyEngine) Name() string {
+	return "caddy"
+}
+
+func (e CaddyEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	port, stopFunc, err := StartCaddyInDocker(CaddyCacheConfig{
+		BackendPort:  config.BackendPort,
+		DefaultTtl:   engineDuration(config.DefaultTtl),
+		DefaultStale: engineDuration(config.DefaultGrace),
+	})
+	return Endpoint{Port: port}, stopFunc, err
+}
+
+func (e CaddyEngine) Capabilities() Capabilities {
+	return Capabilities{DefaultTtl: true, DefaultGrace: true, StaleWhileRevalidate: true, DebugHitMiss: true}
+}
+
+func (e CaddyEngine) DebugHitMiss(header http.Header) HitMiss {
+	cacheStatus := header.Get("Cache-Status")
+	switch {
+	case strings.Contains(cacheStatus, "; hit"):
+		return Hit
+	case strings.Contains(cacheStatus, "fwd="):
+		return Miss
+	default:
+		return Unknown
+	}
+}
+
+// EnvoyEngine runs Envoy with the HTTP cache filter.
+type EnvoyEngine struct{}
+
+func (e EnvoyEngine) Name() string {
+	return "envoy"
+}
+
+func (e EnvoyEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	if err := unsupported(e, "DefaultGrace", config.DefaultGrace); err != nil {
+		return Endpoint{}, nil, err
+	}
+	port, stopFunc, err := StartEnvoyInDocker(EnvoyCacheConfig{
+		BackendPort: config.BackendPort,
+		DefaultTtl:  engineDuration(config.DefaultTtl),
+	})
+	return Endpoint{Port: port}, stopFunc, err
+}
+
+func (e EnvoyEngine) Capabilities() Capabilities {
+	return Capabilities{DefaultTtl: true}
+}
+
+func (e EnvoyEngine) DebugHitMiss(header http.Header) HitMiss {
+	// the cache filter sets no header telling hits from misses,
+	// and an Age header is passed through from the backend as well
+	return Unknown
+}
@@ -0,0 +1,94 @@
+// Contains tests running the same scenarios against all cache engines
+package caching_test
+
+import (
+	"caching"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var reportFile = flag.String("report", "", "write a Markdown table comparing the outcomes of the engine scenarios to this file")
+
+// engineReport collects the outcomes of all scenarios run via forEachEngine, written by TestMain.
+var engineReport caching.Report
+
+// TestEnginesCacheControlMaxAge1 tests that all cache engines cache a response with max-age=1
+// for one second and report hits and misses where they can.
+func TestEnginesCacheControlMaxAge1(t *testing.T) {
+	t.Parallel()
+	forEachEngine(t, func(t *testing.T, engine caching.CacheEngine) {
+		var backendRequests int
+
+		// start a test server
+		testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+		defer testServer.Close()
+
+		// start the cache engine
+		port := startEngine(t, engine, caching.EngineConfig{BackendPort: testServerPort})
+		cacheControl := caching.CacheControl{MaxAge: caching.Seconds(1)}
+
+		// send request
+		resp := mkReq(t, port, "1", withXCacheControl(cacheControl), withEngine(engine))
+		assert.Equal(t, "1", resp.xResponse)
+		if engine.Capabilities().DebugHitMiss {
+			assert.Equal(t, caching.Miss, resp.hitMiss)
+		}
+
+		// send another request and expect to receive the cached response
+		resp = mkReq(t, port, "2", withXCacheControl(cacheControl), withEngine(engine))
+		assert.Equal(t, "1", resp.xResponse)
+		if engine.Capabilities().DebugHitMiss {
+			assert.Equal(t, caching.Hit, resp.hitMiss)
+		}
+
+		// wait for the response to expire
+		time.Sleep(1100 * time.Millisecond)
+
+		// send another request and expect no cached response
+		assert.Equal(t, "3", mkReq(t, port, "3", withXCacheControl(cacheControl)).xResponse)
+
+		// expect two backend requests
+		assert.Equal(t, 2, backendRequests)
+	})
+}
+
+// TestEnginesDefaultTtl tests that all cache engines supporting a default TTL
+// apply it to responses without Cache-Control.
+func TestEnginesDefaultTtl(t *testing.T) {
+	t.Parallel()
+	forEachEngine(t, func(t *testing.T, engine caching.CacheEngine) {
+		if !engine.Capabilities().DefaultTtl {
+			t.Skipf("%s does not support a default TTL", engine.Name())
+		}
+		var backendRequests int
+
+		// start a test server
+		testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Response", r.Header.Get("X-Request"))
+			w.WriteHeader(http.StatusOK)
+			backendRequests++
+		})
+		defer testServer.Close()
+
+		// start the cache engine
+		port := startEngine(t, engine, caching.EngineConfig{BackendPort: testServerPort, DefaultTtl: 1 * time.Second})
+
+		// send request
+		assert.Equal(t, "1", mkReq(t, port, "1").xResponse)
+
+		// send another request and expect the previous cached return
+		assert.Equal(t, "1", mkReq(t, port, "2").xResponse)
+
+		// wait for the response to expire
+		time.Sleep(1100 * time.Millisecond)
+
+		// send another request and expect no cached return
+		assert.Equal(t, "3", mkReq(t, port, "3").xResponse)
+
+		// expect two backend requests
+		assert.Equal(t, 2, backendRequests)
+	})
+}
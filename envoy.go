@@ -0,0 +1,123 @@
+package caching
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path"
+)
+
+const envoyImage = "envoyproxy/envoy:v1.30.2"
+
+// EnvoyCacheConfig is the Envoy (HTTP cache filter) equivalent of VarnishConfig.
+// The cache filter has no notion of a grace period or keep duration.
+type EnvoyCacheConfig struct {
+	BackendPort string
+	// DefaultTtl is emulated by adding a "Cache-Control: max-age" header to backend responses without
+	// a Cache-Control header, because the cache filter only caches responses with explicit freshness.
+	DefaultTtl string
+}
+
+// renderEnvoyConfig renders the static envoy.yaml for the given config.
+func renderEnvoyConfig(config EnvoyCacheConfig) (string, error) {
+	ttl, err := durationSeconds(config.DefaultTtl)
+	if err != nil {
+		return "", err
+	}
+	var responseHeadersToAdd string
+	if ttl > 0 {
+		responseHeadersToAdd = `
+                response_headers_to_add:
+                - header:
+                    key: Cache-Control
+                    value: "` + CacheControl{MaxAge: Seconds(ttl)}.String() + `"
+                  append_action: ADD_IF_ABSENT`
+	}
+	return `static_resources:
+  listeners:
+  - name: listener
+    address:
+      socket_address: { address: 0.0.0.0, port_value: 8080 }
+    filter_chains:
+    - filters:
+      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
+          stat_prefix: ingress
+          route_config:
+            virtual_hosts:
+            - name: backend
+              domains: ["*"]
+              routes:
+              - match: { prefix: "/" }
+                route: { cluster: backend }` + responseHeadersToAdd + `
+          http_filters:
+          - name: envoy.filters.http.cache
+            typed_config:
+              "@type": type.googleapis.com/envoy.extensions.filters.http.cache.v3.CacheConfig
+              typed_config:
+                "@type": type.googleapis.com/envoy.extensions.http.cache.simple_http_cache.v3.SimpleHttpCacheConfig
+          - name: envoy.filters.http.router
+            typed_config:
+              "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+  clusters:
+  - name: backend
+    type: STRICT_DNS
+    load_assignment:
+      cluster_name: backend
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: { address: host.docker.internal, port_value: ` + config.BackendPort + ` }
+`, nil
+}
+
+// StartEnvoyInDocker starts Envoy with the HTTP cache filter as a caching reverse proxy
+// in front of the backend in the same way StartVarnishInDocker does for Varnish.
+func StartEnvoyInDocker(config EnvoyCacheConfig) (string, func() error, error) {
+	err := pullImage(context.Background(), envoyImage, "", "", nil)
+	if err != nil {
+		return "", nil, err
+	}
+	envoyConfig, err := renderEnvoyConfig(config)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// write the config as envoy.yaml file in a temporary directory
+	tmpDir, err := os.MkdirTemp("", "envoy")
+	if err != nil {
+		return "", nil, err
+	}
+	// the temporary directory is kept until the container is stopped
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	configFileName := path.Join(tmpDir, "envoy.yaml")
+	err = os.WriteFile(configFileName, []byte(envoyConfig), 0644)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// create and start an Envoy container
+	port, stopFunc, err := startContainer(&container.Config{
+		Image: envoyImage,
+		User:  "1000:1000",
+		Cmd:   []string{"envoy", "-c", "/etc/envoy/envoy.yaml"},
+		ExposedPorts: nat.PortSet{
+			"8080/tcp": struct{}{},
+		},
+	}, newHostConfig("8080/tcp",
+		// Mount the envoy.yaml file we created above as /etc/envoy/envoy.yaml
+		configFileName+":/etc/envoy/envoy.yaml",
+	), "8080/tcp")
+	if err != nil {
+		return "", nil, err
+	}
+	return port, removeOnStop(tmpDir, stopFunc), nil
+}
@@ -0,0 +1,89 @@
+// Contains tests running scenarios of the Varnish tests against Envoy's HTTP cache filter to document behavioural differences
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestEnvoyNoCacheControl is the Envoy equivalent of TestNoCacheControl, with the default TTL
+// being emulated by adding a Cache-Control header to the backend response.
+func TestEnvoyNoCacheControl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start Envoy container
+	port, stopFunc, err := caching.StartEnvoyInDocker(caching.EnvoyCacheConfig{
+		BackendPort: testServerPort,
+		DefaultTtl:  "1s",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
+
+	// wait half a second
+	time.Sleep(500 * time.Millisecond)
+
+	// send another request and expect the previous cached return
+	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
+
+	// wait for 600 ms
+	time.Sleep(600 * time.Millisecond)
+
+	// send another request and expect no cached return
+	assert.Equal(t, "baz", mkReq(t, port, "baz").xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestEnvoyIgnoresStaleWhileRevalidate tests a difference to Varnish (see TestStaleWhileRevalidate):
+// the cache filter does not serve stale responses, but always revalidates synchronously.
+func TestEnvoyIgnoresStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start Envoy container
+	port, stopFunc, err := caching.StartEnvoyInDocker(caching.EnvoyCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(1), SWR: caching.Seconds(10)}
+
+	// send request to Envoy
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl)).xResponse)
+
+	// send another request and expect to receive a cached response
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(cacheControl)).xResponse)
+
+	// sleep for 1.1 seconds to make the cached response stale
+	time.Sleep(1100 * time.Millisecond)
+
+	// send another request and expect a synchronous backend request instead of the stale response
+	assert.Equal(t, "3", mkReq(t, port, "3", withXCacheControl(cacheControl)).xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
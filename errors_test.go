@@ -5,8 +5,10 @@ import (
 	"caching"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"net/http"
 	"testing"
+	"time"
 )
 
 // Test503FromBackendIsNotVclBackendError tests that a 503 response from the backend
@@ -75,3 +77,127 @@ sub vcl_backend_error {
 	// send request
 	assert.Equal(t, mkResp(http.StatusServiceUnavailable, "", withBody("ERROR: 503 Backend fetch failed")), mkReq(t, port, "foo", withStoreBody()))
 }
+
+// TestConnectTimeout tests that a backend which does not accept the connection within the connect timeout
+// results in a 503 response well before the default connect timeout of 3.5s. The backend is an address of
+// TEST-NET-1 (RFC 5737), which is not routed, such that the connection attempt is never answered.
+func TestConnectTimeout(t *testing.T) {
+	t.Parallel()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendHost:    "192.0.2.1",
+		BackendPort:    "8080",
+		ConnectTimeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect a 503 response within the connect timeout
+	start := time.Now()
+	assert.Equal(t, http.StatusServiceUnavailable, mkReq(t, port, "1").statusCode)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// TestFirstByteTimeout tests that a backend which does not send the response headers
+// within the first byte timeout results in a 503 response.
+func TestFirstByteTimeout(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server which waits for 2 seconds before sending the headers
+	testServerPort, testServer := startTestServer(slowBodyHandler(&backendRequests, 2*time.Second, 1, 0))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		FirstByteTimeout: 1 * time.Second,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect a 503 response
+	assert.Equal(t, http.StatusServiceUnavailable, mkReq(t, port, "1").statusCode)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestFirstByteTimeoutNotExceeded tests that a slow backend sending the response headers
+// and the body within the configured timeouts results in a complete cached response.
+func TestFirstByteTimeoutNotExceeded(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server which waits for 500 ms before sending the headers and between the chunks of the body
+	testServerPort, testServer := startTestServer(slowBodyHandler(&backendRequests, 500*time.Millisecond, 3, 500*time.Millisecond))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		FirstByteTimeout:    1 * time.Second,
+		BetweenBytesTimeout: 1 * time.Second,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect the complete body
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+	assert.Equal(t, mkResp(http.StatusOK, "1", withBody("chunk\nchunk\nchunk\n"), withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "1", withXCacheControl(cacheControl), withStoreBody()))
+
+	// send another request and expect the cached response
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(cacheControl)).xResponse)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestBetweenBytesTimeout tests that a backend stalling in the middle of the body for longer than
+// the between bytes timeout results in a truncated response, because Varnish already streamed the headers
+// and the beginning of the body to the client. The incomplete object is not cached.
+func TestBetweenBytesTimeout(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server which stalls for 2 seconds between the chunks of the body
+	testServerPort, testServer := startTestServer(slowBodyHandler(&backendRequests, 0, 2, 2*time.Second))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		BetweenBytesTimeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect the headers, but a truncated body
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+port+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request", "1")
+	req.Header.Set("X-Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(10)}.String())
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Response"))
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Error(t, err)
+	assert.Equal(t, "chunk\n", string(body))
+
+	// wait for the backend to finish its response
+	time.Sleep(2 * time.Second)
+
+	// send another request and expect no cached response
+	assert.Equal(t, "2", mkReq(t, port, "2").xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
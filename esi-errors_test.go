@@ -0,0 +1,110 @@
+// Contains tests for ESI includes whose fragment fails, and the feature flags deciding how the page is delivered
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingFragmentRoutes returns routes for a page including a fragment, with or without onerror="continue",
+// where the fragment fails with a 500 response or, if timeout is set, stalls beyond a first byte timeout of 500ms.
+func failingFragmentRoutes(onerror bool, timeout bool) caching.Routes {
+	include := `<esi:include src="/fragment"/>`
+	if onerror {
+		include = `<esi:include src="/fragment" onerror="continue"/>`
+	}
+	return caching.Routes{
+		"/page": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("<html>before " + include + " after</html>"))
+		},
+		"/fragment": func(w http.ResponseWriter, r *http.Request) {
+			if timeout {
+				time.Sleep(2 * time.Second)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("error"))
+		},
+	}
+}
+
+// getPage requests the page and returns its status and body, and the error reading the body, if any,
+// e.g. when Varnish aborts the delivery after having sent the headers.
+func getPage(t *testing.T, port string) (int, string, error) {
+	resp, err := http.Get("http://localhost:" + port + "/page")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+// TestEsiFailingFragment tests how a page is delivered whose fragment returns 500 or times out: by default
+// and with onerror="continue", the page is delivered completely, while esi_include_onerror without onerror="continue"
+// aborts the delivery after the headers and the beginning of the page, truncating it.
+func TestEsiFailingFragment(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name      string
+		features  []string
+		onerror   bool
+		timeout   bool
+		truncated bool
+	}{
+		{"500 by default", nil, false, false, false},
+		{"timeout by default", nil, false, true, false},
+		{"500 aborting", []string{"+esi_include_onerror"}, false, false, true},
+		{"timeout aborting", []string{"+esi_include_onerror"}, false, true, true},
+		{"500 continuing", []string{"+esi_include_onerror"}, true, false, false},
+		{"timeout continuing", []string{"+esi_include_onerror"}, true, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			// start a test server
+			testServerPort, testServer := startTestServerWithRoutes(failingFragmentRoutes(test.onerror, test.timeout))
+			defer testServer.Close()
+
+			// start varnish container
+			port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+				BackendPort:      testServerPort,
+				FirstByteTimeout: 500 * time.Millisecond,
+				DoEsi:            true,
+				Features:         test.features,
+			})
+			require.NoError(t, err)
+			defer stopFunc()
+			waitForHealthy(t, port)
+
+			// send request and expect the status of the page, since the headers are sent before the fragment is fetched
+			statusCode, body, err := getPage(t, port)
+			assert.Equal(t, http.StatusOK, statusCode)
+			assert.True(t, strings.HasPrefix(body, "<html>before "), body)
+			if test.truncated {
+				assert.Error(t, err)
+				assert.NotContains(t, body, " after</html>")
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, strings.HasSuffix(body, " after</html>"), body)
+			if !test.onerror && !test.timeout {
+				// the body of the failing fragment is included like any other
+				assert.Contains(t, body, "error")
+			}
+		})
+	}
+}
+
+// TestInvalidFeatures tests that malformed feature flags and setting them twice are rejected.
+func TestInvalidFeatures(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithFeatures("esi_include_onerror"),
+		caching.WithParam("feature", "+http2"))
+	assert.EqualError(t, err, `Features must be flags like +esi_include_onerror, not "esi_include_onerror"
+Features and Params[feature] must not both be set`)
+}
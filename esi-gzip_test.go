@@ -0,0 +1,173 @@
+// Contains tests for ESI in combination with gzip, where Varnish assembles a compressed page from fragments
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// esiPage is a page including a fragment, which starts with a tag, since Varnish only processes ESI in XML.
+const esiPage = `<html>before <esi:include src="/fragment"/> after</html>`
+
+// esiAssembled is esiPage with the fragment included.
+const esiAssembled = `<html>before fragment after</html>`
+
+// esiRoutes returns routes for esiPage and its fragment, where the page and the fragment are compressed
+// by the backend if gzipPage and gzipFragment are set respectively.
+func esiRoutes(gzipPage bool, gzipFragment bool) caching.Routes {
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(esiPage))
+	}
+	fragment := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("fragment"))
+	}
+	if gzipPage {
+		page = caching.GzipHandler(page)
+	}
+	if gzipFragment {
+		fragment = caching.GzipHandler(fragment)
+	}
+	return caching.Routes{"/page": page, "/fragment": fragment}
+}
+
+// assertGzipPage checks that the given response is compressed as a single gzip member containing the expected page.
+func assertGzipPage(t *testing.T, expected string, resp response) {
+	assert.Equal(t, "gzip", resp.contentEncoding)
+	members, err := caching.GzipMembers([]byte(resp.body))
+	if assert.NoError(t, err) && assert.Len(t, members, 1, "gzip members") {
+		assert.Equal(t, expected, string(members[0]))
+	}
+}
+
+// TestEsiDoGzip tests that with DoEsi and DoGzip, Varnish compresses an uncompressed page and its fragment
+// and delivers them as a single gzip member to clients accepting gzip, and uncompressed to other clients.
+func TestEsiDoGzip(t *testing.T) {
+	t.Parallel()
+
+	// start a test server with an uncompressed page and fragment
+	testServerPort, testServer := startTestServerWithRoutes(esiRoutes(false, false))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DoEsi:       true,
+		DoGzip:      true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests accepting gzip, a miss and a hit, and expect the compressed page
+	for _, xRequest := range []string{"1", "2"} {
+		assertGzipPage(t, esiAssembled, mkReq(t, port, xRequest, withPath("/page"), withAcceptEncoding("gzip"), withStoreBody()))
+	}
+
+	// send request not accepting gzip and expect the uncompressed page
+	resp := mkReq(t, port, "3", withPath("/page"), withAcceptEncoding("identity"), withStoreBody())
+	assert.Empty(t, resp.contentEncoding)
+	assert.Equal(t, esiAssembled, resp.body)
+}
+
+// TestEsiCompressedByBackend tests that with DoEsi, Varnish processes a page and a fragment compressed by the backend
+// and stitches them into a single gzip member, and decompresses them for clients not accepting gzip.
+func TestEsiCompressedByBackend(t *testing.T) {
+	t.Parallel()
+
+	// start a test server compressing the page and the fragment
+	testServerPort, testServer := startTestServerWithRoutes(esiRoutes(true, true))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DoEsi:       true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request accepting gzip and expect the compressed page
+	assertGzipPage(t, esiAssembled, mkReq(t, port, "1", withPath("/page"), withAcceptEncoding("gzip"), withStoreBody()))
+
+	// send request not accepting gzip and expect the uncompressed page
+	resp := mkReq(t, port, "2", withPath("/page"), withAcceptEncoding("identity"), withStoreBody())
+	assert.Empty(t, resp.contentEncoding)
+	assert.Equal(t, esiAssembled, resp.body)
+}
+
+// TestEsiMixedCompression tests that with DoEsi, Varnish includes an uncompressed fragment into a page compressed
+// by the backend, and a compressed fragment into an uncompressed page, yielding a valid response either way.
+func TestEsiMixedCompression(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name         string
+		gzipPage     bool
+		gzipFragment bool
+	}{
+		{"compressed page", true, false},
+		{"compressed fragment", false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			// start a test server
+			testServerPort, testServer := startTestServerWithRoutes(esiRoutes(test.gzipPage, test.gzipFragment))
+			defer testServer.Close()
+
+			// start varnish container
+			port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+				BackendPort: testServerPort,
+				DoEsi:       true,
+			})
+			require.NoError(t, err)
+			defer stopFunc()
+			waitForHealthy(t, port)
+
+			// send request accepting gzip and expect the page compressed like the page of the backend
+			resp := mkReq(t, port, "1", withPath("/page"), withAcceptEncoding("gzip"), withStoreBody())
+			if test.gzipPage {
+				assertGzipPage(t, esiAssembled, resp)
+			} else {
+				assert.Empty(t, resp.contentEncoding)
+				assert.Equal(t, esiAssembled, resp.body)
+			}
+
+			// send request not accepting gzip and expect the uncompressed page
+			resp = mkReq(t, port, "2", withPath("/page"), withAcceptEncoding("identity"), withStoreBody())
+			assert.Empty(t, resp.contentEncoding)
+			assert.Equal(t, esiAssembled, resp.body)
+		})
+	}
+}
+
+// TestGzipMembers tests that the members of a gzip-encoded body are decompressed separately,
+// and that a corrupt member is detected.
+func TestGzipMembers(t *testing.T) {
+	t.Parallel()
+	var body []byte
+	for _, content := range []string{"first", "second"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		caching.GzipHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(content))
+		})(recorder, request)
+		assert.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+		body = append(body, recorder.Body.Bytes()...)
+	}
+	members, err := caching.GzipMembers(body)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("first"), []byte("second")}, members)
+
+	// corrupt the checksum of the last member
+	body[len(body)-8] ^= 0xff
+	_, err = caching.GzipMembers(body)
+	assert.Error(t, err)
+}
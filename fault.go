@@ -0,0 +1,79 @@
+package caching
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Fault is a failure which a FaultInjector injects into a backend response.
+type Fault int
+
+const (
+	// FaultServiceUnavailable responds with 503 Service Unavailable.
+	FaultServiceUnavailable Fault = iota
+	// FaultBadGateway responds with 502 Bad Gateway.
+	FaultBadGateway
+	// FaultReset closes the connection without responding. Note that Varnish transparently repeats a fetch
+	// once if it fails like this on a reused connection, before any VCL runs.
+	FaultReset
+	// FaultGarbage responds with garbage instead of an HTTP response.
+	FaultGarbage
+)
+
+// FaultInjector is a backend handler which injects the queued faults into consecutive requests,
+// one fault per request, and passes requests on to the next handler once the queue is empty.
+type FaultInjector struct {
+	next   http.HandlerFunc
+	mutex  sync.Mutex
+	faults []Fault
+	served int
+}
+
+// NewFaultInjector returns a FaultInjector which injects the given faults before passing requests on to next.
+func NewFaultInjector(next http.HandlerFunc, faults ...Fault) *FaultInjector {
+	return &FaultInjector{next: next, faults: faults}
+}
+
+// Inject queues further faults.
+func (f *FaultInjector) Inject(faults ...Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = append(f.faults, faults...)
+}
+
+// Requests returns the number of requests served so far, including those with a fault.
+func (f *FaultInjector) Requests() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.served
+}
+
+func (f *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	f.served++
+	if len(f.faults) == 0 {
+		f.mutex.Unlock()
+		f.next(w, r)
+		return
+	}
+	fault := f.faults[0]
+	f.faults = f.faults[1:]
+	f.mutex.Unlock()
+	switch fault {
+	case FaultServiceUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case FaultBadGateway:
+		w.WriteHeader(http.StatusBadGateway)
+	case FaultReset, FaultGarbage:
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		if fault == FaultGarbage {
+			io.WriteString(conn, "this is not HTTP\r\n\r\n")
+		}
+	}
+}
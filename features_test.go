@@ -0,0 +1,140 @@
+// Contains tests for the VCL feature toggles of VarnishConfig
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestEnableXCacheHeader tests that EnableXCacheHeader reports misses and hits in the X-Cache header.
+func TestEnableXCacheHeader(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:        testServerPort,
+		EnableXCacheHeader: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect a miss
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withXCache("miss")),
+		mkReq(t, port, "1", withXCacheControl(cacheControl)))
+
+	// send another request and expect a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withXCache("hit")),
+		mkReq(t, port, "2", withXCacheControl(cacheControl)))
+
+	// send a request which is passed and expect a miss
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl), withXCache("miss"), withAcceptRanges("")),
+		mkReq(t, port, "3", withXCacheControl(cacheControl), withMethod(http.MethodPost)))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestEnableCacheStatus tests that EnableCacheStatus reports misses, hits with their remaining TTL
+// and passes in the Cache-Status header.
+func TestEnableCacheStatus(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:       testServerPort,
+		EnableCacheStatus: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect a miss
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withCacheStatus("varnish; fwd=uri-miss")),
+		mkReq(t, port, "1", withXCacheControl(cacheControl)))
+
+	// send another request and expect a hit with the remaining TTL rounded down
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withCacheStatus("varnish; hit; ttl=9")),
+		mkReq(t, port, "2", withXCacheControl(cacheControl)))
+
+	// send a request which is passed and expect a bypass
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl), withCacheStatus("varnish; fwd=bypass"), withAcceptRanges("")),
+		mkReq(t, port, "3", withXCacheControl(cacheControl), withMethod(http.MethodPost)))
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestDisableStream tests that with DisableStream, Varnish only delivers the response
+// after it has fetched the complete body from the backend.
+func TestDisableStream(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server which writes the body in three chunks with 500 ms between them
+	testServerPort, testServer := startTestServer(slowBodyHandler(&backendRequests, 0, 3, 500*time.Millisecond))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		DisableStream: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect to receive the response headers only after the complete body has been fetched
+	time1 := time.Now()
+	assert.Equal(t, "1", mkReq(t, port, "1").xResponse)
+	assert.GreaterOrEqual(t, time.Since(time1), 1*time.Second)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestDoEsi tests that DoEsi makes Varnish replace ESI includes with the included fragments.
+func TestDoEsi(t *testing.T) {
+	t.Parallel()
+
+	// start a test server with a page including a fragment
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/page": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`before <esi:include src="/fragment"/> after`))
+		},
+		"/fragment": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("fragment"))
+		},
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DoEsi:       true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request and expect the fragment to be included
+	assert.Equal(t, "before fragment after", mkReq(t, port, "1", withPath("/page"), withStoreBody()).body)
+}
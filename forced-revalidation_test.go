@@ -0,0 +1,96 @@
+// Contains tests for honoring forced revalidations of trusted clients
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestForcedRevalidationSecret tests that with ForcedRevalidation, forced revalidations carrying the secret
+// replace the cached object with a fresh response, while those of anonymous clients are served from the cache,
+// and that the secret does not reach the backend.
+func TestForcedRevalidationSecret(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:        testServerPort,
+		ForcedRevalidation: &caching.ForcedRevalidation{Secret: "s3cret"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "1", withXCacheControl(cacheControl)))
+
+	// send forced revalidations without and with a wrong secret and expect the cached response
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withXCacheControl(cacheControl), withForcedRevalidation()))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "3", withXCacheControl(cacheControl), withForcedRevalidation(), withRequestHeader("X-Revalidation-Secret", "guess")))
+
+	// send a forced revalidation with the secret and expect a fresh response
+	assert.Equal(t, mkResp(http.StatusOK, "4", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "4", withXCacheControl(cacheControl), withForcedRevalidation(), withRequestHeader("X-Revalidation-Secret", "s3cret")))
+
+	// send request and expect the fresh response to have replaced the cached object
+	assert.Equal(t, mkResp(http.StatusOK, "4", withResponseCacheControl(cacheControl)), mkReq(t, port, "5", withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests, neither with the secret nor the internal marker
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"", ""}, recorder.Headers("X-Revalidation-Secret"))
+	assert.Equal(t, []string{"", ""}, recorder.Headers("X-Forced-Revalidation"))
+}
+
+// TestForcedRevalidationAcl tests that with ForcedRevalidation, only forced revalidations of allowed client IPs
+// reach the backend, and that anonymous clients cannot fake the internal marker.
+func TestForcedRevalidationAcl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+		ForcedRevalidation:  &caching.ForcedRevalidation{Allowed: []string{"198.51.100.0/24"}},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+
+	// send forced revalidations from denied clients, one of them faking the internal marker,
+	// and expect the cached response
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.ProxyPort, "2", withXCacheControl(cacheControl), withForcedRevalidation(), withProxyProtocol("203.0.113.9")))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "3", withXCacheControl(cacheControl), withForcedRevalidation(), withRequestHeader("X-Forced-Revalidation", "1")))
+
+	// send a forced revalidation from an allowed client and expect a fresh response
+	assert.Equal(t, mkResp(http.StatusOK, "4", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.ProxyPort, "4", withXCacheControl(cacheControl), withForcedRevalidation(), withProxyProtocol("198.51.100.7")))
+
+	// send request and expect the fresh response to have replaced the cached object
+	assert.Equal(t, mkResp(http.StatusOK, "4", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "5", withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
@@ -0,0 +1,145 @@
+// Contains tests for the X-Forwarded-For and Forwarded headers the backend receives
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestXForwardedFor tests that Varnish appends the client IP to the X-Forwarded-For header of the client
+// and passes the Forwarded header on unchanged, both for fetched and for piped requests.
+func TestXForwardedFor(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Vcl: `
+sub vcl_recv {
+  if (req.url == "/pipe") {
+    return (pipe);
+  }
+}
+`,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a fetched and a piped request
+	assert.Equal(t, mkResp(http.StatusOK, "1"),
+		mkReq(t, port, "1", withRequestHeader("X-Forwarded-For", "203.0.113.1"), withRequestHeader("Forwarded", "for=203.0.113.1")))
+	assert.Equal(t, mkResp(http.StatusOK, "2", withAcceptRanges("")),
+		mkReq(t, port, "2", withPath("/pipe"), withRequestHeader("X-Forwarded-For", "203.0.113.1"), withRequestHeader("Forwarded", "for=203.0.113.1")))
+
+	// expect 2 backend requests with the client IP appended to X-Forwarded-For
+	require.Equal(t, 2, backendRequests)
+	for _, xForwardedFor := range recorder.Headers("X-Forwarded-For") {
+		assert.Regexp(t, `^203\.0\.113\.1, [0-9a-f.:]+$`, xForwardedFor)
+	}
+	assert.Equal(t, []string{"for=203.0.113.1", "for=203.0.113.1"}, recorder.Headers("Forwarded"))
+}
+
+// TestXForwardedForProxyProtocol tests that with the PROXY protocol, Varnish appends the client IP
+// of the PROXY header to the X-Forwarded-For header.
+func TestXForwardedForProxyProtocol(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests with the PROXY protocol, without and with an X-Forwarded-For header
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, instance.ProxyPort, "1", withProxyProtocol("198.51.100.7")))
+	assert.Equal(t, mkResp(http.StatusOK, "2"),
+		mkReq(t, instance.ProxyPort, "2", withProxyProtocol("2001:db8::7"), withRequestHeader("X-Forwarded-For", "203.0.113.1")))
+
+	// expect 2 backend requests with the client IPs of the PROXY headers
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"198.51.100.7", "203.0.113.1, 2001:db8::7"}, recorder.Headers("X-Forwarded-For"))
+}
+
+// TestTrustedProxies tests that with TrustedProxies, the forwarding headers of clients which are not trusted
+// are discarded, while the client IP of the PROXY header still ends up in X-Forwarded-For.
+func TestTrustedProxies(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container, which only trusts an address the requests do not come from
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+		TrustedProxies:      []string{"192.0.2.0/24"},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a direct request and a request with the PROXY protocol, both with forged forwarding headers
+	assert.Equal(t, mkResp(http.StatusOK, "1"),
+		mkReq(t, instance.Port, "1", withRequestHeader("X-Forwarded-For", "203.0.113.1"), withRequestHeader("Forwarded", "for=203.0.113.1")))
+	assert.Equal(t, mkResp(http.StatusOK, "2"),
+		mkReq(t, instance.ProxyPort, "2", withProxyProtocol("198.51.100.7"), withRequestHeader("X-Forwarded-For", "203.0.113.1")))
+
+	// expect 2 backend requests without the forged forwarding headers
+	require.Equal(t, 2, backendRequests)
+	xForwardedFor := recorder.Headers("X-Forwarded-For")
+	assert.Regexp(t, `^[0-9a-f.:]+$`, xForwardedFor[0])
+	assert.NotContains(t, xForwardedFor[0], "203.0.113.1")
+	assert.Equal(t, "198.51.100.7", xForwardedFor[1])
+	assert.Equal(t, []string{"", ""}, recorder.Headers("Forwarded"))
+}
+
+// TestTrustedProxiesTrusted tests that with TrustedProxies, the forwarding headers of trusted clients are kept.
+func TestTrustedProxiesTrusted(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container, which trusts all addresses
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:    testServerPort,
+		TrustedProxies: []string{"0.0.0.0/0", "::/0"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1"),
+		mkReq(t, port, "1", withRequestHeader("X-Forwarded-For", "203.0.113.1"), withRequestHeader("Forwarded", "for=203.0.113.1")))
+
+	// expect 1 backend request with the forwarding headers of the client
+	require.Equal(t, 1, backendRequests)
+	assert.Regexp(t, `^203\.0\.113\.1, [0-9a-f.:]+$`, recorder.Headers("X-Forwarded-For")[0])
+	assert.Equal(t, []string{"for=203.0.113.1"}, recorder.Headers("Forwarded"))
+}
@@ -0,0 +1,183 @@
+package caching
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+)
+
+// geoipDatabase is where VarnishConfig.GeoIPDatabase is mounted in the container.
+const geoipDatabase = "/etc/varnish/geoip.mmdb"
+
+// WriteCountryDatabase writes a MaxMind DB to the given file which maps the given IPv4 CIDR ranges to the given
+// ISO country codes, e.g. "81.2.69.0/24": "GB", like a GeoLite2 Country database, such that tests can use
+// VarnishConfig.GeoIPDatabase without downloading a database with a license key. More specific ranges win
+// over the ranges containing them, and addresses outside all ranges are not found.
+func WriteCountryDatabase(fileName string, countries map[string]string) error {
+	prefixes := make([]netip.Prefix, 0, len(countries))
+	byPrefix := map[netip.Prefix]string{}
+	for cidr, country := range countries {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		if !prefix.Addr().Is4() {
+			return fmt.Errorf("%s is not an IPv4 range", cidr)
+		}
+		prefix = prefix.Masked()
+		prefixes = append(prefixes, prefix)
+		byPrefix[prefix] = country
+	}
+	// insert the larger ranges first, such that the smaller ones contained in them split their records
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if a.Bits() != b.Bits() {
+			return a.Bits() - b.Bits()
+		}
+		return a.Addr().Compare(b.Addr())
+	})
+
+	// the records of the search tree are other nodes (>= 0), empty (-1) or the index of a country (<= -2)
+	nodes := [][2]int{{-1, -1}}
+	var codes []string
+	for _, prefix := range prefixes {
+		country := byPrefix[prefix]
+		index := slices.Index(codes, country)
+		if index < 0 {
+			index = len(codes)
+			codes = append(codes, country)
+		}
+		if prefix.Bits() == 0 {
+			nodes[0] = [2]int{-2 - index, -2 - index}
+			continue
+		}
+		ip := prefix.Addr().As4()
+		node := 0
+		for i := 0; i < prefix.Bits(); i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			record := nodes[node][bit]
+			if i == prefix.Bits()-1 {
+				nodes[node][bit] = -2 - index
+				break
+			}
+			if record < 0 {
+				// a node whose both records inherit the country of the larger range, if any
+				nodes = append(nodes, [2]int{record, record})
+				record = len(nodes) - 1
+				nodes[node][bit] = record
+			}
+			node = record
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(codes))
+	for i, code := range codes {
+		offsets[i] = data.Len()
+		writeMmdbValue(&data, map[string]any{"country": map[string]any{"iso_code": code}})
+	}
+
+	var db bytes.Buffer
+	for _, node := range nodes {
+		for _, record := range node {
+			value := len(nodes)
+			switch {
+			case record >= 0:
+				value = record
+			case record <= -2:
+				// data pointers count from the end of the tree, after the 16 bytes separating it from the data
+				value = len(nodes) + 16 + offsets[-2-record]
+			}
+			db.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	writeMmdbValue(&db, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               "GeoLite2-Country",
+		"description":                 map[string]any{"en": "Countries written by WriteCountryDatabase"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	})
+	return os.WriteFile(fileName, db.Bytes(), 0644)
+}
+
+// writeMmdbValue writes the given string, unsigned integer, map or array in the data format of MaxMind DB.
+// Maps are written with sorted keys.
+func writeMmdbValue(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case string:
+		writeMmdbControl(buf, 2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		writeMmdbUint(buf, 5, uint64(v))
+	case uint32:
+		writeMmdbUint(buf, 6, uint64(v))
+	case uint64:
+		writeMmdbUint(buf, 9, v)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		writeMmdbControl(buf, 7, len(keys))
+		for _, key := range keys {
+			writeMmdbValue(buf, key)
+			writeMmdbValue(buf, v[key])
+		}
+	case []any:
+		writeMmdbControl(buf, 11, len(v))
+		for _, item := range v {
+			writeMmdbValue(buf, item)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported MaxMind DB value %T", value))
+	}
+}
+
+// writeMmdbUint writes an unsigned integer of the given type with as few bytes as needed.
+func writeMmdbUint(buf *bytes.Buffer, dataType int, value uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	trimmed := bytes.TrimLeft(b[:], "\x00")
+	writeMmdbControl(buf, dataType, len(trimmed))
+	buf.Write(trimmed)
+}
+
+// writeMmdbControl writes the control byte of a value of the given type and size, followed by the extended type
+// for types above 7 and by the bytes of sizes of 29 and more.
+func writeMmdbControl(buf *bytes.Buffer, dataType int, size int) {
+	control := byte(dataType << 5)
+	if dataType > 7 {
+		control = 0
+	}
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		control |= byte(size)
+	case size < 29+256:
+		control |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 285+65536:
+		control |= 30
+		sizeBytes = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		control |= 31
+		sizeBytes = []byte{byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+	}
+	buf.WriteByte(control)
+	if dataType > 7 {
+		buf.WriteByte(byte(dataType - 7))
+	}
+	buf.Write(sizeBytes)
+}
@@ -0,0 +1,196 @@
+// Contains tests for varying cached responses on the country of the client looked up in a GeoIP database
+package caching_test
+
+import (
+	"bytes"
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVaryOnCountry tests that with VaryOnCountry, the cache splits by the country of the client IPs injected
+// via the PROXY protocol, where all clients of a country and all clients of unknown countries share an object.
+func TestVaryOnCountry(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// write a database of two countries
+	database := filepath.Join(t.TempDir(), "countries.mmdb")
+	require.NoError(t, caching.WriteCountryDatabase(database, map[string]string{
+		"81.2.69.0/24":    "GB",
+		"216.160.83.0/24": "US",
+	}))
+
+	// start a test server which responds with the country of the X-Country header
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(60)}.String())
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.Header.Get("X-Country")))
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+		GeoIPDatabase:       database,
+		VaryOnCountry:       true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests from different clients and expect the response fetched by the first client of the same country
+	for _, test := range []struct {
+		xRequest  string
+		clientIP  string
+		xResponse string
+		body      string
+	}{
+		{"1", "81.2.69.1", "1", "GB"},
+		{"2", "216.160.83.56", "2", "US"},
+		{"3", "81.2.69.200", "1", "GB"},
+		{"4", "198.51.100.7", "4", "unknown"},
+		{"5", "203.0.113.9", "4", "unknown"},
+		{"6", "216.160.83.1", "2", "US"},
+	} {
+		resp := mkReq(t, instance.ProxyPort, test.xRequest, withProxyProtocol(test.clientIP),
+			withRequestHeader("X-Country", "GB"), withStoreBody(), withCaptureHeaders("Vary"))
+		assert.Equal(t, test.xResponse, resp.xResponse, test.clientIP)
+		assert.Equal(t, test.body, resp.body, test.clientIP)
+		// the country is not known to downstream caches
+		assert.Equal(t, "Accept-Encoding", resp.headers["Vary"], test.clientIP)
+	}
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestWriteCountryDatabase tests that the database maps the addresses of the ranges to their countries,
+// where more specific ranges win, by looking them up like libmaxminddb.
+func TestWriteCountryDatabase(t *testing.T) {
+	t.Parallel()
+	database := filepath.Join(t.TempDir(), "countries.mmdb")
+	require.NoError(t, caching.WriteCountryDatabase(database, map[string]string{
+		"0.0.0.0/0":       "ZZ",
+		"81.2.69.0/24":    "GB",
+		"81.2.69.128/25":  "IE",
+		"216.160.83.0/24": "US",
+		"10.1.2.3/32":     "DE",
+	}))
+	db, err := os.ReadFile(database)
+	require.NoError(t, err)
+	for ip, expected := range map[string]string{
+		"81.2.69.1":     "GB",
+		"81.2.69.127":   "GB",
+		"81.2.69.128":   "IE",
+		"81.2.69.255":   "IE",
+		"216.160.83.56": "US",
+		"10.1.2.3":      "DE",
+		"10.1.2.4":      "ZZ",
+		"198.51.100.7":  "ZZ",
+	} {
+		assert.Equal(t, expected, lookupCountry(t, db, netip.MustParseAddr(ip)), ip)
+	}
+
+	// without a range for all addresses, others are not found
+	require.NoError(t, caching.WriteCountryDatabase(database, map[string]string{"81.2.69.0/24": "GB"}))
+	db, err = os.ReadFile(database)
+	require.NoError(t, err)
+	assert.Equal(t, "GB", lookupCountry(t, db, netip.MustParseAddr("81.2.69.1")))
+	assert.Equal(t, "", lookupCountry(t, db, netip.MustParseAddr("81.2.70.1")))
+
+	assert.Error(t, caching.WriteCountryDatabase(database, map[string]string{"2001:db8::/32": "DE"}))
+}
+
+// TestInvalidGeoIP tests that a relative database path and varying on the country without a database are rejected.
+func TestInvalidGeoIP(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.VaryOnCountry = true
+	}))
+	assert.EqualError(t, err, "VaryOnCountry requires a GeoIPDatabase")
+	_, err = caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.GeoIPDatabase = "countries.mmdb"
+	}))
+	assert.EqualError(t, err, `GeoIPDatabase must be an absolute path, not "countries.mmdb"`)
+}
+
+// lookupCountry looks up the ISO code of the country of the given IPv4 address in the given MaxMind DB
+// with a record size of 24 bits, and returns "" if the address is not found.
+func lookupCountry(t *testing.T, db []byte, ip netip.Addr) string {
+	marker := bytes.LastIndex(db, []byte("\xab\xcd\xefMaxMind.com"))
+	require.GreaterOrEqual(t, marker, 0, "metadata marker")
+	metadata, _ := decodeMmdb(t, db[marker+14:], 0)
+	nodeCount := int(metadata.(map[string]any)["node_count"].(uint64))
+	assert.Equal(t, uint64(24), metadata.(map[string]any)["record_size"])
+	bits := ip.As4()
+	record := 0
+	for i := 0; i < 32 && record < nodeCount; i++ {
+		offset := record*6 + 3*int(bits[i/8]>>(7-i%8)&1)
+		record = int(db[offset])<<16 | int(db[offset+1])<<8 | int(db[offset+2])
+	}
+	if record == nodeCount {
+		return ""
+	}
+	data, _ := decodeMmdb(t, db[nodeCount*6+16:], record-nodeCount-16)
+	return data.(map[string]any)["country"].(map[string]any)["iso_code"].(string)
+}
+
+// decodeMmdb decodes the strings, unsigned integers, maps and arrays of the data format of MaxMind DB
+// at the given offset and returns the value and the offset after it.
+func decodeMmdb(t *testing.T, data []byte, offset int) (any, int) {
+	control := data[offset]
+	offset++
+	dataType := int(control >> 5)
+	if dataType == 0 {
+		dataType = int(data[offset]) + 7
+		offset++
+	}
+	size := int(control & 0x1f)
+	switch size {
+	case 29:
+		size = 29 + int(data[offset])
+		offset++
+	case 30:
+		size = 285 + (int(data[offset])<<8 | int(data[offset+1]))
+		offset += 2
+	}
+	switch dataType {
+	case 2:
+		return string(data[offset : offset+size]), offset + size
+	case 5, 6, 9:
+		var value uint64
+		for _, b := range data[offset : offset+size] {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset + size
+	case 7:
+		m := map[string]any{}
+		for i := 0; i < size; i++ {
+			var key, value any
+			key, offset = decodeMmdb(t, data, offset)
+			value, offset = decodeMmdb(t, data, offset)
+			m[key.(string)] = value
+		}
+		return m, offset
+	case 11:
+		var items []any
+		for i := 0; i < size; i++ {
+			var item any
+			item, offset = decodeMmdb(t, data, offset)
+			items = append(items, item)
+		}
+		return items, offset
+	}
+	t.Fatalf("unexpected type %d", dataType)
+	return nil, offset
+}
@@ -0,0 +1,68 @@
+package caching
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// GzipHandler returns a backend handler which compresses the responses of the given handler with gzip
+// if the request accepts it, like a backend compressing on its own. Varnish asks backends for gzip by default,
+// such that a page and its ESI fragments can be fetched compressed, uncompressed or mixed.
+// The response varies on Accept-Encoding and loses its Content-Length and Content-Digest.
+func GzipHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Add("Vary", "Accept-Encoding")
+			next(w, r)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		next(recorder, r)
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Digest")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.WriteHeader(recorder.Code)
+		gzipWriter := gzip.NewWriter(w)
+		gzipWriter.Write(recorder.Body.Bytes())
+		gzipWriter.Close()
+	}
+}
+
+// GzipMembers decompresses the given gzip-encoded body and returns the decompressed content of each of its members,
+// i.e. of each gzip stream concatenated in the body. It fails if a member is corrupt, e.g. if the checksum or
+// the size in its trailer does not match its content. When Varnish assembles a compressed ESI page from compressed
+// fragments, it must stitch them into a single member with a checksum of the whole page, since many clients
+// only decompress the first member.
+func GzipMembers(body []byte) ([][]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(body))
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	var members [][]byte
+	for {
+		gzipReader.Multistream(false)
+		member, err := io.ReadAll(gzipReader)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+		err = gzipReader.Reset(reader)
+		if errors.Is(err, io.EOF) {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Contains tests for caching HEAD requests
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+var headTestBody = []byte("hello from the backend")
+
+// methodsHandler returns a backend handler which serves headTestBody like caching.BodyHandler
+// and records the method of every backend request.
+func methodsHandler(methods *[]string) http.HandlerFunc {
+	handler := caching.BodyHandler(headTestBody)
+	return func(w http.ResponseWriter, r *http.Request) {
+		*methods = append(*methods, r.Method)
+		handler(w, r)
+	}
+}
+
+// TestHeadFromCachedGet tests that a HEAD request is served from an object cached by a GET request,
+// with the Content-Length of the cached body.
+func TestHeadFromCachedGet(t *testing.T) {
+	t.Parallel()
+	var methods []string
+
+	// start a test server
+	testServerPort, testServer := startTestServer(methodsHandler(&methods))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send GET request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withBody(string(headTestBody))), mkReq(t, port, "1", withStoreBody()))
+
+	// send HEAD request which is a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withContentLength(len(headTestBody))), mkReq(t, port, "2", withHead()))
+
+	// expect only the GET request to reach the backend
+	assert.Equal(t, []string{http.MethodGet}, methods)
+}
+
+// TestHeadMissFetchesGet tests that Varnish fetches a HEAD miss with a GET request, such that the cached
+// object has a body and can also be delivered to later GET requests.
+func TestHeadMissFetchesGet(t *testing.T) {
+	t.Parallel()
+	var methods []string
+
+	// start a test server
+	testServerPort, testServer := startTestServer(methodsHandler(&methods))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send HEAD request which is a miss
+	assert.Equal(t, mkResp(http.StatusOK, "1", withContentLength(len(headTestBody))), mkReq(t, port, "1", withHead()))
+
+	// send GET request which is a hit with the complete body
+	assert.Equal(t, mkResp(http.StatusOK, "1", withBody(string(headTestBody))), mkReq(t, port, "2", withStoreBody()))
+
+	// expect the backend to have received a GET request only
+	assert.Equal(t, []string{http.MethodGet}, methods)
+}
+
+// TestHeadMissPoisonsGet tests that custom VCL which keeps the HEAD method for backend fetches of misses
+// caches a body-less object, which is then delivered to later GET requests.
+func TestHeadMissPoisonsGet(t *testing.T) {
+	t.Parallel()
+	var methods []string
+
+	// start a test server
+	testServerPort, testServer := startTestServer(methodsHandler(&methods))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Vcl: `
+sub vcl_recv {
+  set req.http.X-Method = req.method;
+}
+sub vcl_backend_fetch {
+  set bereq.method = bereq.http.X-Method;
+  unset bereq.http.X-Method;
+}
+`,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send HEAD request which is a miss
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, port, "1", withMethod(http.MethodHead)))
+
+	// send GET request which is a hit on the body-less object
+	assert.Equal(t, mkResp(http.StatusOK, "1", withBody("")), mkReq(t, port, "2", withStoreBody()))
+
+	// expect the backend to have received the HEAD request only
+	assert.Equal(t, []string{http.MethodHead}, methods)
+}
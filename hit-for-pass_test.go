@@ -0,0 +1,153 @@
+// Contains tests contrasting hit-for-miss and hit-for-pass objects
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// etagHandler returns a backend handler like echoCacheControlHandler, which responds with ETag "v1"
+// and with 304 if the request has a matching If-None-Match header.
+func etagHandler(backendRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			*backendRequests++
+			w.Header().Set("Etag", `"v1"`)
+			w.Header().Set("X-Response", r.Header.Get("X-Request"))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		r.Header.Set("X-Etag", `"v1"`)
+		echoCacheControlHandler(backendRequests)(w, r)
+	}
+}
+
+// TestHitForMissCachesNextResponse tests that a cacheable response replaces a hit-for-miss object.
+func TestHitForMissCachesNextResponse(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	private := caching.CacheControl{Private: true}
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request resulting in an uncacheable response, which creates a hit-for-miss object
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(private)), mkReq(t, port, "1", withXCacheControl(private)))
+
+	// send request resulting in a cacheable response
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)), mkReq(t, port, "2", withXCacheControl(cacheControl)))
+
+	// expect the cacheable response to be cached
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)), mkReq(t, port, "3", withXCacheControl(cacheControl)))
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestHitForPassDoesNotCacheNextResponse tests that with HitForPass, a cacheable response does not replace
+// a hit-for-pass object, such that requests are passed until it expires.
+func TestHitForPassDoesNotCacheNextResponse(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	private := caching.CacheControl{Private: true}
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		HitForPass:  true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request resulting in an uncacheable response, which creates a hit-for-pass object
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(private)), mkReq(t, port, "1", withXCacheControl(private)))
+
+	// send requests resulting in cacheable responses, which are passed
+	assert.Equal(t, mkResp(http.StatusOK, "2", withAcceptRanges(""), withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "3", withAcceptRanges(""), withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "3", withXCacheControl(cacheControl)))
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestHitForMissConditionalRequest tests that requests hitting a hit-for-miss object are fetched like misses,
+// i.e. without the conditional headers of the client.
+func TestHitForMissConditionalRequest(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	private := caching.CacheControl{Private: true}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(etagHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request resulting in an uncacheable response, which creates a hit-for-miss object
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(private)), mkReq(t, port, "1", withXCacheControl(private)))
+
+	// send conditional request
+	resp := mkReq(t, port, "2", withXCacheControl(private), withIfNoneMatch(`"v1"`))
+	assert.Equal(t, "2", resp.xResponse)
+
+	// expect the backend not to have received If-None-Match
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"", ""}, recorder.Headers("If-None-Match"))
+}
+
+// TestHitForPassConditionalRequest tests that with HitForPass, requests hitting a hit-for-pass object are passed
+// with the conditional headers of the client, such that the 304 response of the backend reaches the client.
+func TestHitForPassConditionalRequest(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	private := caching.CacheControl{Private: true}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(etagHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		HitForPass:  true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request resulting in an uncacheable response, which creates a hit-for-pass object
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(private)), mkReq(t, port, "1", withXCacheControl(private)))
+
+	// send conditional request
+	assert.Equal(t, mkResp(http.StatusNotModified, "2", withAcceptRanges("")),
+		mkReq(t, port, "2", withXCacheControl(private), withIfNoneMatch(`"v1"`)))
+
+	// expect the backend to have received If-None-Match
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"", `"v1"`}, recorder.Headers("If-None-Match"))
+}
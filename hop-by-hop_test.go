@@ -0,0 +1,115 @@
+// Contains tests for the handling of hop-by-hop headers
+package caching_test
+
+import (
+	"caching"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// hopByHopFields are the header fields sent by the tests of hop-by-hop headers: the hop-by-hop headers,
+// a non-standard header listed as connection token, and an end-to-end header, which must be forwarded.
+var hopByHopFields = map[string]string{
+	"Connection":       "X-Hop",
+	"X-Hop":            "1",
+	"Keep-Alive":       "timeout=5",
+	"Proxy-Connection": "keep-alive",
+	"TE":               "trailers",
+	"Upgrade":          "foo/1",
+	"X-End":            "1",
+}
+
+// rawHeaderFields renders the given header fields as lines of a raw request or response.
+func rawHeaderFields(fields map[string]string) string {
+	var sb strings.Builder
+	for name, value := range fields {
+		sb.WriteString(name + ": " + value + "\r\n")
+	}
+	return sb.String()
+}
+
+// assertHopByHopRemoved asserts that of the hopByHopFields, only the end-to-end header and possibly
+// the non-standard Proxy-Connection were forwarded, and logs which were.
+func assertHopByHopRemoved(t *testing.T, received http.Header, direction string) {
+	forwarded := caching.ForwardedHeaders(hopByHopFields, received)
+	t.Logf("hop-by-hop headers forwarded %s: %v", direction, forwarded)
+	assert.Contains(t, forwarded, "X-End", direction)
+	for _, name := range append(caching.HopByHopHeaders, "X-Hop") {
+		if name != "Proxy-Connection" {
+			assert.NotContains(t, forwarded, http.CanonicalHeaderKey(name), direction)
+		}
+	}
+}
+
+// TestHopByHopRequestHeaders tests that Varnish removes the hop-by-hop headers of a client request, including
+// the headers listed in its Connection header, before forwarding it to the backend, both for misses and passes.
+func TestHopByHopRequestHeaders(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a raw GET request, which is a miss, and a raw POST request, which is passed
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		resp := rawReq(t, port, fmt.Sprintf("%s / HTTP/1.1\r\nHost: localhost:%s\r\nX-Cache-Control: %s\r\nContent-Length: 0\r\n%s\r\n",
+			method, port, cacheControl, rawHeaderFields(hopByHopFields)))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// expect 2 backend requests without the hop-by-hop headers
+	require.Equal(t, 2, backendRequests)
+	for i, request := range recorder.Requests() {
+		assertHopByHopRemoved(t, request.Header, fmt.Sprintf("to the backend (request %d)", i+1))
+	}
+}
+
+// TestHopByHopResponseHeaders tests that Varnish removes the hop-by-hop headers of a backend response,
+// including the headers listed in its Connection header, both when fetching it and when delivering it from the cache.
+func TestHopByHopResponseHeaders(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server responding with hop-by-hop headers
+	rawResponseHandler := caching.RawResponseHandler("HTTP/1.1 200 OK\r\nCache-Control: "+cacheControl.String()+"\r\n"+
+		strings.TrimSuffix(rawHeaderFields(hopByHopFields), "\r\n"), "hello")
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		rawResponseHandler(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a miss and a hit and expect the responses without the hop-by-hop headers
+	for _, direction := range []string{"to the client (miss)", "to the client (hit)"} {
+		resp := rawReq(t, port, fmt.Sprintf("GET / HTTP/1.1\r\nHost: localhost:%s\r\n\r\n", port))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assertHopByHopRemoved(t, resp.Header, direction)
+	}
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
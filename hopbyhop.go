@@ -0,0 +1,43 @@
+package caching
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// HopByHopHeaders are the hop-by-hop headers, which only apply to a single connection, such that proxies must not
+// forward them (RFC 9110, section 7.6.1): Connection, the headers listed in it, and the headers which RFC 2616
+// listed or which clients still send, like the non-standard Proxy-Connection.
+var HopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "TE", "Transfer-Encoding", "Upgrade"}
+
+// RawResponseHandler returns a backend handler which writes the given raw response header (the status line and
+// header fields separated by CRLF) together with a Content-Length and the given body directly to the connection,
+// bypassing the HTTP server of Go, which would refuse to send some hop-by-hop headers or would send them differently.
+// It closes the connection afterwards.
+func RawResponseHandler(header string, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "%s\r\nContent-Length: %d\r\n\r\n%s", header, len(body), body)
+		_ = rw.Flush()
+	}
+}
+
+// ForwardedHeaders returns the names of those of the given sent header fields which are contained in the given
+// received header with the same value, i.e. which a proxy forwarded instead of removing or replacing them.
+// The names are sorted.
+func ForwardedHeaders(sent map[string]string, received http.Header) []string {
+	var forwarded []string
+	for name, value := range sent {
+		if slices.Contains(received.Values(name), value) {
+			forwarded = append(forwarded, http.CanonicalHeaderKey(name))
+		}
+	}
+	slices.Sort(forwarded)
+	return forwarded
+}
@@ -0,0 +1,60 @@
+package caching
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// InProcessEngine runs a Go cache implementation in-process instead of in Docker, allowing authors
+// of Go caches to validate them against the same scenarios as Varnish. The cache is either an
+// http.Handler middleware in front of a reverse proxy to the backend, or an http.RoundTripper
+// used by that reverse proxy, or both.
+type InProcessEngine struct {
+	// EngineName is returned by Name.
+	EngineName string
+	// Middleware wraps the reverse proxy to the backend. It may apply the TTLs of the given config.
+	Middleware func(config EngineConfig, next http.Handler) http.Handler
+	// Transport wraps the transport of the reverse proxy to the backend.
+	// It may apply the TTLs of the given config.
+	Transport func(config EngineConfig, next http.RoundTripper) http.RoundTripper
+	// EngineCapabilities is returned by Capabilities.
+	EngineCapabilities Capabilities
+	// HitMiss implements DebugHitMiss. When nil, DebugHitMiss returns Unknown.
+	HitMiss func(header http.Header) HitMiss
+}
+
+func (e InProcessEngine) Name() string {
+	return e.EngineName
+}
+
+func (e InProcessEngine) Start(config EngineConfig) (Endpoint, func() error, error) {
+	backendUrl, err := url.Parse("http://localhost:" + config.BackendPort)
+	if err != nil {
+		return Endpoint{}, nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(backendUrl)
+	if e.Transport != nil {
+		proxy.Transport = e.Transport(config, http.DefaultTransport)
+	}
+	var handler http.Handler = proxy
+	if e.Middleware != nil {
+		handler = e.Middleware(config, handler)
+	}
+	srv := newServer(handler)
+	return Endpoint{Port: serverPort(srv)}, func() error {
+		srv.Close()
+		return nil
+	}, nil
+}
+
+func (e InProcessEngine) Capabilities() Capabilities {
+	return e.EngineCapabilities
+}
+
+func (e InProcessEngine) DebugHitMiss(header http.Header) HitMiss {
+	if e.HitMiss == nil {
+		return Unknown
+	}
+	return e.HitMiss(header)
+}
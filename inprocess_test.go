@@ -0,0 +1,101 @@
+// Contains tests running scenarios against a cache implemented in Go, running in-process
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var maxAgeRegexp = regexp.MustCompile(`(^|,)\s*max-age=(\d+)`)
+
+type cachedResponse struct {
+	recorder *httptest.ResponseRecorder
+	expires  time.Time
+}
+
+// maxAgeCache is a deliberately naive cache middleware, which only honors max-age of GET responses.
+// It serves as an example of validating a Go cache with this suite.
+func maxAgeCache(config caching.EngineConfig, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	cache := map[string]cachedResponse{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		cached, ok := cache[r.URL.String()]
+		mu.Unlock()
+		xCache := "hit"
+		if !ok || time.Now().After(cached.expires) {
+			xCache = "miss"
+			cached = cachedResponse{recorder: httptest.NewRecorder()}
+			next.ServeHTTP(cached.recorder, r)
+			if m := maxAgeRegexp.FindStringSubmatch(cached.recorder.Header().Get("Cache-Control")); m != nil {
+				maxAge, _ := strconv.Atoi(m[2])
+				cached.expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+				mu.Lock()
+				cache[r.URL.String()] = cached
+				mu.Unlock()
+			}
+		}
+		for name, values := range cached.recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.Header().Set("X-Cache", xCache)
+		w.WriteHeader(cached.recorder.Code)
+		w.Write(cached.recorder.Body.Bytes())
+	})
+}
+
+var maxAgeCacheEngine = caching.InProcessEngine{
+	EngineName:         "max-age-cache",
+	Middleware:         maxAgeCache,
+	EngineCapabilities: caching.Capabilities{DebugHitMiss: true},
+	HitMiss: func(header http.Header) caching.HitMiss {
+		if header.Get("X-Cache") == "hit" {
+			return caching.Hit
+		}
+		return caching.Miss
+	},
+}
+
+// TestInProcessCacheControlMaxAge1 is the in-process equivalent of TestCacheControlMaxAge1.
+func TestInProcessCacheControlMaxAge1(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start the in-process cache
+	port := startEngine(t, maxAgeCacheEngine, caching.EngineConfig{BackendPort: testServerPort})
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(1)}
+
+	// send request
+	resp := mkReq(t, port, "1", withXCacheControl(cacheControl), withEngine(maxAgeCacheEngine))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Equal(t, caching.Miss, resp.hitMiss)
+
+	// send another request and expect to receive the cached response
+	resp = mkReq(t, port, "2", withXCacheControl(cacheControl), withEngine(maxAgeCacheEngine))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Equal(t, caching.Hit, resp.hitMiss)
+
+	// wait for the response to expire
+	time.Sleep(1100 * time.Millisecond)
+
+	// send another request and expect no cached response
+	assert.Equal(t, "3", mkReq(t, port, "3", withXCacheControl(cacheControl)).xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
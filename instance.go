@@ -0,0 +1,431 @@
+package caching
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/docker/go-connections/nat"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VarnishInstance is a Varnish container started by StartVarnishInstanceInDocker.
+type VarnishInstance struct {
+	// Port is the port on the host where Varnish accepts client requests.
+	Port string
+	// ProxyPort is the port on the host where Varnish accepts client requests with the PROXY protocol,
+	// if VarnishConfig.EnableProxyProtocol is set.
+	ProxyPort string
+	// Listeners are the host ports, or the paths of the Unix domain sockets on the host, of the
+	// VarnishConfig.Listeners by their name.
+	Listeners map[string]string
+	// AdminPort is the port on the host where the CLI of Varnish accepts connections authenticated with the secret
+	// in the AdminSecretFile on the host, if VarnishConfig.EnableAdmin is set (see Admin).
+	AdminPort       string
+	AdminSecretFile string
+
+	stop func() error
+	// stopContainer stops the current container only, which Restart replaces.
+	stopContainer func() error
+	probeSecret   string
+	containerID   string
+	log           *containerLog
+	// config is the config the instance was started with, for ReloadVCL to render the VCL again.
+	config VarnishConfig
+	// vcl is the VCL the instance was started with, for Restart to start with it again.
+	vcl string
+	// storageDir is the directory of the host with the file of VarnishConfig.FileStorage.
+	storageDir string
+	// reloads is the number of VCLs loaded by ReloadVCL, to name them uniquely.
+	reloads int
+	// switchedAt is when SwitchBackend last switched with ExpireObjects, if ever.
+	switchedAt time.Time
+	// bgfetches is the number of completed background fetches seen by WaitForBackgroundFetch.
+	bgfetches int
+}
+
+// ObjectInfo is the state of a cached object as reported by VarnishInstance.ObjectInfo.
+type ObjectInfo struct {
+	// Cached is true if the cache contains an object for the URL, even if it is stale.
+	// Hit-for-miss and hit-for-pass objects do not count as cached.
+	Cached bool
+	// Ttl is the remaining TTL, which is negative for stale objects.
+	Ttl time.Duration
+	// Grace and Keep are the grace and keep periods of the object.
+	Grace time.Duration
+	Keep  time.Duration
+	// Hits is the number of hits of the object, including the one of the probe request itself.
+	Hits int
+}
+
+// objectInfoVcl answers probe requests carrying the given secret in an X-Object-Info header with a synthetic
+// response reporting the state of the cached object, without ever fetching it from the backend.
+// Neither varnishadm nor varnishlog can look up an object by its URL, so a probe request is the only way
+// to learn about it. It runs before the custom VCL, such that it cannot deliver or fetch the object.
+func objectInfoVcl(secret string) string {
+	return `
+sub vcl_hit {
+  if (req.http.X-Object-Info == "` + secret + `") {
+    set req.http.X-Object-Ttl = obj.ttl;
+    set req.http.X-Object-Grace = obj.grace;
+    set req.http.X-Object-Keep = obj.keep;
+    set req.http.X-Object-Hits = obj.hits;
+    return (synth(200, "Cached"));
+  }
+}
+sub vcl_miss {
+  if (req.http.X-Object-Info == "` + secret + `") {
+    return (synth(404, "Not Cached"));
+  }
+}
+sub vcl_pass {
+  if (req.http.X-Object-Info == "` + secret + `") {
+    return (synth(404, "Not Cached"));
+  }
+}
+sub vcl_synth {
+  if (req.http.X-Object-Info == "` + secret + `") {
+    set resp.http.X-Object-Ttl = req.http.X-Object-Ttl;
+    set resp.http.X-Object-Grace = req.http.X-Object-Grace;
+    set resp.http.X-Object-Keep = req.http.X-Object-Keep;
+    set resp.http.X-Object-Hits = req.http.X-Object-Hits;
+    return (deliver);
+  }
+}
+`
+}
+
+// StartVarnishInstanceInDocker starts Varnish like StartVarnishInDocker,
+// but returns an instance which can also be queried for the state of the cache.
+func StartVarnishInstanceInDocker(config VarnishConfig) (*VarnishInstance, error) {
+	return StartVarnishInstanceInDockerContext(context.Background(), config)
+}
+
+// StartVarnishInstanceInDockerContext starts Varnish like StartVarnishInstanceInDocker,
+// but gives up when the context is done before Varnish has been started (see StartVarnishInDockerContext).
+func StartVarnishInstanceInDockerContext(ctx context.Context, config VarnishConfig) (*VarnishInstance, error) {
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	probeSecret := hex.EncodeToString(secret)
+	instance, err := startVarnish(ctx, config, renderVcl(config, objectInfoVcl(probeSecret)), nil)
+	if err != nil {
+		return nil, err
+	}
+	instance.probeSecret = probeSecret
+	return instance, nil
+}
+
+// Stop stops the Varnish container. It reports an error if the container may have been left behind.
+func (v *VarnishInstance) Stop() error {
+	return v.stop()
+}
+
+// Restart stops the Varnish container and starts a new one with the config and the VCL the instance was started
+// with on the same port, like a restart of a cache node. The VCLs loaded by ReloadVCL are gone, and so is the cache,
+// unless the objects persist in the file of VarnishConfig.FileStorage, which is kept. ProxyPort, Listeners,
+// AdminPort and AdminSecretFile change, if any. Like after starting Varnish, the new container may take a moment
+// to respond.
+func (v *VarnishInstance) Restart() error {
+	err := v.stopContainer()
+	if err != nil {
+		return err
+	}
+	loopback := "127.0.0.1"
+	if v.config.ListenIPv6 {
+		loopback = "::1"
+	}
+	restarted, err := startVarnishContainer(context.Background(), v.config, v.vcl, &nat.PortBinding{HostIP: loopback, HostPort: v.Port}, v.storageDir)
+	if err != nil {
+		return fmt.Errorf("could not restart Varnish: %w", err)
+	}
+	v.ProxyPort = restarted.ProxyPort
+	v.Listeners = restarted.Listeners
+	v.AdminPort = restarted.AdminPort
+	v.AdminSecretFile = restarted.AdminSecretFile
+	v.stopContainer = restarted.stopContainer
+	v.containerID = restarted.containerID
+	v.log = restarted.log
+	// the new container has neither loaded VCLs nor a log of background fetches
+	v.reloads = 0
+	v.bgfetches = 0
+	return nil
+}
+
+// ObjectInfo reports whether an object for a GET request to the given URL (path and query) is currently cached,
+// and its remaining TTL, grace and keep. Of objects varying on request headers, only the variant for a request
+// without any of these headers is found.
+func (v *VarnishInstance) ObjectInfo(url string) (ObjectInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+v.Port+url, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	req.Header.Set("X-Object-Info", v.probeSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ObjectInfo{}, nil
+	case http.StatusOK:
+	default:
+		return ObjectInfo{}, fmt.Errorf("unexpected status %d of object info for %s", resp.StatusCode, url)
+	}
+	info := ObjectInfo{Cached: true}
+	for _, field := range []struct {
+		header string
+		value  *time.Duration
+	}{
+		{"X-Object-Ttl", &info.Ttl},
+		{"X-Object-Grace", &info.Grace},
+		{"X-Object-Keep", &info.Keep},
+	} {
+		// Varnish renders durations as seconds with three decimals
+		seconds, err := strconv.ParseFloat(resp.Header.Get(field.header), 64)
+		if err != nil {
+			return ObjectInfo{}, fmt.Errorf("invalid %s of object info for %s: %w", field.header, url, err)
+		}
+		*field.value = time.Duration(seconds * float64(time.Second))
+	}
+	info.Hits, err = strconv.Atoi(resp.Header.Get("X-Object-Hits"))
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("invalid X-Object-Hits of object info for %s: %w", url, err)
+	}
+	return info, nil
+}
+
+// WaitForBackgroundFetch waits until one more background fetch has completed than at its previous call,
+// such that the object fetched in the background (if any) is in the cache. It replaces sleeping for a while
+// after a request in grace, which is flaky on slow machines. Each call must match exactly one background fetch.
+// The MAIN.s_bgfetch counter of varnishstat is incremented when a background fetch starts, not when it completes,
+// so the log is searched for background fetch transactions instead, which are only complete once the fetched
+// object has been inserted into the cache or abandoned.
+func (v *VarnishInstance) WaitForBackgroundFetch(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := v.Crash()
+		if err != nil {
+			return err
+		}
+		completed, err := v.completedBackgroundFetches()
+		if err != nil {
+			return err
+		}
+		if completed > v.bgfetches {
+			v.bgfetches++
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("background fetch did not complete within %s", timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Counter returns the current value of the given varnishstat counter, e.g. "MAIN.busy_sleep".
+func (v *VarnishInstance) Counter(name string) (uint64, error) {
+	output, err := execInContainer(v.containerID, "varnishstat", "-n", "/tmp/varnish_workdir", "-1", "-f", name)
+	if err != nil {
+		return 0, err
+	}
+	// each line consists of the name, the value, the average rate and the description of a counter
+	fields := strings.Fields(output)
+	if len(fields) < 2 || fields[0] != name {
+		return 0, fmt.Errorf("counter %s not found", name)
+	}
+	return strconv.ParseUint(fields[1], 10, 64)
+}
+
+// Transaction returns the client transactions of the requests with the given X-Request-ID header from the log of Varnish,
+// together with their backend transactions, as printed by varnishlog. It fails if there is none.
+func (v *VarnishInstance) Transaction(requestID string) (string, error) {
+	if strings.ContainsAny(requestID, `"\`) {
+		return "", fmt.Errorf("invalid X-Request-ID %q", requestID)
+	}
+	output, err := execInContainer(v.containerID, "varnishlog", "-n", "/tmp/varnish_workdir", "-d",
+		"-g", "request", "-q", `ReqHeader:X-Request-ID eq "`+requestID+`"`)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(output) == "" {
+		return "", fmt.Errorf("no transaction with X-Request-ID %s", requestID)
+	}
+	return output, nil
+}
+
+// VclFlow returns the VCL subroutines which ran for the requests with the given X-Request-ID header, with their
+// return actions, e.g. "vcl_recv:hash", "vcl_hash:lookup", "vcl_hit:deliver" and "vcl_deliver:deliver".
+// The subroutines of the client transaction are followed by those of its backend transactions,
+// e.g. "vcl_backend_fetch:fetch" and "vcl_backend_response:deliver".
+func (v *VarnishInstance) VclFlow(requestID string) ([]string, error) {
+	transaction, err := v.Transaction(requestID)
+	if err != nil {
+		return nil, err
+	}
+	return ParseVclFlow(transaction), nil
+}
+
+// ParseVclFlow returns the VCL flow like VclFlow of the given transactions as printed by varnishlog,
+// e.g. those returned by Transaction.
+func ParseVclFlow(transactions string) []string {
+	var flow []string
+	for _, record := range logRecords(transactions) {
+		switch record.tag {
+		case "VCL_call":
+			flow = append(flow, "vcl_"+strings.ToLower(record.value))
+		case "VCL_return":
+			if len(flow) > 0 && !strings.Contains(flow[len(flow)-1], ":") {
+				flow[len(flow)-1] += ":" + record.value
+			}
+		}
+	}
+	return flow
+}
+
+// MatchVclFlow checks that the given flow returned by VclFlow contains the expected steps in this order,
+// possibly with further steps in between. A step without a return action, e.g. "vcl_hit", matches any.
+func MatchVclFlow(flow []string, expected ...string) error {
+	i := 0
+	for _, step := range flow {
+		if i == len(expected) {
+			break
+		}
+		if step == expected[i] || !strings.Contains(expected[i], ":") && strings.HasPrefix(step, expected[i]+":") {
+			i++
+		}
+	}
+	if i < len(expected) {
+		return fmt.Errorf("VCL flow %s does not contain %s", strings.Join(flow, ", "), expected[i])
+	}
+	return nil
+}
+
+// VclLog returns the messages which the VCL logged with std.log for the requests with the given X-Request-ID header,
+// in the client transaction followed by those in its backend transactions. Custom VCL under test can log values
+// as "name: value" for VclLogValues to look them up, e.g. std.log("ttl: " + beresp.ttl).
+func (v *VarnishInstance) VclLog(requestID string) ([]string, error) {
+	transaction, err := v.Transaction(requestID)
+	if err != nil {
+		return nil, err
+	}
+	return ParseVclLog(transaction), nil
+}
+
+// ParseVclLog returns the messages logged with std.log like VclLog of the given transactions as printed
+// by varnishlog, e.g. those returned by Transaction.
+func ParseVclLog(transactions string) []string {
+	var messages []string
+	for _, record := range logRecords(transactions) {
+		if record.tag == "VCL_Log" {
+			messages = append(messages, record.value)
+		}
+	}
+	return messages
+}
+
+// VclLogValues returns the values of the given messages logged as "name: value" by name.
+// Of names logged several times, the last value is returned. Other messages are ignored.
+func VclLogValues(messages []string) map[string]string {
+	values := map[string]string{}
+	for _, message := range messages {
+		name, value, ok := strings.Cut(message, ": ")
+		if ok {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// logRecord is a record of a transaction as printed by varnishlog.
+type logRecord struct {
+	tag   string
+	value string
+}
+
+// logRecords returns the records of the given transactions printed by varnishlog, whose lines look like
+// "-   VCL_call       RECV", prefixed with "--" in backend transactions.
+func logRecords(transactions string) []logRecord {
+	var records []logRecord
+	for _, line := range strings.Split(transactions, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.Trim(fields[0], "-") != "" {
+			continue
+		}
+		// the value may contain spaces of its own
+		value := strings.TrimSpace(strings.SplitN(strings.TrimSpace(line), fields[1], 2)[1])
+		records = append(records, logRecord{tag: fields[1], value: value})
+	}
+	return records
+}
+
+// Stats is a snapshot of the varnishstat counters of a Varnish instance by name, e.g. "MAIN.cache_hit".
+type Stats map[string]uint64
+
+// Stats returns a snapshot of all varnishstat counters. Workers add their counts to the counters in batches,
+// e.g. when they become idle, so counters may lag behind the responses by a few milliseconds.
+func (v *VarnishInstance) Stats() (Stats, error) {
+	output, err := execInContainer(v.containerID, "varnishstat", "-n", "/tmp/varnish_workdir", "-1")
+	if err != nil {
+		return nil, err
+	}
+	stats := Stats{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// bitmaps like VBE.*.happy are not counters
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[0]] = value
+	}
+	return stats, nil
+}
+
+// Diff returns the differences of the counters which changed between the given snapshots, such that tests
+// can assert e.g. exactly one MAIN.cache_miss and two MAIN.cache_hit in between. Counters missing in before
+// count as 0. Gauges like MAIN.n_object may decrease, and uptimes like MAIN.uptime change all the time.
+func Diff(before Stats, after Stats) map[string]int64 {
+	diff := map[string]int64{}
+	for name, value := range after {
+		if value != before[name] {
+			diff[name] = int64(value) - int64(before[name])
+		}
+	}
+	for name, value := range before {
+		if _, ok := after[name]; !ok {
+			diff[name] = -int64(value)
+		}
+	}
+	return diff
+}
+
+// completedBackgroundFetches returns the number of completed background fetches in the log of Varnish.
+func (v *VarnishInstance) completedBackgroundFetches() (int, error) {
+	// -d processes the log from its start and exits at its end, but also prints incomplete transactions
+	output, err := execInContainer(v.containerID, "varnishlog", "-n", "/tmp/varnish_workdir", "-d", "-b",
+		"-g", "vxid", "-q", `Begin ~ "bgfetch"`, "-i", "Begin,End")
+	if err != nil {
+		return 0, err
+	}
+	completed := 0
+	for _, transaction := range strings.Split(output, "\n\n") {
+		for _, line := range strings.Split(transaction, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[1] == "End" {
+				completed++
+				break
+			}
+		}
+	}
+	return completed, nil
+}
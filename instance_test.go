@@ -0,0 +1,374 @@
+// Contains tests for querying the state of the cache, the counters and the log of a Varnish instance
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// TestObjectInfo tests that ObjectInfo reports the remaining TTL and the grace of a cached object,
+// also after it became stale, without fetching the object itself.
+func TestObjectInfo(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(2), SWR: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// expect the object not to be cached yet
+	info, err := instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.False(t, info.Cached)
+
+	// send request
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)).xResponse)
+
+	// expect the object to be cached with a TTL of almost two seconds
+	info, err = instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.True(t, info.Cached)
+	assert.Greater(t, info.Ttl, 1*time.Second)
+	assert.LessOrEqual(t, info.Ttl, 2*time.Second)
+	assert.Equal(t, 10*time.Second, info.Grace)
+	assert.Equal(t, 1, info.Hits)
+
+	// wait for the object to become stale
+	time.Sleep(2100 * time.Millisecond)
+
+	// expect the object to still be cached with a negative TTL
+	info, err = instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.True(t, info.Cached)
+	assert.Less(t, info.Ttl, time.Duration(0))
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestObjectInfoHitForMiss tests that ObjectInfo does not report a hit-for-miss object as cached.
+func TestObjectInfoHitForMiss(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withXCacheControl(caching.CacheControl{NoStore: true})).xResponse)
+
+	// expect the object not to be cached
+	info, err := instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.False(t, info.Cached)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestStatsDiff tests that the difference of two snapshots of the counters reports the misses and hits in between,
+// and that unchanged counters are left out.
+func TestStatsDiff(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// take a snapshot once the health checks have been counted
+	eventuallyCounter(t, instance, "MAIN.client_req", 1)
+	before, err := instance.Stats()
+	require.NoError(t, err)
+
+	// send a miss and two hits
+	for _, xRequest := range []string{"1", "2", "3"} {
+		assert.Equal(t, "1", mkReq(t, instance.Port, xRequest, withXCacheControl(cacheControl)).xResponse)
+	}
+
+	// take another snapshot once the hits have been counted
+	eventuallyCounter(t, instance, "MAIN.cache_hit", before["MAIN.cache_hit"]+2)
+	after, err := instance.Stats()
+	require.NoError(t, err)
+
+	// expect exactly one miss and two hits
+	diff := caching.Diff(before, after)
+	assert.Equal(t, int64(1), diff["MAIN.cache_miss"])
+	assert.Equal(t, int64(2), diff["MAIN.cache_hit"])
+	assert.NotContains(t, diff, "MAIN.cache_hitpass")
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestRequestIDTransaction tests that the X-Request-ID sent by the client is forwarded to the backend
+// and echoed with EchoRequestID, and that it finds the transactions of the request in the log of Varnish.
+func TestRequestIDTransaction(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		EchoRequestID: true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a miss and a hit and expect their X-Request-ID to be echoed
+	for _, xRequest := range []string{"1", "2"} {
+		if !assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withHeader("X-Request-ID", requestID(t, xRequest))),
+			mkReq(t, instance.Port, xRequest, withXCacheControl(cacheControl), withCaptureHeaders("X-Request-ID"))) {
+			logTransaction(t, instance, xRequest)
+		}
+	}
+
+	// expect the backend to have received the X-Request-ID of the miss
+	assert.Equal(t, []string{requestID(t, "1")}, recorder.Headers("X-Request-ID"))
+
+	// expect the transactions of the miss to contain its backend request, and those of the hit not to
+	miss, err := instance.Transaction(requestID(t, "1"))
+	require.NoError(t, err)
+	assert.Regexp(t, `VCL_call\s+MISS`, miss)
+	assert.Regexp(t, `BereqHeader\s+X-Request-ID: `+regexp.QuoteMeta(requestID(t, "1")), miss)
+	hit, err := instance.Transaction(requestID(t, "2"))
+	require.NoError(t, err)
+	assert.Regexp(t, `VCL_call\s+HIT`, hit)
+	assert.NotContains(t, hit, "BereqHeader")
+
+	// expect no transactions for an unknown X-Request-ID
+	_, err = instance.Transaction(requestID(t, "3"))
+	assert.Error(t, err)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestVclFlow tests that the VCL flow of a request shows the subroutines which ran for misses, hits and passes,
+// including those of the backend transaction.
+func TestVclFlow(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a miss, a hit and a POST request, which is passed
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "1", mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "3", mkReq(t, instance.Port, "3", withMethod(http.MethodPost), withXCacheControl(cacheControl)).xResponse)
+
+	// expect the flows of a miss, a hit and a pass
+	assertVclFlow(t, instance, "1", "vcl_recv:hash", "vcl_hash:lookup", "vcl_miss:fetch", "vcl_deliver:deliver",
+		"vcl_backend_fetch:fetch", "vcl_backend_response:deliver")
+	assertVclFlow(t, instance, "2", "vcl_recv:hash", "vcl_hit:deliver", "vcl_deliver")
+	assertVclFlow(t, instance, "3", "vcl_recv:pass", "vcl_pass:fetch", "vcl_deliver", "vcl_backend_fetch")
+
+	// expect the flow of the hit not to contain a miss or a backend fetch
+	flow, err := instance.VclFlow(requestID(t, "2"))
+	require.NoError(t, err)
+	assert.Error(t, caching.MatchVclFlow(flow, "vcl_miss"))
+	assert.Error(t, caching.MatchVclFlow(flow, "vcl_backend_fetch"))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestVclLog tests that values logged by custom VCL with std.log can be looked up for a request,
+// both those of the client transaction and those of its backend transaction.
+func TestVclLog(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL logging the URL and the TTL of the response
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Vcl: `
+import std;
+sub vcl_recv {
+  std.log("url: " + req.url);
+}
+sub vcl_backend_response {
+  std.log("ttl: " + beresp.ttl);
+}`,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a miss and a hit
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1", withPath("/logged"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "1", mkReq(t, instance.Port, "2", withPath("/logged"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect the values of the miss to be logged by the client and the backend transaction
+	messages, err := instance.VclLog(requestID(t, "1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"url: /logged", "ttl: 300.000"}, messages)
+
+	// expect the hit to only log the URL
+	messages, err = instance.VclLog(requestID(t, "2"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"url": "/logged"}, caching.VclLogValues(messages))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// transactionsOfMiss is the output of varnishlog for a miss, with a backend transaction, as returned by Transaction.
+// The logged messages and a request header contain the text of tags.
+const transactionsOfMiss = `*   << Request  >> 32770
+-   Begin          req 32769 rxreq
+-   ReqMethod      GET
+-   ReqURL         /logged
+-   ReqHeader      X-Note: VCL_call MISS
+-   VCL_call       RECV
+-   VCL_Log        url: /logged
+-   VCL_Log        VCL_Log: a  message  with  VCL_Log
+-   VCL_return     hash
+-   VCL_call       HASH
+-   VCL_return     lookup
+-   VCL_call       MISS
+-   VCL_return     fetch
+-   Link           bereq 32771 fetch
+-   VCL_call       DELIVER
+-   VCL_return     deliver
+-   End
+
+**  << BeReq    >> 32771
+--  Begin          bereq 32770 fetch
+--  VCL_call       BACKEND_FETCH
+--  VCL_return     fetch
+--  VCL_call       BACKEND_RESPONSE
+--  VCL_Log        ttl: 300.000
+--  VCL_return     deliver
+--  End
+`
+
+// TestParseVclFlow tests that the VCL flow of canned varnishlog output contains the subroutines with their return
+// actions, first those of the client transaction and then those of its backend transaction.
+func TestParseVclFlow(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []string{"vcl_recv:hash", "vcl_hash:lookup", "vcl_miss:fetch", "vcl_deliver:deliver",
+		"vcl_backend_fetch:fetch", "vcl_backend_response:deliver"}, caching.ParseVclFlow(transactionsOfMiss))
+	assert.Empty(t, caching.ParseVclFlow(""))
+}
+
+// TestParseVclLog tests that the messages logged in canned varnishlog output are returned verbatim,
+// including spaces and the text of tags.
+func TestParseVclLog(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []string{"url: /logged", "VCL_Log: a  message  with  VCL_Log", "ttl: 300.000"},
+		caching.ParseVclLog(transactionsOfMiss))
+}
+
+// TestMatchVclFlow tests that expected steps match in order with further steps in between,
+// and that steps without a return action match any return action.
+func TestMatchVclFlow(t *testing.T) {
+	t.Parallel()
+	flow := []string{"vcl_recv:hash", "vcl_hash:lookup", "vcl_hit:deliver", "vcl_deliver:deliver"}
+	tests := []struct {
+		name     string
+		expected []string
+		err      string
+	}{
+		{"nothing", nil, ""},
+		{"all steps", []string{"vcl_recv:hash", "vcl_hash:lookup", "vcl_hit:deliver", "vcl_deliver:deliver"}, ""},
+		{"steps in between", []string{"vcl_recv:hash", "vcl_deliver:deliver"}, ""},
+		{"any return action", []string{"vcl_hit", "vcl_deliver"}, ""},
+		{"other return action", []string{"vcl_hit:pass"},
+			"VCL flow vcl_recv:hash, vcl_hash:lookup, vcl_hit:deliver, vcl_deliver:deliver does not contain vcl_hit:pass"},
+		{"wrong order", []string{"vcl_deliver", "vcl_hit"},
+			"VCL flow vcl_recv:hash, vcl_hash:lookup, vcl_hit:deliver, vcl_deliver:deliver does not contain vcl_hit"},
+		{"missing step", []string{"vcl_recv", "vcl_miss"},
+			"VCL flow vcl_recv:hash, vcl_hash:lookup, vcl_hit:deliver, vcl_deliver:deliver does not contain vcl_miss"},
+		{"prefix of a subroutine", []string{"vcl_h"},
+			"VCL flow vcl_recv:hash, vcl_hash:lookup, vcl_hit:deliver, vcl_deliver:deliver does not contain vcl_h"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := caching.MatchVclFlow(flow, test.expected...)
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+}
+
+// TestVclLogValues tests that messages logged as "name: value" are looked up by name, with the last value of
+// names logged several times, and that values may contain the separator themselves.
+func TestVclLogValues(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		messages []string
+		expected map[string]string
+	}{
+		{"none", nil, map[string]string{}},
+		{"values", []string{"url: /logged", "ttl: 300.000"}, map[string]string{"url": "/logged", "ttl": "300.000"}},
+		{"last value", []string{"ttl: 1.000", "ttl: 2.000"}, map[string]string{"ttl": "2.000"}},
+		{"separator in value", []string{"header: X-Foo: bar"}, map[string]string{"header": "X-Foo: bar"}},
+		{"empty value", []string{"cookie: "}, map[string]string{"cookie": ""}},
+		{"other messages", []string{"no value", "ttl:1.000"}, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, caching.VclLogValues(test.messages))
+		})
+	}
+}
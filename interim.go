@@ -0,0 +1,22 @@
+package caching
+
+import (
+	"net/http"
+)
+
+// InterimHandler returns a backend handler which sends interim responses with the given 1xx statuses before
+// passing the request on to next. Responses with 103 (Early Hints) carry a Link header preloading /style.css,
+// which the final response does not carry. The interim responses are sent regardless of whether the request
+// asked for them, e.g. 100 (Continue) is sent without an Expect header.
+func InterimHandler(statuses []int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, status := range statuses {
+			if status == http.StatusEarlyHints {
+				w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+			}
+			w.WriteHeader(status)
+			w.Header().Del("Link")
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,82 @@
+// Contains tests for interim (1xx) responses
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// TestInterimResponsesFromBackend documents how Varnish handles interim responses sent by the backend
+// for cacheable and passed requests: it never forwards them to the client. The final status is logged,
+// since Varnish either skips the interim responses or fails the fetch.
+func TestInterimResponsesFromBackend(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server sending interim responses
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/early-hints": caching.InterimHandler([]int{http.StatusEarlyHints}, echoCacheControlHandler(&backendRequests)),
+		"/continue":    caching.InterimHandler([]int{http.StatusContinue}, echoCacheControlHandler(&backendRequests)),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	for _, path := range []string{"/early-hints", "/continue"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			// send request
+			resp := mkReq(t, port, "1", withPath(path), withMethod(method), withRecordInterim(),
+				withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(300)}))
+
+			// expect no interim responses and a final response
+			assert.Empty(t, resp.interimStatuses, "%s %s", method, path)
+			assert.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable}, resp.statusCode, "%s %s", method, path)
+			t.Logf("%s %s with interim responses from the backend: %d", method, path, resp.statusCode)
+		}
+	}
+}
+
+// TestExpectContinue tests that Varnish itself responds to Expect: 100-continue with 100 (Continue),
+// and neither forwards the Expect header nor the interim response of the backend.
+func TestExpectContinue(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	var requestBodies []string
+
+	// start a test server which reads the request body
+	testServerPort, testServer := startTestServer(recorder.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		requestBodies = append(requestBodies, string(body))
+		echoCacheControlHandler(&backendRequests)(w, r)
+	}))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request with a body, waiting for 100 (Continue) before sending the body
+	assert.Equal(t, mkResp(http.StatusOK, "1", withAcceptRanges(""), withInterimStatuses(http.StatusContinue)),
+		mkReq(t, port, "1", withMethod(http.MethodPost), withRequestBody("hello"), withRequestHeader("Expect", "100-continue"), withRecordInterim()))
+
+	// expect 1 backend request with the body, but without Expect
+	assert.Equal(t, 1, backendRequests)
+	assert.Equal(t, []string{"hello"}, requestBodies)
+	assert.Equal(t, []string{""}, recorder.Headers("Expect"))
+}
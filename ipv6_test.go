@@ -0,0 +1,118 @@
+// Contains tests for IPv6 listeners, backends and client addresses
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestIPv6Listener tests that Varnish serves and caches responses for clients connecting over IPv6.
+func TestIPv6Listener(t *testing.T) {
+	requireIPv6(t)
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container listening on ::1
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		ListenIPv6:  true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send two requests over IPv6, of which the second is a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "1", withIPv6(), withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withIPv6(), withXCacheControl(cacheControl)))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestIPv6Backend tests that Varnish connects to a backend whose name resolves to both an IPv4 and an IPv6 address
+// over IPv4 by default, and over IPv6 with the prefer_ipv6 parameter.
+func TestIPv6Backend(t *testing.T) {
+	t.Parallel()
+
+	// create a dual-stack network
+	network, err := caching.NewIPv6Network()
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, network.Remove()) }()
+
+	// start a backend container on the network
+	_, stopBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+	require.NoError(t, err)
+	defer stopBackend()
+
+	for _, preferIPv6 := range []string{"off", "on"} {
+		// start varnish container on the network
+		port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+			Network:     network,
+			BackendHost: "backend",
+			BackendPort: caching.EchoBackendPort,
+			Params:      map[string]string{"prefer_ipv6": preferIPv6},
+		})
+		require.NoError(t, err)
+		defer stopFunc()
+		waitForHealthy(t, port)
+
+		// send request
+		resp := mkReq(t, port, "1", withCaptureHeaders("X-Remote-Addr"))
+		assert.Equal(t, "1", resp.xResponse)
+
+		// expect the backend to have been connected to from an address of the expected family
+		if preferIPv6 == "on" {
+			assert.Regexp(t, `^fd[0-9a-f:]+$`, resp.headers["X-Remote-Addr"])
+		} else {
+			assert.Regexp(t, `^[0-9.]+$`, resp.headers["X-Remote-Addr"])
+		}
+	}
+}
+
+// TestIPv6ClientIp tests that ACLs match the IPv6 addresses of clients, which are claimed with the PROXY protocol.
+func TestIPv6ClientIp(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container, which only allows purging from an IPv6 network
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+		PurgeAllowed:        []string{"2001:db8::/32"},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request from an IPv6 client
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.ProxyPort, "1", withProxyProtocol("2001:db8::7"), withXCacheControl(cacheControl)))
+
+	// send PURGE requests from IPv6 clients outside and inside of the allowed network
+	assert.Equal(t, mkResp(http.StatusForbidden, ""),
+		mkReq(t, instance.ProxyPort, "2", withMethod("PURGE"), withProxyProtocol("2001:db9::7")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withAcceptRanges("")),
+		mkReq(t, instance.ProxyPort, "3", withMethod("PURGE"), withProxyProtocol("2001:db8::7")))
+
+	// expect the object to be fetched again, and the backend to have received the IPv6 addresses of the clients
+	assert.Equal(t, mkResp(http.StatusOK, "4", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.ProxyPort, "4", withProxyProtocol("2001:db8::8"), withXCacheControl(cacheControl)))
+	assert.Equal(t, 2, backendRequests)
+	assert.Equal(t, []string{"2001:db8::7", "2001:db8::8"}, recorder.Headers("X-Forwarded-For"))
+}
@@ -0,0 +1,94 @@
+// Contains tests for authenticating requests at the edge by signed tokens
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestJwtAuth tests that with JwtAuth, protected content is cached once for all clients with a valid token,
+// while requests with an expired, tampered, foreign or missing token are rejected even though the content is cached.
+func TestJwtAuth(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var backendAuthorizations, backendClaims []string
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+	const secret = "edge-secret"
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		backendAuthorizations = append(backendAuthorizations, r.Header.Values("Authorization")...)
+		backendClaims = append(backendClaims, r.Header.Get("X-Jwt-Claims"))
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container protecting /private/
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		JwtAuth:     &caching.JwtAuth{Secret: secret, Condition: `req.url ~ "^/private/"`},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	alice := caching.SignJwt(secret, map[string]any{"sub": "alice", "exp": exp})
+	bob := caching.SignJwt(secret, map[string]any{"sub": "bob", "exp": exp})
+	expired := caching.SignJwt(secret, map[string]any{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()})
+	foreign := caching.SignJwt("other-secret", map[string]any{"sub": "alice", "exp": exp})
+	// the claims of an admin with the signature of alice
+	aliceParts := strings.Split(alice, ".")
+	adminParts := strings.Split(caching.SignJwt("guess", map[string]any{"sub": "admin", "exp": exp}), ".")
+	tampered := aliceParts[0] + "." + adminParts[1] + "." + aliceParts[2]
+	unsigned := aliceParts[0] + "." + aliceParts[1] + "."
+
+	// send requests with valid tokens and expect the second to be served from the cache
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "1", withPath("/private/page"), withXCacheControl(cacheControl), withAuthorization("Bearer "+alice)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withPath("/private/page"), withXCacheControl(cacheControl), withAuthorization("Bearer "+bob)))
+
+	// send requests with invalid tokens and expect them to be rejected
+	for name, authorization := range map[string]string{
+		"expired":  "Bearer " + expired,
+		"foreign":  "Bearer " + foreign,
+		"tampered": "Bearer " + tampered,
+		"unsigned": "Bearer " + unsigned,
+		"basic":    "Basic YWxpY2U6c2VjcmV0",
+		"missing":  "",
+	} {
+		resp := mkReq(t, port, name, withPath("/private/page"), withAuthorization(authorization),
+			withCaptureHeaders("WWW-Authenticate"))
+		assert.Equal(t, http.StatusUnauthorized, resp.statusCode, name)
+		assert.Equal(t, "Bearer", resp.headers["WWW-Authenticate"], name)
+	}
+
+	// send request for unprotected content without a token
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "3", withPath("/public/page"), withXCacheControl(cacheControl)))
+
+	// expect the backend to receive the claims of the token instead of the token
+	assert.Empty(t, backendAuthorizations)
+	if assert.Len(t, backendClaims, 2) {
+		assert.Contains(t, backendClaims[0], `"sub":"alice"`)
+		assert.Empty(t, backendClaims[1])
+	}
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestInvalidJwtAuth tests that an empty secret is rejected.
+func TestInvalidJwtAuth(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.JwtAuth = &caching.JwtAuth{}
+	}))
+	assert.EqualError(t, err, "JwtAuth.Secret must not be empty")
+}
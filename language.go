@@ -0,0 +1,34 @@
+package caching
+
+// AcceptLanguage is an Accept-Language header sent by real clients with the language VarnishConfig.Languages
+// normalizes it to for the languages "en", "de" and "fr".
+type AcceptLanguage struct {
+	Value    string
+	Language string
+}
+
+// AcceptLanguageCorpus lists Accept-Language headers as sent by browsers in various locales, e.g. to send a request
+// with each of them and compare the number of cached variants with and without VarnishConfig.Languages.
+var AcceptLanguageCorpus = []AcceptLanguage{
+	{"en-US,en;q=0.9", "en"},
+	{"en-US,en;q=0.5", "en"},
+	{"en-GB,en;q=0.9", "en"},
+	{"en-GB,en-US;q=0.9,en;q=0.8", "en"},
+	{"en", "en"},
+	{"de-DE,de;q=0.9,en-US;q=0.8,en;q=0.7", "de"},
+	{"de-DE,de;q=0.9", "de"},
+	{"de,en-US;q=0.7,en;q=0.3", "de"},
+	{"de-AT,de;q=0.9,en;q=0.8", "de"},
+	{"de-CH", "de"},
+	{"gsw-CH,de-CH;q=0.9,de;q=0.8", "de"},
+	{"fr-FR,fr;q=0.9,en-US;q=0.8,en;q=0.7", "fr"},
+	{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", "fr"},
+	{"fr-BE,fr;q=0.9,nl;q=0.8", "fr"},
+	{"nl-BE,nl;q=0.9,fr-BE;q=0.8,fr;q=0.7", "fr"},
+	{"pt-BR,pt;q=0.9,en-US;q=0.8,en;q=0.7", "en"},
+	{"es-ES,es;q=0.9", "en"},
+	{"zh-CN,zh;q=0.9", "en"},
+	{"ja", "en"},
+	{"*", "en"},
+	{"de;q=0,fr", "fr"},
+}
@@ -0,0 +1,122 @@
+// Contains tests for normalizing the Accept-Language header to a small set of languages
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// languageHandler returns a backend handler which responds with the Accept-Language header of the request
+// as body, varying on Accept-Language.
+func languageHandler(backendRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(60)}.String())
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	}
+}
+
+// TestLanguagesCorpus tests that with Languages, the Accept-Language headers of the corpus are normalized to
+// their expected languages, such that the cache holds one object per language instead of one per header.
+func TestLanguagesCorpus(t *testing.T) {
+	t.Parallel()
+	distinct := map[string]bool{}
+	languages := map[string]bool{}
+	for _, acceptLanguage := range caching.AcceptLanguageCorpus {
+		distinct[acceptLanguage.Value] = true
+		languages[acceptLanguage.Language] = true
+	}
+	for _, test := range []struct {
+		name      string
+		languages []string
+		objects   int
+	}{
+		{"not normalized", nil, len(distinct)},
+		{"normalized", []string{"en", "de", "fr"}, len(languages)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var backendRequests int
+
+			// start a test server
+			testServerPort, testServer := startTestServer(languageHandler(&backendRequests))
+			defer testServer.Close()
+
+			// start varnish container
+			instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+				BackendPort: testServerPort,
+				Languages:   test.languages,
+			})
+			require.NoError(t, err)
+			defer instance.Stop()
+			waitForHealthy(t, instance.Port)
+
+			// the hit-for-miss object of the health check counts as well
+			before, err := instance.Counter("MAIN.n_object")
+			require.NoError(t, err)
+
+			// send a request per header of the corpus
+			for i, acceptLanguage := range caching.AcceptLanguageCorpus {
+				resp := mkReq(t, instance.Port, strconv.Itoa(i), withRequestHeader("Accept-Language", acceptLanguage.Value),
+					withStoreBody())
+				if test.languages == nil {
+					assert.Equal(t, acceptLanguage.Value, resp.body)
+				} else {
+					assert.Equal(t, acceptLanguage.Language, resp.body, acceptLanguage.Value)
+				}
+			}
+
+			// expect an object per distinct header or per language
+			after, err := instance.Counter("MAIN.n_object")
+			require.NoError(t, err)
+			objects := after - before
+			t.Logf("%d requests cached as %d objects", len(caching.AcceptLanguageCorpus), objects)
+			assert.Equal(t, uint64(test.objects), objects)
+			assert.Equal(t, test.objects, backendRequests)
+		})
+	}
+}
+
+// TestLanguagesDefault tests that with Languages, requests without an Accept-Language header or with unsupported
+// languages only get the first language, and that the languages of the header are matched case-insensitively.
+func TestLanguagesDefault(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(languageHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Languages:   []string{"de", "en"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests and expect the first language by default
+	assert.Equal(t, "de", mkReq(t, port, "1", withStoreBody()).body)
+	assert.Equal(t, "1", mkReq(t, port, "2", withRequestHeader("Accept-Language", "it-IT,it;q=0.9")).xResponse)
+	assert.Equal(t, "en", mkReq(t, port, "3", withRequestHeader("Accept-Language", "EN-us"), withStoreBody()).body)
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestInvalidLanguages tests that languages which are not language codes are rejected.
+func TestInvalidLanguages(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.Languages = []string{"en", "de-DE"}
+	}))
+	assert.EqualError(t, err, `Languages must be language codes like en, not "de-DE"`)
+}
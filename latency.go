@@ -0,0 +1,230 @@
+package caching
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyClassVcl reports in an X-Latency-Class response header whether Varnish delivered a fresh object ("hit"),
+// a stale one within its grace period ("grace"), fetched a miss ("miss") or passed the request ("pass").
+// It comes before the custom VCL, such that it runs even if the custom VCL returns from these subroutines.
+const latencyClassVcl = `
+sub vcl_recv {
+  unset req.http.X-Latency-Class;
+}
+
+sub vcl_hit {
+  if (obj.ttl >= 0s) {
+    set req.http.X-Latency-Class = "hit";
+  } else {
+    set req.http.X-Latency-Class = "grace";
+  }
+}
+
+sub vcl_miss {
+  set req.http.X-Latency-Class = "miss";
+}
+
+sub vcl_pass {
+  set req.http.X-Latency-Class = "pass";
+}
+
+sub vcl_deliver {
+  set resp.http.X-Latency-Class = req.http.X-Latency-Class;
+}
+`
+
+// LatencyBenchmark measures the latency of cache hits, misses and stale responses delivered within the grace period
+// (stale-while-revalidate) through Varnish under load, e.g. to quantify the benefit of a change of the VCL or of
+// a parameter by running it with both configs and comparing the reports (see WriteLatencyMarkdown).
+type LatencyBenchmark struct {
+	// Config is the config of Varnish to measure. Its BackendPort is replaced with the one of the backend of the
+	// benchmark, which responds to misses after BackendDelay with a body of BodySize bytes.
+	Config       VarnishConfig
+	BackendDelay time.Duration
+	BodySize     int
+	// Requests is the number of requests per class, 1000 if 0, of which Concurrency (8 if 0) are sent at a time.
+	Requests    int
+	Concurrency int
+}
+
+// LatencyPercentiles are the 50th, 95th and 99th percentile of the latencies of Count requests.
+type LatencyPercentiles struct {
+	Count         int
+	P50, P95, P99 time.Duration
+}
+
+// LatencyReport are the latencies of hits, misses and stale responses measured by a LatencyBenchmark.
+// Requests are sorted by how Varnish delivered them, so e.g. requests meant to be hits which found their object
+// expired are counted as misses.
+type LatencyReport struct {
+	Hit, Miss, Grace LatencyPercentiles
+}
+
+// Run starts Varnish with the config and a backend of the benchmark and measures the latencies in three phases
+// of Requests requests each: requests for new URLs, which are misses, requests for up to 100 URLs cached for an
+// hour, which are hits once each of them has been fetched by another miss, and requests for the URLs of the first
+// phase, which are cached for one second with a grace period of an hour, once they have expired, such that Varnish
+// delivers the stale objects while refreshing them in the background. All objects must fit into the storage.
+func (b LatencyBenchmark) Run() (LatencyReport, error) {
+	requests := b.Requests
+	if requests == 0 {
+		requests = 1000
+	}
+	concurrency := b.Concurrency
+	if concurrency == 0 {
+		concurrency = 8
+	}
+	body := strings.Repeat("x", b.BodySize)
+	backendPort, backend := StartTestServer(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/stale/"):
+			w.Header().Set("Cache-Control", CacheControl{MaxAge: Seconds(1), SWR: Seconds(3600)}.String())
+		case strings.HasPrefix(r.URL.Path, "/fresh/"):
+			w.Header().Set("Cache-Control", CacheControl{MaxAge: Seconds(3600)}.String())
+		default:
+			w.Header().Set("Cache-Control", CacheControl{NoStore: true}.String())
+		}
+		time.Sleep(b.BackendDelay)
+		_, _ = io.WriteString(w, body)
+	})
+	defer backend.Close()
+
+	config := b.Config
+	config.BackendPort = backendPort
+	config.Vcl = latencyClassVcl + config.Vcl
+	instance, err := StartVarnishInstanceInDocker(config)
+	if err != nil {
+		return LatencyReport{}, err
+	}
+	defer instance.Stop()
+	err = waitUntilHealthy(instance.Port, 30*time.Second)
+	if err != nil {
+		return LatencyReport{}, err
+	}
+
+	var mutex sync.Mutex
+	latencies := map[string][]time.Duration{}
+	client := http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{MaxIdleConnsPerHost: concurrency}}
+	defer client.CloseIdleConnections()
+	// load sends the requests for the given URLs, concurrency at a time, and records their latencies by class
+	load := func(urls []string) error {
+		work := make(chan string)
+		errs := make(chan error, concurrency)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for url := range work {
+					start := time.Now()
+					response, err := client.Get(url)
+					if err == nil {
+						_, err = io.Copy(io.Discard, response.Body)
+						response.Body.Close()
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					latency := time.Since(start)
+					mutex.Lock()
+					class := response.Header.Get("X-Latency-Class")
+					latencies[class] = append(latencies[class], latency)
+					mutex.Unlock()
+				}
+			}()
+		}
+		var err error
+	send:
+		for _, url := range urls {
+			select {
+			case work <- url:
+			case err = <-errs:
+				break send
+			}
+		}
+		close(work)
+		wg.Wait()
+		if err == nil && len(errs) > 0 {
+			err = <-errs
+		}
+		return err
+	}
+
+	// the hits cycle through up to 100 URLs, which are fetched before
+	base := "http://localhost:" + instance.Port
+	warm := min(requests, 100)
+	stale := make([]string, requests)
+	fresh := make([]string, warm+requests)
+	for i := range stale {
+		stale[i] = fmt.Sprintf("%s/stale/%d", base, i)
+	}
+	for i := range fresh {
+		fresh[i] = fmt.Sprintf("%s/fresh/%d", base, i%warm)
+	}
+	err = load(stale)
+	if err != nil {
+		return LatencyReport{}, err
+	}
+	expired := time.Now().Add(1500 * time.Millisecond)
+	err = load(fresh)
+	if err != nil {
+		return LatencyReport{}, err
+	}
+	time.Sleep(time.Until(expired))
+	err = load(stale)
+	if err != nil {
+		return LatencyReport{}, err
+	}
+	return LatencyReport{
+		Hit:   percentiles(latencies["hit"]),
+		Miss:  percentiles(latencies["miss"]),
+		Grace: percentiles(latencies["grace"]),
+	}, nil
+}
+
+// percentiles returns the percentiles of the given latencies by the nearest-rank method.
+func percentiles(latencies []time.Duration) LatencyPercentiles {
+	if len(latencies) == 0 {
+		return LatencyPercentiles{}
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	rank := func(p int) time.Duration {
+		return sorted[(p*len(sorted)+99)/100-1]
+	}
+	return LatencyPercentiles{Count: len(sorted), P50: rank(50), P95: rank(95), P99: rank(99)}
+}
+
+// WriteLatencyMarkdown writes the given reports by name, e.g. of a config before and after a change, as a Markdown
+// table with one row per report and class. The reports are sorted by name.
+func WriteLatencyMarkdown(w io.Writer, reports map[string]LatencyReport) error {
+	names := make([]string, 0, len(reports))
+	for name := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("| Config | Class | Requests | p50 | p95 | p99 |\n")
+	sb.WriteString("|---|---|---|---|---|---|\n")
+	for _, name := range names {
+		report := reports[name]
+		for _, class := range []struct {
+			name        string
+			percentiles LatencyPercentiles
+		}{{"hit", report.Hit}, {"miss", report.Miss}, {"grace", report.Grace}} {
+			p := class.percentiles
+			sb.WriteString(fmt.Sprintf("| %s | %s | %d | %s | %s | %s |\n", name, class.name, p.Count, p.P50, p.P95, p.P99))
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,54 @@
+// Contains tests for the latency benchmark of hits, misses and stale responses
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLatencyBenchmark tests that hits and stale responses within the grace period are delivered without waiting
+// for the backend, while misses take at least as long as the backend.
+func TestLatencyBenchmark(t *testing.T) {
+	t.Parallel()
+	backendDelay := 20 * time.Millisecond
+
+	// run the benchmark
+	report, err := caching.LatencyBenchmark{BackendDelay: backendDelay, BodySize: 1024, Requests: 200, Concurrency: 4}.Run()
+	require.NoError(t, err)
+	var sb strings.Builder
+	require.NoError(t, caching.WriteLatencyMarkdown(&sb, map[string]caching.LatencyReport{"default": report}))
+	t.Log("\n" + sb.String())
+
+	// expect 200 requests per class, and 100 more misses fetching the objects for the hits
+	assert.Equal(t, 300, report.Miss.Count)
+	assert.Equal(t, 200, report.Hit.Count)
+	assert.Equal(t, 200, report.Grace.Count)
+
+	// expect the misses to wait for the backend, but neither the hits nor the stale responses
+	assert.GreaterOrEqual(t, report.Miss.P50, backendDelay)
+	assert.Less(t, report.Hit.P50, backendDelay)
+	assert.Less(t, report.Grace.P50, backendDelay)
+}
+
+// TestWriteLatencyMarkdown tests that reports are rendered sorted by name with one row per class.
+func TestWriteLatencyMarkdown(t *testing.T) {
+	t.Parallel()
+	var sb strings.Builder
+	require.NoError(t, caching.WriteLatencyMarkdown(&sb, map[string]caching.LatencyReport{
+		"b": {Hit: caching.LatencyPercentiles{Count: 10, P50: time.Millisecond, P95: 2 * time.Millisecond, P99: 3 * time.Millisecond}},
+		"a": {Miss: caching.LatencyPercentiles{Count: 5, P50: 20 * time.Millisecond, P95: 25 * time.Millisecond, P99: 30 * time.Millisecond}},
+	}))
+	assert.Equal(t, `| Config | Class | Requests | p50 | p95 | p99 |
+|---|---|---|---|---|---|
+| a | hit | 0 | 0s | 0s | 0s |
+| a | miss | 5 | 20ms | 25ms | 30ms |
+| a | grace | 0 | 0s | 0s | 0s |
+| b | hit | 10 | 1ms | 2ms | 3ms |
+| b | miss | 0 | 0s | 0s | 0s |
+| b | grace | 0 | 0s | 0s | 0s |
+`, sb.String())
+}
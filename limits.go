@@ -0,0 +1,82 @@
+package caching
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// limitParam is a size limit of VarnishConfig with the parameter of varnishd it sets and the minimum varnishd accepts.
+type limitParam struct {
+	field   string
+	param   string
+	value   int
+	minimum int
+}
+
+// limitParams returns the size limits of the given config.
+func limitParams(config VarnishConfig) []limitParam {
+	return []limitParam{
+		{"HttpReqHdrLen", "http_req_hdr_len", config.HttpReqHdrLen, 40},
+		{"HttpReqSize", "http_req_size", config.HttpReqSize, 256},
+		{"HttpRespHdrLen", "http_resp_hdr_len", config.HttpRespHdrLen, 40},
+		{"WorkspaceClient", "workspace_client", config.WorkspaceClient, 9 << 10},
+		{"WorkspaceBackend", "workspace_backend", config.WorkspaceBackend, 1 << 10},
+	}
+}
+
+// paddingLineLength is the length of the header lines RawRequestOfSize and PaddedHeadersHandler pad with by default,
+// well below the default limits for single header lines.
+const paddingLineLength = 1000
+
+// HeaderValueOfLength returns a value for a header with the given name, such that the header line "Name: value",
+// without the terminating CRLF, is exactly the given length, which is how varnishd measures it against
+// http_req_hdr_len and http_resp_hdr_len. It panics if the length is too short for the name.
+func HeaderValueOfLength(name string, length int) string {
+	n := length - len(name) - len(": ")
+	if n < 1 {
+		panic(fmt.Sprintf("header line of %d bytes is too short for %s", length, name))
+	}
+	return strings.Repeat("x", n)
+}
+
+// RawRequestOfSize returns a raw GET request for the given path on localhost whose head, including the terminating
+// empty line, is exactly the given number of bytes, as measured by varnishd against http_req_size. It is padded with
+// header lines X-Pad-1, X-Pad-2, ... of at most 1000 bytes, below the default of http_req_hdr_len.
+// It panics if the size is too small for the request line, the Host header and a padding header.
+func RawRequestOfSize(path string, size int) string {
+	head := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n"
+	// the padding excludes the empty line, and each header line needs a CRLF
+	padding := size - len(head) - len("\r\n")
+	var sb strings.Builder
+	sb.WriteString(head)
+	for i := 1; padding > 0; i++ {
+		name := fmt.Sprintf("X-Pad-%d", i)
+		line := min(padding, paddingLineLength+len("\r\n"))
+		// leave enough for the next line if there is one
+		if next := fmt.Sprintf("X-Pad-%d: x\r\n", i+1); padding-line > 0 && padding-line < len(next) {
+			line -= len(next)
+		}
+		sb.WriteString(name + ": " + HeaderValueOfLength(name, line-len("\r\n")) + "\r\n")
+		padding -= line
+	}
+	if padding < 0 {
+		panic(fmt.Sprintf("request of %d bytes is too small for %s", size, path))
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// PaddedHeadersHandler returns a backend handler which responds with the given number of uncacheable header lines
+// X-Pad-1, X-Pad-2, ... of the given length each, e.g. a single line just above http_resp_hdr_len, or many lines
+// summing up to more than workspace_backend.
+func PaddedHeadersHandler(count int, length int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 1; i <= count; i++ {
+			name := fmt.Sprintf("X-Pad-%d", i)
+			w.Header().Set(name, HeaderValueOfLength(name, length))
+		}
+		w.Header().Set("Cache-Control", CacheControl{NoStore: true}.String())
+		w.WriteHeader(http.StatusOK)
+	}
+}
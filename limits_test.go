@@ -0,0 +1,182 @@
+// Contains tests for the size limits of headers and workspaces
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestRequestHeaderLength tests that a request header line of exactly HttpReqHdrLen bytes is accepted,
+// while a longer one is answered with 400 without reaching the backend.
+func TestRequestHeaderLength(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, HttpReqHdrLen: 1024})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests with a header line just under and just over the limit
+	assert.Equal(t, http.StatusOK, rawReq(t, port, "GET /under HTTP/1.1\r\nHost: localhost\r\nX-Long: "+
+		caching.HeaderValueOfLength("X-Long", 1024)+"\r\n\r\n").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, rawReq(t, port, "GET /over HTTP/1.1\r\nHost: localhost\r\nX-Long: "+
+		caching.HeaderValueOfLength("X-Long", 1025)+"\r\n\r\n").StatusCode)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestRequestSize tests that a request head of HttpReqSize bytes is accepted, while Varnish closes the connection
+// without a response for a larger one, even though each of its header lines is short enough.
+func TestRequestSize(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, HttpReqSize: 4096})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a request just under the limit
+	assert.Equal(t, http.StatusOK, rawReq(t, port, caching.RawRequestOfSize("/under", 4095)).StatusCode)
+
+	// send a request just over the limit and expect the connection to be closed without a response
+	conn, reader := rawConn(t, port)
+	_, err = io.WriteString(conn, caching.RawRequestOfSize("/over", 4097))
+	require.NoError(t, err)
+	_, err = http.ReadResponse(reader, nil)
+	assert.Error(t, err)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestResponseHeaderLength tests that a backend response header line of exactly HttpRespHdrLen bytes is delivered,
+// while a longer one fails the fetch with 503.
+func TestResponseHeaderLength(t *testing.T) {
+	t.Parallel()
+
+	// start a test server with a header line just under and just over the limit
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/under": caching.PaddedHeadersHandler(1, 1024),
+		"/over":  caching.PaddedHeadersHandler(1, 1025),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, HttpRespHdrLen: 1024})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests and expect the longer header line to fail the fetch
+	resp := rawReq(t, port, "GET /under HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, resp.Header.Get("X-Pad-1"), 1024-len("X-Pad-1: "))
+	assert.Equal(t, http.StatusServiceUnavailable, rawReq(t, port, "GET /over HTTP/1.1\r\nHost: localhost\r\n\r\n").StatusCode)
+}
+
+// TestBackendWorkspace tests that backend responses whose headers fit into WorkspaceBackend are delivered,
+// while headers exceeding it fail the fetch with 503, even though each header line is short enough.
+func TestBackendWorkspace(t *testing.T) {
+	t.Parallel()
+
+	// start a test server with 4 KB and with 24 KB of headers
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/under": caching.PaddedHeadersHandler(4, 1000),
+		"/over":  caching.PaddedHeadersHandler(24, 1000),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, WorkspaceBackend: 16 << 10})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests and expect the larger headers to fail the fetch
+	assert.Equal(t, http.StatusOK, rawReq(t, port, "GET /under HTTP/1.1\r\nHost: localhost\r\n\r\n").StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, rawReq(t, port, "GET /over HTTP/1.1\r\nHost: localhost\r\n\r\n").StatusCode)
+}
+
+// TestClientWorkspace tests that a request whose VCL copies of a header fit into WorkspaceClient is served,
+// while running out of the client workspace fails the request with a server error and is counted as overflow.
+func TestClientWorkspace(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL copying a request header 8 times
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:     testServerPort,
+		WorkspaceClient: 16 << 10,
+		Vcl: `
+sub vcl_recv {
+  if (req.http.X-Pad) {
+    set req.http.X-Copy = req.http.X-Pad + req.http.X-Pad + req.http.X-Pad + req.http.X-Pad +
+      req.http.X-Pad + req.http.X-Pad + req.http.X-Pad + req.http.X-Pad;
+  }
+}`,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a request with 800 bytes and one with 4000 bytes to copy
+	assert.Equal(t, http.StatusOK, rawReq(t, instance.Port, "GET /under HTTP/1.1\r\nHost: localhost\r\nX-Pad: "+
+		strings.Repeat("x", 100)+"\r\n\r\n").StatusCode)
+	assert.GreaterOrEqual(t, rawReq(t, instance.Port, "GET /over HTTP/1.1\r\nHost: localhost\r\nX-Pad: "+
+		strings.Repeat("x", 4000)+"\r\n\r\n").StatusCode, http.StatusInternalServerError)
+
+	// expect 1 backend request and an overflow of the client workspace
+	assert.Equal(t, 1, backendRequests)
+	overflows, err := instance.Counter("MAIN.ws_client_overflow")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), overflows)
+}
+
+// TestRawRequestOfSize tests that RawRequestOfSize pads requests to exactly the given size with short header lines.
+func TestRawRequestOfSize(t *testing.T) {
+	t.Parallel()
+	for _, size := range []int{35, 47, 100, 1033, 1034, 1045, 4096, 32 << 10} {
+		request := caching.RawRequestOfSize("/", size)
+		assert.Len(t, request, size)
+		assert.True(t, strings.HasPrefix(request, "GET / HTTP/1.1\r\nHost: localhost\r\n"))
+		assert.True(t, strings.HasSuffix(request, "\r\n\r\n"))
+		for _, line := range strings.Split(strings.TrimSuffix(request, "\r\n\r\n"), "\r\n") {
+			assert.LessOrEqual(t, len(line), 1000)
+		}
+	}
+	assert.Panics(t, func() { caching.RawRequestOfSize("/", 40) })
+}
+
+// TestInvalidLimits tests that size limits below the minimums of varnishd or set twice are rejected.
+func TestInvalidLimits(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithParam("http_req_size", "64k"),
+		caching.WithConfig(func(c *caching.VarnishConfig) {
+			c.HttpReqSize = 64 << 10
+			c.WorkspaceClient = 4096
+		}))
+	assert.EqualError(t, err, `HttpReqSize and Params[http_req_size] must not both be set
+WorkspaceClient must be 0 or at least 9216 bytes, not 4096`)
+}
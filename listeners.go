@@ -0,0 +1,92 @@
+package caching
+
+import (
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Listener is a further endpoint where Varnish accepts client requests besides the Port of the VarnishInstance,
+// e.g. to compare the behavior of the entry points of a single cache (see VarnishConfig.Listeners).
+type Listener struct {
+	// Name identifies the listener in VarnishInstance.Listeners, and in VCL as local.socket.
+	Name string
+	// Proxy makes the listener accept the PROXY protocol (version 1 or 2) instead of plain HTTP connections,
+	// like the one of EnableProxyProtocol.
+	Proxy bool
+	// Socket makes the listener a Unix domain socket instead of a TCP port. The socket is created in a directory
+	// of the host mounted into the container, which requires Docker to run on the same host, e.g. on Linux.
+	// For connections to it, client.ip is 0.0.0.0 unless the PROXY protocol claims another one.
+	Socket bool
+}
+
+// reservedListenerNames are the names of the listeners of the entrypoint script of the image and of
+// EnableProxyProtocol, which Listeners must not reuse.
+var reservedListenerNames = []string{"http", "proxy", "proxyprotocol"}
+
+// listenersDir is the directory in the Varnish container the directory of the sockets of the Listeners is mounted to.
+const listenersDir = "/var/run/varnish-listeners"
+
+// listenerContainerPort returns the container port of the listener at the given index, which follow the port of
+// the listener of EnableProxyProtocol.
+func listenerContainerPort(index int) string {
+	return strconv.Itoa(8445 + index)
+}
+
+// listenerArgs returns the -a arguments of varnishd for the Listeners of the config.
+func listenerArgs(config VarnishConfig) []string {
+	var args []string
+	for i, listener := range config.Listeners {
+		arg := listener.Name + "=:" + listenerContainerPort(i)
+		if listener.Socket {
+			arg = listener.Name + "=" + listenersDir + "/" + listener.Name + ".sock"
+		}
+		if listener.Proxy {
+			arg += ",PROXY"
+		}
+		if listener.Socket {
+			// the socket is created by the varnish user of the container, but connected to by the user of the host
+			arg += ",mode=0666"
+		}
+		args = append(args, "-a", arg)
+	}
+	return args
+}
+
+// bindListeners binds the TCP listeners of the config to free ports of the given loopback address of the host,
+// which are allocated in advance like the one of EnableProxyProtocol, and mounts a new directory of the host
+// for the Unix domain sockets, if any. It returns the host port or the path of the socket on the host by the name
+// of the listener, and the directory, which the caller removes once the container is stopped.
+func bindListeners(config VarnishConfig, hostConfig *container.HostConfig, exposedPorts nat.PortSet, loopback string) (map[string]string, string, error) {
+	if len(config.Listeners) == 0 {
+		return nil, "", nil
+	}
+	var socketDir string
+	listeners := map[string]string{}
+	for i, listener := range config.Listeners {
+		if listener.Socket {
+			if socketDir == "" {
+				dir, err := newWritableDir("varnish-listeners")
+				if err != nil {
+					return nil, "", err
+				}
+				socketDir = dir
+				hostConfig.Binds = append(hostConfig.Binds, socketDir+":"+listenersDir)
+			}
+			listeners[listener.Name] = filepath.Join(socketDir, listener.Name+".sock")
+			continue
+		}
+		hostPort, err := freePort()
+		if err != nil {
+			os.RemoveAll(socketDir)
+			return nil, "", err
+		}
+		containerPort := nat.Port(listenerContainerPort(i) + "/tcp")
+		exposedPorts[containerPort] = struct{}{}
+		hostConfig.PortBindings[containerPort] = []nat.PortBinding{{HostIP: loopback, HostPort: hostPort}}
+		listeners[listener.Name] = hostPort
+	}
+	return listeners, socketDir, nil
+}
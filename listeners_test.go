@@ -0,0 +1,73 @@
+// Contains tests for further listen endpoints of a single Varnish instance
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestListeners tests that a plain, a PROXY protocol and a Unix domain socket listener share the cache of the
+// instance, while VCL tells them apart by local.socket and takes client.ip from the entry point.
+func TestListeners(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start test server
+	port, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with further listeners
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: port,
+		Listeners: []caching.Listener{
+			{Name: "plain"},
+			{Name: "proxied", Proxy: true},
+			{Name: "socket", Socket: true},
+		},
+		Vcl: `
+sub vcl_deliver {
+  set resp.http.X-Socket = local.socket;
+  set resp.http.X-Client-Ip = client.ip;
+}
+`,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+	require.Len(t, instance.Listeners, 3)
+
+	// send a request to the port of the instance, which is a miss
+	captured := withCaptureHeaders("X-Socket", "X-Client-Ip")
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl),
+		withHeader("X-Socket", "http"), withHeader("X-Client-Ip", "127.0.0.1")),
+		mkReq(t, instance.Port, "1", withXCacheControl(cacheControl), captured))
+
+	// send requests to each listener, which are hits
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl),
+		withHeader("X-Socket", "plain"), withHeader("X-Client-Ip", "127.0.0.1")),
+		mkReq(t, instance.Listeners["plain"], "2", withXCacheControl(cacheControl), captured))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl),
+		withHeader("X-Socket", "proxied"), withHeader("X-Client-Ip", "203.0.113.9")),
+		mkReq(t, instance.Listeners["proxied"], "3", withXCacheControl(cacheControl), withProxyProtocol("203.0.113.9"), captured))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl),
+		withHeader("X-Socket", "socket"), withHeader("X-Client-Ip", "0.0.0.0")),
+		mkReq(t, "", "4", withXCacheControl(cacheControl), withSocket(instance.Listeners["socket"]), captured))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestInvalidListeners tests that listeners without a valid and unique name are rejected before Varnish starts.
+func TestInvalidListeners(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.Listeners = []caching.Listener{{Name: "plain"}, {Name: "plain", Socket: true}, {Name: "../socket"}, {Name: "proxy"}}
+	}))
+	assert.EqualError(t, err, `Listeners[1].Name "plain" is not unique
+Listeners[2].Name must be a name like plain or socket, not "../socket"
+Listeners[3].Name "proxy" is reserved`)
+}
@@ -0,0 +1,158 @@
+// Contains tests for long-lived bidirectional streams through Varnish
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// exchange sends the message on the stream and expects it to be echoed.
+func exchange(t *testing.T, stream *caching.DuplexStream, message string) {
+	require.NoError(t, stream.Send(message))
+	echo, err := stream.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, "echo: "+message, echo)
+}
+
+// TestLongLivedStreamPiped tests that with PipeCondition, a bidirectional stream is piped to the backend and
+// outlives the timeouts of the backend and timeout_idle, while other requests are still cached.
+func TestLongLivedStreamPiped(t *testing.T) {
+	t.Parallel()
+	var streamRequests, backendRequests int
+
+	// start a test server with a streaming endpoint
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/stream/": func(w http.ResponseWriter, r *http.Request) {
+			streamRequests++
+			caching.DuplexEchoHandler(w, r)
+		},
+		"/": echoCacheControlHandler(&backendRequests),
+	})
+	defer testServer.Close()
+
+	// start varnish container with timeouts shorter than the pauses of the stream
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		PipeCondition:       `req.url ~ "^/stream/"`,
+		FirstByteTimeout:    1 * time.Second,
+		BetweenBytesTimeout: 1 * time.Second,
+		Params:              map[string]string{"timeout_idle": "1"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// open a stream and expect the response before the request body ends
+	stream, err := caching.OpenDuplexStream(port, "/stream/1", "1")
+	require.NoError(t, err)
+	defer stream.Close()
+	exchange(t, stream, "hello")
+	response, err := stream.Response()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "1", response.Header.Get("X-Response"))
+
+	// exchange messages with pauses exceeding the timeouts, and send other requests in between
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+	for i, message := range []string{"world", "again"} {
+		time.Sleep(1500 * time.Millisecond)
+		exchange(t, stream, message)
+		assert.Equal(t, "2", mkReq(t, port, []string{"2", "3"}[i], withXCacheControl(cacheControl)).xResponse)
+	}
+
+	// end the stream and expect the response to end as well
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Receive()
+	assert.Error(t, err)
+
+	// expect one stream request and one other backend request
+	assert.Equal(t, 1, streamRequests)
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestLongLivedStreamPipeTimeout tests that Varnish closes a piped stream without traffic for longer
+// than the "pipe_timeout" parameter, while traffic at shorter intervals keeps it open.
+func TestLongLivedStreamPipeTimeout(t *testing.T) {
+	t.Parallel()
+
+	// start a test server
+	testServerPort, testServer := startTestServer(caching.DuplexEchoHandler)
+	defer testServer.Close()
+
+	// start varnish container with a short pipe timeout
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		PipeCondition: `req.url ~ "^/stream/"`,
+		Params:        map[string]string{"pipe_timeout": "2"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// open a stream and keep it busy for longer than the pipe timeout
+	stream, err := caching.OpenDuplexStream(port, "/stream/1", "1")
+	require.NoError(t, err)
+	defer stream.Close()
+	for i := 0; i < 5; i++ {
+		exchange(t, stream, "ping")
+		time.Sleep(time.Second)
+	}
+
+	// pause for longer than the pipe timeout and expect the stream to be closed
+	time.Sleep(3 * time.Second)
+	_ = stream.Send("late")
+	_, err = stream.Receive()
+	assert.Error(t, err)
+}
+
+// TestLongLivedStreamWithoutPipe tests that without pipe, Varnish passes the streaming POST request, but sends the
+// request body to the backend before reading the response, such that the client only receives the echoes
+// after it has ended the request body. Bidirectional streams therefore require pipe.
+func TestLongLivedStreamWithoutPipe(t *testing.T) {
+	t.Parallel()
+
+	// start a test server
+	testServerPort, testServer := startTestServer(caching.DuplexEchoHandler)
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// open a stream and wait for the response in the background
+	stream, err := caching.OpenDuplexStream(port, "/stream/1", "1")
+	require.NoError(t, err)
+	defer stream.Close()
+	responded := make(chan time.Time, 1)
+	go func() {
+		_, _ = stream.Response()
+		responded <- time.Now()
+	}()
+
+	// send messages with pauses and end the request body
+	for _, message := range []string{"hello", "world"} {
+		require.NoError(t, stream.Send(message))
+		time.Sleep(500 * time.Millisecond)
+	}
+	closed := time.Now()
+	require.NoError(t, stream.CloseSend())
+
+	// expect the response only after the request body ended, and then all echoes
+	assert.True(t, (<-responded).After(closed))
+	response, err := stream.Response()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	for _, message := range []string{"hello", "world"} {
+		echo, err := stream.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, "echo: "+message, echo)
+	}
+}
@@ -0,0 +1,152 @@
+// Contains tests for the handling of long and percent-encoded URLs
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawGet sends a GET request for the given URL, which is sent exactly as given.
+func rawGet(t *testing.T, port string, url string) *http.Response {
+	return rawReq(t, port, "GET "+url+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+}
+
+// TestLongURLCached tests that URLs of 16 KB are cached and hashed completely, such that URLs differing only
+// in their last character are separate objects, and that the backend receives them unchanged.
+func TestLongURLCached(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, DefaultTtl: time.Minute})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for a long URL twice, for one differing in the last character and for a percent-encoded one
+	long := caching.URLOfLength("/long/", 16<<10)
+	other := long[:len(long)-1] + "y"
+	encoded := caching.EncodedURLOfLength("/encoded/", 16<<10)
+	for _, u := range []string{long, long, other, encoded, encoded} {
+		assert.Equal(t, http.StatusOK, rawGet(t, port, u).StatusCode)
+	}
+
+	// expect 3 backend requests for the unchanged URLs
+	assert.Equal(t, 3, backendRequests)
+	requests := recorder.Requests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, long, requests[0].URL)
+	assert.Equal(t, other, requests[1].URL)
+	assert.Equal(t, encoded, requests[2].URL)
+}
+
+// TestLongURLRejected tests that the longest URL Varnish accepts is bound by HttpReqSize, since the request line
+// is part of the request head, and by the default of 32k without it.
+func TestLongURLRejected(t *testing.T) {
+	t.Parallel()
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer testServer.Close()
+
+	// start varnish containers with a limit of 4k and with the default
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, HttpReqSize: 4096})
+	require.NoError(t, err)
+	defer stopFunc()
+	defaultPort, stopDefaultFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort})
+	require.NoError(t, err)
+	defer stopDefaultFunc()
+	waitForHealthy(t, port)
+	waitForHealthy(t, defaultPort)
+
+	// search the limits and expect the request heads of URLLengthLimit to just fit
+	limit, err := caching.URLLengthLimit(port, 64<<10)
+	require.NoError(t, err)
+	assert.Equal(t, 4096-len("GET  HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"), limit)
+	defaultLimit, err := caching.URLLengthLimit(defaultPort, 64<<10)
+	require.NoError(t, err)
+	t.Logf("URL length limits: %d with 4k, %d by default", limit, defaultLimit)
+	assert.Equal(t, 32<<10-len("GET  HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"), defaultLimit)
+}
+
+// TestPercentEncodingCacheKey tests that Varnish hashes URLs as they are sent, such that URLs differing only in their
+// percent-encoding are separate objects, even those which RFC 3986 considers equivalent.
+func TestPercentEncodingCacheKey(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort, DefaultTtl: time.Minute})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	for _, encoding := range caching.PercentEncodings {
+		// send requests for both URLs and the first one again
+		for _, u := range []string{encoding.URL, encoding.Other, encoding.URL} {
+			assert.Equal(t, http.StatusOK, rawGet(t, port, u).StatusCode, encoding.Name)
+		}
+	}
+
+	// expect 2 backend requests per pair, which receive the URLs unchanged
+	assert.Equal(t, 2*len(caching.PercentEncodings), backendRequests)
+	requests := recorder.Requests()
+	require.Len(t, requests, 2*len(caching.PercentEncodings))
+	for i, encoding := range caching.PercentEncodings {
+		assert.Equal(t, encoding.URL, requests[2*i].URL, encoding.Name)
+		assert.Equal(t, encoding.Other, requests[2*i+1].URL, encoding.Name)
+	}
+}
+
+// TestURLLengthLimitGo tests URLLengthLimit against a Go server, which rejects request heads exceeding its
+// MaxHeaderBytes plus a slack of 4096 bytes with 431.
+func TestURLLengthLimitGo(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.MaxHeaderBytes = 4096
+	server.Start()
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	// search the limit and expect the request head to just fit into MaxHeaderBytes and the slack
+	limit, err := caching.URLLengthLimit(serverURL.Port(), 64<<10)
+	require.NoError(t, err)
+	assert.Equal(t, 8192-len("GET  HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"), limit)
+
+	// expect the maximum length if all URLs are accepted
+	limit, err = caching.URLLengthLimit(serverURL.Port(), 100)
+	require.NoError(t, err)
+	assert.Equal(t, 100, limit)
+}
+
+// TestURLOfLength tests that the URLs are padded to exactly the given length.
+func TestURLOfLength(t *testing.T) {
+	t.Parallel()
+	for _, length := range []int{9, 10, 11, 12, 1000} {
+		assert.Len(t, caching.URLOfLength("/long/", length), length)
+		encoded := caching.EncodedURLOfLength("/encoded/", length)
+		assert.Len(t, encoded, length)
+		decoded, err := url.PathUnescape(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, "/encoded/"+strings.Repeat("x", len(decoded)-len("/encoded/")), decoded)
+	}
+	assert.Panics(t, func() { caching.URLOfLength("/long/", 5) })
+}
@@ -0,0 +1,37 @@
+// Contains the setup shared by all tests
+package caching_test
+
+import (
+	"caching"
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestMain calibrates the time scale before the tests run, unless running with -short, e.g. for the Docker-free tests
+// only, and writes the engine report after all tests have run, if requested with -report.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Short() {
+		calibration, err := caching.CalibrateTimeScale()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "calibrating time scale: %v\n", err)
+		} else if calibration.Scale > 1 {
+			fmt.Fprintf(os.Stderr, "scaling waits by %d (%+v)\n", calibration.Scale, calibration)
+		}
+	}
+	code := m.Run()
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err == nil {
+			err = engineReport.WriteMarkdown(f)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "writing report: %v\n", err)
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
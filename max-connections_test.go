@@ -0,0 +1,103 @@
+// Contains tests for limiting the number of connections to the backend
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestMaxConnectionsExceeded tests that with MaxConnections, a miss exceeding the number of connections
+// to the backend is not queued, but responded to with 503 right away, and counted as busy.
+func TestMaxConnectionsExceeded(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var barriers caching.Barriers
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server which blocks requests to /slow at a barrier
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/slow":  barriers.Wait("fetch", echoCacheControlHandler(&backendRequests)),
+		"/other": echoCacheControlHandler(&backendRequests),
+	})
+	defer testServer.Close()
+
+	// start varnish container with a single connection to the backend
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:    testServerPort,
+		MaxConnections: 1,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request and wait for its fetch to occupy the connection
+	first := make(chan response)
+	go func() { first <- mkReq(t, instance.Port, "1", withPath("/slow"), withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("fetch", 1, 10*time.Second))
+
+	// send a request for another URL, which fails right away
+	start := time.Now()
+	assert.Equal(t, http.StatusServiceUnavailable, mkReq(t, instance.Port, "2", withPath("/other"), withXCacheControl(cacheControl)).statusCode)
+	assert.Less(t, time.Since(start), 1*time.Second)
+	eventuallyCounter(t, instance, "VBE.boot.default.busy", 1)
+
+	// release the fetch, after which the connection is available again
+	barriers.Release("fetch")
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), <-first)
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "3", withPath("/other"), withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestMaxConnectionsHitsServed tests that with MaxConnections, hits are still served while all connections
+// to the backend are occupied.
+func TestMaxConnectionsHitsServed(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var barriers caching.Barriers
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server which blocks requests to /slow at a barrier
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/slow":   barriers.Wait("fetch", echoCacheControlHandler(&backendRequests)),
+		"/cached": echoCacheControlHandler(&backendRequests),
+	})
+	defer testServer.Close()
+
+	// start varnish container with a single connection to the backend
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:    testServerPort,
+		MaxConnections: 1,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request, which is cached
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "1", withPath("/cached"), withXCacheControl(cacheControl)))
+
+	// send request and wait for its fetch to occupy the connection
+	slow := make(chan response)
+	go func() { slow <- mkReq(t, port, "2", withPath("/slow"), withXCacheControl(cacheControl)) }()
+	require.NoError(t, barriers.AwaitArrivals("fetch", 1, 10*time.Second))
+
+	// send requests for the cached object, which are hits
+	for _, xRequest := range []string{"3", "4", "5"} {
+		assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+			mkReq(t, port, xRequest, withPath("/cached"), withXCacheControl(cacheControl)))
+	}
+
+	// release the fetch
+	barriers.Release("fetch")
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)), <-slow)
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
@@ -0,0 +1,97 @@
+// Contains tests for caching responses to requests with methods other than GET and HEAD
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestCacheableMethods tests that with CacheableMethods, responses to requests with the given methods are cached
+// per method and fetched with that method, while those of other methods are still passed.
+func TestCacheableMethods(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		CacheableMethods: []string{http.MethodOptions, "PROPFIND"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a miss and a hit for each cacheable method
+	for _, method := range []string{http.MethodOptions, "PROPFIND"} {
+		assert.Equal(t, method, mkReq(t, port, method, withMethod(method), withXCacheControl(cacheControl)).xResponse)
+		assert.Equal(t, method, mkReq(t, port, "hit", withMethod(method), withXCacheControl(cacheControl)).xResponse)
+	}
+
+	// send a GET request, which does not share an object with the other methods
+	assert.Equal(t, "get", mkReq(t, port, "get", withXCacheControl(cacheControl)).xResponse)
+
+	// send POST requests, which are still passed
+	assert.Equal(t, "post1", mkReq(t, port, "post1", withMethod(http.MethodPost), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "post2", mkReq(t, port, "post2", withMethod(http.MethodPost), withXCacheControl(cacheControl)).xResponse)
+
+	// expect 5 backend requests with the methods of the client requests
+	assert.Equal(t, 5, backendRequests)
+	var methods []string
+	for _, request := range recorder.Requests() {
+		methods = append(methods, request.Method)
+	}
+	assert.Equal(t, []string{http.MethodOptions, "PROPFIND", http.MethodGet, http.MethodPost, http.MethodPost}, methods)
+	assert.Equal(t, []string{"", "", "", "", ""}, recorder.Headers("X-Cacheable-Method"))
+}
+
+// TestCacheableMethodsWithAuthorization tests that with CacheableMethods, requests with an Authorization header
+// are not looked up in the cache, like the built-in VCL does for GET requests.
+func TestCacheableMethodsWithAuthorization(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		CacheableMethods: []string{http.MethodOptions},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a request, which is cached
+	assert.Equal(t, "1", mkReq(t, port, "1", withMethod(http.MethodOptions), withXCacheControl(cacheControl)).xResponse)
+
+	// send requests with an Authorization header, which are not served from the cache
+	assert.Equal(t, "2", mkReq(t, port, "2", withMethod(http.MethodOptions), withXCacheControl(cacheControl), withAuthorization("Test 12345")).xResponse)
+	assert.Equal(t, "3", mkReq(t, port, "3", withMethod(http.MethodOptions), withXCacheControl(cacheControl), withAuthorization("Test 12345")).xResponse)
+
+	// send a request without, which is still a hit
+	assert.Equal(t, "1", mkReq(t, port, "4", withMethod(http.MethodOptions), withXCacheControl(cacheControl)).xResponse)
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestInvalidCacheableMethods tests that methods which are not tokens are rejected, since they are rendered as VCL.
+func TestInvalidCacheableMethods(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.CacheableMethods = []string{"PROPFIND", `GET" || true || "`}
+	}))
+	assert.EqualError(t, err, `CacheableMethods must be methods like OPTIONS, not "GET\" || true || \""`)
+}
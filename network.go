@@ -0,0 +1,182 @@
+package caching
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path"
+	"time"
+)
+
+// Network is a Docker network of its own, which isolates the containers attached to it from
+// the containers of other tests. Containers on a network reach each other by their aliases,
+// instead of via the host with the host.docker.internal host-gateway.
+type Network struct {
+	// Name is the name of the Docker network.
+	Name string
+
+	id   string
+	ipv6 bool
+}
+
+// NewNetwork creates a Docker network with a random name. It must be removed with Remove
+// once all containers attached to it have been stopped.
+func NewNetwork() (*Network, error) {
+	return newNetwork(types.NetworkCreate{Driver: "bridge"})
+}
+
+// NewIPv6Network creates a dual-stack Docker network like NewNetwork, on which containers have an IPv6 address
+// of a random unique local /64 subnet in addition to their IPv4 address, and their aliases resolve to both.
+func NewIPv6Network() (*Network, error) {
+	globalID := make([]byte, 5)
+	_, err := rand.Read(globalID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := newNetwork(types.NetworkCreate{
+		Driver:     "bridge",
+		EnableIPv6: true,
+		IPAM: &network.IPAM{
+			// Docker does not assign IPv6 subnets by default, so the fd00::/8 range for local use
+			// with a random global ID is used, like RFC 4193 suggests.
+			Config: []network.IPAMConfig{{
+				Subnet: fmt.Sprintf("fd%02x:%02x%02x:%02x%02x::/64", globalID[0], globalID[1], globalID[2], globalID[3], globalID[4]),
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.ipv6 = true
+	return n, nil
+}
+
+func newNetwork(options types.NetworkCreate) (*Network, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+	name := "caching-" + hex.EncodeToString(suffix)
+	response, err := cli.NetworkCreate(context.Background(), name, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Network{Name: name, id: response.ID}, nil
+}
+
+// Remove removes the Docker network. Stopped containers are removed asynchronously,
+// so it retries for a while as long as containers are still attached to the network.
+func (n *Network) Remove() error {
+	var err error
+	for i := 0; i < 50; i++ {
+		err = cli.NetworkRemove(context.Background(), n.id)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// attach makes the given host config attach a container to the network instead of the default bridge network,
+// and returns the networking config under which the container is reachable by the given aliases.
+// The host.docker.internal host-gateway is removed, such that the container cannot reach the test servers
+// on the host.
+func (n *Network) attach(hostConfig *container.HostConfig, aliases ...string) *network.NetworkingConfig {
+	hostConfig.NetworkMode = container.NetworkMode(n.Name)
+	hostConfig.ExtraHosts = nil
+	return &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			n.Name: {Aliases: aliases},
+		},
+	}
+}
+
+// echoBackendConf renders the nginx.conf of the containerized backend started by StartEchoBackendInDocker,
+// which only listens on IPv6 on IPv6 networks, since IPv6 may be unavailable in containers on other networks.
+func echoBackendConf(ipv6 bool) string {
+	listen := "    listen 8080;\n"
+	if ipv6 {
+		listen += "    listen [::]:8080;\n"
+	}
+	return `worker_processes 1;
+pid /tmp/nginx.pid;
+error_log /dev/stderr info;
+events {}
+http {
+  access_log /dev/stdout;
+  client_body_temp_path /tmp/client_body;
+  proxy_temp_path /tmp/proxy;
+  fastcgi_temp_path /tmp/fastcgi;
+  uwsgi_temp_path /tmp/uwsgi;
+  scgi_temp_path /tmp/scgi;
+  server {
+` + listen + `    location / {
+      # like the handlers of the test servers, echo the X-Request and X-Cache-Control request headers
+      # (nginx omits headers with empty values)
+      add_header X-Response $http_x_request always;
+      add_header Cache-Control $http_x_cache_control always;
+      add_header X-Backend $hostname always;
+      add_header X-Remote-Addr $remote_addr always;
+      return 200 $http_x_request;
+    }
+  }
+}
+`
+}
+
+// EchoBackendPort is the port the backend started by StartEchoBackendInDocker listens on in its container.
+const EchoBackendPort = "8080"
+
+// StartEchoBackendInDocker starts an nginx container as a backend attached to the given network, where it is
+// reachable by the given alias at EchoBackendPort. Like the handlers of the test servers, it responds to all
+// requests with 200, the X-Request request header as X-Response header and body, and the X-Cache-Control
+// request header as Cache-Control, its host name (a prefix of the container ID) as X-Backend, and the address
+// of the client (i.e. Varnish) as X-Remote-Addr. It returns the host port of the backend together with a function that will
+// stop the container.
+func StartEchoBackendInDocker(n *Network, alias string) (string, func() error, error) {
+	err := pullImage(context.Background(), nginxImage, "", "", nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// write the config as nginx.conf file in a temporary directory
+	tmpDir, err := os.MkdirTemp("", "backend")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	confFileName := path.Join(tmpDir, "nginx.conf")
+	err = os.WriteFile(confFileName, []byte(echoBackendConf(n.ipv6)), 0644)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// create and start an nginx container attached to the network
+	hostConfig := newHostConfig(EchoBackendPort+"/tcp",
+		// Mount the nginx.conf file we created above as /etc/nginx/nginx.conf
+		confFileName+":/etc/nginx/nginx.conf",
+	)
+	c, err := runContainer(context.Background(), &container.Config{
+		Image: nginxImage,
+		// Run nginx directly as the unprivileged owner of /tmp like StartNginxInDocker does.
+		User:       "1000:1000",
+		Entrypoint: []string{"nginx"},
+		Cmd:        []string{"-c", "/etc/nginx/nginx.conf", "-g", "daemon off;"},
+		ExposedPorts: nat.PortSet{
+			EchoBackendPort + "/tcp": struct{}{},
+		},
+	}, hostConfig, n.attach(hostConfig, alias), nil, nil, EchoBackendPort+"/tcp", nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.hostPort, c.stop, nil
+}
@@ -0,0 +1,207 @@
+// Contains tests for Varnish and backend containers attached to a Docker network of their own
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestNetworkBackendContainer tests that Varnish caches the responses of a containerized backend
+// it reaches by its alias on a network of their own.
+func TestNetworkBackendContainer(t *testing.T) {
+	t.Parallel()
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// create a network
+	network, err := caching.NewNetwork()
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, network.Remove()) }()
+
+	// start a backend container on the network
+	_, stopBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+	require.NoError(t, err)
+	defer stopBackend()
+
+	// start varnish container on the network
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		Network:     network,
+		BackendHost: "backend",
+		BackendPort: caching.EchoBackendPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "1", withXCacheControl(cacheControl)))
+
+	// expect the cached response
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withXCacheControl(cacheControl)))
+
+	// expect an uncacheable response to be fetched again
+	assert.Equal(t, mkResp(http.StatusOK, "3"), mkReq(t, port, "3", withPath("/uncacheable")))
+	assert.Equal(t, mkResp(http.StatusOK, "4"), mkReq(t, port, "4", withPath("/uncacheable")))
+}
+
+// TestNetworkIsolation tests that Varnish containers on different networks each reach the backend container
+// on their own network, even when the backend containers share their alias.
+func TestNetworkIsolation(t *testing.T) {
+	t.Parallel()
+	var ports, backendPorts [2]string
+
+	for i := range ports {
+		// create a network
+		network, err := caching.NewNetwork()
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, network.Remove()) }()
+
+		// start a backend container on the network, with the same alias on all networks
+		backendPort, stopBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+		require.NoError(t, err)
+		defer stopBackend()
+		backendPorts[i] = backendPort
+
+		// start varnish container on the network
+		port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+			Network:     network,
+			BackendHost: "backend",
+			BackendPort: caching.EchoBackendPort,
+		})
+		require.NoError(t, err)
+		defer stopFunc()
+		waitForHealthy(t, port)
+		ports[i] = port
+	}
+
+	for i := range ports {
+		// send a request directly to the backend container and one through varnish
+		direct := mkReq(t, backendPorts[i], "direct", withCaptureHeaders("X-Backend"))
+		proxied := mkReq(t, ports[i], "proxied", withCaptureHeaders("X-Backend"))
+
+		// expect varnish to have reached the backend container on its own network
+		require.NotEmpty(t, direct.headers["X-Backend"])
+		assert.Equal(t, direct.headers["X-Backend"], proxied.headers["X-Backend"])
+	}
+
+	// expect the backend containers to be different ones
+	assert.NotEqual(t, mkReq(t, backendPorts[0], "direct", withCaptureHeaders("X-Backend")).headers["X-Backend"],
+		mkReq(t, backendPorts[1], "direct", withCaptureHeaders("X-Backend")).headers["X-Backend"])
+}
+
+// TestBackendReResolution documents that Varnish resolves the host name of a backend only when compiling the VCL:
+// once the backend container has been replaced by one with another address, fetches fail until the VCL is reloaded.
+// Resolving host names at runtime requires vmod dynamic (see TestBackendResolveTtl).
+func TestBackendReResolution(t *testing.T) {
+	t.Parallel()
+	noStore := caching.CacheControl{NoStore: true}
+
+	// create a network
+	network, err := caching.NewNetwork()
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, network.Remove()) }()
+
+	// start a backend container on the network
+	oldBackendPort, stopOldBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+	require.NoError(t, err)
+	defer stopOldBackend()
+
+	// start varnish container on the network
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		Network:        network,
+		BackendHost:    "backend",
+		BackendPort:    caching.EchoBackendPort,
+		ConnectTimeout: 1 * time.Second,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request and expect it to reach the old backend container
+	oldBackend := mkReq(t, oldBackendPort, "direct", withCaptureHeaders("X-Backend")).headers["X-Backend"]
+	require.NotEmpty(t, oldBackend)
+	assert.Equal(t, oldBackend, mkReq(t, instance.Port, "1", withXCacheControl(noStore), withCaptureHeaders("X-Backend")).headers["X-Backend"])
+
+	// replace the backend container by a new one with the same alias, which is started first to get another address
+	newBackendPort, stopNewBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+	require.NoError(t, err)
+	defer stopNewBackend()
+	newBackend := mkReq(t, newBackendPort, "direct", withCaptureHeaders("X-Backend")).headers["X-Backend"]
+	require.NotEmpty(t, newBackend)
+	stopOldBackend()
+
+	// send request, which still tries to reach the address of the old backend container
+	assert.Equal(t, http.StatusServiceUnavailable, mkReq(t, instance.Port, "2", withXCacheControl(noStore)).statusCode)
+
+	// reload the VCL, which resolves the alias again, and expect requests to reach the new backend container
+	require.NoError(t, instance.ReloadVCL(""))
+	assert.Equal(t, newBackend, mkReq(t, instance.Port, "3", withXCacheControl(noStore), withCaptureHeaders("X-Backend")).headers["X-Backend"])
+}
+
+// TestBackendResolveTtl tests that with BackendResolveTtl, Varnish resolves the host name of a backend at runtime:
+// once the backend container has been replaced by one with another address, fetches reach the new backend container
+// after the TTL of the lookup, without reloading the VCL.
+func TestBackendResolveTtl(t *testing.T) {
+	t.Parallel()
+	noStore := caching.CacheControl{NoStore: true}
+
+	// create a network
+	network, err := caching.NewNetwork()
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, network.Remove()) }()
+
+	// start a backend container on the network
+	oldBackendPort, stopOldBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+	require.NoError(t, err)
+	defer stopOldBackend()
+
+	// start varnish container on the network, resolving the alias every second
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		Network:           network,
+		BackendHost:       "backend",
+		BackendPort:       caching.EchoBackendPort,
+		BackendResolveTtl: 1 * time.Second,
+		ConnectTimeout:    1 * time.Second,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request and expect it to reach the old backend container
+	oldBackend := mkReq(t, oldBackendPort, "direct", withCaptureHeaders("X-Backend")).headers["X-Backend"]
+	require.NotEmpty(t, oldBackend)
+	assert.Equal(t, oldBackend, mkReq(t, instance.Port, "1", withXCacheControl(noStore), withCaptureHeaders("X-Backend")).headers["X-Backend"])
+
+	// replace the backend container by a new one with the same alias
+	newBackendPort, stopNewBackend, err := caching.StartEchoBackendInDocker(network, "backend")
+	require.NoError(t, err)
+	defer stopNewBackend()
+	newBackend := mkReq(t, newBackendPort, "direct", withCaptureHeaders("X-Backend")).headers["X-Backend"]
+	require.NotEmpty(t, newBackend)
+	stopOldBackend()
+
+	// expect requests to reach the new backend container once the alias has been resolved again
+	require.Eventually(t, func() bool {
+		resp := mkReq(t, instance.Port, "2", withXCacheControl(noStore), withCaptureHeaders("X-Backend"))
+		return resp.statusCode == http.StatusOK && resp.headers["X-Backend"] == newBackend
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "requests did not reach the new backend container")
+}
+
+// TestInvalidBackendResolveTtl tests that a negative BackendResolveTtl and one together with a BackendSocket
+// are rejected.
+func TestInvalidBackendResolveTtl(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.BackendResolveTtl = -1 * time.Second
+	}))
+	assert.EqualError(t, err, "BackendResolveTtl must be >= 0")
+	_, err = caching.Start(caching.WithBackendSocket("/tmp/backend.sock"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.BackendResolveTtl = 1 * time.Second
+	}))
+	assert.EqualError(t, err, "BackendResolveTtl and BackendSocket must not both be set")
+}
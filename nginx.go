@@ -0,0 +1,118 @@
+package caching
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path"
+	"strings"
+)
+
+const nginxImage = "nginx:1.27.0-alpine"
+
+// NginxCacheConfig is the nginx equivalent of VarnishConfig.
+// Nginx has no counterpart to DefaultKeep and can only enable or disable
+// the use of stale responses, instead of limiting it to a grace period.
+type NginxCacheConfig struct {
+	BackendPort string
+	// DefaultTtl is rendered as proxy_cache_valid and applies to responses without
+	// Cache-Control or Expires headers, like the default TTL of Varnish does.
+	DefaultTtl string
+	// UseStale renders proxy_cache_use_stale, which is the closest equivalent to a (non-zero)
+	// DefaultGrace of Varnish. Stale-while-revalidate of responses is honored regardless.
+	UseStale bool
+	// Config is added to the location block proxying to the backend.
+	Config string
+}
+
+// renderNginxConf renders the complete nginx.conf for the given config. All temporary
+// paths point to /tmp, because the container runs with a read-only root filesystem.
+func renderNginxConf(config NginxCacheConfig) string {
+	var sb strings.Builder
+	sb.WriteString(`worker_processes 1;
+pid /tmp/nginx.pid;
+error_log /dev/stderr info;
+events {}
+http {
+  access_log /dev/stdout;
+  client_body_temp_path /tmp/client_body;
+  proxy_temp_path /tmp/proxy;
+  fastcgi_temp_path /tmp/fastcgi;
+  uwsgi_temp_path /tmp/uwsgi;
+  scgi_temp_path /tmp/scgi;
+  proxy_cache_path /tmp/cache keys_zone=cache:1m;
+  server {
+    listen 8080;
+    location / {
+      proxy_pass http://host.docker.internal:` + config.BackendPort + `;
+      proxy_cache cache;
+      # coalesce concurrent requests for the same object like Varnish's waiting list does
+      proxy_cache_lock on;
+      # revalidate expired objects with conditional requests
+      proxy_cache_revalidate on;
+      # revalidate stale objects asynchronously like Varnish does within grace
+      proxy_cache_background_update on;
+`)
+	if config.DefaultTtl != "" && config.DefaultTtl != "0s" {
+		sb.WriteString("      proxy_cache_valid 200 203 204 300 301 404 410 414 " + config.DefaultTtl + ";\n")
+	}
+	if config.UseStale {
+		sb.WriteString("      proxy_cache_use_stale updating;\n")
+	}
+	sb.WriteString("      add_header X-Cache $upstream_cache_status;\n")
+	sb.WriteString(config.Config)
+	sb.WriteString(`
+    }
+  }
+}
+`)
+	return sb.String()
+}
+
+// StartNginxInDocker starts nginx as a caching reverse proxy in front of the backend
+// in the same way StartVarnishInDocker does for Varnish.
+func StartNginxInDocker(config NginxCacheConfig) (string, func() error, error) {
+	err := pullImage(context.Background(), nginxImage, "", "", nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// write the config as nginx.conf file in a temporary directory
+	tmpDir, err := os.MkdirTemp("", "nginx")
+	if err != nil {
+		return "", nil, err
+	}
+	// the temporary directory is kept until the container is stopped
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	confFileName := path.Join(tmpDir, "nginx.conf")
+	err = os.WriteFile(confFileName, []byte(renderNginxConf(config)), 0644)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// create and start an nginx container
+	port, stopFunc, err := startContainer(&container.Config{
+		Image: nginxImage,
+		// Run nginx directly as the unprivileged owner of /tmp,
+		// bypassing the entrypoint scripts which want to modify the config.
+		User:       "1000:1000",
+		Entrypoint: []string{"nginx"},
+		Cmd:        []string{"-c", "/etc/nginx/nginx.conf", "-g", "daemon off;"},
+		ExposedPorts: nat.PortSet{
+			"8080/tcp": struct{}{},
+		},
+	}, newHostConfig("8080/tcp",
+		// Mount the nginx.conf file we created above as /etc/nginx/nginx.conf
+		confFileName+":/etc/nginx/nginx.conf",
+	), "8080/tcp")
+	if err != nil {
+		return "", nil, err
+	}
+	return port, removeOnStop(tmpDir, stopFunc), nil
+}
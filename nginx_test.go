@@ -0,0 +1,172 @@
+// Contains tests running scenarios of the Varnish tests against nginx to document behavioural differences
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestNginxNoCacheControl is the nginx equivalent of TestNoCacheControl and tests that nginx
+// uses proxy_cache_valid like Varnish uses its default TTL for responses without Cache-Control.
+func TestNginxNoCacheControl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start nginx container
+	port, stopFunc, err := caching.StartNginxInDocker(caching.NginxCacheConfig{
+		BackendPort: testServerPort,
+		DefaultTtl:  "1s",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
+
+	// wait half a second
+	time.Sleep(500 * time.Millisecond)
+
+	// send another request and expect the previous cached return
+	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
+
+	// wait for 600 ms
+	time.Sleep(600 * time.Millisecond)
+
+	// send another request and expect no cached return
+	assert.Equal(t, "baz", mkReq(t, port, "baz").xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestNginxCacheControlMaxAge1 is the nginx equivalent of TestCacheControlMaxAge1 and additionally
+// checks the X-Cache header rendered from $upstream_cache_status.
+func TestNginxCacheControlMaxAge1(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start nginx container
+	port, stopFunc, err := caching.StartNginxInDocker(caching.NginxCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request to nginx
+	resp := mkReq(t, port, "1", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)}))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Equal(t, "MISS", resp.xCache)
+
+	// send another request and expect to receive a cached response
+	resp = mkReq(t, port, "2", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)}))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Equal(t, "HIT", resp.xCache)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestNginxStaleWhileRevalidate is the nginx equivalent of TestStaleWhileRevalidate and tests that nginx
+// honors stale-while-revalidate with a background update without any proxy_cache_use_stale configuration.
+func TestNginxStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		xRequest := r.Header.Get("X-Request")
+		if xRequest == "2" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", caching.CacheControl{MaxAge: caching.Seconds(1), SWR: caching.Seconds(10)}.String())
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start nginx container
+	port, stopFunc, err := caching.StartNginxInDocker(caching.NginxCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request to nginx
+	assert.Equal(t, "1", mkReq(t, port, "1").xResponse)
+
+	// sleep for 1.1 seconds to make the cached response stale
+	time.Sleep(1100 * time.Millisecond)
+
+	// send another request and expect to receive the stale response very fast
+	time1 := time.Now()
+	resp := mkReq(t, port, "2")
+	time2 := time.Now()
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Equal(t, "STALE", resp.xCache)
+	assert.Less(t, time2.Sub(time1), 100*time.Millisecond)
+
+	// sleep for 600 ms to let nginx update the cached response
+	time.Sleep(600 * time.Millisecond)
+
+	// send yet another request and expect to receive the second cached response
+	assert.Equal(t, "2", mkReq(t, port, "3").xResponse)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestNginxUseStaleIgnoresMaximumStaleness tests a difference to Varnish: with proxy_cache_use_stale,
+// nginx serves a stale response regardless of how long ago it became stale, whereas Varnish limits
+// this to the default grace period.
+func TestNginxUseStaleIgnoresMaximumStaleness(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start nginx container
+	port, stopFunc, err := caching.StartNginxInDocker(caching.NginxCacheConfig{
+		BackendPort: testServerPort,
+		UseStale:    true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request to nginx
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).xResponse)
+
+	// sleep for 3 seconds to make the cached response stale for much longer than its TTL
+	time.Sleep(3 * time.Second)
+
+	// send another request and still expect the stale response
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).xResponse)
+
+	// wait a bit for the background update to complete
+	time.Sleep(100 * time.Millisecond)
+
+	// expect two backend requests
+	assert.Equal(t, 2, backendRequests)
+}
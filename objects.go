@@ -0,0 +1,145 @@
+package caching
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachedObject is an object in the cache as listed by VarnishInstance.ListObjects.
+type CachedObject struct {
+	// URL and Host are the URL (path and query) and the Host header of the backend request which fetched the object,
+	// which make up its cache key unless the VCL hashes other inputs.
+	URL  string
+	Host string
+	// Vary is the Vary header of the object. Each variant is an object of its own.
+	Vary string
+	// Ttl is the remaining TTL, which is negative for stale objects. Unlike VarnishInstance.ObjectInfo,
+	// it is only accurate to about a second, since Varnish logs the time of the fetch in seconds.
+	Ttl time.Duration
+	// Grace and Keep are the grace and keep periods of the object.
+	Grace time.Duration
+	Keep  time.Duration
+	// Fetched is when the object was fetched, i.e. the reference time of its TTL.
+	Fetched time.Time
+}
+
+// expKillRegexp matches the records of the expiry thread about objects leaving the cache as printed by varnishlog
+// with -g raw, e.g. "0 ExpKill - EXP_Expired xid=32770 t=-1 h=0", "EXP_Removed xid=32770 t=297 h=1" for a replaced
+// or purged object, or "LRU xid=32770" for an object evicted to make room for others. The xid is the one of the fetch.
+var expKillRegexp = regexp.MustCompile(`(?m)ExpKill\s+\S\s+(?:EXP_Expired|EXP_Removed|LRU) x(?:id)?=(\d+)`)
+
+// ListObjects returns the objects currently in the cache, stale or not, sorted by URL, host and the time they were
+// fetched, e.g. to assert that exactly these objects are cached or to explain a failing test. Hit-for-pass and
+// hit-for-miss objects do not count as cached. Varnish cannot list its objects, so they are reconstructed from the log:
+// the backend fetches which inserted an object, minus the objects which have expired, have been replaced, purged
+// or evicted since. Objects whose fetch has been overwritten in the log by many later requests are missing.
+func (v *VarnishInstance) ListObjects() ([]CachedObject, error) {
+	// the expiry thread logs without a transaction of its own
+	output, err := execInContainer(v.containerID, "varnishlog", "-n", "/tmp/varnish_workdir", "-d", "-g", "raw", "-i", "ExpKill")
+	if err != nil {
+		return nil, err
+	}
+	removed := map[string]bool{}
+	for _, match := range expKillRegexp.FindAllStringSubmatch(output, -1) {
+		removed[match[1]] = true
+	}
+
+	// -d processes the log from its start and exits at its end, but also prints incomplete transactions
+	output, err = execInContainer(v.containerID, "varnishlog", "-n", "/tmp/varnish_workdir", "-d", "-b", "-g", "vxid",
+		"-i", "BereqURL,BereqHeader,BerespHeader,TTL,VCL_return,End")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var objects []CachedObject
+	for _, transaction := range strings.Split(output, "\n\n") {
+		// the transaction starts with a line like "*   << BeReq    >> 32770"
+		lines := strings.SplitN(strings.TrimSpace(transaction), "\n", 2)
+		fields := strings.Fields(lines[0])
+		if len(fields) == 0 || fields[0] != "*" || removed[fields[len(fields)-1]] {
+			continue
+		}
+		object, ok := cachedObject(transaction)
+		if ok && object.Fetched.Add(object.Ttl+object.Grace+object.Keep).After(now) {
+			object.Ttl = time.Until(object.Fetched.Add(object.Ttl))
+			objects = append(objects, object)
+		}
+	}
+	slices.SortStableFunc(objects, func(a, b CachedObject) int {
+		if a.URL != b.URL {
+			return strings.Compare(a.URL, b.URL)
+		}
+		if a.Host != b.Host {
+			return strings.Compare(a.Host, b.Host)
+		}
+		return a.Fetched.Compare(b.Fetched)
+	})
+	return objects, nil
+}
+
+// cachedObject returns the object inserted into the cache by the given backend transaction printed by varnishlog,
+// with its total TTL instead of the remaining one. It returns false if the fetch is incomplete or did not insert
+// a cacheable object.
+func cachedObject(transaction string) (CachedObject, bool) {
+	var object CachedObject
+	var ttl []string
+	var vclReturn string
+	complete := false
+	// the End record has no value, which logRecords skips
+	for _, line := range strings.Split(transaction, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "-" && fields[1] == "End" {
+			complete = true
+		}
+	}
+	for _, record := range logRecords(transaction) {
+		switch record.tag {
+		case "BereqURL":
+			object.URL = record.value
+		case "BereqHeader", "BerespHeader":
+			name, value, _ := strings.Cut(record.value, ":")
+			value = strings.TrimSpace(value)
+			switch {
+			case record.tag == "BereqHeader" && strings.EqualFold(name, "Host"):
+				object.Host = value
+			case record.tag == "BerespHeader" && strings.EqualFold(name, "Vary"):
+				object.Vary = value
+			}
+		case "TTL":
+			// e.g. "RFC 120 10 0 1700000000 1700000000 1700000000 0 120 cacheable" or "VCL 120 10 0 1700000000 cacheable",
+			// where the last record is the one in effect
+			ttl = strings.Fields(record.value)
+		case "VCL_return":
+			vclReturn = record.value
+		}
+	}
+	// hit-for-pass and hit-for-miss objects are logged as HFP and HFM
+	if !complete || vclReturn != "deliver" || len(ttl) < 6 || ttl[0] != "RFC" && ttl[0] != "VCL" || ttl[len(ttl)-1] != "cacheable" {
+		return CachedObject{}, false
+	}
+	values := make([]float64, 4)
+	for i := range values {
+		value, err := strconv.ParseFloat(ttl[i+1], 64)
+		if err != nil {
+			return CachedObject{}, false
+		}
+		values[i] = value
+	}
+	object.Ttl = time.Duration(values[0] * float64(time.Second))
+	object.Grace = time.Duration(values[1] * float64(time.Second))
+	object.Keep = time.Duration(values[2] * float64(time.Second))
+	object.Fetched = time.Unix(0, int64(values[3]*float64(time.Second)))
+	return object, true
+}
+
+// ObjectURLs returns the URLs of the given objects, e.g. to assert which objects are cached.
+func ObjectURLs(objects []CachedObject) []string {
+	urls := make([]string, len(objects))
+	for i, object := range objects {
+		urls[i] = object.URL
+	}
+	return urls
+}
@@ -0,0 +1,59 @@
+// Contains tests for listing the objects in the cache of a Varnish instance
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestListObjects tests that exactly the cacheable objects are listed with their remaining TTL,
+// and that expired objects are no longer listed.
+func TestListObjects(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300), SWR: caching.Seconds(10)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests for two cacheable objects, an uncacheable one and a short-lived one
+	for _, path := range []string{"/b", "/a"} {
+		assert.Equal(t, http.StatusOK, mkReq(t, instance.Port, "1", withPath(path), withXCacheControl(cacheControl)).statusCode)
+	}
+	assert.Equal(t, http.StatusOK, mkReq(t, instance.Port, "2", withPath("/uncacheable"),
+		withXCacheControl(caching.CacheControl{NoStore: true})).statusCode)
+	assert.Equal(t, http.StatusOK, mkReq(t, instance.Port, "3", withPath("/short"),
+		withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).statusCode)
+
+	// expect the cacheable objects and the short-lived one to be listed
+	objects, err := instance.ListObjects()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b", "/short"}, caching.ObjectURLs(objects))
+	if assert.Len(t, objects, 3) {
+		assert.Equal(t, "localhost:"+instance.Port, objects[0].Host)
+		assert.InDelta(t, 300, objects[0].Ttl.Seconds(), 2)
+		assert.Equal(t, 10*time.Second, objects[0].Grace)
+	}
+
+	// expect the short-lived object to be gone once it expired
+	require.Eventually(t, func() bool {
+		objects, err := instance.ListObjects()
+		return err == nil && assert.ObjectsAreEqual([]string{"/a", "/b"}, caching.ObjectURLs(objects))
+	}, eventuallyTimeout, eventuallyTick, "short-lived object still listed")
+
+	// expect 4 backend requests
+	assert.Equal(t, 4, backendRequests)
+}
@@ -0,0 +1,149 @@
+package caching
+
+import (
+	"context"
+	"time"
+)
+
+// Option configures Varnish started by Start. Options are applied in order, so later options override earlier ones.
+// Unlike the fields of VarnishConfig, they keep working when further settings are added.
+type Option func(config *VarnishConfig)
+
+// NewVarnishConfig returns the config resulting from applying the given options to an empty config.
+func NewVarnishConfig(options ...Option) VarnishConfig {
+	var config VarnishConfig
+	for _, option := range options {
+		option(&config)
+	}
+	return config
+}
+
+// Start starts Varnish configured by the given options like StartVarnishInstanceInDocker.
+func Start(options ...Option) (*VarnishInstance, error) {
+	return StartVarnishInstanceInDocker(NewVarnishConfig(options...))
+}
+
+// StartContext starts Varnish configured by the given options like StartVarnishInstanceInDockerContext.
+func StartContext(ctx context.Context, options ...Option) (*VarnishInstance, error) {
+	return StartVarnishInstanceInDockerContext(ctx, NewVarnishConfig(options...))
+}
+
+// WithBackend sets the port of the backend on the host, e.g. the one of a test server.
+func WithBackend(port string) Option {
+	return func(config *VarnishConfig) {
+		config.BackendPort = port
+	}
+}
+
+// WithBackendHost sets the host name or IP address and the port of the backend (see VarnishConfig.BackendHost).
+func WithBackendHost(host string, port string) Option {
+	return func(config *VarnishConfig) {
+		config.BackendHost = host
+		config.BackendPort = port
+	}
+}
+
+// WithBackendSocket sets the Unix domain socket of the backend (see VarnishConfig.BackendSocket).
+func WithBackendSocket(socket string) Option {
+	return func(config *VarnishConfig) {
+		config.BackendSocket = socket
+	}
+}
+
+// WithTTL sets the default TTL for responses without explicit expiration.
+func WithTTL(ttl time.Duration) Option {
+	return func(config *VarnishConfig) {
+		config.DefaultTtl = ttl
+	}
+}
+
+// WithGrace sets the default grace period.
+func WithGrace(grace time.Duration) Option {
+	return func(config *VarnishConfig) {
+		config.DefaultGrace = grace
+	}
+}
+
+// WithKeep sets the default keep period.
+func WithKeep(keep time.Duration) Option {
+	return func(config *VarnishConfig) {
+		config.DefaultKeep = keep
+	}
+}
+
+// WithVCLSnippet appends the given VCL to the custom VCL. Snippets defining the same subroutine are concatenated
+// by Varnish, so they run in the order of the options.
+func WithVCLSnippet(vcl string) Option {
+	return func(config *VarnishConfig) {
+		config.Vcl += vcl
+	}
+}
+
+// WithParam sets a parameter of varnishd, e.g. WithParam("rush_exponent", "2").
+func WithParam(name string, value string) Option {
+	return func(config *VarnishConfig) {
+		if config.Params == nil {
+			config.Params = map[string]string{}
+		}
+		config.Params[name] = value
+	}
+}
+
+// WithFeatures raises or lowers the given feature flags of varnishd, e.g. WithFeatures("+esi_include_onerror")
+// (see VarnishConfig.Features).
+func WithFeatures(features ...string) Option {
+	return func(config *VarnishConfig) {
+		config.Features = append(config.Features, features...)
+	}
+}
+
+// WithStorageSize sets the size of the cache storage, e.g. "16M".
+func WithStorageSize(size string) Option {
+	return func(config *VarnishConfig) {
+		config.StorageSize = size
+	}
+}
+
+// WithFileStorage stores cacheable objects in a file using the given stevedore (see VarnishConfig.FileStorage).
+func WithFileStorage(stevedore string) Option {
+	return func(config *VarnishConfig) {
+		config.FileStorage = stevedore
+	}
+}
+
+// WithMemoryLimit limits the memory of the container in bytes (see VarnishConfig.MemoryLimit).
+func WithMemoryLimit(bytes int64) Option {
+	return func(config *VarnishConfig) {
+		config.MemoryLimit = bytes
+	}
+}
+
+// WithCPUs limits the CPU time of the container to the given number of CPUs (see VarnishConfig.CPUs).
+func WithCPUs(cpus float64) Option {
+	return func(config *VarnishConfig) {
+		config.CPUs = cpus
+	}
+}
+
+// WithNetwork attaches Varnish to the given network, where the backend is reachable by the given alias and port.
+func WithNetwork(network *Network, backendAlias string, backendPort string) Option {
+	return func(config *VarnishConfig) {
+		config.Network = network
+		config.BackendHost = backendAlias
+		config.BackendPort = backendPort
+	}
+}
+
+// WithImage runs the given Varnish image, pulled with the given credentials unless nil (see VarnishConfig.Image).
+func WithImage(image string, auth *RegistryAuth) Option {
+	return func(config *VarnishConfig) {
+		config.Image = image
+		config.RegistryAuth = auth
+	}
+}
+
+// WithConfig changes any field of the config by the given function, for settings without an option of their own,
+// e.g. WithConfig(func(c *VarnishConfig) { c.EnableXCacheHeader = true }).
+func WithConfig(configure func(config *VarnishConfig)) Option {
+	return Option(configure)
+}
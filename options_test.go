@@ -0,0 +1,66 @@
+// Contains tests for starting Varnish with functional options
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestNewVarnishConfig tests that options are applied in order, with snippets concatenated and params merged.
+func TestNewVarnishConfig(t *testing.T) {
+	t.Parallel()
+	config := caching.NewVarnishConfig(
+		caching.WithBackend("8080"),
+		caching.WithTTL(time.Second),
+		caching.WithTTL(10*time.Second),
+		caching.WithGrace(5*time.Second),
+		caching.WithVCLSnippet("sub vcl_recv {}\n"),
+		caching.WithVCLSnippet("sub vcl_deliver {}\n"),
+		caching.WithParam("rush_exponent", "2"),
+		caching.WithParam("thread_pools", "1"),
+		caching.WithConfig(func(c *caching.VarnishConfig) { c.EnableXCacheHeader = true }),
+	)
+	assert.Equal(t, caching.VarnishConfig{
+		BackendPort:        "8080",
+		DefaultTtl:         10 * time.Second,
+		DefaultGrace:       5 * time.Second,
+		Vcl:                "sub vcl_recv {}\nsub vcl_deliver {}\n",
+		Params:             map[string]string{"rush_exponent": "2", "thread_pools": "1"},
+		EnableXCacheHeader: true,
+	}, config)
+}
+
+// TestStartWithOptions tests that Varnish started by options caches responses with the default TTL
+// and runs the VCL snippets.
+func TestStartWithOptions(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container by options
+	instance, err := caching.Start(
+		caching.WithBackend(testServerPort),
+		caching.WithTTL(10*time.Second),
+		caching.WithVCLSnippet(`
+sub vcl_deliver {
+  set resp.http.X-Vcl = "snippet";
+}`),
+	)
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests without Cache-Control, the second of which is a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withHeader("X-Vcl", "snippet")), mkReq(t, instance.Port, "1", withCaptureHeaders("X-Vcl")))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withHeader("X-Vcl", "snippet")), mkReq(t, instance.Port, "2", withCaptureHeaders("X-Vcl")))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
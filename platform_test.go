@@ -0,0 +1,51 @@
+// Contains tests for selecting the platform of the Varnish image
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+// TestNativePlatform tests that Varnish starts with the image pulled for the native platform given as Platform.
+// This assumes that Docker runs on the same architecture as the tests, like Docker Desktop does.
+func TestNativePlatform(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container for the native platform
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Platform:    "linux/" + runtime.GOARCH,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests, the second of which is a hit
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "1", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "2", withXCacheControl(cacheControl)))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestInvalidPlatform tests that a Platform without an architecture is rejected before starting a container.
+func TestInvalidPlatform(t *testing.T) {
+	t.Parallel()
+	_, _, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: "8080",
+		Platform:    "arm64",
+	})
+	assert.ErrorContains(t, err, `invalid platform "arm64"`)
+}
@@ -0,0 +1,189 @@
+package caching
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PoisoningVector is a request carrying an input which is typically not part of the cache key but may be reflected
+// by the backend, such that an attacker could store a response containing a value of their choice in the cache.
+// Request is the raw request line and header fields, each terminated by CRLF, in which "{target}" is replaced by
+// the request target, "{host}" by the Host header of regular requests and "{canary}" by a unique random value.
+type PoisoningVector struct {
+	Name    string
+	Request string
+}
+
+// PoisoningVectors are the unkeyed headers and odd Host values which CheckPoisoning sends by default.
+var PoisoningVectors = []PoisoningVector{
+	{"X-Forwarded-Host", "GET {target} HTTP/1.1\r\nHost: {host}\r\nX-Forwarded-Host: {canary}.example\r\n"},
+	{"X-Host", "GET {target} HTTP/1.1\r\nHost: {host}\r\nX-Host: {canary}.example\r\n"},
+	{"X-Forwarded-Server", "GET {target} HTTP/1.1\r\nHost: {host}\r\nX-Forwarded-Server: {canary}.example\r\n"},
+	{"Forwarded", "GET {target} HTTP/1.1\r\nHost: {host}\r\nForwarded: host={canary}.example\r\n"},
+	{"X-Forwarded-Prefix", "GET {target} HTTP/1.1\r\nHost: {host}\r\nX-Forwarded-Prefix: /{canary}\r\n"},
+	{"X-Original-URL", "GET {target} HTTP/1.1\r\nHost: {host}\r\nX-Original-URL: /{canary}\r\n"},
+	{"X-Rewrite-URL", "GET {target} HTTP/1.1\r\nHost: {host}\r\nX-Rewrite-URL: /{canary}\r\n"},
+	{"duplicate Host", "GET {target} HTTP/1.1\r\nHost: {host}\r\nHost: {canary}.example\r\n"},
+	{"absolute URI", "GET http://{canary}.example{target} HTTP/1.1\r\nHost: {host}\r\n"},
+	{"absolute URI with other Host", "GET http://{host}{target} HTTP/1.1\r\nHost: {canary}.example\r\n"},
+}
+
+// PoisoningResult is the outcome of sending a PoisoningVector: whether the response to the attacker contained
+// the canary, and whether the response to a subsequent regular request for the same URL contained it, i.e.
+// whether the cache served the reflected value to other users.
+type PoisoningResult struct {
+	Vector    string
+	Status    int
+	Reflected bool
+	Poisoned  bool
+}
+
+// CheckPoisoning sends each of the given vectors, or PoisoningVectors if none are given, to localhost at the given
+// port for the given path, followed by a regular request for the same URL, and reports for each vector whether
+// the canary ended up in the response to the regular request. Each vector uses its own query parameter to
+// request an uncached URL, such that the vectors do not influence each other.
+func CheckPoisoning(port string, path string, vectors ...PoisoningVector) ([]PoisoningResult, error) {
+	if len(vectors) == 0 {
+		vectors = PoisoningVectors
+	}
+	host := "localhost:" + port
+	client := http.Client{Timeout: 10 * time.Second}
+	results := make([]PoisoningResult, 0, len(vectors))
+	for _, vector := range vectors {
+		random := make([]byte, 6)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+		canary := "poison" + hex.EncodeToString(random)
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		target := path + separator + "poisoning=" + canary
+		request := strings.NewReplacer("{target}", target, "{host}", host, "{canary}", canary).Replace(vector.Request)
+
+		status, reflected, err := sendPoisoningRequest(host, request+"Connection: close\r\n\r\n", canary)
+		if err != nil {
+			return nil, fmt.Errorf("vector %s: %w", vector.Name, err)
+		}
+		response, err := client.Get("http://" + host + target)
+		if err != nil {
+			return nil, fmt.Errorf("vector %s: %w", vector.Name, err)
+		}
+		poisoned, err := containsCanary(response, canary)
+		if err != nil {
+			return nil, fmt.Errorf("vector %s: %w", vector.Name, err)
+		}
+		results = append(results, PoisoningResult{vector.Name, status, reflected, poisoned})
+	}
+	return results, nil
+}
+
+// Poisoned returns the names of the vectors of the given results which poisoned the cache.
+func Poisoned(results []PoisoningResult) []string {
+	var names []string
+	for _, result := range results {
+		if result.Poisoned {
+			names = append(names, result.Vector)
+		}
+	}
+	return names
+}
+
+// sendPoisoningRequest writes the given raw request to a new connection and returns the status of the response
+// and whether it contains the given canary. A connection closed without a response counts as status 0.
+func sendPoisoningRequest(host string, request string, canary string) (int, bool, error) {
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(conn, request)
+	if err != nil {
+		return 0, false, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	reflected, err := containsCanary(response, canary)
+	return response.StatusCode, reflected, err
+}
+
+// containsCanary reads and closes the body of the given response and returns whether its header fields or its
+// body contain the given canary, ignoring case, as hosts may be lowercased on the way.
+func containsCanary(response *http.Response, canary string) (bool, error) {
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(strings.ToLower(string(body)), canary) {
+		return true, nil
+	}
+	for _, values := range response.Header {
+		for _, value := range values {
+			if strings.Contains(strings.ToLower(value), canary) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// UnkeyedInputHandler returns a deliberately vulnerable backend handler for CheckPoisoning, which responds with
+// a cacheable page linking to its canonical URL. Like many frameworks behind proxies, it builds that URL from
+// X-Forwarded-Host, X-Host, X-Forwarded-Server or the host of Forwarded instead of Host, prepends
+// X-Forwarded-Prefix to the path and takes the path from X-Original-URL or X-Rewrite-URL, if present.
+func UnkeyedInputHandler(maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		for _, value := range []string{
+			r.Header.Get("X-Forwarded-Host"),
+			r.Header.Get("X-Host"),
+			r.Header.Get("X-Forwarded-Server"),
+			forwardedHost(r.Header.Get("Forwarded")),
+		} {
+			if value != "" {
+				host = value
+				break
+			}
+		}
+		path := r.URL.Path
+		for _, value := range []string{r.Header.Get("X-Original-URL"), r.Header.Get("X-Rewrite-URL")} {
+			if value != "" {
+				path = value
+				break
+			}
+		}
+		canonical := "http://" + host + r.Header.Get("X-Forwarded-Prefix") + path
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+		w.Header().Set("Link", "<"+canonical+">; rel=canonical")
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprintf(w, `<html><head><link rel="canonical" href="%s"></head></html>`, canonical)
+	}
+}
+
+// forwardedHost returns the host parameter of the first element of the given Forwarded header, if any.
+func forwardedHost(forwarded string) string {
+	first, _, _ := strings.Cut(forwarded, ",")
+	for _, pair := range strings.Split(first, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && strings.EqualFold(name, "host") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
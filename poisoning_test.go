@@ -0,0 +1,130 @@
+// Contains tests for web cache poisoning through unkeyed inputs
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// unkeyedHeaders are the headers of the PoisoningVectors which UnkeyedInputHandler reflects.
+var unkeyedHeaders = []string{
+	"X-Forwarded-Host", "X-Host", "X-Forwarded-Server", "Forwarded", "X-Forwarded-Prefix", "X-Original-URL",
+	"X-Rewrite-URL",
+}
+
+// TestPoisoningDefaultVcl tests that with the built-in VCL, each unkeyed header reflected by the backend poisons
+// the cache, while a duplicate Host is rejected and a different Host is part of the cache key.
+func TestPoisoningDefaultVcl(t *testing.T) {
+	t.Parallel()
+
+	// start a vulnerable test server
+	testServerPort, testServer := startTestServer(caching.UnkeyedInputHandler(time.Minute))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send the vectors and expect the reflected headers to poison the cache
+	results, err := caching.CheckPoisoning(port, "/page")
+	require.NoError(t, err)
+	t.Logf("poisoning results: %+v", results)
+	poisoned := caching.Poisoned(results)
+	assert.Subset(t, poisoned, unkeyedHeaders)
+	assert.NotContains(t, poisoned, "duplicate Host")
+	assert.NotContains(t, poisoned, "absolute URI with other Host")
+}
+
+// TestPoisoningHashOnHeaders tests that adding the unkeyed headers to the cache key prevents the poisoning, although
+// the backend still reflects them to the attacker.
+func TestPoisoningHashOnHeaders(t *testing.T) {
+	t.Parallel()
+
+	// start a vulnerable test server
+	testServerPort, testServer := startTestServer(caching.UnkeyedInputHandler(time.Minute))
+	defer testServer.Close()
+
+	// start varnish container, which hashes on the unkeyed headers
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		HashOn:      caching.HashOn{Headers: unkeyedHeaders},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send the vectors and expect them to be reflected, but not to poison the cache
+	results, err := caching.CheckPoisoning(port, "/page")
+	require.NoError(t, err)
+	t.Logf("poisoning results: %+v", results)
+	for _, result := range results {
+		if result.Vector == "X-Forwarded-Host" {
+			assert.True(t, result.Reflected)
+		}
+	}
+	assert.Empty(t, caching.Poisoned(results))
+}
+
+// TestPoisoningStrippedHeaders tests that removing the unkeyed headers in vcl_recv prevents the poisoning,
+// as the backend no longer sees them.
+func TestPoisoningStrippedHeaders(t *testing.T) {
+	t.Parallel()
+
+	// start a vulnerable test server
+	testServerPort, testServer := startTestServer(caching.UnkeyedInputHandler(time.Minute))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL removing the unkeyed headers
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Vcl: `
+sub vcl_recv {
+  unset req.http.X-Forwarded-Host;
+  unset req.http.X-Host;
+  unset req.http.X-Forwarded-Server;
+  unset req.http.Forwarded;
+  unset req.http.X-Forwarded-Prefix;
+  unset req.http.X-Original-URL;
+  unset req.http.X-Rewrite-URL;
+}`,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send the vectors and expect none to poison the cache
+	results, err := caching.CheckPoisoning(port, "/page", caching.PoisoningVectors[:len(unkeyedHeaders)]...)
+	require.NoError(t, err)
+	t.Logf("poisoning results: %+v", results)
+	for _, result := range results {
+		assert.False(t, result.Reflected, result.Vector)
+	}
+	assert.Empty(t, caching.Poisoned(results))
+}
+
+// TestPoisoningWithoutCache tests CheckPoisoning directly against the vulnerable backend, which reflects each
+// unkeyed header to the attacker, but cannot poison anything without a cache.
+func TestPoisoningWithoutCache(t *testing.T) {
+	t.Parallel()
+
+	// start a vulnerable test server
+	testServerPort, testServer := startTestServer(caching.UnkeyedInputHandler(time.Minute))
+	defer testServer.Close()
+
+	// send the vectors of the unkeyed headers
+	results, err := caching.CheckPoisoning(testServerPort, "/page?lang=en", caching.PoisoningVectors[:len(unkeyedHeaders)]...)
+	require.NoError(t, err)
+	require.Len(t, results, len(unkeyedHeaders))
+	for i, result := range results {
+		assert.Equal(t, unkeyedHeaders[i], result.Vector)
+		assert.Equal(t, http.StatusOK, result.Status, result.Vector)
+		assert.True(t, result.Reflected, result.Vector)
+		assert.False(t, result.Poisoned, result.Vector)
+	}
+}
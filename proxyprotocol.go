@@ -0,0 +1,39 @@
+package caching
+
+import (
+	"fmt"
+	"net"
+)
+
+// DialProxyProtocol opens a connection to localhost at the given port and sends a PROXY protocol (version 1)
+// header, which claims that the connection originates from the given client IP. The port must be the ProxyPort
+// of a VarnishInstance. The destination in the header is the actual destination of the connection.
+func DialProxyProtocol(port string, clientIP string) (net.Conn, error) {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client IP %q", clientIP)
+	}
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	family := "TCP4"
+	destination := remote.IP.String()
+	if ip.To4() == nil {
+		family = "TCP6"
+		if remote.IP.To4() != nil {
+			// both addresses must be of the same family
+			destination = "::ffff:" + destination
+		}
+	} else if remote.IP.To4() == nil {
+		destination = "127.0.0.1"
+	}
+	_, err = fmt.Fprintf(conn, "PROXY %s %s %s %d %d\r\n", family, ip, destination, local.Port, remote.Port)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,58 @@
+// Contains tests for the pull policy of the Varnish image
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestPullNeverPresentImage tests that with PullNever, Varnish starts from an image Docker already has.
+func TestPullNeverPresentImage(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container, which pulls the image if necessary
+	_, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		PullPolicy:  caching.PullIfNotPresent,
+	})
+	require.NoError(t, err)
+	stopFunc()
+
+	// start another varnish container without pulling
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		PullPolicy:  caching.PullNever,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+}
+
+// TestPullNeverMissingImage tests that with PullNever, starting Varnish fails if Docker does not have the image
+// for the requested platform, instead of pulling it.
+func TestPullNeverMissingImage(t *testing.T) {
+	t.Parallel()
+	_, _, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: "8080",
+		Platform:    "linux/s390x",
+		PullPolicy:  caching.PullNever,
+	})
+	assert.ErrorContains(t, err, `is not present and the pull policy is "never"`)
+}
+
+// TestInvalidPullPolicy tests that an unknown pull policy is rejected before starting a container.
+func TestInvalidPullPolicy(t *testing.T) {
+	t.Parallel()
+	_, _, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: "8080",
+		PullPolicy:  "sometimes",
+	})
+	assert.ErrorContains(t, err, `invalid pull policy "sometimes"`)
+}
@@ -0,0 +1,126 @@
+// Contains tests for purging and banning cached objects
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestPurgeWithoutAcl tests that without PurgeAllowed, the built-in VCL pipes PURGE requests to the backend,
+// which responds with 405, and the cached object is kept.
+func TestPurgeWithoutAcl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server which does not allow PURGE
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PURGE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "1", withXCacheControl(cacheControl)))
+
+	// send PURGE request, which reaches the backend
+	assert.Equal(t, mkResp(http.StatusMethodNotAllowed, ""), mkReq(t, port, "2", withMethod("PURGE")))
+
+	// expect the object to still be cached
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "3", withXCacheControl(cacheControl)))
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestPurgeAcl tests that PURGE requests are only accepted from allowed client IPs.
+func TestPurgeAcl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+		PurgeAllowed:        []string{"198.51.100.0/24"},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+
+	// send PURGE requests from a denied client directly and via the PROXY protocol
+	assert.Equal(t, mkResp(http.StatusForbidden, ""), mkReq(t, instance.Port, "2", withMethod("PURGE")))
+	assert.Equal(t, mkResp(http.StatusForbidden, ""),
+		mkReq(t, instance.ProxyPort, "3", withMethod("PURGE"), withProxyProtocol("203.0.113.9")))
+
+	// expect the object to still be cached
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "4", withXCacheControl(cacheControl)))
+
+	// send PURGE request from an allowed client
+	assert.Equal(t, mkResp(http.StatusOK, "", withAcceptRanges("")),
+		mkReq(t, instance.ProxyPort, "5", withMethod("PURGE"), withProxyProtocol("198.51.100.7")))
+
+	// expect the object to be fetched again
+	assert.Equal(t, mkResp(http.StatusOK, "6", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "6", withXCacheControl(cacheControl)))
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestBanAcl tests that BAN requests from allowed client IPs invalidate all objects whose URL matches.
+func TestBanAcl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		EnableProxyProtocol: true,
+		PurgeAllowed:        []string{"198.51.100.0/24"},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests to three paths
+	for _, path := range []string{"/products/1", "/products/2", "/about"} {
+		assert.Equal(t, mkResp(http.StatusOK, path, withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, path, withPath(path), withXCacheControl(cacheControl)))
+	}
+
+	// send BAN request from a denied client
+	assert.Equal(t, mkResp(http.StatusForbidden, ""),
+		mkReq(t, instance.ProxyPort, "ban", withPath("/products/"), withMethod("BAN"), withProxyProtocol("203.0.113.9")))
+
+	// send BAN request from an allowed client
+	assert.Equal(t, mkResp(http.StatusOK, "", withAcceptRanges("")),
+		mkReq(t, instance.ProxyPort, "ban", withPath("/products/"), withMethod("BAN"), withProxyProtocol("198.51.100.7")))
+
+	// expect the banned objects to be fetched again, but not the other one
+	assert.Equal(t, mkResp(http.StatusOK, "new", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "new", withPath("/products/1"), withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "new", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "new", withPath("/products/2"), withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "/about", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "new", withPath("/about"), withXCacheControl(cacheControl)))
+	assert.Equal(t, 5, backendRequests)
+}
@@ -0,0 +1,88 @@
+// Contains tests for caching responses to requests with the QUERY method
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestCacheQueryMethod tests that with CacheQueryMethod, responses to QUERY requests are cached per request body
+// and Content-Type, and that misses are fetched with the QUERY method and the request body.
+func TestCacheQueryMethod(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var recorder caching.RequestRecorder
+	var uploads caching.UploadRecorder
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+	query := `{"select": "name", "where": {"id": 1}}`
+
+	// start a test server
+	testServerPort, testServer := startTestServer(recorder.Wrap(uploads.Wrap(echoCacheControlHandler(&backendRequests))))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		CacheQueryMethod: "64KB",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a miss and a hit
+	assert.Equal(t, "1", mkReq(t, port, "1", withMethod("QUERY"), withRequestBody(query),
+		withRequestHeader("Content-Type", "application/json"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "2", withMethod("QUERY"), withRequestBody(query),
+		withRequestHeader("Content-Type", "application/json"), withXCacheControl(cacheControl)).xResponse)
+
+	// send requests with another body and another Content-Type, which are misses
+	assert.Equal(t, "3", mkReq(t, port, "3", withMethod("QUERY"), withRequestBody(strings.Replace(query, "1", "2", 1)),
+		withRequestHeader("Content-Type", "application/json"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "4", mkReq(t, port, "4", withMethod("QUERY"), withRequestBody(query),
+		withRequestHeader("Content-Type", "application/x-query"), withXCacheControl(cacheControl)).xResponse)
+
+	// send a GET request, which does not share an object with the QUERY requests
+	assert.Equal(t, "5", mkReq(t, port, "5", withXCacheControl(cacheControl)).xResponse)
+
+	// expect 4 backend requests, of which the QUERY requests carried their bodies
+	assert.Equal(t, 4, backendRequests)
+	var methods []string
+	for _, request := range recorder.Requests() {
+		methods = append(methods, request.Method)
+	}
+	assert.Equal(t, []string{"QUERY", "QUERY", "QUERY", http.MethodGet}, methods)
+	require.Len(t, uploads.Uploads(), 4)
+	assert.Equal(t, caching.ContentDigest([]byte(query)), uploads.Uploads()[0].ContentDigest)
+	assert.Equal(t, int64(0), uploads.Uploads()[3].Size)
+}
+
+// TestCacheQueryMethodBodyLimit tests that with CacheQueryMethod, QUERY requests with larger bodies
+// are responded to with 413 without reaching the backend.
+func TestCacheQueryMethodBodyLimit(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		CacheQueryMethod: "1KB",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a QUERY request with a body of 2KB
+	assert.Equal(t, http.StatusRequestEntityTooLarge,
+		mkReq(t, port, "1", withMethod("QUERY"), withRequestBody(string(caching.CompressibleBody(2048)))).statusCode)
+
+	// expect no backend request
+	assert.Equal(t, 0, backendRequests)
+}
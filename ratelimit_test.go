@@ -0,0 +1,91 @@
+// Contains tests for rate limiting with vsthrottle
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestRateLimitCountingHits tests that with CountHits, all requests of a client count against its limit,
+// and that exceeding requests are responded to with 429 and Retry-After.
+func TestRateLimitCountingHits(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container, which identifies clients by a request header to not count the health checks
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		RateLimit: &caching.RateLimit{
+			Limit:     2,
+			Period:    10 * time.Second,
+			Key:       "req.http.X-Client",
+			CountHits: true,
+		},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a miss and a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "1", withXCacheControl(cacheControl), withRequestHeader("X-Client", "a")))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "2", withXCacheControl(cacheControl), withRequestHeader("X-Client", "a")))
+
+	// send another request, which exceeds the limit
+	assert.Equal(t, mkResp(http.StatusTooManyRequests, "", withHeader("Retry-After", "10")),
+		mkReq(t, port, "3", withXCacheControl(cacheControl), withRequestHeader("X-Client", "a"), withCaptureHeaders("Retry-After")))
+
+	// send a request of another client
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "4", withXCacheControl(cacheControl), withRequestHeader("X-Client", "b")))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestRateLimitNotCountingHits tests that without CountHits, only requests reaching the backend
+// count against the limit of a client.
+func TestRateLimitNotCountingHits(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		RateLimit: &caching.RateLimit{
+			Limit:  2,
+			Period: 10 * time.Second,
+			Key:    "req.http.X-Client",
+		},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a miss and several hits
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "1", withXCacheControl(cacheControl), withRequestHeader("X-Client", "a")))
+	for _, xRequest := range []string{"2", "3", "4", "5"} {
+		assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, xRequest, withXCacheControl(cacheControl), withRequestHeader("X-Client", "a")))
+	}
+
+	// send two more misses, of which the second exceeds the limit
+	assert.Equal(t, mkResp(http.StatusOK, "6", withResponseCacheControl(cacheControl)),
+		mkReq(t, port, "6", withPath("/other"), withXCacheControl(cacheControl), withRequestHeader("X-Client", "a")))
+	assert.Equal(t, mkResp(http.StatusTooManyRequests, "", withHeader("Retry-After", "10")),
+		mkReq(t, port, "7", withPath("/another"), withXCacheControl(cacheControl), withRequestHeader("X-Client", "a"), withCaptureHeaders("Retry-After")))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
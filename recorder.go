@@ -0,0 +1,57 @@
+package caching
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RecordedRequest is a request received by a backend handler wrapped by RequestRecorder.
+type RecordedRequest struct {
+	Method     string
+	URL        string
+	Header     http.Header
+	RemoteAddr string
+}
+
+// RequestRecorder records the requests received by the backend, such that tests can assert
+// what Varnish sends to the backend. It is safe for concurrent use.
+type RequestRecorder struct {
+	mutex    sync.Mutex
+	requests []RecordedRequest
+}
+
+// Wrap returns a backend handler which records each request before passing it on to next.
+func (rr *RequestRecorder) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rr.mutex.Lock()
+		rr.requests = append(rr.requests, RecordedRequest{
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			Header:     r.Header.Clone(),
+			RemoteAddr: r.RemoteAddr,
+		})
+		rr.mutex.Unlock()
+		next(w, r)
+	}
+}
+
+// Requests returns the requests recorded so far in the order they were received.
+func (rr *RequestRecorder) Requests() []RecordedRequest {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	requests := make([]RecordedRequest, len(rr.requests))
+	copy(requests, rr.requests)
+	return requests
+}
+
+// Headers returns the values of the given header of all requests recorded so far,
+// with all values of a request joined by ", " and an empty string for requests without the header.
+func (rr *RequestRecorder) Headers(name string) []string {
+	requests := rr.Requests()
+	values := make([]string, len(requests))
+	for i, request := range requests {
+		values[i] = strings.Join(request.Header.Values(name), ", ")
+	}
+	return values
+}
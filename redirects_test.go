@@ -0,0 +1,130 @@
+// Contains tests for caching redirects
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// redirectHandler returns a backend handler which echoes the X-Request header as X-Response and responds
+// with the status in the X-Status-Code header, a Location of /target and the Cache-Control requested
+// via the X-Cache-Control header.
+func redirectHandler(backendRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		if cacheControl := r.Header.Get("X-Cache-Control"); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		status, err := strconv.Atoi(r.Header.Get("X-Status-Code"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/target")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(status)
+	}
+}
+
+// TestRedirectDefaultTtl tests that Varnish applies the default TTL to permanent redirects (301 and 308),
+// but not to temporary redirects (302 and 307), which are only cached with explicit freshness.
+func TestRedirectDefaultTtl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(redirectHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		DefaultTtl:  300 * time.Second,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusPermanentRedirect} {
+		path := "/" + strconv.Itoa(status)
+
+		// send two requests, of which the second is a hit
+		assert.Equal(t, mkResp(status, "1", withLocation("/target")), mkReq(t, port, "1", withPath(path), withXStatusCode(status), withNoFollow()))
+		assert.Equal(t, mkResp(status, "1", withLocation("/target")), mkReq(t, port, "2", withPath(path), withXStatusCode(status), withNoFollow()))
+	}
+	for _, status := range []int{http.StatusFound, http.StatusTemporaryRedirect} {
+		path := "/" + strconv.Itoa(status)
+
+		// send two requests, which both reach the backend
+		assert.Equal(t, mkResp(status, "1", withLocation("/target")), mkReq(t, port, "1", withPath(path), withXStatusCode(status), withNoFollow()))
+		assert.Equal(t, mkResp(status, "2", withLocation("/target")), mkReq(t, port, "2", withPath(path), withXStatusCode(status), withNoFollow()))
+	}
+
+	// expect 6 backend requests
+	assert.Equal(t, 6, backendRequests)
+}
+
+// TestRedirectMaxAge tests that all redirects are cached with explicit freshness.
+func TestRedirectMaxAge(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(redirectHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		path := "/" + strconv.Itoa(status)
+
+		// send two requests, of which the second is a hit
+		assert.Equal(t, mkResp(status, "1", withLocation("/target"), withResponseCacheControl(cacheControl)),
+			mkReq(t, port, "1", withPath(path), withXStatusCode(status), withXCacheControl(cacheControl), withNoFollow()))
+		assert.Equal(t, mkResp(status, "1", withLocation("/target"), withResponseCacheControl(cacheControl)),
+			mkReq(t, port, "2", withPath(path), withXStatusCode(status), withXCacheControl(cacheControl), withNoFollow()))
+	}
+
+	// expect 4 backend requests
+	assert.Equal(t, 4, backendRequests)
+}
+
+// TestRedirectFollowed tests that the client follows redirects unless withNoFollow is given,
+// such that the response of the redirect target is returned.
+func TestRedirectFollowed(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/redirect": redirectHandler(&backendRequests),
+		"/target":   echoCacheControlHandler(&backendRequests),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request, which follows the redirect
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, port, "1", withPath("/redirect"), withXStatusCode(http.StatusFound)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
@@ -0,0 +1,147 @@
+package caching
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// RegistryAuth are the credentials for pulling an image from a private registry.
+type RegistryAuth struct {
+	Username string
+	Password string
+	// IdentityToken is used instead of Username and Password if set, e.g. a refresh token of the registry.
+	IdentityToken string
+}
+
+// encode returns the credentials for the registry of the given image as expected by the Docker API,
+// which is empty without credentials.
+func (a *RegistryAuth) encode(image string) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	serverAddress, err := registryServerAddress(image)
+	if err != nil {
+		return "", err
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+		ServerAddress: serverAddress,
+	})
+}
+
+// dockerHubServerAddress is the key of the credentials for Docker Hub in the config of the Docker CLI.
+const dockerHubServerAddress = "https://index.docker.io/v1/"
+
+// registryServerAddress returns the address of the registry of the given image, as used by docker login.
+func registryServerAddress(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	domain := reference.Domain(named)
+	if domain == "docker.io" {
+		return dockerHubServerAddress, nil
+	}
+	return domain, nil
+}
+
+// dockerConfig is the part of the config.json of the Docker CLI containing the credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DockerConfigRegistryAuth returns the credentials for the registry of the given image which docker login stored
+// in the config of the Docker CLI ($DOCKER_CONFIG/config.json or ~/.docker/config.json), either in the file itself
+// or in the credential store of a credential helper, e.g. docker-credential-osxkeychain, which must be on the PATH.
+// It returns nil if there are no credentials for the registry.
+func DockerConfigRegistryAuth(image string) (*RegistryAuth, error) {
+	serverAddress, err := registryServerAddress(image)
+	if err != nil {
+		return nil, err
+	}
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+	content, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config dockerConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Docker config: %w", err)
+	}
+	if helper := withDefault(config.CredHelpers[serverAddress], config.CredsStore); helper != "" {
+		return credentialHelperAuth(helper, serverAddress)
+	}
+	auth, ok := config.Auths[serverAddress]
+	if !ok {
+		return nil, nil
+	}
+	if auth.IdentityToken != "" {
+		return &RegistryAuth{IdentityToken: auth.IdentityToken}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials for %s in Docker config: %w", serverAddress, err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials for %s in Docker config", serverAddress)
+	}
+	return &RegistryAuth{Username: username, Password: password}, nil
+}
+
+// credentialHelperAuth gets the credentials for the given registry from the given credential helper.
+func credentialHelperAuth(helper string, serverAddress string) (*RegistryAuth, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		// the helpers report missing credentials on stdout
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %w: %s%s", helper, err, stderr.String(), stdout.String())
+	}
+	var credentials struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &credentials)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output of credential helper %s: %w", helper, err)
+	}
+	// a username of <token> marks an identity token
+	if credentials.Username == "<token>" {
+		return &RegistryAuth{IdentityToken: credentials.Secret}, nil
+	}
+	return &RegistryAuth{Username: credentials.Username, Password: credentials.Secret}, nil
+}
@@ -0,0 +1,66 @@
+// Contains tests for the credentials of private registries
+package caching_test
+
+import (
+	"caching"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDockerConfig writes the given config.json of the Docker CLI to a temporary directory,
+// which it sets as DOCKER_CONFIG for the test.
+func writeDockerConfig(t *testing.T, config string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+// TestDockerConfigRegistryAuth tests that DockerConfigRegistryAuth finds the credentials stored by docker login
+// in the config file by the registry of the image, with Docker Hub for images without a registry.
+func TestDockerConfigRegistryAuth(t *testing.T) {
+	writeDockerConfig(t, `{
+  "auths": {
+    "registry.example.com": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("user:s3cr:t"))+`"},
+    "https://index.docker.io/v1/": {"identitytoken": "token"}
+  }
+}`)
+
+	auth, err := caching.DockerConfigRegistryAuth("registry.example.com/team/varnish:7.5")
+	require.NoError(t, err)
+	assert.Equal(t, &caching.RegistryAuth{Username: "user", Password: "s3cr:t"}, auth)
+
+	auth, err = caching.DockerConfigRegistryAuth("varnish:7.5.0-alpine")
+	require.NoError(t, err)
+	assert.Equal(t, &caching.RegistryAuth{IdentityToken: "token"}, auth)
+
+	auth, err = caching.DockerConfigRegistryAuth("ghcr.io/team/varnish:7.5")
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+}
+
+// TestDockerConfigRegistryAuthCredentialHelper tests that DockerConfigRegistryAuth gets the credentials from
+// the credential helper configured for the registry.
+func TestDockerConfigRegistryAuthCredentialHelper(t *testing.T) {
+	writeDockerConfig(t, `{"credHelpers": {"registry.example.com": "fake"}}`)
+
+	// put a fake credential helper on the PATH, which only knows registry.example.com
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-fake"), []byte(`#!/bin/sh
+read server
+if [ "$1" = get ] && [ "$server" = registry.example.com ]; then
+  echo '{"ServerURL": "registry.example.com", "Username": "helper", "Secret": "s3cret"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	auth, err := caching.DockerConfigRegistryAuth("registry.example.com/team/varnish:7.5")
+	require.NoError(t, err)
+	assert.Equal(t, &caching.RegistryAuth{Username: "helper", Password: "s3cret"}, auth)
+}
@@ -0,0 +1,79 @@
+package caching
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReloadVCL replaces the custom VCL (see VarnishConfig.Vcl) of the instance without restarting it, like
+// varnishreload does: the VCL is rendered with the config of the instance, written into the container,
+// compiled with vcl.load and activated with vcl.use. Cached objects are kept, since they do not belong to a VCL.
+// The previous VCL stays loaded and cools down once vcl_cooldown has passed (see LoadedVcls).
+// If the VCL fails to compile, the previous VCL stays active and the error contains the output of the compiler.
+func (v *VarnishInstance) ReloadVCL(vcl string) error {
+	v.reloads++
+	config := v.config
+	config.Vcl = vcl
+	return v.useVcl("reload"+strconv.Itoa(v.reloads), renderVcl(config, v.instanceVcl()))
+}
+
+// useVcl writes the given VCL into the container, loads it with the given name and activates it.
+func (v *VarnishInstance) useVcl(name string, vcl string) error {
+	fileName := "/tmp/" + name + ".vcl"
+	_, err := execInContainerWithInput(v.containerID, vcl, "sh", "-c", `cat > "$0"`, fileName)
+	if err != nil {
+		return err
+	}
+	_, err = execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "vcl.load", name, fileName)
+	if err != nil {
+		return fmt.Errorf("could not load VCL %s: %w", name, err)
+	}
+	_, err = execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "vcl.use", name)
+	if err != nil {
+		return fmt.Errorf("could not use VCL %s: %w", name, err)
+	}
+	return nil
+}
+
+// LoadedVcl is a VCL loaded by Varnish as reported by VarnishInstance.LoadedVcls.
+type LoadedVcl struct {
+	// Name is the name of the VCL, which is "boot" for the VCL Varnish was started with,
+	// and "reload1", "reload2" and so on for the VCLs loaded by ReloadVCL, or "switch3" and so on for SwitchBackend.
+	Name string
+	// Active is true for the VCL handling new requests.
+	Active bool
+	// Temperature is "warm" for the active VCL and VCLs in use, "cooling" for VCLs which are no longer in use,
+	// but have not been cooled down yet, and "cold" for VCLs whose backends and VMODs have been released.
+	Temperature string
+	// Busy is the number of requests and backend fetches currently using the VCL.
+	Busy int
+}
+
+// LoadedVcls returns the VCLs loaded by Varnish, as listed by vcl.list, in the order they have been loaded.
+func (v *VarnishInstance) LoadedVcls() ([]LoadedVcl, error) {
+	output, err := execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "vcl.list")
+	if err != nil {
+		return nil, err
+	}
+	var vcls []LoadedVcl
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		// e.g. "active   auto/warm   0 boot", or with state and temperature separated by spaces
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '/'
+		})
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("unexpected line of vcl.list: %q", line)
+		}
+		// the number of busy requests may be omitted
+		name := fields[3]
+		busy, err := strconv.Atoi(name)
+		if err == nil && len(fields) > 4 {
+			name = fields[4]
+		} else {
+			busy = 0
+		}
+		vcls = append(vcls, LoadedVcl{Name: name, Active: fields[0] == "active", Temperature: fields[2], Busy: busy})
+	}
+	return vcls, nil
+}
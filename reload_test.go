@@ -0,0 +1,132 @@
+// Contains tests for reloading the VCL of a running Varnish instance
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestReloadVCLKeepsCachedObjects tests that cached objects survive a reload of the VCL,
+// and that they are delivered by the new VCL right away.
+func TestReloadVCLKeepsCachedObjects(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withHeader("X-Vcl", "")),
+		mkReq(t, instance.Port, "1", withXCacheControl(cacheControl), withCaptureHeaders("X-Vcl")))
+
+	// reload the VCL with a VCL marking delivered responses
+	require.NoError(t, instance.ReloadVCL(`
+sub vcl_deliver {
+  set resp.http.X-Vcl = "reloaded";
+}`))
+
+	// send request, which is a hit delivered by the new VCL
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl), withHeader("X-Vcl", "reloaded")),
+		mkReq(t, instance.Port, "2", withXCacheControl(cacheControl), withCaptureHeaders("X-Vcl")))
+
+	// expect the object to still be cached
+	eventuallyCached(t, instance, "/")
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestReloadVCLCompileError tests that reloading a VCL which fails to compile reports the compiler error,
+// and that the previous VCL stays active.
+func TestReloadVCLCompileError(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// reload the VCL with a VCL referring to an unknown subroutine
+	err = instance.ReloadVCL(`
+sub vcl_recv {
+  call unknown;
+}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown")
+
+	// expect the boot VCL to stay active
+	vcls, err := instance.LoadedVcls()
+	require.NoError(t, err)
+	require.Len(t, vcls, 1)
+	assert.Equal(t, caching.LoadedVcl{Name: "boot", Active: true, Temperature: "warm"}, vcls[0])
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestReloadVCLCooling tests that the previous VCL stays loaded after a reload, but is no longer active,
+// and that it becomes cold once vcl_cooldown has passed.
+func TestReloadVCLCooling(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container, which cools down unused VCLs after a second instead of ten minutes
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Params: map[string]string{
+			"vcl_cooldown": "1",
+		},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// reload the VCL
+	require.NoError(t, instance.ReloadVCL(""))
+
+	// expect the new VCL to be active and the boot VCL to be available
+	vcls, err := instance.LoadedVcls()
+	require.NoError(t, err)
+	require.Len(t, vcls, 2)
+	assert.Equal(t, "boot", vcls[0].Name)
+	assert.False(t, vcls[0].Active)
+	assert.Equal(t, caching.LoadedVcl{Name: "reload1", Active: true, Temperature: "warm"}, vcls[1])
+
+	// expect the boot VCL to become cold
+	require.Eventually(t, func() bool {
+		vcls, err := instance.LoadedVcls()
+		return err == nil && len(vcls) == 2 && vcls[0].Temperature == "cold"
+	}, eventuallyTimeout, eventuallyTick, "boot VCL not cold")
+}
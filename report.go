@@ -0,0 +1,74 @@
+package caching
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Outcome is the result of running a scenario against a cache engine.
+type Outcome string
+
+const (
+	Pass Outcome = "pass"
+	Fail Outcome = "fail"
+	Skip Outcome = "skip"
+)
+
+// Report collects the outcomes of scenarios run against several cache engines
+// and renders them as a side-by-side table. It is safe for concurrent use by parallel tests.
+type Report struct {
+	mu       sync.Mutex
+	outcomes map[string]map[string]Outcome
+}
+
+// Record records the outcome of the given scenario for the given engine.
+func (r *Report) Record(scenario string, engine string, outcome Outcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.outcomes == nil {
+		r.outcomes = map[string]map[string]Outcome{}
+	}
+	if r.outcomes[scenario] == nil {
+		r.outcomes[scenario] = map[string]Outcome{}
+	}
+	r.outcomes[scenario][engine] = outcome
+}
+
+// WriteMarkdown writes the report as a Markdown table with one row per scenario and one column
+// per engine. Both scenarios and engines are sorted by name, and missing outcomes are rendered as "-".
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var scenarios, engines []string
+	for scenario, outcomes := range r.outcomes {
+		scenarios = append(scenarios, scenario)
+		for engine := range outcomes {
+			if !slices.Contains(engines, engine) {
+				engines = append(engines, engine)
+			}
+		}
+	}
+	sort.Strings(scenarios)
+	sort.Strings(engines)
+
+	var sb strings.Builder
+	sb.WriteString("| Scenario | " + strings.Join(engines, " | ") + " |\n")
+	sb.WriteString("|---" + strings.Repeat("|---", len(engines)) + "|\n")
+	for _, scenario := range scenarios {
+		sb.WriteString("| " + scenario + " |")
+		for _, engine := range engines {
+			outcome, ok := r.outcomes[scenario][engine]
+			if !ok {
+				outcome = "-"
+			}
+			sb.WriteString(fmt.Sprintf(" %s |", outcome))
+		}
+		sb.WriteString("\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,98 @@
+package caching
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerStats is the resource usage of a Varnish container as reported by VarnishInstance.ContainerStats.
+type ContainerStats struct {
+	// MemoryUsage is the memory used by all processes of the container in bytes, without the page cache,
+	// like docker stats reports it. Besides the cache storage, it includes the transient storage,
+	// the workspaces and stacks of the worker threads and the shared memory log.
+	MemoryUsage uint64
+	// MemoryLimit is the memory limit of the container in bytes, which is the memory of the host
+	// (or the virtual machine running Docker) unless the container is limited.
+	MemoryLimit uint64
+	// CPUPercent is the CPU usage of the container during about the last second, in percent of a single CPU
+	// like docker stats reports it, e.g. 200 for two CPUs being busy.
+	CPUPercent float64
+	// CPUThrottled is how long the container has been throttled in total since it started,
+	// which only happens with VarnishConfig.CPUs.
+	CPUThrottled time.Duration
+}
+
+// ContainerStats returns the current resource usage of the Varnish container as reported by docker stats,
+// e.g. for storage-pressure tests asserting that the memory stays within the storage size plus some overhead
+// (see StorageBytes). It takes about a second, which Docker waits to measure the CPU usage.
+func (v *VarnishInstance) ContainerStats() (ContainerStats, error) {
+	// without streaming, Docker takes two samples to report the CPU usage in between
+	response, err := cli.ContainerStats(context.Background(), v.containerID, false)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	defer response.Body.Close()
+	var stats types.StatsJSON
+	err = json.NewDecoder(response.Body).Decode(&stats)
+	if err != nil {
+		return ContainerStats{}, fmt.Errorf("invalid stats of container %s: %w", v.containerID, err)
+	}
+	return ContainerStats{
+		MemoryUsage:  memoryUsage(stats.MemoryStats),
+		MemoryLimit:  stats.MemoryStats.Limit,
+		CPUPercent:   cpuPercent(stats.Stats),
+		CPUThrottled: time.Duration(stats.CPUStats.ThrottlingData.ThrottledTime),
+	}, nil
+}
+
+// memoryUsage returns the memory usage without the page cache, which the kernel reclaims under pressure,
+// like docker stats: the inactive files are subtracted, which are named differently by cgroup v1 and v2.
+func memoryUsage(stats types.MemoryStats) uint64 {
+	for _, name := range []string{"total_inactive_file", "inactive_file"} {
+		if inactive, ok := stats.Stats[name]; ok && inactive < stats.Usage {
+			return stats.Usage - inactive
+		}
+	}
+	return stats.Usage
+}
+
+// cpuPercent returns the CPU usage between the previous and the current sample like docker stats:
+// the CPU time of the container relative to the CPU time of the whole system, scaled by the number of CPUs.
+func cpuPercent(stats types.Stats) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	return cpuDelta / systemDelta * cpus * 100
+}
+
+// StorageBytes returns the number of bytes of a storage size like VarnishConfig.StorageSize, e.g. 16777216 for "16M".
+// Like varnishd, it takes the units k, m, g and t as powers of 1024, in upper or lower case and optionally followed
+// by b, and bytes without a unit. An empty size is the default of 1M.
+func StorageBytes(size string) (uint64, error) {
+	size = withDefault(size, "1M")
+	if !storageSizeRegexp.MatchString(size) {
+		return 0, fmt.Errorf("invalid storage size %q", size)
+	}
+	digits := strings.TrimRight(size, "kKmMgGtTbB")
+	bytes, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid storage size %q: %w", size, err)
+	}
+	// e.g. "m" for "MB", or "" for bytes
+	unit := strings.TrimRight(strings.ToLower(size[len(digits):]), "b")
+	if unit == "" {
+		return bytes, nil
+	}
+	return bytes << (10 * (strings.Index("kmgt", unit) + 1)), nil
+}
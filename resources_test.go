@@ -0,0 +1,152 @@
+// Contains tests for the resource usage of the Varnish container
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStorageBytes tests that storage sizes are converted to bytes with units in powers of 1024.
+func TestStorageBytes(t *testing.T) {
+	t.Parallel()
+	for size, expected := range map[string]uint64{
+		"":     1 << 20,
+		"512":  512,
+		"512b": 512,
+		"2kB":  2 << 10,
+		"16M":  16 << 20,
+		"1g":   1 << 30,
+	} {
+		bytes, err := caching.StorageBytes(size)
+		assert.NoError(t, err, size)
+		assert.Equal(t, expected, bytes, size)
+	}
+	_, err := caching.StorageBytes("16 MB")
+	assert.Error(t, err)
+}
+
+// TestMemoryWithinStorageSize tests that caching more objects than fit into the storage evicts objects
+// instead of growing the memory of the container beyond the storage size plus some overhead.
+func TestMemoryWithinStorageSize(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	const bodySize = 1 << 20
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(largeBodyHandler(&backendRequests, bodySize))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		StorageSize: "16M",
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+	before, err := instance.ContainerStats()
+	require.NoError(t, err)
+	assert.Greater(t, before.MemoryLimit, before.MemoryUsage)
+	assert.GreaterOrEqual(t, before.CPUPercent, 0.0)
+
+	// send requests for objects of three times the storage size in total
+	for i := 0; i < 48; i++ {
+		assert.Equal(t, http.StatusOK, mkReq(t, instance.Port, strconv.Itoa(i), withPath("/"+strconv.Itoa(i)),
+			withXCacheControl(cacheControl)).statusCode)
+	}
+
+	// expect objects to have been evicted
+	nuked, err := instance.Counter("MAIN.n_lru_nuked")
+	require.NoError(t, err)
+	assert.Greater(t, nuked, uint64(0))
+
+	// expect the memory to have grown by no more than the storage size plus the same again as overhead
+	after, err := instance.ContainerStats()
+	require.NoError(t, err)
+	storageBytes, err := caching.StorageBytes("16M")
+	require.NoError(t, err)
+	assert.Less(t, after.MemoryUsage-min(after.MemoryUsage, before.MemoryUsage), 2*storageBytes)
+
+	// expect 48 backend requests
+	assert.Equal(t, 48, backendRequests)
+}
+
+// TestMemoryLimit tests that the memory of the container is limited as configured.
+func TestMemoryLimit(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with 128 MiB of memory
+	instance, err := caching.Start(caching.WithBackend(testServerPort), caching.WithMemoryLimit(128<<20))
+	require.NoError(t, err)
+	defer instance.Stop()
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusOK, "1"), mkReq(t, instance.Port, "1"))
+
+	// expect the memory to be limited
+	stats, err := instance.ContainerStats()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(128<<20), stats.MemoryLimit)
+	assert.Less(t, stats.MemoryUsage, stats.MemoryLimit)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestCPUs tests that Varnish limited to a tenth of a CPU is throttled under load, but keeps responding.
+func TestCPUs(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var mutex sync.Mutex
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container with a tenth of a CPU
+	instance, err := caching.Start(caching.WithBackend(testServerPort), caching.WithCPUs(0.1))
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests for distinct URLs in parallel, which are all misses
+	inParallel(20, func(i int) {
+		for j := 0; j < 50; j++ {
+			path := "/" + strconv.Itoa(i) + "/" + strconv.Itoa(j)
+			assert.Equal(t, http.StatusOK, mkReq(t, instance.Port, strconv.Itoa(i), withPath(path)).statusCode)
+		}
+	})
+
+	// expect varnish to have been throttled
+	stats, err := instance.ContainerStats()
+	require.NoError(t, err)
+	assert.Greater(t, stats.CPUThrottled, time.Duration(0))
+
+	// expect 1000 backend requests
+	assert.Equal(t, 1000, backendRequests)
+}
+
+// TestInvalidResourceLimits tests that resource limits below the minimum of Docker are rejected.
+func TestInvalidResourceLimits(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithMemoryLimit(1<<20), caching.WithCPUs(-1))
+	assert.EqualError(t, err, "MemoryLimit must be 0 or at least 6 MiB, not 1048576\nCPUs must be >= 0")
+}
@@ -0,0 +1,152 @@
+// Contains tests for restarts of the varnishd child process and of the Varnish container, with and without file storage
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestChildRestartAfterPanic documents what happens when the varnishd child process panics: the manager process
+// restarts it, after which Varnish responds to requests again, but with an empty cache, since the malloc storage
+// does not survive the restart. The panic is counted by the manager process, and its message is kept.
+func TestChildRestartAfterPanic(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a miss and a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)))
+
+	// panic the child and wait for its restart
+	report, err := instance.PanicChild(30 * time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, report, "You asked for it")
+	require.NoError(t, instance.Crash())
+	waitForHealthy(t, instance.Port)
+
+	// expect the object to be gone
+	info, err := instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.False(t, info.Cached)
+
+	// send a miss and a hit again
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "3", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "4", withXCacheControl(cacheControl)))
+
+	// expect the panic to be counted
+	panics, err := instance.Counter("MGT.child_panic")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), panics)
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestRestart tests that restarting Varnish keeps its port, but empties the cache in memory.
+func TestRestart(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+	port := instance.Port
+
+	// send a miss and a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)))
+
+	// restart varnish
+	require.NoError(t, instance.Restart())
+	assert.Equal(t, port, instance.Port)
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// expect the object to be gone
+	info, err := instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.False(t, info.Cached)
+
+	// send a miss and a hit again
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "3", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "4", withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestFileStorageNotPersistent documents that the classic file storage does not persist objects across restarts:
+// although the file is kept, varnishd starts with an empty cache, just like with the malloc storage.
+func TestFileStorageNotPersistent(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with file storage
+	instance, err := caching.Start(caching.WithBackend(testServerPort), caching.WithFileStorage("file"), caching.WithStorageSize("16M"))
+	require.NoError(t, err)
+	defer instance.Stop()
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// send a miss and a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)))
+
+	// expect the object to be stored in the file
+	eventuallyCounter(t, instance, "SMF.file.g_alloc", 1)
+
+	// restart varnish
+	require.NoError(t, instance.Restart())
+	failOnCrash(t, instance)
+	waitForHealthy(t, instance.Port)
+
+	// expect the object to be gone
+	info, err := instance.ObjectInfo("/")
+	require.NoError(t, err)
+	assert.False(t, info.Cached)
+
+	// send a miss and a hit again
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "3", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "3", withResponseCacheControl(cacheControl)), mkReq(t, instance.Port, "4", withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestInvalidFileStorage tests that a cluster rejects file storage.
+func TestInvalidFileStorage(t *testing.T) {
+	t.Parallel()
+	_, _, err := caching.StartVarnishClusterInDocker(caching.NewVarnishConfig(caching.WithBackend("8080"), caching.WithFileStorage("file")), 2)
+	assert.EqualError(t, err, "a Varnish cluster cannot use file storage")
+}
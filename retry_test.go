@@ -0,0 +1,121 @@
+// Contains tests for retrying failed backend fetches
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRetryThenSucceed tests that failed backend fetches are retried until the backend responds successfully.
+func TestRetryThenSucceed(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server failing the first two requests
+	injector := caching.NewFaultInjector(echoCacheControlHandler(&backendRequests), caching.FaultServiceUnavailable, caching.FaultGarbage)
+	testServerPort, testServer := startTestServer(injector.ServeHTTP)
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:        testServerPort,
+		RetryStatuses:      []int{http.StatusServiceUnavailable},
+		RetryBackendErrors: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)), mkReq(t, port, "1", withXCacheControl(cacheControl)))
+
+	// expect 3 backend requests, of which 1 succeeded
+	assert.Equal(t, 3, injector.Requests())
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestRetryExhausted tests that the client receives a 503 response once max_retries is exhausted.
+func TestRetryExhausted(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server failing the first five requests
+	injector := caching.NewFaultInjector(echoCacheControlHandler(&backendRequests),
+		caching.FaultBadGateway, caching.FaultBadGateway, caching.FaultBadGateway, caching.FaultBadGateway, caching.FaultBadGateway)
+	testServerPort, testServer := startTestServer(injector.ServeHTTP)
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		MaxRetries:    2,
+		RetryStatuses: []int{http.StatusBadGateway},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusServiceUnavailable, ""), mkReq(t, port, "1"))
+
+	// expect the initial backend request and 2 retries
+	assert.Equal(t, 3, injector.Requests())
+	assert.Equal(t, 0, backendRequests)
+}
+
+// TestRetryWithCoalescing tests that concurrent requests for the same object wait for the retried
+// backend fetch instead of triggering their own fetches.
+func TestRetryWithCoalescing(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server failing the first two requests and responding slowly afterwards
+	injector := caching.NewFaultInjector(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		echoCacheControlHandler(&backendRequests)(w, r)
+	}, caching.FaultServiceUnavailable, caching.FaultServiceUnavailable)
+	testServerPort, testServer := startTestServer(injector.ServeHTTP)
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	const N = 5
+
+	// send N requests in parallel
+	var wg sync.WaitGroup
+	xResponses := make([]string, N)
+	wg.Add(N)
+	for i := 0; i < N; i++ {
+		var i = i
+		go func() {
+			resp := mkReq(t, port, strconv.Itoa(i), withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(300)}))
+			assert.Equal(t, http.StatusOK, resp.statusCode)
+			xResponses[i] = resp.xResponse
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	// expect all requests to have been served by the same backend response
+	for i := 1; i < N; i++ {
+		assert.Equal(t, xResponses[0], xResponses[i])
+	}
+
+	// expect the initial backend request and 2 retries, of which 1 succeeded
+	assert.Equal(t, 3, injector.Requests())
+	assert.Equal(t, 1, backendRequests)
+}
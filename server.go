@@ -4,6 +4,8 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -26,11 +28,61 @@ func newListener() net.Listener {
 	return l
 }
 
-func StartTestServer(handler func(w http.ResponseWriter, r *http.Request)) (string, *httptest.Server) {
-	srv := newServer(http.HandlerFunc(handler))
-	// determine port
+// serverPort determines the port a started server listens on.
+func serverPort(srv *httptest.Server) string {
 	hostNameAndPort := srv.URL[len("http://"):]
 	indexOfPort := strings.LastIndex(hostNameAndPort, ":")
-	port := hostNameAndPort[indexOfPort+1:]
-	return port, srv
+	return hostNameAndPort[indexOfPort+1:]
+}
+
+func StartTestServer(handler func(w http.ResponseWriter, r *http.Request)) (string, *httptest.Server) {
+	srv := newServer(http.HandlerFunc(handler))
+	return serverPort(srv), srv
+}
+
+// StartTestServerOnSocket starts a test server like StartTestServer, which listens on a Unix domain socket
+// instead of a TCP port, and returns the path of the socket for VarnishConfig.BackendSocket.
+// The socket is created in a directory of its own, since the whole directory is mounted into the container,
+// and is writable by everyone, since Varnish connects to it as the unprivileged varnish user.
+func StartTestServerOnSocket(handler func(w http.ResponseWriter, r *http.Request)) (string, *httptest.Server) {
+	dir, err := os.MkdirTemp("", "backend")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	socket := filepath.Join(dir, "backend.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chmod(socket, 0777)
+	if err != nil {
+		panic(err)
+	}
+	server := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{
+			Handler: http.HandlerFunc(handler),
+		},
+	}
+	server.Start()
+	return socket, server
+}
+
+// Routes maps paths of the test server to the handlers for requests to these paths.
+type Routes map[string]http.HandlerFunc
+
+// StartTestServerWithRoutes starts a test server like StartTestServer, which dispatches requests
+// to the handler registered for their path. Requests to any other path are responded to with 404.
+// The paths are patterns of http.ServeMux, such that "/prefix/" matches all paths below /prefix.
+func StartTestServerWithRoutes(routes Routes) (string, *httptest.Server) {
+	mux := http.NewServeMux()
+	for pattern, handler := range routes {
+		mux.HandleFunc(pattern, handler)
+	}
+	srv := newServer(mux)
+	return serverPort(srv), srv
 }
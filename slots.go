@@ -0,0 +1,94 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// MaxVarnishContainersEnv is the environment variable limiting how many Varnish containers run at the same time,
+// e.g. CACHING_MAX_VARNISH_CONTAINERS=4. Starting another one blocks until a running one has been stopped.
+// If it is unset or 0, the number is not limited.
+const MaxVarnishContainersEnv = "CACHING_MAX_VARNISH_CONTAINERS"
+
+// varnishSlots limits the number of running Varnish containers, such that many parallel tests
+// wait for each other instead of exhausting the resources of Docker.
+var varnishSlots = newSlots(os.Getenv(MaxVarnishContainersEnv))
+
+// slots is a counting semaphore, which can acquire several slots at once.
+type slots struct {
+	limitValue string
+	parse      sync.Once
+	limit      int
+	err        error
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	used       int
+}
+
+// newSlots returns slots with the given limit, which is unlimited if empty or 0. The limit is parsed on first use,
+// such that an invalid limit fails acquiring slots instead of initializing the package.
+func newSlots(limit string) *slots {
+	s := &slots{limitValue: limit}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// parseLimit parses the limit once and returns the error of parsing it, if any.
+func (s *slots) parseLimit() error {
+	s.parse.Do(func() {
+		if s.limitValue == "" {
+			return
+		}
+		limit, err := strconv.Atoi(s.limitValue)
+		if err != nil || limit < 0 {
+			s.err = fmt.Errorf("%s must be a number >= 0, not %q", MaxVarnishContainersEnv, s.limitValue)
+			return
+		}
+		s.limit = limit
+	})
+	return s.err
+}
+
+// acquire blocks until n slots are free and returns a function releasing them, which may be called repeatedly.
+// At most all slots are acquired, such that a cluster of more nodes than the limit runs on its own
+// instead of waiting forever. It gives up with the error of the context when the context is done,
+// and fails if the limit is invalid.
+func (s *slots) acquire(ctx context.Context, n int) (func(), error) {
+	err := s.parseLimit()
+	if err != nil {
+		return nil, err
+	}
+	if s.limit == 0 {
+		return func() {}, nil
+	}
+	n = min(n, s.limit)
+	// wake up the waiting below when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+	s.mutex.Lock()
+	for s.used+n > s.limit {
+		if ctx.Err() != nil {
+			s.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+		s.cond.Wait()
+	}
+	s.used += n
+	s.mutex.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			s.used -= n
+			s.mutex.Unlock()
+			s.cond.Broadcast()
+		})
+	}, nil
+}
@@ -0,0 +1,139 @@
+// Contains tests for limiting the number of running Varnish containers
+package caching
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// blockedTimeout is how long an acquisition which is expected to block is given before it counts as blocked.
+const blockedTimeout = 100 * time.Millisecond
+
+// acquireWithin acquires n of the given slots, giving up after blockedTimeout.
+func acquireWithin(s *slots, n int) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), blockedTimeout)
+	defer cancel()
+	return s.acquire(ctx, n)
+}
+
+// TestSlotsBlockUntilReleased tests that acquiring more slots than are free blocks until enough have been released.
+func TestSlotsBlockUntilReleased(t *testing.T) {
+	t.Parallel()
+	s := newSlots("2")
+	release, err := s.acquire(context.Background(), 2)
+	require.NoError(t, err)
+
+	// acquire another slot, which blocks
+	acquired := make(chan func())
+	go func() {
+		release, err := s.acquire(context.Background(), 1)
+		assert.NoError(t, err)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot while all slots were used")
+	case <-time.After(blockedTimeout):
+	}
+
+	// release the slots and expect the slot to be acquired
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not acquire a slot after the slots were released")
+	}
+}
+
+// TestSlotsReleaseRepeatedly tests that releasing slots again has no effect, so it cannot free slots of others.
+func TestSlotsReleaseRepeatedly(t *testing.T) {
+	t.Parallel()
+	s := newSlots("2")
+	releaseFirst, err := s.acquire(context.Background(), 1)
+	require.NoError(t, err)
+	releaseSecond, err := s.acquire(context.Background(), 1)
+	require.NoError(t, err)
+	defer releaseSecond()
+
+	// release the first slot twice and expect only one slot to be free
+	releaseFirst()
+	releaseFirst()
+	_, err = acquireWithin(s, 2)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	release, err := acquireWithin(s, 1)
+	require.NoError(t, err)
+	release()
+}
+
+// TestSlotsAtMostLimit tests that acquiring more slots than the limit, like for a cluster with more nodes,
+// acquires all slots instead of blocking forever.
+func TestSlotsAtMostLimit(t *testing.T) {
+	t.Parallel()
+	s := newSlots("2")
+	release, err := acquireWithin(s, 3)
+	require.NoError(t, err)
+
+	// expect all slots to be used until released
+	_, err = acquireWithin(s, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	release()
+	release, err = acquireWithin(s, 2)
+	require.NoError(t, err)
+	release()
+}
+
+// TestSlotsContextCanceled tests that a blocked acquisition gives up with the error of its context once canceled,
+// without acquiring slots.
+func TestSlotsContextCanceled(t *testing.T) {
+	t.Parallel()
+	s := newSlots("1")
+	release, err := s.acquire(context.Background(), 1)
+	require.NoError(t, err)
+
+	// acquire another slot, which blocks, and cancel it
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := s.acquire(ctx, 1)
+		done <- err
+	}()
+	time.Sleep(blockedTimeout)
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("acquisition did not give up after the context was canceled")
+	}
+
+	// expect the slot to be free once released
+	release()
+	release, err = acquireWithin(s, 1)
+	require.NoError(t, err)
+	release()
+}
+
+// TestSlotsUnlimited tests that an empty limit and 0 do not limit the number of slots.
+func TestSlotsUnlimited(t *testing.T) {
+	t.Parallel()
+	for _, limit := range []string{"", "0"} {
+		s := newSlots(limit)
+		for i := 0; i < 3; i++ {
+			_, err := acquireWithin(s, 100)
+			assert.NoError(t, err, "limit %q", limit)
+		}
+	}
+}
+
+// TestSlotsInvalidLimit tests that an invalid limit fails acquiring slots.
+func TestSlotsInvalidLimit(t *testing.T) {
+	t.Parallel()
+	for _, limit := range []string{"four", "-1"} {
+		_, err := newSlots(limit).acquire(context.Background(), 1)
+		assert.EqualError(t, err, MaxVarnishContainersEnv+` must be a number >= 0, not "`+limit+`"`)
+	}
+}
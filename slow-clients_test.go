@@ -0,0 +1,110 @@
+// Contains tests for clients reading responses slowly
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// bodySize is the size of the responses in these tests, which must exceed the socket buffers
+// between Varnish and the client such that Varnish actually has to wait for the client.
+const bodySize = 16 * 1024 * 1024
+
+// TestIdleSendTimeoutStreamed tests that Varnish closes the connection to a client which does not read
+// a streamed response for longer than idle_send_timeout, truncating the response.
+func TestIdleSendTimeoutStreamed(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(largeBodyHandler(&backendRequests, bodySize))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:     testServerPort,
+		IdleSendTimeout: 1 * time.Second,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request, stop reading for 3 seconds and expect a truncated response
+	n, err := getSlowly(t, port, "1", "", 3*time.Second, 0)
+	assert.Error(t, err)
+	assert.Less(t, n, bodySize)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestIdleSendTimeoutNotExceeded tests that a client reading slowly, but steadily,
+// receives the complete response despite a short idle_send_timeout.
+func TestIdleSendTimeoutNotExceeded(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(largeBodyHandler(&backendRequests, bodySize))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:     testServerPort,
+		IdleSendTimeout: 1 * time.Second,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request, read it in about 2 seconds and expect the complete response
+	n, err := getSlowly(t, port, "1", "", 0, bodySize/2)
+	assert.NoError(t, err)
+	assert.Equal(t, bodySize, n)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestSendTimeoutCached tests that send_timeout also limits the total time of delivering a cached
+// response to a slow client, truncating the response, while the cached object remains intact.
+func TestSendTimeoutCached(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(largeBodyHandler(&backendRequests, bodySize))
+	defer testServer.Close()
+
+	// start varnish container with enough storage for the response
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		SendTimeout: 1 * time.Second,
+		StorageSize: "64M",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}.String()
+
+	// send request and read the response quickly to cache it
+	n, err := getSlowly(t, port, "1", cacheControl, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bodySize, n)
+
+	// send another request, read it in about 4 seconds and expect a truncated response
+	n, err = getSlowly(t, port, "2", cacheControl, 0, bodySize/4)
+	assert.Error(t, err)
+	assert.Less(t, n, bodySize)
+
+	// send yet another request and expect the complete cached response
+	n, err = getSlowly(t, port, "3", cacheControl, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bodySize, n)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
@@ -0,0 +1,107 @@
+// Contains tests for the handling of request smuggling attempts
+package caching_test
+
+import (
+	"caching"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smuggledRequest is the request hidden in the body of the smuggling vectors, which must never reach the backend.
+const smuggledRequest = "GET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+// smugglingVector is a raw request whose framing is ambiguous, such that a proxy and a backend disagreeing on where
+// its body ends would interpret the rest as a second request. Rejected vectors must be answered with 400.
+type smugglingVector struct {
+	name     string
+	request  string
+	rejected bool
+}
+
+// smugglingVectors returns CL.TE, TE.CL and obs-fold vectors, each hiding smuggledRequest.
+func smugglingVectors() []smugglingVector {
+	// a terminated chunked body followed by the smuggled request, and a chunk containing the smuggled request
+	terminated := "0\r\n\r\n" + smuggledRequest
+	chunk := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(smuggledRequest), smuggledRequest)
+	post := func(path string, fields string, body string) string {
+		return "POST " + path + " HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\n" + body
+	}
+	return []smugglingVector{
+		{"CL.TE", post("/cl-te", fmt.Sprintf("Content-Length: %d\r\nTransfer-Encoding: chunked\r\n", len(terminated)), terminated), true},
+		{"TE.CL", post("/te-cl", "Content-Length: 4\r\nTransfer-Encoding: chunked\r\n", chunk), true},
+		{"TE.TE obfuscated", post("/te-te", fmt.Sprintf("Content-Length: %d\r\nTransfer-Encoding: xchunked\r\n", len(terminated)), terminated), true},
+		{"TE.TE duplicate", post("/te-te", fmt.Sprintf("Content-Length: %d\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n", len(terminated)), terminated), true},
+		{"TE with space before colon", post("/te-space", fmt.Sprintf("Content-Length: %d\r\nTransfer-Encoding : chunked\r\n", len(terminated)), terminated), false},
+		{"duplicate CL", post("/cl-cl", fmt.Sprintf("Content-Length: 0\r\nContent-Length: %d\r\n", len(smuggledRequest)), smuggledRequest), false},
+		{"obs-fold TE", post("/fold-te", fmt.Sprintf("Transfer-Encoding:\r\n chunked\r\nContent-Length: %d\r\n", len(terminated)), terminated), false},
+		{"obs-fold CL", post("/fold-cl", fmt.Sprintf("X-Fold: 1\r\n Content-Length: 0\r\nContent-Length: %d\r\n", len(smuggledRequest)), smuggledRequest), false},
+	}
+}
+
+// TestSmuggling tests that Varnish rejects requests with ambiguous framing or forwards them with a body of
+// unambiguous length, such that neither Varnish nor the backend interprets the hidden request as a second request.
+func TestSmuggling(t *testing.T) {
+	t.Parallel()
+	var recorder caching.RequestRecorder
+
+	// start a test server, which consumes the body and reports the path it saw
+	testServerPort, testServer := startTestServer(recorder.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Cache-Control", caching.CacheControl{NoStore: true}.String())
+		w.Header().Set("X-Path", r.URL.Path)
+	}))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{BackendPort: testServerPort})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	for _, vector := range smugglingVectors() {
+		t.Run(vector.name, func(t *testing.T) {
+			conn, reader := rawConn(t, port)
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			// send the vector, a closed connection counts as rejection as well
+			_, err := io.WriteString(conn, vector.request)
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				assert.False(t, vector.rejected, "expected 400 instead of %v", err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			t.Logf("%s: %d %s", vector.name, resp.StatusCode, resp.Header.Get("X-Path"))
+			if vector.rejected {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			}
+			assert.NotEqual(t, "/smuggled", resp.Header.Get("X-Path"))
+			if resp.Close {
+				return
+			}
+
+			// send a regular request on the same connection and expect its own response, not one for the smuggled request
+			_, err = io.WriteString(conn, "GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			require.NoError(t, err)
+			next, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				return
+			}
+			next.Body.Close()
+			assert.Equal(t, "/next", next.Header.Get("X-Path"))
+		})
+	}
+
+	// expect the backend to never see the smuggled request
+	for _, request := range recorder.Requests() {
+		assert.False(t, strings.HasPrefix(request.URL, "/smuggled"), "backend received %s %s", request.Method, request.URL)
+	}
+}
@@ -0,0 +1,232 @@
+package caching
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SoakCounters are the varnishstat counters sampled by a SoakTest by default: the number of objects, the bytes
+// allocated in the cache storage of the official image and in the transient storage, and the number of threads.
+var SoakCounters = []string{"MAIN.n_object", "SMA.s0.g_bytes", "SMA.Transient.g_bytes", "MAIN.threads"}
+
+// SoakTest sends mixed traffic with rotating URLs to Varnish for a long time, e.g. hours, and samples varnishstat
+// counters periodically, to catch objects or memory leaking by the VCL, which a short test would not notice.
+// The traffic consists of cacheable responses for URLs changing every Rotation, uncacheable responses, 404 responses,
+// POST requests and requests with cookies, such that objects are inserted, expired and replaced all the time.
+type SoakTest struct {
+	// Config is the config of Varnish to soak. Its BackendPort is replaced with the one of the backend of the test,
+	// which responds with a max-age of Ttl in whole seconds (1s if 0) and no grace period, such that objects expire
+	// soon after and the number of objects levels off unless the VCL keeps them longer.
+	Config VarnishConfig
+	Ttl    time.Duration
+	// Duration is how long the traffic is sent. The counters are sampled every Interval (10s if 0).
+	Duration time.Duration
+	Interval time.Duration
+	// URLs is the number of cacheable URLs (1000 if 0), which are replaced by new ones every Rotation (10s if 0).
+	URLs     int
+	Rotation time.Duration
+	// Concurrency is the number of requests sent at a time, 4 if 0.
+	Concurrency int
+	// Counters are the counters to sample, SoakCounters if nil. MaxGrowth is the growth of a counter by which it
+	// counts as leaking, relative to its mean at the start (see DetectLeaks), 0.1 for counters not listed.
+	Counters  []string
+	MaxGrowth map[string]float64
+}
+
+// SoakSample is a sample of the counters taken After the start of a SoakTest.
+type SoakSample struct {
+	After    time.Duration
+	Counters map[string]uint64
+}
+
+// Leak is a counter which grew steadily during a SoakTest: its mean rose in each quarter of the samples after
+// the warm-up, from First to Last.
+type Leak struct {
+	Counter     string
+	First, Last float64
+}
+
+// SoakReport is the outcome of a SoakTest: the samples, the leaks detected in them, and the number of requests sent,
+// of which Errors failed without a response and ServerErrors were answered with a 5xx status.
+type SoakReport struct {
+	Samples      []SoakSample
+	Leaks        []Leak
+	Requests     int64
+	Errors       int64
+	ServerErrors int64
+}
+
+// Run starts Varnish with the config and a backend of the test, sends the traffic for the duration while sampling
+// the counters, and detects leaks in the samples.
+func (s SoakTest) Run() (SoakReport, error) {
+	ttl := withDefaultDuration(s.Ttl, time.Second)
+	interval := withDefaultDuration(s.Interval, 10*time.Second)
+	rotation := withDefaultDuration(s.Rotation, 10*time.Second)
+	urls := s.URLs
+	if urls == 0 {
+		urls = 1000
+	}
+	concurrency := s.Concurrency
+	if concurrency == 0 {
+		concurrency = 4
+	}
+	counters := s.Counters
+	if counters == nil {
+		counters = SoakCounters
+	}
+
+	cacheable := CacheControl{MaxAge: Seconds(int(ttl.Seconds())), SWR: Seconds(0)}.String()
+	backendPort, backend := StartTestServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/uncacheable/"):
+			w.Header().Set("Cache-Control", CacheControl{NoStore: true}.String())
+		case strings.HasPrefix(r.URL.Path, "/missing/"):
+			w.Header().Set("Cache-Control", cacheable)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			w.Header().Set("Cache-Control", cacheable)
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	})
+	defer backend.Close()
+
+	config := s.Config
+	config.BackendPort = backendPort
+	instance, err := StartVarnishInstanceInDocker(config)
+	if err != nil {
+		return SoakReport{}, err
+	}
+	defer instance.Stop()
+	err = waitUntilHealthy(instance.Port, 30*time.Second)
+	if err != nil {
+		return SoakReport{}, err
+	}
+
+	var report SoakReport
+	var requests, failed, serverErrors atomic.Int64
+	base := "http://localhost:" + instance.Port
+	start := time.Now()
+	deadline := start.Add(s.Duration)
+	client := http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{MaxIdleConnsPerHost: concurrency}}
+	defer client.CloseIdleConnections()
+	// send mixes the kinds of requests by their number, and rotates the cacheable URLs by the elapsed time
+	send := func(n int64) error {
+		key := n % int64(urls)
+		var request *http.Request
+		var err error
+		switch n % 10 {
+		case 0:
+			request, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/uncacheable/%d", base, key), nil)
+		case 1:
+			request, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/missing/%d", base, key), nil)
+		case 2:
+			request, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s/post/%d", base, key), strings.NewReader("soak"))
+		case 3:
+			request, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/cookie/%d", base, key), nil)
+			if err == nil {
+				request.Header.Set("Cookie", fmt.Sprintf("session=%d", key))
+			}
+		default:
+			generation := time.Since(start) / rotation
+			request, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/cacheable/%d/%d", base, generation, key), nil)
+		}
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		_, err = io.Copy(io.Discard, response.Body)
+		if response.StatusCode >= 500 {
+			serverErrors.Add(1)
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if send(requests.Add(1)) != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		<-ticker.C
+		stats, err := instance.Stats()
+		if err != nil {
+			wg.Wait()
+			return report, err
+		}
+		sample := SoakSample{After: time.Since(start), Counters: map[string]uint64{}}
+		for _, counter := range counters {
+			sample.Counters[counter] = stats[counter]
+		}
+		report.Samples = append(report.Samples, sample)
+	}
+	wg.Wait()
+
+	report.Leaks = DetectLeaks(report.Samples, counters, s.MaxGrowth)
+	report.Requests = requests.Load()
+	report.Errors = failed.Load()
+	report.ServerErrors = serverErrors.Load()
+	return report, nil
+}
+
+// DetectLeaks returns the given counters which grew steadily in the given samples. The first quarter of the samples
+// is the warm-up, in which caches fill up, and is ignored. The rest is split into four quarters, and a counter leaks
+// if its mean rose from each quarter to the next, and rose from the first to the last quarter by more than its
+// maximum growth relative to the first one (0.1 if missing), i.e. if it neither levels off nor fluctuates.
+// It needs at least 8 samples and returns no leaks otherwise.
+func DetectLeaks(samples []SoakSample, counters []string, maxGrowth map[string]float64) []Leak {
+	if len(samples) < 8 {
+		return nil
+	}
+	samples = samples[len(samples)/4:]
+	var leaks []Leak
+	for _, counter := range counters {
+		means := make([]float64, 4)
+		for quarter := range means {
+			part := samples[quarter*len(samples)/4 : (quarter+1)*len(samples)/4]
+			for _, sample := range part {
+				means[quarter] += float64(sample.Counters[counter])
+			}
+			means[quarter] /= float64(len(part))
+		}
+		rising := true
+		for quarter := 1; quarter < len(means); quarter++ {
+			rising = rising && means[quarter] > means[quarter-1]
+		}
+		growth, ok := maxGrowth[counter]
+		if !ok {
+			growth = 0.1
+		}
+		if rising && means[3]-means[0] > growth*max(means[0], 1) {
+			leaks = append(leaks, Leak{Counter: counter, First: means[0], Last: means[3]})
+		}
+	}
+	return leaks
+}
+
+// withDefaultDuration returns the given duration, or the default if 0.
+func withDefaultDuration(d time.Duration, defaultValue time.Duration) time.Duration {
+	if d == 0 {
+		return defaultValue
+	}
+	return d
+}
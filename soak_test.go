@@ -0,0 +1,102 @@
+// Contains tests for the soak test mode detecting leaks under long-running churn
+package caching_test
+
+import (
+	"caching"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var soakDuration = flag.Duration("soak", 0, "run TestSoak for this long, e.g. 4h, with the default interval, URLs and rotation instead of a short run")
+
+// shortSoakTest returns a SoakTest of the given config, which runs for 20 seconds with frequent samples and rotations.
+func shortSoakTest(config caching.VarnishConfig) caching.SoakTest {
+	return caching.SoakTest{
+		Config:   config,
+		Duration: 20 * time.Second,
+		Interval: 500 * time.Millisecond,
+		URLs:     100,
+		Rotation: time.Second,
+	}
+}
+
+// TestSoak tests that the default VCL neither leaks objects, storage nor threads under churn, and that all requests
+// are answered without a server error. It runs for 20 seconds, or for the duration of the -soak flag.
+func TestSoak(t *testing.T) {
+	t.Parallel()
+	soak := shortSoakTest(caching.VarnishConfig{StorageSize: "64M"})
+	if *soakDuration > 0 {
+		soak = caching.SoakTest{Config: soak.Config, Duration: *soakDuration}
+	}
+
+	// run the soak test
+	report, err := soak.Run()
+	require.NoError(t, err)
+	require.NotEmpty(t, report.Samples)
+	t.Logf("%d requests, %d samples, last %v", report.Requests, len(report.Samples), report.Samples[len(report.Samples)-1])
+
+	// expect no leaks and no errors
+	assert.Empty(t, report.Leaks)
+	assert.Positive(t, report.Requests)
+	assert.Zero(t, report.Errors)
+	assert.Zero(t, report.ServerErrors)
+}
+
+// TestSoakDetectsLeak tests that VCL caching the rotating URLs for an hour regardless of the backend is reported
+// as leaking objects and storage.
+func TestSoakDetectsLeak(t *testing.T) {
+	t.Parallel()
+	vcl := `
+sub vcl_backend_response {
+  if (bereq.url ~ "^/cacheable/") {
+    set beresp.ttl = 1h;
+  }
+}
+`
+
+	// run the soak test
+	report, err := shortSoakTest(caching.VarnishConfig{StorageSize: "64M", Vcl: vcl}).Run()
+	require.NoError(t, err)
+
+	// expect the objects and the storage to leak
+	var leaking []string
+	for _, leak := range report.Leaks {
+		leaking = append(leaking, leak.Counter)
+	}
+	assert.Contains(t, leaking, "MAIN.n_object")
+	assert.Contains(t, leaking, "SMA.s0.g_bytes")
+}
+
+// TestDetectLeaks tests that only counters rising from each quarter after the warm-up to the next by more than
+// their maximum growth are reported as leaking.
+func TestDetectLeaks(t *testing.T) {
+	t.Parallel()
+	series := map[string][]uint64{
+		// fills up during the warm-up and levels off
+		"levels": {0, 50, 100, 100, 101, 100, 100, 101, 100, 101, 100, 101},
+		// fluctuates without a trend
+		"fluctuates": {100, 120, 90, 110, 95, 130, 100, 90, 120, 100, 110, 95},
+		// rises steadily
+		"rises": {100, 110, 120, 130, 140, 150, 160, 170, 180, 190, 200, 210},
+		// rises steadily, but less than its maximum growth
+		"tolerated": {100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140, 144},
+	}
+	counters := []string{"levels", "fluctuates", "rises", "tolerated"}
+	samples := make([]caching.SoakSample, 12)
+	for i := range samples {
+		samples[i] = caching.SoakSample{After: time.Duration(i) * time.Second, Counters: map[string]uint64{}}
+		for _, counter := range counters {
+			samples[i].Counters[counter] = series[counter][i]
+		}
+	}
+
+	// expect only the steadily rising counter beyond the default maximum growth
+	leaks := caching.DetectLeaks(samples, counters, map[string]float64{"tolerated": 0.3})
+	assert.Equal(t, []caching.Leak{{Counter: "rises", First: 135, Last: 200}}, leaks)
+
+	// expect no leaks with too few samples
+	assert.Empty(t, caching.DetectLeaks(samples[:7], counters, nil))
+}
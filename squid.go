@@ -0,0 +1,99 @@
+package caching
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"os"
+	"path"
+	"strings"
+)
+
+const squidImage = "ubuntu/squid:6.6-24.04_beta"
+
+// defaultRefreshPattern is the catch-all refresh_pattern of the default squid.conf,
+// which derives a heuristic freshness lifetime of 20% of the age given by Last-Modified.
+const defaultRefreshPattern = ". 0 20% 4320"
+
+// SquidCacheConfig is the Squid equivalent of VarnishConfig.
+// Squid has no default TTL in seconds, but derives freshness heuristically from refresh_pattern rules.
+type SquidCacheConfig struct {
+	BackendPort string
+	// RefreshPatterns are rendered as refresh_pattern lines (without the directive name)
+	// and default to Squid's catch-all rule. Note that their lifetimes are given in minutes.
+	RefreshPatterns []string
+	// Config is added to the end of squid.conf.
+	Config string
+}
+
+// renderSquidConf renders squid.conf for the given config, configuring Squid as a memory-only
+// reverse proxy (accelerator) for the backend. All state paths point to /tmp, because the
+// container runs with a read-only root filesystem.
+func renderSquidConf(config SquidCacheConfig) string {
+	var sb strings.Builder
+	sb.WriteString(`http_port 8080 accel no-vhost defaultsite=backend
+cache_peer host.docker.internal parent ` + config.BackendPort + ` 0 no-query originserver name=backend
+cache_peer_access backend allow all
+http_access allow all
+cache_mem 8 MB
+pid_filename /tmp/squid.pid
+coredump_dir /tmp
+cache_log stdio:/dev/stderr
+access_log stdio:/dev/stdout
+`)
+	refreshPatterns := config.RefreshPatterns
+	if len(refreshPatterns) == 0 {
+		refreshPatterns = []string{defaultRefreshPattern}
+	}
+	for _, refreshPattern := range refreshPatterns {
+		sb.WriteString("refresh_pattern " + refreshPattern + "\n")
+	}
+	sb.WriteString(config.Config)
+	return sb.String()
+}
+
+// StartSquidInDocker starts Squid as a caching reverse proxy in front of the backend
+// in the same way StartVarnishInDocker does for Varnish.
+func StartSquidInDocker(config SquidCacheConfig) (string, func() error, error) {
+	err := pullImage(context.Background(), squidImage, "", "", nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// write the config as squid.conf file in a temporary directory
+	tmpDir, err := os.MkdirTemp("", "squid")
+	if err != nil {
+		return "", nil, err
+	}
+	// the temporary directory is kept until the container is stopped
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	confFileName := path.Join(tmpDir, "squid.conf")
+	err = os.WriteFile(confFileName, []byte(renderSquidConf(config)), 0644)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// create and start a Squid container
+	port, stopFunc, err := startContainer(&container.Config{
+		Image: squidImage,
+		// Run squid in the foreground as the unprivileged owner of /tmp.
+		User:       "1000:1000",
+		Entrypoint: []string{"squid"},
+		Cmd:        []string{"-N", "-f", "/etc/squid/squid.conf"},
+		ExposedPorts: nat.PortSet{
+			"8080/tcp": struct{}{},
+		},
+	}, newHostConfig("8080/tcp",
+		// Mount the squid.conf file we created above as /etc/squid/squid.conf
+		confFileName+":/etc/squid/squid.conf",
+	), "8080/tcp")
+	if err != nil {
+		return "", nil, err
+	}
+	return port, removeOnStop(tmpDir, stopFunc), nil
+}
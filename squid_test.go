@@ -0,0 +1,107 @@
+// Contains tests running scenarios of the Varnish tests against Squid to document behavioural differences
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestSquidCacheControlMaxAge1 is the Squid equivalent of TestCacheControlMaxAge1.
+func TestSquidCacheControlMaxAge1(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start Squid container
+	port, stopFunc, err := caching.StartSquidInDocker(caching.SquidCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request to Squid
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).xResponse)
+
+	// send another request and expect to receive a cached response
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(1)})).xResponse)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestSquidHeuristicFreshnessFromLastModified tests a difference to Varnish (see TestNoCacheControl):
+// Squid caches a response without explicit expiration for a fraction of the age given by its Last-Modified
+// header, whereas Varnish applies its default TTL, which is zero in this test.
+func TestSquidHeuristicFreshnessFromLastModified(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	lastModified := time.Now().Add(-2 * time.Hour).UTC().Format(http.TimeFormat)
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start Squid container with the default refresh_pattern (20% of the Last-Modified age, i.e. 24 minutes)
+	port, stopFunc, err := caching.StartSquidInDocker(caching.SquidCacheConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
+
+	// send another request and expect the heuristically fresh cached response
+	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestSquidRefreshPatternWithoutLastModified tests that a refresh_pattern with a minimum lifetime
+// makes Squid cache responses without any validator or expiration, like the default TTL of Varnish.
+func TestSquidRefreshPatternWithoutLastModified(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		backendRequests++
+	})
+	defer testServer.Close()
+
+	// start Squid container with a minimum lifetime of one minute
+	port, stopFunc, err := caching.StartSquidInDocker(caching.SquidCacheConfig{
+		BackendPort:     testServerPort,
+		RefreshPatterns: []string{". 1 20% 1"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, "foo", mkReq(t, port, "foo").xResponse)
+
+	// send another request and expect the cached response
+	assert.Equal(t, "foo", mkReq(t, port, "bar").xResponse)
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
@@ -0,0 +1,127 @@
+package caching
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventStreamHandler returns a backend handler which responds with an endless stream of Server-Sent Events, one
+// every interval, until the connection is closed. Like the other handlers, it echoes the X-Request header as
+// X-Response and the X-Cache-Control header as Cache-Control, which defaults to no-cache as usual for event streams.
+// The data of each event is the time it was sent in RFC 3339 format with nanoseconds, and the events are numbered
+// starting at 1 by their id.
+func EventStreamHandler(interval time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", withDefault(r.Header.Get("X-Cache-Control"), "no-cache"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		controller := http.NewResponseController(w)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for id := 1; ; id++ {
+			_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, time.Now().Format(time.RFC3339Nano))
+			if err == nil {
+				err = controller.Flush()
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// Event is a Server-Sent Event received by an EventStream.
+type Event struct {
+	ID   string
+	Data string
+	// Sent is when EventStreamHandler sent the event according to its data, which is the zero time
+	// for events of other backends.
+	Sent time.Time
+	// Received is when the blank line ending the event was read.
+	Received time.Time
+}
+
+// Latency returns how long the event took from the backend to the client.
+func (e Event) Latency() time.Duration {
+	return e.Received.Sub(e.Sent)
+}
+
+// EventStream is the client side of a stream of Server-Sent Events, which reads the events incrementally
+// as they arrive rather than reading the whole response body.
+type EventStream struct {
+	// Response is the response opening the stream. Its body must not be read directly.
+	Response *http.Response
+	reader   *bufio.Reader
+}
+
+// OpenEventStream sends a request for the given path to localhost at the given port with Accept: text/event-stream
+// and the given X-Request header, and returns the stream once the response header has been received.
+// The response is returned even if it is not an event stream, such that tests can inspect it.
+func OpenEventStream(port string, path string, xRequest string) (*EventStream, error) {
+	request, err := http.NewRequest(http.MethodGet, "http://localhost:"+port+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("X-Request", xRequest)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{Response: response, reader: bufio.NewReader(response.Body)}, nil
+}
+
+// Next reads the next event, blocking until it has been received completely. Comments are skipped,
+// and multiple data lines are joined by newlines. It returns io.EOF when the stream ends.
+func (s *EventStream) Next() (Event, error) {
+	var event Event
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return Event{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if event.ID == "" && data == nil {
+				continue
+			}
+			event.Received = time.Now()
+			event.Data = strings.Join(data, "\n")
+			event.Sent, _ = time.Parse(time.RFC3339Nano, event.Data)
+			return event, nil
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			event.ID = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// Close closes the stream, which makes Varnish abandon the delivery.
+func (s *EventStream) Close() error {
+	return s.Response.Body.Close()
+}
+
+// EventIDs returns the ids of the given events, which are numbers for events of EventStreamHandler.
+func EventIDs(events []Event) []int {
+	ids := make([]int, len(events))
+	for i, event := range events {
+		ids[i], _ = strconv.Atoi(event.ID)
+	}
+	return ids
+}
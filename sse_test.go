@@ -0,0 +1,177 @@
+// Contains tests for Server-Sent Events streamed through Varnish
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// eventInterval is the interval between the events sent by the event stream handlers of the tests.
+const eventInterval = 200 * time.Millisecond
+
+// eventStreamHandler returns a backend handler like caching.EventStreamHandler with eventInterval,
+// which counts the backend requests, and sends a Cache-Control of max-age=60 if cacheable is set.
+func eventStreamHandler(backendRequests *int, cacheable bool) http.HandlerFunc {
+	handler := caching.EventStreamHandler(eventInterval)
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		if cacheable {
+			r.Header.Set("X-Cache-Control", "max-age=60")
+		}
+		handler(w, r)
+	}
+}
+
+// nextEvents reads the next n events of the stream, failing the test if they do not arrive in time.
+func nextEvents(t *testing.T, stream *caching.EventStream, n int) []caching.Event {
+	var events []caching.Event
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(events) < n && err == nil {
+			var event caching.Event
+			event, err = stream.Next()
+			if err == nil {
+				events = append(events, event)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(n+5) * eventInterval):
+		// closing the stream makes the pending read fail
+		stream.Close()
+		<-done
+		t.Fatalf("timed out waiting for %d events, received %d", n, len(events))
+	}
+	require.NoError(t, err)
+	return events
+}
+
+// TestEventStreamNotBuffered tests that Varnish streams the events of an endless event stream to the client
+// as soon as the backend sends them, rather than buffering the response body.
+func TestEventStreamNotBuffered(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(eventStreamHandler(&backendRequests, false))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// open the stream and expect a chunked event stream
+	stream, err := caching.OpenEventStream(instance.Port, "/events", "1")
+	require.NoError(t, err)
+	defer stream.Close()
+	assert.Equal(t, http.StatusOK, stream.Response.StatusCode)
+	assert.Equal(t, "text/event-stream", stream.Response.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", stream.Response.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, stream.Response.TransferEncoding)
+
+	// expect each event to arrive right after it was sent
+	events := nextEvents(t, stream, 5)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, caching.EventIDs(events))
+	for _, event := range events {
+		assert.Less(t, event.Latency(), eventInterval/2, "latency of event %s", event.ID)
+	}
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestEventStreamNotCached tests that an event stream with Cache-Control: no-cache is never cached,
+// such that concurrent and later clients get event streams of their own from the backend.
+func TestEventStreamNotCached(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(eventStreamHandler(&backendRequests, false))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// open a stream and read some events
+	first, err := caching.OpenEventStream(instance.Port, "/events", "1")
+	require.NoError(t, err)
+	defer first.Close()
+	nextEvents(t, first, 2)
+
+	// open another stream while the first one is still running, and expect it to start with the first event
+	opened := time.Now()
+	second, err := caching.OpenEventStream(instance.Port, "/events", "2")
+	require.NoError(t, err)
+	assert.Equal(t, "2", second.Response.Header.Get("X-Response"))
+	events := nextEvents(t, second, 2)
+	assert.Equal(t, []int{1, 2}, caching.EventIDs(events))
+	assert.True(t, events[0].Sent.After(opened))
+	second.Close()
+
+	// open a stream after the second one was closed
+	third, err := caching.OpenEventStream(instance.Port, "/events", "3")
+	require.NoError(t, err)
+	defer third.Close()
+	assert.Equal(t, "3", third.Response.Header.Get("X-Response"))
+	assert.Equal(t, []int{1}, caching.EventIDs(nextEvents(t, third, 1)))
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestEventStreamWithTtlShared tests that Varnish caches an event stream with a TTL while it is still being
+// fetched, such that later clients share the stream of the first client and get all of its past events replayed
+// at once. Backends must therefore mark event streams as uncacheable, like EventStreamHandler does by default.
+func TestEventStreamWithTtlShared(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server sending a TTL with the event stream
+	testServerPort, testServer := startTestServer(eventStreamHandler(&backendRequests, true))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// open a stream and read some events
+	first, err := caching.OpenEventStream(instance.Port, "/events", "1")
+	require.NoError(t, err)
+	defer first.Close()
+	nextEvents(t, first, 3)
+
+	// open another stream and expect it to replay the events of the first one
+	opened := time.Now()
+	second, err := caching.OpenEventStream(instance.Port, "/events", "2")
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, "1", second.Response.Header.Get("X-Response"))
+	events := nextEvents(t, second, 4)
+	assert.Equal(t, []int{1, 2, 3, 4}, caching.EventIDs(events))
+	assert.True(t, events[0].Sent.Before(opened))
+	assert.Less(t, events[2].Received.Sub(opened), eventInterval/2)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
@@ -0,0 +1,94 @@
+// Contains tests for how stale responses are signaled to clients
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestStaleAge tests that a stale response delivered during the grace period has an Age exceeding its max-age,
+// which is all that signals its staleness to clients by default.
+func TestStaleAge(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.ScaledSeconds(1)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:  testServerPort,
+		DefaultGrace: caching.Scaled(10 * time.Second),
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	resp := mkReq(t, instance.Port, "1", withXCacheControl(cacheControl), withCaptureHeaders("Age", "Warning"))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Equal(t, 0, ageOf(t, resp))
+
+	// wait for the response to have been stale for a second
+	eventuallyStaleFor(t, instance, "/", caching.Scaled(1*time.Second))
+
+	// expect the stale response with an Age exceeding its max-age, but without Warning
+	resp = mkReq(t, instance.Port, "2", withXCacheControl(cacheControl), withCaptureHeaders("Age", "Warning"))
+	assert.Equal(t, "1", resp.xResponse)
+	assert.Greater(t, ageOf(t, resp), caching.TimeScale())
+	assert.Equal(t, "", resp.headers["Warning"])
+
+	// wait for the background fetch and expect a fresh response
+	waitForBackgroundFetch(t, instance)
+	resp = mkReq(t, instance.Port, "3", withXCacheControl(cacheControl), withCaptureHeaders("Age", "Warning"))
+	assert.Equal(t, "2", resp.xResponse)
+	assert.LessOrEqual(t, ageOf(t, resp), caching.TimeScale())
+}
+
+// TestWarnStale tests that with WarnStale, stale responses carry a Warning header, while fresh ones do not.
+func TestWarnStale(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.ScaledSeconds(1)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:  testServerPort,
+		DefaultGrace: caching.Scaled(10 * time.Second),
+		WarnStale:    true,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send a miss and a fresh hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withHeader("Warning", ""), withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "1", withXCacheControl(cacheControl), withCaptureHeaders("Warning")))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withHeader("Warning", ""), withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "2", withXCacheControl(cacheControl), withCaptureHeaders("Warning")))
+
+	// wait for the response to become stale
+	eventuallyStale(t, instance, "/")
+
+	// expect the stale response with a Warning
+	assert.Equal(t, mkResp(http.StatusOK, "1", withHeader("Warning", `110 - "Response is Stale"`), withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "3", withXCacheControl(cacheControl), withCaptureHeaders("Warning")))
+
+	// wait for the background fetch and expect a fresh response without Warning
+	waitForBackgroundFetch(t, instance)
+	assert.Equal(t, mkResp(http.StatusOK, "3", withHeader("Warning", ""), withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "4", withXCacheControl(cacheControl), withCaptureHeaders("Warning")))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
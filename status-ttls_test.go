@@ -0,0 +1,93 @@
+// Contains tests for assigning TTLs per status
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestStatusTtls tests that responses with a status of StatusTTLs are cached, even if the status
+// is not cacheable by default or the response has max-age=0, while other statuses are not affected.
+func TestStatusTtls(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(0)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		StatusTTLs: map[int]time.Duration{
+			http.StatusNotFound:                   300 * time.Second,
+			http.StatusUnavailableForLegalReasons: 300 * time.Second,
+			http.StatusInternalServerError:        300 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	for _, status := range []int{http.StatusNotFound, http.StatusUnavailableForLegalReasons, http.StatusInternalServerError} {
+		path := "/" + strconv.Itoa(status)
+
+		// send two requests, of which the second is a hit
+		assert.Equal(t, mkResp(status, "1", withResponseCacheControl(cacheControl)),
+			mkReq(t, port, "1", withPath(path), withXStatusCode(status), withXCacheControl(cacheControl)))
+		assert.Equal(t, mkResp(status, "1", withResponseCacheControl(cacheControl)),
+			mkReq(t, port, "2", withPath(path), withXStatusCode(status), withXCacheControl(cacheControl)))
+	}
+
+	// send two requests resulting in a status without TTL, which both reach the backend
+	assert.Equal(t, mkResp(http.StatusGone, "1"), mkReq(t, port, "1", withPath("/410"), withXStatusCode(http.StatusGone)))
+	assert.Equal(t, mkResp(http.StatusGone, "2"), mkReq(t, port, "2", withPath("/410"), withXStatusCode(http.StatusGone)))
+
+	// expect 5 backend requests
+	assert.Equal(t, 5, backendRequests)
+}
+
+// TestStatusTtlsGrace tests that an expired negatively cached response is served stale during the grace period,
+// even when the backend would respond successfully by now.
+func TestStatusTtlsGrace(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort:  testServerPort,
+		DefaultGrace: 10 * time.Second,
+		StatusTTLs:   map[int]time.Duration{http.StatusNotFound: 1 * time.Second},
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request resulting in 404
+	assert.Equal(t, mkResp(http.StatusNotFound, "1"), mkReq(t, instance.Port, "1", withXStatusCode(http.StatusNotFound)))
+
+	// wait for the response to expire
+	eventuallyStale(t, instance, "/")
+
+	// send request which would result in a cacheable 200, but still expect the stale 404 response
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+	assert.Equal(t, mkResp(http.StatusNotFound, "1"), mkReq(t, instance.Port, "2", withXStatusCode(http.StatusOK), withXCacheControl(cacheControl)))
+
+	// wait for the background fetch and expect the 200 response
+	waitForBackgroundFetch(t, instance)
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "3", withXStatusCode(http.StatusOK), withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
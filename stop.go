@@ -0,0 +1,80 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"time"
+)
+
+// drainVcl rejects all new requests while the requests in flight finish with the VCL they started with.
+// Closing the connection makes clients (and load balancers) retry elsewhere instead of reusing it.
+const drainVcl = `vcl 4.1;
+
+backend default none;
+
+sub vcl_recv {
+  return (synth(503, "Draining"));
+}
+
+sub vcl_synth {
+  set resp.http.Connection = "close";
+}
+`
+
+// StopGracefully drains Varnish before stopping it, like a cache node taken out of rotation during a rolling deploy:
+// new requests are rejected with 503 and Connection: close, while the requests in flight, including their backend
+// fetches, may finish. Varnish is stopped once none is left or the given timeout has passed, in which case
+// the remaining requests are aborted and an error is returned, joined with the error of stopping if any.
+// Varnish itself does not wait for requests in flight when it is stopped.
+func (v *VarnishInstance) StopGracefully(timeout time.Duration) error {
+	err := v.useVcl("drain", drainVcl)
+	if err != nil {
+		return errors.Join(fmt.Errorf("could not drain Varnish: %w", err), v.stop())
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		busy, err := v.busyRequests()
+		if err != nil {
+			return errors.Join(fmt.Errorf("could not drain Varnish: %w", err), v.stop())
+		}
+		if busy == 0 {
+			return v.stop()
+		}
+		if time.Now().After(deadline) {
+			return errors.Join(fmt.Errorf("requests still in flight after draining Varnish for %s: %d", timeout, busy), v.stop())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// busyRequests returns the number of requests and backend fetches in flight, which use any VCL but the one draining.
+func (v *VarnishInstance) busyRequests() (int, error) {
+	vcls, err := v.LoadedVcls()
+	if err != nil {
+		return 0, err
+	}
+	busy := 0
+	for _, vcl := range vcls {
+		if vcl.Name != "drain" {
+			busy += vcl.Busy
+		}
+	}
+	return busy, nil
+}
+
+// StopImmediately kills varnishd without any grace period, like a crashed or evicted cache node, such that
+// the requests in flight are aborted. Like Stop, it reports an error if the container may have been left behind.
+func (v *VarnishInstance) StopImmediately() error {
+	// the container exiting is not a crash
+	v.log.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	err := cli.ContainerKill(ctx, v.containerID, "KILL")
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.Join(fmt.Errorf("could not kill container %s: %w", v.containerID, err), v.stop())
+	}
+	// stopping the killed container only cleans up, e.g. releases its slot (see MaxVarnishContainersEnv)
+	return v.stop()
+}
@@ -0,0 +1,208 @@
+// Contains tests for stopping Varnish, gracefully or immediately, and how requests in flight behave meanwhile
+package caching_test
+
+import (
+	"caching"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStop tests that stopping Varnish reports no error, that Varnish no longer responds afterward,
+// and that stopping it again reports no error either, since the container is already gone.
+func TestStop(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	waitForHealthy(t, instance.Port)
+
+	// send request
+	assert.Equal(t, "1", mkReq(t, instance.Port, "1").xResponse)
+
+	// stop varnish
+	assert.NoError(t, instance.Stop())
+
+	// expect varnish not to respond anymore
+	_, err = http.Get("http://localhost:" + instance.Port + "/")
+	assert.Error(t, err)
+
+	// expect stopping again to succeed
+	assert.NoError(t, instance.Stop())
+
+	// expect one backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestStopCluster tests that stopping a cluster reports no error.
+func TestStopCluster(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish cluster
+	ports, stopFunc, err := caching.StartVarnishClusterInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	}, 2)
+	require.NoError(t, err)
+	for _, port := range ports {
+		waitForHealthy(t, port)
+	}
+
+	// stop the cluster
+	assert.NoError(t, stopFunc())
+}
+
+// TestStopGracefully tests that draining Varnish rejects new requests with 503 and Connection: close,
+// while a request in flight finishes with the response of the backend before Varnish is stopped.
+func TestStopGracefully(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var barriers caching.Barriers
+
+	// start a test server which blocks requests to /slow at a barrier
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/slow": barriers.Wait("fetch", echoCacheControlHandler(&backendRequests)),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	waitForHealthy(t, instance.Port)
+
+	// send request and wait for its fetch to be in flight
+	inFlight := make(chan response)
+	go func() { inFlight <- mkReq(t, instance.Port, "1", withPath("/slow")) }()
+	require.NoError(t, barriers.AwaitArrivals("fetch", 1, 10*time.Second))
+
+	// start draining varnish and wait for the draining VCL to be active
+	stopped := make(chan error)
+	go func() { stopped <- instance.StopGracefully(10 * time.Second) }()
+	require.Eventually(t, func() bool {
+		vcls, err := instance.LoadedVcls()
+		return err == nil && len(vcls) == 2 && vcls[1].Name == "drain" && vcls[1].Active
+	}, eventuallyTimeout, eventuallyTick, "draining VCL not active")
+
+	// send another request, which is rejected and closes the connection
+	resp := rawReq(t, instance.Port, fmt.Sprintf("GET /slow HTTP/1.1\r\nHost: localhost:%s\r\nX-Request: 2\r\n\r\n", instance.Port))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	// expect varnish to wait for the request in flight
+	select {
+	case err := <-stopped:
+		t.Fatalf("varnish stopped with requests in flight: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// release the fetch, after which the request in flight finishes and varnish stops
+	barriers.Release("fetch")
+	assert.Equal(t, mkResp(http.StatusOK, "1"), <-inFlight)
+	assert.NoError(t, <-stopped)
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestStopGracefullyTimeout tests that draining Varnish gives up on a request in flight after the timeout,
+// aborts it and reports that.
+func TestStopGracefullyTimeout(t *testing.T) {
+	t.Parallel()
+	var backendRequests atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+
+	// start a test server which holds requests until the test finishes
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/":     countingEchoCacheControlHandler(&backendRequests),
+		"/slow": holdingHandler(&backendRequests, release),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	waitForHealthy(t, instance.Port)
+
+	// send request, which is held by the backend
+	inFlight := make(chan error)
+	go func() {
+		resp, err := http.Get("http://localhost:" + instance.Port + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+	eventuallyBackendRequests(t, &backendRequests, 1)
+
+	// expect draining to time out
+	start := time.Now()
+	err = instance.StopGracefully(1 * time.Second)
+	assert.ErrorContains(t, err, "requests still in flight after draining Varnish for 1s: 1")
+	assert.GreaterOrEqual(t, time.Since(start), 1*time.Second)
+
+	// expect the request in flight to be aborted
+	assert.Error(t, <-inFlight)
+}
+
+// TestStopImmediately tests that killing Varnish aborts a request in flight right away.
+func TestStopImmediately(t *testing.T) {
+	t.Parallel()
+	var backendRequests atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+
+	// start a test server which holds requests until the test finishes
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/":     countingEchoCacheControlHandler(&backendRequests),
+		"/slow": holdingHandler(&backendRequests, release),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	waitForHealthy(t, instance.Port)
+
+	// send request, which is held by the backend
+	inFlight := make(chan error)
+	go func() {
+		resp, err := http.Get("http://localhost:" + instance.Port + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+	eventuallyBackendRequests(t, &backendRequests, 1)
+
+	// kill varnish
+	start := time.Now()
+	assert.NoError(t, instance.StopImmediately())
+
+	// expect the request in flight to be aborted right away
+	assert.Error(t, <-inFlight)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,78 @@
+package caching
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SwitchPolicy decides what happens to the objects cached from the previous backend when
+// VarnishInstance.SwitchBackend switches to another one.
+type SwitchPolicy string
+
+const (
+	// KeepObjects keeps delivering the objects of the previous backend until they expire,
+	// and only fetches from the new backend afterwards.
+	KeepObjects SwitchPolicy = "keep"
+	// ExpireObjects treats the objects cached before the switch as expired: within their grace, they are still
+	// delivered while being refetched from the new backend in the background, where the new backend can revalidate
+	// them by their validators if they have a keep period. Without grace, they are fetched right away.
+	ExpireObjects SwitchPolicy = "expire"
+	// PurgeObjects bans all cached objects, such that all requests are fetched from the new backend.
+	PurgeObjects SwitchPolicy = "purge"
+)
+
+// SwitchBackend repoints Varnish to the backend on the given port of the same host, like a blue/green deployment
+// switching from one backend to the other. The VCL is rendered with the new port and activated with vcl.use, which
+// switches all new backend fetches at once, while fetches in flight finish with the previous backend. The objects
+// cached from the previous backend are handled according to the given policy. Later calls of ReloadVCL keep
+// the new backend, while Restart goes back to the VCL the instance was started with.
+func (v *VarnishInstance) SwitchBackend(port string, policy SwitchPolicy) error {
+	config := v.config
+	config.BackendPort = port
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+	if policy != KeepObjects && policy != ExpireObjects && policy != PurgeObjects {
+		return fmt.Errorf("unknown switch policy %q", policy)
+	}
+	previous := v.switchedAt
+	if policy == ExpireObjects {
+		v.switchedAt = time.Now()
+	}
+	v.reloads++
+	err = v.useVcl("switch"+strconv.Itoa(v.reloads), renderVcl(config, v.instanceVcl()))
+	if err != nil {
+		v.switchedAt = previous
+		return err
+	}
+	v.config = config
+	if policy == PurgeObjects {
+		_, err = execInContainer(v.containerID, "varnishadm", "-n", "/tmp/varnish_workdir", "ban", "obj.status", "!=", "0")
+		if err != nil {
+			return fmt.Errorf("could not ban the objects of the previous backend: %w", err)
+		}
+	}
+	return nil
+}
+
+// instanceVcl returns the VCL the instance adds before the custom VCL: the probe for ObjectInfo and, after
+// SwitchBackend with ExpireObjects, the limit of req.ttl treating the objects cached before the switch as expired.
+func (v *VarnishInstance) instanceVcl() string {
+	var vcl string
+	if v.probeSecret != "" {
+		vcl = objectInfoVcl(v.probeSecret)
+	}
+	if !v.switchedAt.IsZero() {
+		// the clock of the container is the one of the host
+		switchedAt := strconv.FormatFloat(float64(v.switchedAt.UnixMicro())/1e6, 'f', 6, 64)
+		vcl += `
+import std;
+sub vcl_recv {
+  set req.ttl = now - std.time("` + switchedAt + `", now);
+}
+`
+	}
+	return vcl
+}
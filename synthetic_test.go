@@ -0,0 +1,165 @@
+// Contains tests for synthetic responses
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// brokenBackendHandler returns a backend handler which responds with garbage instead of an HTTP response,
+// such that the backend fetch fails.
+func brokenBackendHandler(backendRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "this is not HTTP\r\n\r\n")
+	}
+}
+
+// TestSyntheticMaintenancePage tests that a synthetic response with a condition is delivered
+// without contacting the backend.
+func TestSyntheticMaintenancePage(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Synthetics: []caching.Synthetic{{
+			Status:    http.StatusServiceUnavailable,
+			Condition: `req.url ~ "^/maintenance/"`,
+			Body:      "down for maintenance",
+			Headers:   map[string]string{"Retry-After": "120"},
+		}},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests matching the condition
+	for _, xRequest := range []string{"1", "2"} {
+		assert.Equal(t, mkResp(http.StatusServiceUnavailable, "", withBody("down for maintenance"), withHeader("Retry-After", "120")),
+			mkReq(t, port, xRequest, withPath("/maintenance/page"), withStoreBody(), withCaptureHeaders("Retry-After")))
+	}
+
+	// send request not matching the condition
+	assert.Equal(t, mkResp(http.StatusOK, "3"), mkReq(t, port, "3"))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestSyntheticCustom404 tests that a synthetic response applies to synth() calls of the custom VCL with its status.
+func TestSyntheticCustom404(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a custom VCL
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Synthetics: []caching.Synthetic{{
+			Status:  http.StatusNotFound,
+			Body:    "nothing to see here",
+			Headers: map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		}},
+		Vcl: `
+sub vcl_recv {
+  if (req.url ~ "^/hidden") {
+    return (synth(404));
+  }
+}
+`,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request
+	assert.Equal(t, mkResp(http.StatusNotFound, "", withBody("nothing to see here"), withHeader("Content-Type", "text/plain; charset=utf-8")),
+		mkReq(t, port, "1", withPath("/hidden"), withStoreBody(), withCaptureHeaders("Content-Type")))
+
+	// expect 0 backend requests
+	assert.Equal(t, 0, backendRequests)
+}
+
+// TestSyntheticBackendError tests that a synthetic response replaces the response to a failed backend fetch
+// and is not cached without a TTL.
+func TestSyntheticBackendError(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(brokenBackendHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Synthetics: []caching.Synthetic{{
+			Status:         http.StatusBadGateway,
+			OnBackendError: true,
+			Body:           "backend failed",
+		}},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests
+	for _, xRequest := range []string{"1", "2"} {
+		assert.Equal(t, mkResp(http.StatusBadGateway, "", withBody("backend failed")), mkReq(t, port, xRequest, withStoreBody()))
+	}
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
+
+// TestSyntheticBackendErrorCached tests that a synthetic response to a failed backend fetch is cached for its TTL.
+func TestSyntheticBackendErrorCached(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+
+	// start a test server
+	testServerPort, testServer := startTestServer(brokenBackendHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Synthetics: []caching.Synthetic{{
+			Status:         http.StatusBadGateway,
+			OnBackendError: true,
+			Ttl:            10 * time.Second,
+			Body:           "backend failed",
+		}},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests
+	for _, xRequest := range []string{"1", "2"} {
+		assert.Equal(t, mkResp(http.StatusBadGateway, "", withBody("backend failed")), mkReq(t, port, xRequest, withStoreBody()))
+	}
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
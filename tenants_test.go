@@ -0,0 +1,191 @@
+// Contains tests for caching policies per tenant, i.e. per Host header
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestTenantTtl tests that the TTL of a tenant only applies to the objects of its host.
+func TestTenantTtl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(60)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a short TTL for a.example
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Tenants:     []caching.Tenant{{Host: "a.example", Ttl: 1 * time.Second}, {Host: "b.example"}},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for both hosts
+	assert.Equal(t, "a1", mkReq(t, port, "a1", withHost("a.example"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "b1", mkReq(t, port, "b1", withHost("b.example"), withXCacheControl(cacheControl)).xResponse)
+
+	// wait for the TTL of a.example to pass
+	time.Sleep(2 * time.Second)
+
+	// send requests and expect the object of a.example to be fetched again, but not the one of b.example
+	assert.Equal(t, "a2", mkReq(t, port, "a2", withHost("A.Example"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "b1", mkReq(t, port, "b2", withHost("b.example"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestTenantPurgeIsolation tests that a tenant can purge and ban its own objects with its secret,
+// but neither the objects of another tenant nor its own without the secret.
+func TestTenantPurgeIsolation(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Tenants: []caching.Tenant{
+			{Host: "a.example", PurgeSecret: "secret-a"},
+			{Host: "b.example", PurgeSecret: "secret-b"},
+		},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests for the same paths of both hosts
+	for _, host := range []string{"a.example", "b.example"} {
+		for _, path := range []string{"/", "/products/1"} {
+			mkReq(t, port, host+path, withHost(host), withPath(path), withXCacheControl(cacheControl))
+		}
+	}
+
+	// send PURGE and BAN requests of a.example for b.example, and without a secret, and expect them to be rejected
+	assert.Equal(t, mkResp(http.StatusForbidden, ""), mkReq(t, port, "purge", withHost("b.example"), withMethod("PURGE"),
+		withRequestHeader("X-Purge-Secret", "secret-a")))
+	assert.Equal(t, mkResp(http.StatusForbidden, ""), mkReq(t, port, "ban", withHost("b.example"), withPath("/products/"),
+		withMethod("BAN"), withRequestHeader("X-Purge-Secret", "secret-a")))
+	assert.Equal(t, mkResp(http.StatusForbidden, ""), mkReq(t, port, "purge", withHost("a.example"), withMethod("PURGE")))
+
+	// send PURGE and BAN requests of a.example for its own objects
+	assert.Equal(t, mkResp(http.StatusOK, "", withAcceptRanges("")), mkReq(t, port, "purge", withHost("a.example"),
+		withMethod("PURGE"), withRequestHeader("X-Purge-Secret", "secret-a")))
+	assert.Equal(t, mkResp(http.StatusOK, "", withAcceptRanges("")), mkReq(t, port, "ban", withHost("a.example"),
+		withPath("/products/"), withMethod("BAN"), withRequestHeader("X-Purge-Secret", "secret-a")))
+
+	// expect the objects of a.example to be fetched again, but not the ones of b.example
+	for _, host := range []string{"a.example", "b.example"} {
+		for _, path := range []string{"/", "/products/1"} {
+			expected := host + path
+			if host == "a.example" {
+				expected = "new"
+			}
+			assert.Equal(t, expected, mkReq(t, port, "new", withHost(host), withPath(path),
+				withXCacheControl(cacheControl)).xResponse, host+path)
+		}
+	}
+
+	// expect 6 backend requests
+	assert.Equal(t, 6, backendRequests)
+}
+
+// TestTenantBanMixedCaseHost tests that a BAN request of a tenant spelling its Host header in mixed case bans
+// the objects of the tenant whichever way their requests spelled it, but not the objects of other tenants.
+func TestTenantBanMixedCaseHost(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container with a tenant configured in mixed case
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Tenants: []caching.Tenant{
+			{Host: "Shop.Example", PurgeSecret: "secret-shop"},
+			{Host: "b.example", PurgeSecret: "secret-b"},
+		},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send requests spelling the host of the tenant in different ways, and one for the other tenant
+	assert.Equal(t, "lower", mkReq(t, port, "lower", withHost("shop.example"), withPath("/products/1"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "upper", mkReq(t, port, "upper", withHost("SHOP.EXAMPLE"), withPath("/products/1"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "b", mkReq(t, port, "b", withHost("b.example"), withPath("/products/1"), withXCacheControl(cacheControl)).xResponse)
+
+	// send a BAN request of the tenant in mixed case
+	assert.Equal(t, mkResp(http.StatusOK, "", withAcceptRanges("")), mkReq(t, port, "ban", withHost("sHoP.eXaMpLe"),
+		withPath("/products/"), withMethod("BAN"), withRequestHeader("X-Purge-Secret", "secret-shop")))
+
+	// expect the objects of the tenant to be fetched again, but not the one of the other tenant
+	assert.Equal(t, "new lower", mkReq(t, port, "new lower", withHost("shop.example"), withPath("/products/1"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "new upper", mkReq(t, port, "new upper", withHost("SHOP.EXAMPLE"), withPath("/products/1"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "b", mkReq(t, port, "new b", withHost("b.example"), withPath("/products/1"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect 5 backend requests
+	assert.Equal(t, 5, backendRequests)
+}
+
+// TestTenantNoCrossPoisoning tests that requests for one tenant which name another tenant in other headers
+// or in a differently spelled Host header do not replace the objects of the other tenant.
+func TestTenantNoCrossPoisoning(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server
+	testServerPort, testServer := startTestServer(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Tenants:     []caching.Tenant{{Host: "a.example"}, {Host: "b.example"}},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request for b.example
+	assert.Equal(t, "b", mkReq(t, port, "b", withHost("b.example"), withXCacheControl(cacheControl)).xResponse)
+
+	// send requests for a.example naming b.example in other ways, and expect them to be fetched
+	assert.Equal(t, "forwarded", mkReq(t, port, "forwarded", withHost("a.example"),
+		withRequestHeader("X-Forwarded-Host", "b.example"), withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "port", mkReq(t, port, "port", withHost("b.example:8080"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect the object of b.example to be intact
+	assert.Equal(t, "b", mkReq(t, port, "check", withHost("b.example"), withXCacheControl(cacheControl)).xResponse)
+
+	// expect 3 backend requests
+	assert.Equal(t, 3, backendRequests)
+}
+
+// TestInvalidTenants tests that invalid and duplicate hosts and negative durations of tenants are rejected.
+func TestInvalidTenants(t *testing.T) {
+	t.Parallel()
+	_, err := caching.Start(caching.WithBackend("8080"), caching.WithConfig(func(c *caching.VarnishConfig) {
+		c.Tenants = []caching.Tenant{{Host: "a.example", Ttl: -1 * time.Minute}, {Host: "A.example"}, {Host: `"evil`}}
+	}))
+	assert.EqualError(t, err, `Tenants[0].Ttl must be >= 0
+Tenants[1].Host "A.example" is not unique
+Tenants[2].Host must be a host like example.com, not "\"evil"`)
+}
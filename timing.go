@@ -0,0 +1,150 @@
+package caching
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// TimeScaleEnv is the environment variable setting the time scale of Scaled instead of calibrating it,
+// e.g. CACHING_TIME_SCALE=3 on a slow CI runner, or CACHING_TIME_SCALE=1 to skip the calibration.
+const TimeScaleEnv = "CACHING_TIME_SCALE"
+
+// maxTimeScale bounds the calibrated time scale, such that a host which is hardly responsive does not make
+// the scenarios wait for minutes.
+const maxTimeScale = 10
+
+// requestBudget, hitBudget and startBudget are the latencies of a miss and of a hit through Varnish and of starting
+// a Varnish container which the margins of timing-sensitive scenarios tolerate at a time scale of 1, e.g. a request
+// sent 100ms before its object expires, or a stale hit expected within 100ms instead of waiting for the backend.
+const (
+	requestBudget = 25 * time.Millisecond
+	hitBudget     = 10 * time.Millisecond
+	startBudget   = 10 * time.Second
+)
+
+// calibrationRequests is the number of misses and hits Calibrate measures.
+const calibrationRequests = 20
+
+// timeScale is the factor of Scaled.
+var timeScale atomic.Int64
+
+func init() {
+	timeScale.Store(1)
+}
+
+// TimeScale returns the factor by which Scaled stretches durations, which is 1 unless set by SetTimeScale.
+func TimeScale() int {
+	return int(timeScale.Load())
+}
+
+// SetTimeScale sets the factor by which Scaled stretches durations. It must be at least 1.
+func SetTimeScale(scale int) {
+	if scale < 1 {
+		panic(fmt.Sprintf("invalid time scale %d", scale))
+	}
+	timeScale.Store(int64(scale))
+}
+
+// Scaled returns the given duration stretched by the time scale. Timing-sensitive scenarios scale their TTLs, grace
+// periods and waits alike, such that they keep their proportions, while the margins grow with the latency of a slow
+// host. The scale is a whole number, so whole seconds remain whole seconds (see ScaledSeconds).
+func Scaled(d time.Duration) time.Duration {
+	return d * time.Duration(timeScale.Load())
+}
+
+// ScaledSeconds returns a present DeltaSeconds of the given number of seconds stretched by the time scale,
+// e.g. for a max-age which matches a TTL of Scaled(time.Second).
+func ScaledSeconds(seconds int) DeltaSeconds {
+	return Seconds(seconds * TimeScale())
+}
+
+// Calibration is the latency of the host measured by Calibrate, and the time scale derived from it.
+type Calibration struct {
+	// ContainerStart is how long starting a Varnish container took until it served requests.
+	ContainerStart time.Duration
+	// Miss and Hit are the slowest of the misses and of the hits, each sent through Varnish to a local backend.
+	Miss time.Duration
+	Hit  time.Duration
+	// Scale is the time scale which keeps these latencies within the margins of the scenarios.
+	Scale int
+}
+
+// Calibrate starts a Varnish container in front of a local backend and measures how long starting it took and how
+// long the slowest misses and hits took. The time scale is the largest factor by which these exceed the latencies the
+// scenarios tolerate, rounded up, at least 1 and at most 10. It does not change the time scale.
+func Calibrate() (Calibration, error) {
+	backendPort, backend := StartTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	var calibration Calibration
+	start := time.Now()
+	instance, err := StartVarnishInstanceInDocker(VarnishConfig{BackendPort: backendPort, DefaultTtl: time.Minute})
+	if err != nil {
+		return calibration, err
+	}
+	defer instance.Stop()
+	err = waitUntilHealthy(instance.Port, 30*time.Second)
+	if err != nil {
+		return calibration, err
+	}
+	calibration.ContainerStart = time.Since(start)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	get := func(url string) (time.Duration, error) {
+		start := time.Now()
+		response, err := client.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+		_, err = io.Copy(io.Discard, response.Body)
+		return time.Since(start), err
+	}
+	for i := 0; i < calibrationRequests; i++ {
+		url := fmt.Sprintf("http://localhost:%s/calibrate/%d", instance.Port, i)
+		miss, err := get(url)
+		if err != nil {
+			return calibration, err
+		}
+		hit, err := get(url)
+		if err != nil {
+			return calibration, err
+		}
+		calibration.Miss = max(calibration.Miss, miss)
+		calibration.Hit = max(calibration.Hit, hit)
+	}
+
+	ceil := func(d time.Duration, budget time.Duration) int {
+		return int((d + budget - 1) / budget)
+	}
+	calibration.Scale = min(max(1, ceil(calibration.Miss, requestBudget), ceil(calibration.Hit, hitBudget),
+		ceil(calibration.ContainerStart, startBudget)), maxTimeScale)
+	return calibration, nil
+}
+
+// CalibrateTimeScale sets the time scale to the one of TimeScaleEnv if set, and to the one measured by Calibrate
+// otherwise, which it returns. It is meant to be called once before the scenarios run, e.g. in TestMain.
+// If the calibration fails, the time scale remains unchanged.
+func CalibrateTimeScale() (Calibration, error) {
+	if value := os.Getenv(TimeScaleEnv); value != "" {
+		scale, err := strconv.Atoi(value)
+		if err != nil || scale < 1 {
+			return Calibration{}, fmt.Errorf("invalid %s %q", TimeScaleEnv, value)
+		}
+		SetTimeScale(scale)
+		return Calibration{Scale: scale}, nil
+	}
+	calibration, err := Calibrate()
+	if err != nil {
+		return calibration, err
+	}
+	SetTimeScale(calibration.Scale)
+	return calibration, nil
+}
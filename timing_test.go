@@ -0,0 +1,31 @@
+// Contains tests for the time scale of timing-sensitive scenarios
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestTimeScaleEnv tests that TimeScaleEnv sets the time scale without calibrating it, and that invalid values
+// leave it unchanged. It does not run in parallel, since the other tests scale their waits.
+func TestTimeScaleEnv(t *testing.T) {
+	defer caching.SetTimeScale(caching.TimeScale())
+
+	// set a time scale of 3 and expect durations and seconds to be tripled
+	t.Setenv(caching.TimeScaleEnv, "3")
+	calibration, err := caching.CalibrateTimeScale()
+	require.NoError(t, err)
+	assert.Equal(t, 3, calibration.Scale)
+	assert.Equal(t, 3, caching.TimeScale())
+	assert.Equal(t, 1500*time.Millisecond, caching.Scaled(500*time.Millisecond))
+	assert.Equal(t, caching.Seconds(3), caching.ScaledSeconds(1))
+
+	// set an invalid time scale and expect the previous one to remain
+	t.Setenv(caching.TimeScaleEnv, "0")
+	_, err = caching.CalibrateTimeScale()
+	assert.EqualError(t, err, `invalid CACHING_TIME_SCALE "0"`)
+	assert.Equal(t, 3, caching.TimeScale())
+}
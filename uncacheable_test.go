@@ -0,0 +1,183 @@
+// Contains tests for marking responses with certain statuses as uncacheable
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestUncacheableStatuses tests that responses with a status of UncacheableStatuses are not cached,
+// even though the status is cacheable by default, and that concurrent requests are not coalesced
+// while the hit-for-miss object lives.
+func TestUncacheableStatuses(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	sleepTime := caching.Scaled(1 * time.Second)
+
+	// start a test server responding slowly
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleepTime)
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		DefaultTtl:          300 * time.Second,
+		UncacheableStatuses: []int{http.StatusNotFound},
+		UncacheableTtl:      caching.Scaled(10 * time.Second),
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request creating the hit-for-miss object
+	assert.Equal(t, mkResp(http.StatusNotFound, "first"), mkReq(t, port, "first", withXStatusCode(http.StatusNotFound)))
+
+	const N = 5
+
+	// send N requests in parallel, which all reach the backend in parallel
+	elapsed := inParallel(N, func(i int) {
+		assert.Equal(t, mkResp(http.StatusNotFound, strconv.Itoa(i)), mkReq(t, port, strconv.Itoa(i), withXStatusCode(http.StatusNotFound)))
+	})
+	assert.Less(t, elapsed, sleepTime+caching.Scaled(500*time.Millisecond))
+
+	// expect N+1 backend requests
+	assert.Equal(t, N+1, backendRequests)
+}
+
+// TestUncacheableTtl tests that once the hit-for-miss object expired after UncacheableTtl,
+// concurrent requests are coalesced again, such that they wait for the first backend request.
+func TestUncacheableTtl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	sleepTime := caching.Scaled(1 * time.Second)
+
+	// start a test server responding slowly
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleepTime)
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:         testServerPort,
+		DefaultTtl:          300 * time.Second,
+		UncacheableStatuses: []int{http.StatusNotFound},
+		UncacheableTtl:      caching.Scaled(1 * time.Second),
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request creating the hit-for-miss object
+	assert.Equal(t, mkResp(http.StatusNotFound, "first"), mkReq(t, port, "first", withXStatusCode(http.StatusNotFound)))
+
+	// wait to let the hit-for-miss object expire
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
+
+	const N = 5
+
+	// send N requests in parallel. The first one reaches the backend, while the others wait for it
+	// on the waiting list. Its response creates a new hit-for-miss object, after which the others
+	// reach the backend in parallel, so that this takes about 2 * sleepTime.
+	elapsed := inParallel(N, func(i int) {
+		assert.Equal(t, mkResp(http.StatusNotFound, strconv.Itoa(i)), mkReq(t, port, strconv.Itoa(i), withXStatusCode(http.StatusNotFound)))
+	})
+	assert.Greater(t, elapsed, 2*sleepTime-caching.Scaled(100*time.Millisecond))
+	assert.Less(t, elapsed, 2*sleepTime+caching.Scaled(500*time.Millisecond))
+
+	// expect N+1 backend requests
+	assert.Equal(t, N+1, backendRequests)
+}
+
+// TestHitForMissTtl tests that once the hit-for-miss object created by the built-in VCL expired after HitForMissTtl,
+// concurrent requests are coalesced again, such that they wait for the first backend request.
+func TestHitForMissTtl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	sleepTime := caching.Scaled(1 * time.Second)
+	noStore := caching.CacheControl{NoStore: true}
+
+	// start a test server responding slowly
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleepTime)
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		HitForMissTtl: caching.Scaled(1 * time.Second),
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send request creating the hit-for-miss object
+	assert.Equal(t, mkResp(http.StatusOK, "first", withResponseCacheControl(noStore)), mkReq(t, port, "first", withXCacheControl(noStore)))
+
+	// wait to let the hit-for-miss object expire
+	time.Sleep(caching.Scaled(1100 * time.Millisecond))
+
+	const N = 5
+
+	// send N requests in parallel. The first one reaches the backend, while the others wait for it
+	// on the waiting list. Its response creates a new hit-for-miss object, after which the others
+	// reach the backend in parallel, so that this takes about 2 * sleepTime.
+	elapsed := inParallel(N, func(i int) {
+		assert.Equal(t, mkResp(http.StatusOK, strconv.Itoa(i), withResponseCacheControl(noStore)),
+			mkReq(t, port, strconv.Itoa(i), withXCacheControl(noStore)))
+	})
+	assert.Greater(t, elapsed, 2*sleepTime-caching.Scaled(100*time.Millisecond))
+	assert.Less(t, elapsed, 2*sleepTime+caching.Scaled(500*time.Millisecond))
+
+	// expect N+1 backend requests
+	assert.Equal(t, N+1, backendRequests)
+}
+
+// TestZeroHitForMissTtl documents why the built-in VCL keeps hit-for-miss objects for 120s: without a usable
+// hit-for-miss object, concurrent requests for an uncacheable response are serialized on the waiting list,
+// since each response only wakes up the next request, which fetches from the backend again.
+func TestZeroHitForMissTtl(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	sleepTime := caching.Scaled(500 * time.Millisecond)
+	noStore := caching.CacheControl{NoStore: true}
+
+	// start a test server responding slowly
+	testServerPort, testServer := startTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleepTime)
+		echoCacheControlHandler(&backendRequests)(w, r)
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:   testServerPort,
+		HitForMissTtl: -time.Second,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	const N = 4
+
+	// send N requests in parallel, which reach the backend one after the other
+	elapsed := inParallel(N, func(i int) {
+		assert.Equal(t, mkResp(http.StatusOK, strconv.Itoa(i), withResponseCacheControl(noStore)),
+			mkReq(t, port, strconv.Itoa(i), withXCacheControl(noStore)))
+	})
+	assert.Greater(t, elapsed, N*sleepTime-caching.Scaled(100*time.Millisecond))
+
+	// expect N backend requests
+	assert.Equal(t, N, backendRequests)
+}
@@ -0,0 +1,69 @@
+// Contains tests for a backend listening on a Unix domain socket
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestUnixSocketBackend tests that Varnish fetches from a backend listening on a Unix domain socket
+// mounted into the container, and caches its responses like those of a TCP backend.
+func TestUnixSocketBackend(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server listening on a Unix domain socket
+	socket, testServer := caching.StartTestServerOnSocket(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container connecting to the socket
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendSocket: socket,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send requests, the second of which is a hit
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "2", withXCacheControl(cacheControl)))
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestUnixSocketBackendReload tests that a reloaded VCL still connects to the Unix domain socket,
+// since the socket is referred to by its path in the container rather than a resolved address.
+func TestUnixSocketBackendReload(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+
+	// start a test server listening on a Unix domain socket
+	socket, testServer := caching.StartTestServerOnSocket(echoCacheControlHandler(&backendRequests))
+	defer testServer.Close()
+
+	// start varnish container connecting to the socket
+	instance, err := caching.StartVarnishInstanceInDocker(caching.VarnishConfig{
+		BackendSocket: socket,
+	})
+	require.NoError(t, err)
+	defer instance.Stop()
+	waitForHealthy(t, instance.Port)
+
+	// send request, reload the VCL and send a request for another path
+	assert.Equal(t, mkResp(http.StatusOK, "1", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "1", withXCacheControl(cacheControl)))
+	require.NoError(t, instance.ReloadVCL(""))
+	assert.Equal(t, mkResp(http.StatusOK, "2", withResponseCacheControl(cacheControl)),
+		mkReq(t, instance.Port, "2", withPath("/other"), withXCacheControl(cacheControl)))
+
+	// expect 2 backend requests
+	assert.Equal(t, 2, backendRequests)
+}
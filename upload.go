@@ -0,0 +1,123 @@
+package caching
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ChunkedBody is a request body which is read in chunks of a fixed size with a pause before each chunk but the
+// first, like a slow upload. Since its length is unknown to the HTTP client, it is sent with chunked encoding.
+// It is safe for concurrent use, but can only be sent once.
+type ChunkedBody struct {
+	body      []byte
+	chunkSize int
+	pause     time.Duration
+
+	mutex    sync.Mutex
+	offset   int
+	finished time.Time
+}
+
+// NewChunkedBody returns a body sending the given bytes in chunks of the given size with the given pause in between.
+func NewChunkedBody(body []byte, chunkSize int, pause time.Duration) *ChunkedBody {
+	return &ChunkedBody{body: body, chunkSize: chunkSize, pause: pause}
+}
+
+// Read reads at most the next chunk, pausing before each chunk but the first.
+func (b *ChunkedBody) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	offset := b.offset
+	b.mutex.Unlock()
+	if offset == len(b.body) {
+		return 0, io.EOF
+	}
+	if offset > 0 && offset%b.chunkSize == 0 {
+		time.Sleep(b.pause)
+	}
+	// read up to the end of the current chunk
+	end := min(offset-offset%b.chunkSize+b.chunkSize, len(b.body), offset+len(p))
+	n := copy(p, b.body[offset:end])
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.offset += n
+	if b.offset == len(b.body) {
+		b.finished = time.Now()
+	}
+	return n, nil
+}
+
+// Finished returns when the last byte was read, which is the zero time until then.
+func (b *ChunkedBody) Finished() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.finished
+}
+
+// Upload is a request body received by a backend handler wrapped by UploadRecorder.
+type Upload struct {
+	// Size is the number of bytes received.
+	Size int64
+	// ContentDigest is the SHA-256 digest of the received bytes like ContentDigest returns it.
+	ContentDigest string
+	// Chunked is true if the body was sent with chunked encoding rather than with a Content-Length.
+	Chunked bool
+	// FirstByte and LastByte are when the first and the last byte of the body were received.
+	FirstByte time.Time
+	LastByte  time.Time
+}
+
+// Throughput returns the bytes per second received between the first and the last byte.
+func (u Upload) Throughput() float64 {
+	return float64(u.Size) / u.LastByte.Sub(u.FirstByte).Seconds()
+}
+
+// UploadRecorder records the request bodies received by the backend with their timing, such that tests can assert
+// whether Varnish streams request bodies to the backend or buffers them first. It is safe for concurrent use.
+type UploadRecorder struct {
+	mutex   sync.Mutex
+	uploads []Upload
+}
+
+// Wrap returns a backend handler which reads and records the body of each request before passing it on to next,
+// which receives an empty body. Requests whose body cannot be read completely are recorded as well.
+func (ur *UploadRecorder) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload := Upload{Chunked: r.ContentLength == -1}
+		digest := sha256.New()
+		buffer := make([]byte, 32*1024)
+		var err error
+		for err == nil {
+			var n int
+			n, err = r.Body.Read(buffer)
+			if n > 0 {
+				if upload.Size == 0 {
+					upload.FirstByte = time.Now()
+				}
+				upload.Size += int64(n)
+				upload.LastByte = time.Now()
+				digest.Write(buffer[:n])
+			}
+		}
+		upload.ContentDigest = "sha-256=:" + base64.StdEncoding.EncodeToString(digest.Sum(nil)) + ":"
+		ur.mutex.Lock()
+		ur.uploads = append(ur.uploads, upload)
+		ur.mutex.Unlock()
+		if err != io.EOF {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Uploads returns the request bodies recorded so far in the order they were received completely.
+func (ur *UploadRecorder) Uploads() []Upload {
+	ur.mutex.Lock()
+	defer ur.mutex.Unlock()
+	uploads := make([]Upload, len(ur.uploads))
+	copy(uploads, ur.uploads)
+	return uploads
+}
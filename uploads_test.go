@@ -0,0 +1,119 @@
+// Contains tests for large request bodies uploaded through Varnish
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestStreamingUpload tests that Varnish streams a chunked request body of several megabytes to the backend
+// while the client is still sending it, instead of buffering it first, and that the body arrives unchanged.
+func TestStreamingUpload(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var uploads caching.UploadRecorder
+	payload := caching.RandomBody(4*1024*1024, 1)
+
+	// start a test server
+	testServerPort, testServer := startTestServer(uploads.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a POST request with a body of 8 chunks, uploaded in about 1.4 seconds
+	body := caching.NewChunkedBody(payload, 512*1024, 200*time.Millisecond)
+	assert.Equal(t, mkResp(http.StatusOK, "1", withAcceptRanges("")), mkReq(t, port, "1", withMethod(http.MethodPost), withRequestBodyReader(body)))
+
+	// expect the backend to have received the complete body with chunked encoding,
+	// starting long before the client had sent all of it
+	require.Len(t, uploads.Uploads(), 1)
+	upload := uploads.Uploads()[0]
+	assert.Equal(t, int64(len(payload)), upload.Size)
+	assert.Equal(t, caching.ContentDigest(payload), upload.ContentDigest)
+	assert.True(t, upload.Chunked)
+	assert.Less(t, upload.FirstByte, body.Finished().Add(-time.Second))
+	t.Logf("upload throughput: %.0f bytes/s", upload.Throughput())
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestBufferedUpload tests that with CacheRequestBody, Varnish only sends a request body to the backend
+// once the client has sent all of it, with a Content-Length instead of chunked encoding.
+func TestBufferedUpload(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var uploads caching.UploadRecorder
+	payload := caching.RandomBody(2*1024*1024, 2)
+
+	// start a test server
+	testServerPort, testServer := startTestServer(uploads.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container buffering request bodies, with a storage large enough for them
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		StorageSize:      "16M",
+		CacheRequestBody: "4MB",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a POST request with a body of 4 chunks, uploaded in about 0.6 seconds
+	body := caching.NewChunkedBody(payload, 512*1024, 200*time.Millisecond)
+	assert.Equal(t, mkResp(http.StatusOK, "1", withAcceptRanges("")), mkReq(t, port, "1", withMethod(http.MethodPost), withRequestBodyReader(body)))
+
+	// expect the backend to have received the complete body with a Content-Length,
+	// only after the client had sent all of it
+	require.Len(t, uploads.Uploads(), 1)
+	upload := uploads.Uploads()[0]
+	assert.Equal(t, int64(len(payload)), upload.Size)
+	assert.Equal(t, caching.ContentDigest(payload), upload.ContentDigest)
+	assert.False(t, upload.Chunked)
+	assert.Greater(t, upload.FirstByte, body.Finished())
+
+	// expect 1 backend request
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestUploadExceedingCacheRequestBody tests that with CacheRequestBody, Varnish responds to a request
+// whose body exceeds the size with 413, without sending any of it to the backend.
+func TestUploadExceedingCacheRequestBody(t *testing.T) {
+	t.Parallel()
+	var backendRequests int
+	var uploads caching.UploadRecorder
+	payload := caching.RandomBody(2*1024*1024, 3)
+
+	// start a test server
+	testServerPort, testServer := startTestServer(uploads.Wrap(echoCacheControlHandler(&backendRequests)))
+	defer testServer.Close()
+
+	// start varnish container buffering request bodies of up to 1MB
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		StorageSize:      "16M",
+		CacheRequestBody: "1MB",
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// send a POST request with a body of 2MB
+	body := caching.NewChunkedBody(payload, 512*1024, 0)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, mkReq(t, port, "1", withMethod(http.MethodPost), withRequestBodyReader(body)).statusCode)
+
+	// expect no backend request
+	assert.Empty(t, uploads.Uploads())
+	assert.Equal(t, 0, backendRequests)
+}
@@ -0,0 +1,114 @@
+package caching
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// URLOfLength returns the given prefix, e.g. "/long/" or "/search?q=", padded with "x" to exactly the given length.
+// It panics if the prefix is longer than that.
+func URLOfLength(prefix string, length int) string {
+	if len(prefix) > length {
+		panic(fmt.Sprintf("URL of %d bytes is too short for %s", length, prefix))
+	}
+	return prefix + strings.Repeat("x", length-len(prefix))
+}
+
+// EncodedURLOfLength returns the given prefix padded with percent-encoded characters "%78" (an encoded "x") to
+// exactly the given length, e.g. to compare caches measuring URLs before and after decoding. Since each encoded
+// character takes three bytes, the padding ends with up to two unencoded "x" to reach the length.
+// It panics if the prefix is longer than that.
+func EncodedURLOfLength(prefix string, length int) string {
+	if len(prefix) > length {
+		panic(fmt.Sprintf("URL of %d bytes is too short for %s", length, prefix))
+	}
+	padding := length - len(prefix)
+	return prefix + strings.Repeat("%78", padding/3) + strings.Repeat("x", padding%3)
+}
+
+// PercentEncoding is a pair of URLs which differ in their percent-encoding only. RFC 3986 considers them equivalent
+// if Equivalent is true, i.e. if they only differ in the encoding of unreserved characters or the case of the hex
+// digits, and a cache normalizing URLs may share an object for them. Otherwise they identify different resources.
+type PercentEncoding struct {
+	Name       string
+	URL        string
+	Other      string
+	Equivalent bool
+}
+
+// PercentEncodings are edge cases of percent-encoding, e.g. to test whether a cache hashes URLs as they are sent.
+var PercentEncodings = []PercentEncoding{
+	{"encoded unreserved character", "/%7Euser", "/~user", true},
+	{"lowercase hex digits", "/caf%c3%a9", "/caf%C3%A9", true},
+	{"encoded letter", "/%61bc", "/abc", true},
+	{"encoded slash", "/a%2Fb", "/a/b", false},
+	{"encoded question mark", "/a%3Fb", "/a?b", false},
+	{"double encoding", "/a%252Fb", "/a%2Fb", false},
+	{"encoded space or plus", "/search?q=a%20b", "/search?q=a+b", false},
+}
+
+// rejectedURLStatuses are the statuses of responses rejecting a request for its URL or header size.
+var rejectedURLStatuses = []int{
+	http.StatusBadRequest,
+	http.StatusRequestEntityTooLarge,
+	http.StatusRequestURITooLong,
+	http.StatusRequestHeaderFieldsTooLarge,
+}
+
+// URLLengthLimit returns the length of the longest URL of at most maxLength bytes which the HTTP server at localhost
+// on the given port accepts in a GET request with just a Host and a Connection header, e.g. to compare the limits of Varnish versions
+// and other front-ends. It searches the length by bisection with URLs from URLOfLength, each of which the server
+// must either respond to or reject by closing the connection or with 400, 413, 414 or 431. It returns 0 if even
+// a URL of two bytes is rejected.
+func URLLengthLimit(port string, maxLength int) (int, error) {
+	accepted, rejected := 1, maxLength+1
+	for rejected-accepted > 1 {
+		length := (accepted + rejected) / 2
+		ok, err := acceptsURL(port, URLOfLength("/", length))
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			accepted = length
+		} else {
+			rejected = length
+		}
+	}
+	if accepted == 1 {
+		return 0, nil
+	}
+	return accepted, nil
+}
+
+// acceptsURL returns whether the server at localhost on the given port responds to a GET request for the given URL
+// with a status other than those of rejectedURLStatuses.
+func acceptsURL(port string, url string) (bool, error) {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(conn, "GET "+url+" HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		// the server closed the connection while the URL was still being sent
+		return false, nil
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return false, err
+		}
+		return false, nil
+	}
+	response.Body.Close()
+	return !slices.Contains(rejectedURLStatuses, response.StatusCode), nil
+}
@@ -2,41 +2,76 @@
 package caching_test
 
 import (
+	"bufio"
 	"caching"
+	"compress/gzip"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 type request struct {
-	path          string
-	method        string
-	xStatusCode   int
-	xRequest      string
-	cacheControl  string
-	authorization string
-	cookie        string
-	ifNoneMatch   string
-	storeBody     bool
-	origin        string
-	range_        string
+	path           string
+	method         string
+	xStatusCode    int
+	xRequest       string
+	xCacheControl  string
+	xEtag          string
+	xSetCookies    []string
+	cacheControl   string
+	pragma         string
+	authorization  string
+	cookie         string
+	ifNoneMatch    string
+	storeBody      bool
+	digestBody     bool
+	origin         string
+	range_         string
+	acceptEncoding string
+	captureHeaders []string
+	engine         caching.CacheEngine
+	requestHeaders map[string]string
+	host           string
+	proxyClientIP  string
+	socket         string
+	ipv6           bool
+	requestBody    string
+	bodyReader     io.Reader
+	recordInterim  bool
+	noFollow       bool
 }
 
 type response struct {
 	statusCode               int
 	xResponse                string
 	body                     string
+	bodyDigest               string
+	bodySize                 int64
+	declaredDigest           string
 	cacheControl             string
 	xCache                   string
 	cacheStatus              string
 	contentRange             string
 	acceptRanges             string
 	accessControlAllowOrigin string
+	contentEncoding          string
+	headers                  map[string]string
+	setCookies               []string
+	hitMiss                  caching.HitMiss
+	interimStatuses          []int
 }
 
 func mkReq(t *testing.T, port string, xRequest string, modifiers ...func(*request)) response {
@@ -85,9 +120,36 @@ func withBody(body string) func(*response) {
 	}
 }
 
-func withResponseCacheControl(cacheControl string) func(*response) {
+func withResponseCacheControl(cacheControl caching.CacheControl) func(*response) {
 	return func(r *response) {
-		r.cacheControl = cacheControl
+		r.cacheControl = cacheControl.String()
+	}
+}
+
+// withResponseCacheControlValue expects the given Cache-Control header value verbatim, e.g. with directives
+// in an order CacheControl does not render or with invalid syntax.
+func withResponseCacheControlValue(value string) func(*response) {
+	return func(r *response) {
+		r.cacheControl = value
+	}
+}
+
+func withSetCookies(setCookies ...string) func(*response) {
+	return func(r *response) {
+		r.setCookies = setCookies
+	}
+}
+
+func withAccessControlAllowOrigin(accessControlAllowOrigin string) func(*response) {
+	return func(r *response) {
+		r.accessControlAllowOrigin = accessControlAllowOrigin
+	}
+}
+
+// withInterimStatuses expects the interim (1xx) responses recorded via withRecordInterim to have the given statuses.
+func withInterimStatuses(statuses ...int) func(*response) {
+	return func(r *response) {
+		r.interimStatuses = statuses
 	}
 }
 
@@ -97,6 +159,26 @@ func withXCache(xCache string) func(*response) {
 	}
 }
 
+// withHeader expects the response header captured via withCaptureHeaders to have the given value.
+func withHeader(name string, value string) func(*response) {
+	return func(r *response) {
+		if r.headers == nil {
+			r.headers = map[string]string{}
+		}
+		r.headers[name] = value
+	}
+}
+
+// withContentLength expects the Content-Length response header captured via withHead to have the given value.
+func withContentLength(contentLength int) func(*response) {
+	return withHeader("Content-Length", strconv.Itoa(contentLength))
+}
+
+// withLocation expects the Location response header captured via withNoFollow to have the given value.
+func withLocation(location string) func(*response) {
+	return withHeader("Location", location)
+}
+
 func withPath(path string) func(*request) {
 	return func(r *request) {
 		r.path = path
@@ -115,12 +197,73 @@ func withCacheControl(cacheControl string) func(*request) {
 	}
 }
 
+// withForcedRevalidation makes the request look like a browser's forced reload,
+// which asks all caches on the way to revalidate with the origin server.
+func withForcedRevalidation() func(*request) {
+	return func(r *request) {
+		r.cacheControl = caching.CacheControl{NoCache: true}.String()
+		r.pragma = "no-cache"
+	}
+}
+
+// withXSetCookies asks a backend using echoCacheControlHandler to respond with the given Set-Cookie headers.
+func withXSetCookies(setCookies ...string) func(*request) {
+	return func(r *request) {
+		r.xSetCookies = append(r.xSetCookies, setCookies...)
+	}
+}
+
+// withXEtag asks a backend using echoCacheControlHandler to respond with the given ETag.
+func withXEtag(etag string) func(*request) {
+	return func(r *request) {
+		r.xEtag = etag
+	}
+}
+
+// withXCacheControl asks a backend using echoCacheControlHandler
+// to respond with the given Cache-Control header.
+func withXCacheControl(cacheControl caching.CacheControl) func(*request) {
+	return func(r *request) {
+		r.xCacheControl = cacheControl.String()
+	}
+}
+
 func withOrigin(origin string) func(*request) {
 	return func(r *request) {
 		r.origin = origin
 	}
 }
 
+// withHead turns the request into a HEAD request and captures the Content-Length response header.
+// The response to a HEAD request is always expected to have no body.
+func withHead() func(*request) {
+	return func(r *request) {
+		r.method = http.MethodHead
+		r.captureHeaders = append(r.captureHeaders, "Content-Length")
+	}
+}
+
+// withPreflight turns the request into a CORS preflight request for the given method and request headers.
+// Combine it with withOrigin.
+func withPreflight(method string, headers ...string) func(*request) {
+	return func(r *request) {
+		r.method = http.MethodOptions
+		withRequestHeader("Access-Control-Request-Method", method)(r)
+		if len(headers) > 0 {
+			withRequestHeader("Access-Control-Request-Headers", strings.Join(headers, ", "))(r)
+		}
+	}
+}
+
+// withDigestBody reads the body without storing it, and records its SHA-256 digest (decompressed if it is
+// gzip-encoded) and its size as received, together with the Content-Digest header declared by the backend.
+// See assertBodyDigest.
+func withDigestBody() func(*request) {
+	return func(r *request) {
+		r.digestBody = true
+	}
+}
+
 func withStoreBody() func(*request) {
 	return func(r *request) {
 		r.storeBody = true
@@ -133,6 +276,76 @@ func withAuthorization(authorization string) func(*request) {
 	}
 }
 
+// withHost overrides the Host header, which otherwise is localhost with the port of Varnish.
+func withHost(host string) func(*request) {
+	return func(r *request) {
+		r.host = host
+	}
+}
+
+// withProxyProtocol sends the request with a PROXY protocol header claiming the given client IP,
+// which requires the port of the PROXY listener of Varnish.
+func withProxyProtocol(clientIP string) func(*request) {
+	return func(r *request) {
+		r.proxyClientIP = clientIP
+	}
+}
+
+// withSocket connects to Varnish at the given Unix domain socket of a VarnishConfig.Listeners instead of the port.
+func withSocket(socket string) func(*request) {
+	return func(r *request) {
+		r.socket = socket
+	}
+}
+
+// withIPv6 connects to Varnish over IPv6, which requires VarnishConfig.ListenIPv6.
+func withIPv6() func(*request) {
+	return func(r *request) {
+		r.ipv6 = true
+	}
+}
+
+// withRequestBody sends the given request body.
+func withRequestBody(body string) func(*request) {
+	return func(r *request) {
+		r.requestBody = body
+	}
+}
+
+// withRequestBodyReader sends the request body read from the given reader, e.g. a caching.ChunkedBody,
+// with chunked encoding.
+func withRequestBodyReader(body io.Reader) func(*request) {
+	return func(r *request) {
+		r.bodyReader = body
+	}
+}
+
+// withRecordInterim records the statuses of interim (1xx) responses received before the final response.
+// It also limits the request to 10 seconds, in case the final response never arrives.
+func withRecordInterim() func(*request) {
+	return func(r *request) {
+		r.recordInterim = true
+	}
+}
+
+// withNoFollow returns redirect responses instead of following them and captures the Location response header.
+func withNoFollow() func(*request) {
+	return func(r *request) {
+		r.noFollow = true
+		r.captureHeaders = append(r.captureHeaders, "Location")
+	}
+}
+
+// withRequestHeader sets an arbitrary request header.
+func withRequestHeader(name string, value string) func(*request) {
+	return func(r *request) {
+		if r.requestHeaders == nil {
+			r.requestHeaders = map[string]string{}
+		}
+		r.requestHeaders[name] = value
+	}
+}
+
 func withCookie(cookie string) func(*request) {
 	return func(r *request) {
 		r.cookie = cookie
@@ -157,15 +370,90 @@ func withRange(range_ string) func(*request) {
 	}
 }
 
+// withAcceptEncoding sets the Accept-Encoding header explicitly, which also prevents
+// the http.Client from transparently decompressing the response body.
+func withAcceptEncoding(acceptEncoding string) func(*request) {
+	return func(r *request) {
+		r.acceptEncoding = acceptEncoding
+	}
+}
+
+// withCaptureHeaders captures the values of the given response headers (empty if absent),
+// for headers which are not captured by default.
+func withCaptureHeaders(names ...string) func(*request) {
+	return func(r *request) {
+		r.captureHeaders = append(r.captureHeaders, names...)
+	}
+}
+
+// withEngine reports in the hitMiss field of the response whether the given engine served it from the cache.
+func withEngine(engine caching.CacheEngine) func(*request) {
+	return func(r *request) {
+		r.engine = engine
+	}
+}
+
 func req(t *testing.T, port string, r request) response {
 	httpClient := http.Client{}
-	req, err := http.NewRequest(r.method, "http://localhost:"+port+r.path, nil)
+	if r.proxyClientIP != "" {
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return caching.DialProxyProtocol(port, r.proxyClientIP)
+			},
+			DisableKeepAlives: true,
+		}
+	}
+	if r.socket != "" {
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", r.socket)
+			},
+			DisableKeepAlives: true,
+		}
+	}
+	if r.noFollow {
+		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	var requestBody io.Reader
+	if r.requestBody != "" {
+		requestBody = strings.NewReader(r.requestBody)
+	}
+	if r.bodyReader != nil {
+		requestBody = r.bodyReader
+	}
+	host := "localhost"
+	if r.ipv6 {
+		host = "[::1]"
+	}
+	req, err := http.NewRequest(r.method, "http://"+host+":"+port+r.path, requestBody)
+	require.NoError(t, err)
+	var interimStatuses []int
+	if r.recordInterim {
+		httpClient.Timeout = 10 * time.Second
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				interimStatuses = append(interimStatuses, code)
+				return nil
+			},
+		}))
+	}
 	if r.xStatusCode != 0 {
 		req.Header.Set("X-Status-Code", strconv.Itoa(r.xStatusCode))
 	}
 	if r.xRequest != "" {
 		req.Header.Set("X-Request", r.xRequest)
 	}
+	if r.xCacheControl != "" {
+		req.Header.Set("X-Cache-Control", r.xCacheControl)
+	}
+	if r.xEtag != "" {
+		req.Header.Set("X-Etag", r.xEtag)
+	}
+	for _, setCookie := range r.xSetCookies {
+		req.Header.Add("X-Set-Cookie", setCookie)
+	}
 	if r.authorization != "" {
 		req.Header.Set("Authorization", r.authorization)
 	}
@@ -175,6 +463,9 @@ func req(t *testing.T, port string, r request) response {
 	if r.cacheControl != "" {
 		req.Header.Set("Cache-Control", r.cacheControl)
 	}
+	if r.pragma != "" {
+		req.Header.Set("Pragma", r.pragma)
+	}
 	if r.origin != "" {
 		req.Header.Set("Origin", r.origin)
 	}
@@ -184,6 +475,17 @@ func req(t *testing.T, port string, r request) response {
 	if r.range_ != "" {
 		req.Header.Set("Range", r.range_)
 	}
+	if r.acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", r.acceptEncoding)
+	}
+	// identify the request for the log of Varnish, unless the test sets an X-Request-ID of its own
+	req.Header.Set("X-Request-ID", requestID(t, r.xRequest))
+	for name, value := range r.requestHeaders {
+		req.Header.Set(name, value)
+	}
+	if r.host != "" {
+		req.Host = r.host
+	}
 	assert.NoError(t, err)
 	resp, err := httpClient.Do(req)
 	assert.NoError(t, err)
@@ -191,36 +493,516 @@ func req(t *testing.T, port string, r request) response {
 	if r.storeBody {
 		body = readBody(t, resp)
 	}
+	var bodyDigest, declaredDigest string
+	var bodySize int64
+	if r.digestBody {
+		bodyDigest, bodySize = digestBody(t, resp)
+		declaredDigest = resp.Header.Get("Content-Digest")
+	}
+	if r.method == http.MethodHead {
+		assert.Empty(t, readBody(t, resp), "response to HEAD request has a body")
+	}
+	var headers map[string]string
+	for _, name := range r.captureHeaders {
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[name] = resp.Header.Get(name)
+	}
+	var hitMiss caching.HitMiss
+	if r.engine != nil {
+		hitMiss = r.engine.DebugHitMiss(resp.Header)
+	}
 	return response{
 		statusCode:               resp.StatusCode,
 		xResponse:                resp.Header.Get("X-Response"),
 		body:                     body,
+		bodyDigest:               bodyDigest,
+		bodySize:                 bodySize,
+		declaredDigest:           declaredDigest,
 		cacheControl:             resp.Header.Get("Cache-Control"),
 		xCache:                   resp.Header.Get("X-Cache"),
 		cacheStatus:              resp.Header.Get("Cache-Status"),
 		contentRange:             resp.Header.Get("Content-Range"),
 		acceptRanges:             resp.Header.Get("Accept-Ranges"),
 		accessControlAllowOrigin: resp.Header.Get("Access-Control-Allow-Origin"),
+		contentEncoding:          resp.Header.Get("Content-Encoding"),
+		headers:                  headers,
+		setCookies:               resp.Header.Values("Set-Cookie"),
+		hitMiss:                  hitMiss,
+		interimStatuses:          interimStatuses,
 	}
 }
 
+// ageOf returns the Age of the response, which must have been captured via withCaptureHeaders.
+func ageOf(t *testing.T, resp response) int {
+	age, err := strconv.Atoi(resp.headers["Age"])
+	require.NoError(t, err)
+	return age
+}
+
 func readBody(t *testing.T, resp *http.Response) string {
 	body, err := io.ReadAll(resp.Body)
 	assert.NoError(t, err)
 	return string(body)
 }
 
+// digestBody reads the body of the given response and returns its digest, of the decompressed body if it is
+// gzip-encoded, together with the size of the body as received.
+func digestBody(t *testing.T, resp *http.Response) (string, int64) {
+	defer resp.Body.Close()
+	counter := &countingReader{reader: resp.Body}
+	var decoded io.Reader = counter
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(counter)
+		require.NoError(t, err)
+		decoded = gzipReader
+	}
+	digest, _, err := caching.ReaderDigest(decoded)
+	require.NoError(t, err)
+	// count the rest of the body after the end of the gzip stream, if any
+	_, err = io.Copy(io.Discard, counter)
+	require.NoError(t, err)
+	return digest, counter.n
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// assertBodyDigest checks that the body of a response requested withDigestBody matches the given body byte for byte,
+// and that the backend declared the digest of the given body as its Content-Digest.
+func assertBodyDigest(t *testing.T, body []byte, resp response) bool {
+	expected := caching.ContentDigest(body)
+	return assert.Equal(t, expected, resp.declaredDigest, "declared digest") &&
+		assert.Equal(t, expected, resp.bodyDigest, "digest of the body")
+}
+
+// testSeed returns the seed for the random bodies of the test (see caching.Seed), which is logged if the test fails.
+func testSeed(t *testing.T) int64 {
+	seed := caching.Seed(t.Name())
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("random bodies generated with seed %d", seed)
+		}
+	})
+	return seed
+}
+
+// assertBody checks that the stored body of a response equals the expected body, reporting the ranges of bytes
+// which differ instead of both bodies, which may be large and binary.
+func assertBody(t *testing.T, expected []byte, body string) bool {
+	ranges := caching.DiffBodies(expected, []byte(body))
+	if ranges == nil {
+		return true
+	}
+	return assert.Fail(t, "bodies differ", "expected %d bytes, got %d bytes, differing in bytes %v", len(expected), len(body), ranges)
+}
+
+// gunzip decompresses a gzip-encoded response body.
+func gunzip(t *testing.T, body string) string {
+	reader, err := gzip.NewReader(strings.NewReader(body))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(decompressed)
+}
+
 func startTestServer(handler http.HandlerFunc) (string, *httptest.Server) {
 	return caching.StartTestServer(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/health" {
-			w.Header().Set("Cache-Control", "no-store")
-			w.WriteHeader(http.StatusOK)
+			healthHandler(w, r)
 			return
 		}
 		handler(w, r)
 	})
 }
 
+// startTestServerWithRoutes starts a test server with a handler per path, in addition to the /health path.
+func startTestServerWithRoutes(routes caching.Routes) (string, *httptest.Server) {
+	routes["/health"] = healthHandler
+	return caching.StartTestServerWithRoutes(routes)
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", caching.CacheControl{NoStore: true}.String())
+	w.WriteHeader(http.StatusOK)
+}
+
+// echoCacheControlHandler returns a backend handler which echoes the X-Request header as X-Response
+// and responds with the Cache-Control, ETag and Set-Cookie headers requested via the X-Cache-Control, X-Etag
+// and X-Set-Cookie headers, and with the status requested via the X-Status-Code header (200 by default).
+// This allows a single backend to serve responses with different Cache-Control directives per request.
+func echoCacheControlHandler(backendRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		if cacheControl := r.Header.Get("X-Cache-Control"); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		if etag := r.Header.Get("X-Etag"); etag != "" {
+			w.Header().Set("Etag", etag)
+		}
+		for _, setCookie := range r.Header.Values("X-Set-Cookie") {
+			w.Header().Add("Set-Cookie", setCookie)
+		}
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		status := http.StatusOK
+		if xStatusCode, err := strconv.Atoi(r.Header.Get("X-Status-Code")); err == nil {
+			status = xStatusCode
+		}
+		w.WriteHeader(status)
+	}
+}
+
+// countingEchoCacheControlHandler returns echoCacheControlHandler counting the backend requests atomically,
+// for tests polling the count while the backend may still be handling requests.
+func countingEchoCacheControlHandler(backendRequests *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		// the request has been counted already
+		var counted int
+		echoCacheControlHandler(&counted)(w, r)
+	}
+}
+
+// startEngine starts the given cache engine in front of the backend configured in config,
+// stops it when the test finishes and waits until it is healthy.
+func startEngine(t *testing.T, engine caching.CacheEngine, config caching.EngineConfig) string {
+	endpoint, stopFunc, err := engine.Start(config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, stopFunc())
+	})
+	waitForHealthy(t, endpoint.Port)
+	return endpoint.Port
+}
+
+// forEachEngine runs the given scenario as a parallel subtest against every cache engine
+// and records the outcome of each subtest in the engine report.
+func forEachEngine(t *testing.T, scenario func(t *testing.T, engine caching.CacheEngine)) {
+	scenarioName := strings.TrimPrefix(t.Name(), "TestEngines")
+	for _, engine := range caching.Engines() {
+		t.Run(engine.Name(), func(t *testing.T) {
+			t.Parallel()
+			t.Cleanup(func() {
+				outcome := caching.Pass
+				if t.Failed() {
+					outcome = caching.Fail
+				} else if t.Skipped() {
+					outcome = caching.Skip
+				}
+				engineReport.Record(scenarioName, engine.Name(), outcome)
+			})
+			scenario(t, engine)
+		})
+	}
+}
+
+// inParallel calls send n times in parallel with the indexes 0 to n-1 and returns how long it took until all returned.
+func inParallel(n int, send func(i int)) time.Duration {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			send(i)
+		}()
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+// holdingHandler returns a backend handler which counts each request when it arrives, holds it open until
+// the release channel is closed and then responds like echoCacheControlHandler.
+// Requests whose client goes away are abandoned.
+func holdingHandler(backendRequests *atomic.Int32, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		select {
+		case <-release:
+			// the request has been counted already
+			var counted int
+			echoCacheControlHandler(&counted)(w, r)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// queueClients sends k requests with the given modifiers in parallel, such that all but the first one queue
+// up behind the backend fetch of the first one. It returns the responses and how long each client waited.
+func queueClients(t *testing.T, port string, k int, modifiers ...func(*request)) ([]response, []time.Duration) {
+	responses := make([]response, k)
+	waited := make([]time.Duration, k)
+	inParallel(k, func(i int) {
+		start := time.Now()
+		responses[i] = mkReq(t, port, strconv.Itoa(i), modifiers...)
+		waited[i] = time.Since(start)
+	})
+	return responses, waited
+}
+
+// slowBodyHandler returns a backend handler which echoes the X-Request header as X-Response and the X-Cache-Control
+// header as Cache-Control after waiting for headerDelay, and then writes a chunked body of the given number of
+// "chunk" lines, flushing each line and waiting for chunkDelay between lines.
+func slowBodyHandler(backendRequests *int, headerDelay time.Duration, chunks int, chunkDelay time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		time.Sleep(headerDelay)
+		if cacheControl := r.Header.Get("X-Cache-Control"); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < chunks; i++ {
+			if i > 0 {
+				time.Sleep(chunkDelay)
+			}
+			io.WriteString(w, "chunk\n")
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// largeBodyHandler returns a backend handler which serves a compressible body of the given size
+// like caching.BodyHandler and counts the backend requests.
+func largeBodyHandler(backendRequests *int, size int) http.HandlerFunc {
+	handler := caching.BodyHandler(caching.CompressibleBody(size))
+	return func(w http.ResponseWriter, r *http.Request) {
+		*backendRequests++
+		handler(w, r)
+	}
+}
+
+// slowReader limits reading from the underlying reader to bytesPerSecond bytes per second on average.
+type slowReader struct {
+	reader         io.Reader
+	bytesPerSecond int
+	start          time.Time
+	read           int
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	n, err := s.reader.Read(p)
+	s.read += n
+	// wait until reading the bytes read so far took long enough
+	time.Sleep(time.Duration(s.read)*time.Second/time.Duration(s.bytesPerSecond) - time.Since(s.start))
+	return n, err
+}
+
+// getSlowly sends a GET request with the given X-Request and X-Cache-Control headers, waits for the given
+// delay after receiving the response headers and then reads the body with the given number of bytes per second,
+// or as fast as possible for 0.
+// It returns the length of the body read and the error which reading ended with, if any.
+func getSlowly(t *testing.T, port string, xRequest string, xCacheControl string, delay time.Duration, bytesPerSecond int) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+port+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request", xRequest)
+	if xCacheControl != "" {
+		req.Header.Set("X-Cache-Control", xCacheControl)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	time.Sleep(delay)
+	var body io.Reader = resp.Body
+	if bytesPerSecond > 0 {
+		body = &slowReader{reader: resp.Body, bytesPerSecond: bytesPerSecond}
+	}
+	n, err := io.Copy(io.Discard, body)
+	return int(n), err
+}
+
+// getAndAbort sends a GET request with the given X-Request and X-Cache-Control headers, reads the first n bytes
+// of the body and then aborts the request by closing the connection. It returns the bytes read.
+func getAndAbort(t *testing.T, port string, xRequest string, xCacheControl string, n int) string {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+port+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request", xRequest)
+	if xCacheControl != "" {
+		req.Header.Set("X-Cache-Control", xCacheControl)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	// closing the body before reading it completely closes the connection
+	defer resp.Body.Close()
+	body := make([]byte, n)
+	_, err = io.ReadFull(resp.Body, body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+// rawReq sends the given raw request over a new connection, which allows to send requests
+// the HTTP client of Go would refuse to send or would send differently.
+func rawReq(t *testing.T, port string, request string) *http.Response {
+	conn, reader := rawConn(t, port)
+	_, err := io.WriteString(conn, request)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	return resp
+}
+
+// rawConn opens a new connection for raw requests, which is closed when the test ends, together with a reader
+// for reading several responses from it, e.g. of requests sent on the same connection one after another.
+func rawConn(t *testing.T, port string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// eventuallyTimeout and eventuallyTick bound the polling of the eventually* assertions. The timeout is scaled
+// by the time scale.
+const (
+	eventuallyTimeout = 10 * time.Second
+	eventuallyTick    = 20 * time.Millisecond
+)
+
+// eventuallyCached waits until an object for the given URL is cached, stale or not,
+// as reported by the object info of the given Varnish instance.
+func eventuallyCached(t *testing.T, instance *caching.VarnishInstance, url string) {
+	require.Eventually(t, func() bool {
+		info, err := instance.ObjectInfo(url)
+		return crashed(instance) || err == nil && info.Cached
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "object for %s not cached", url)
+	require.NoError(t, instance.Crash())
+}
+
+// eventuallyStale waits until the cached object for the given URL has expired, such that it is
+// delivered from grace or revalidated, as reported by the object info of the given Varnish instance.
+// It replaces sleeping for longer than the TTL of the object.
+func eventuallyStale(t *testing.T, instance *caching.VarnishInstance, url string) {
+	require.Eventually(t, func() bool {
+		info, err := instance.ObjectInfo(url)
+		return crashed(instance) || err == nil && info.Cached && info.Ttl <= 0
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "object for %s not stale", url)
+	require.NoError(t, instance.Crash())
+}
+
+// eventuallyStaleFor waits until the cached object for the given URL has been stale for at least the given
+// duration, e.g. for its Age to exceed its max-age by whole seconds.
+func eventuallyStaleFor(t *testing.T, instance *caching.VarnishInstance, url string, d time.Duration) {
+	require.Eventually(t, func() bool {
+		info, err := instance.ObjectInfo(url)
+		return crashed(instance) || err == nil && info.Cached && info.Ttl <= -d
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "object for %s not stale for %s", url, d)
+	require.NoError(t, instance.Crash())
+}
+
+// eventuallyOutOfGrace waits until the object for the given URL is no longer delivered, not even from grace,
+// as reported by the object info of the given Varnish instance, whose probe requests are subject to req.grace
+// like other requests. It replaces sleeping for longer than the TTL and grace of the object.
+func eventuallyOutOfGrace(t *testing.T, instance *caching.VarnishInstance, url string) {
+	require.Eventually(t, func() bool {
+		info, err := instance.ObjectInfo(url)
+		return crashed(instance) || err == nil && !info.Cached
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "object for %s still cached", url)
+	require.NoError(t, instance.Crash())
+}
+
+// eventuallyBackendRequests waits until the backend has received the given number of requests,
+// e.g. once asynchronous revalidations have reached it. The backend must count them atomically,
+// e.g. with countingEchoCacheControlHandler.
+func eventuallyBackendRequests(t *testing.T, backendRequests *atomic.Int32, n int32) {
+	require.Eventually(t, func() bool {
+		return backendRequests.Load() == n
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "expected %d backend requests", n)
+}
+
+// eventuallyCounter waits until the given varnishstat counter of the given Varnish instance has reached n.
+func eventuallyCounter(t *testing.T, instance *caching.VarnishInstance, name string, n uint64) {
+	require.Eventually(t, func() bool {
+		value, err := instance.Counter(name)
+		return crashed(instance) || err == nil && value >= n
+	}, caching.Scaled(eventuallyTimeout), eventuallyTick, "expected %s to reach %d", name, n)
+	require.NoError(t, instance.Crash())
+}
+
+// waitForBackgroundFetch waits for the next background fetch of the given Varnish instance to complete.
+func waitForBackgroundFetch(t *testing.T, instance *caching.VarnishInstance) {
+	require.NoError(t, instance.WaitForBackgroundFetch(10*time.Second))
+}
+
+// crashed returns whether varnishd of the given Varnish instance has crashed, to stop polling it.
+func crashed(instance *caching.VarnishInstance) bool {
+	select {
+	case <-instance.Crashed():
+		return true
+	default:
+		return false
+	}
+}
+
+// failOnCrash fails the test as soon as varnishd of the given Varnish instance crashes, with the panic message
+// and the last log lines, instead of leaving the test to fail with connection errors or to time out.
+func failOnCrash(t *testing.T, instance *caching.VarnishInstance) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-instance.Crashed():
+			t.Error(instance.Crash())
+		case <-done:
+		}
+	}()
+	// t.Error must not be called after the test has completed
+	t.Cleanup(func() {
+		close(done)
+		wg.Wait()
+	})
+}
+
+// requestID returns the X-Request-ID which req sends with the request of the given test with the given X-Request.
+// It is only unique if the test does not send the same X-Request twice.
+func requestID(t *testing.T, xRequest string) string {
+	return t.Name() + ":" + xRequest
+}
+
+// logTransaction logs the transactions of the requests of the test with the given X-Request from the log of the given
+// Varnish instance, e.g. after a failed assertion about the response, to show what Varnish did.
+func logTransaction(t *testing.T, instance *caching.VarnishInstance, xRequest string) {
+	transaction, err := instance.Transaction(requestID(t, xRequest))
+	if err != nil {
+		t.Log("transaction not found:", err)
+		return
+	}
+	t.Log(transaction)
+}
+
+// assertVclFlow asserts that the VCL subroutines which ran for the request of the test with the given X-Request
+// contain the expected steps in this order (see caching.MatchVclFlow), e.g. "vcl_recv:hash", "vcl_hit", "vcl_deliver".
+func assertVclFlow(t *testing.T, instance *caching.VarnishInstance, xRequest string, expected ...string) bool {
+	flow, err := instance.VclFlow(requestID(t, xRequest))
+	if !assert.NoError(t, err) {
+		return false
+	}
+	return assert.NoError(t, caching.MatchVclFlow(flow, expected...), "request %s", xRequest)
+}
+
+// requireIPv6 skips the test if the host cannot listen on the IPv6 loopback interface.
+func requireIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	l.Close()
+}
+
 func waitForHealthy(t *testing.T, port string) {
 	httpClient := http.Client{}
 	for i := 0; i < 100; i++ {
@@ -233,3 +1015,16 @@ func waitForHealthy(t *testing.T, port string) {
 		time.Sleep(100 * time.Millisecond)
 	}
 }
+
+// deltaSecondsRegexp matches the delta-seconds of the directives of a Cache-Control header value.
+var deltaSecondsRegexp = regexp.MustCompile(`(=\s*)(\d+)`)
+
+// scaledCacheControl multiplies the delta-seconds of the given Cache-Control header value by the time scale
+// (see caching.Scaled), keeping the value verbatim otherwise.
+func scaledCacheControl(value string) string {
+	return deltaSecondsRegexp.ReplaceAllStringFunc(value, func(directive string) string {
+		match := deltaSecondsRegexp.FindStringSubmatch(directive)
+		seconds, _ := strconv.Atoi(match[2])
+		return match[1] + strconv.Itoa(seconds*caching.TimeScale())
+	})
+}
@@ -0,0 +1,212 @@
+package caching
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VclDuration renders the given duration as a VCL duration, e.g. "10s" or "500ms", which varnishd accepts
+// for parameters as well.
+func VclDuration(d time.Duration) string {
+	switch {
+	case d%time.Second == 0:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	case d%time.Millisecond == 0:
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	default:
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+	}
+}
+
+// vclBytesRegexp matches the literals of VCL byte sizes.
+var vclBytesRegexp = regexp.MustCompile(`^\d+(\.\d+)?(B|KB|MB|GB|TB)$`)
+
+// featureRegexp matches a feature flag of varnishd to raise or lower.
+var featureRegexp = regexp.MustCompile(`^[+-][a-z0-9_]+$`)
+
+// headerNameRegexp matches the names of headers which can be rendered as VCL, e.g. req.http.X-Language.
+var headerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// cookieNameRegexp matches the names of cookies, which are tokens.
+var cookieNameRegexp = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// methodRegexp matches request methods, which are tokens like the names of cookies.
+var methodRegexp = cookieNameRegexp
+
+// languageRegexp matches the primary language subtags of language tags, e.g. en or gsw.
+var languageRegexp = regexp.MustCompile(`^[A-Za-z]{2,8}$`)
+
+// tenantHostRegexp matches the hosts of tenants, optionally with a port.
+var tenantHostRegexp = regexp.MustCompile(`^[a-z0-9.-]+(:\d+)?$`)
+
+// listenerNameRegexp matches the names of listeners, which name the files of their sockets as well.
+var listenerNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// storageSizeRegexp matches the sizes of the storage of varnishd.
+var storageSizeRegexp = regexp.MustCompile(`^\d+[kKmMgGtT]?[bB]?$`)
+
+// validate checks the config before a container is started, such that mistakes are reported by descriptive errors
+// instead of a varnishd failing to start or to compile the VCL. It reports all mistakes at once.
+func (c VarnishConfig) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	vclBytes := func(name string, value string) {
+		check(value == "" || vclBytesRegexp.MatchString(value), "%s must be a VCL byte size like 64KB or 1MB, not %q", name, value)
+	}
+	status := func(name string, status int) {
+		check(status >= 100 && status <= 999, "%s must be HTTP statuses, not %d", name, status)
+	}
+	longString := func(name string, value string) {
+		check(!strings.Contains(value, `"}`), `%s must not contain "}`, name)
+	}
+
+	if c.BackendSocket == "" {
+		port, err := strconv.Atoi(c.BackendPort)
+		check(err == nil && port > 0 && port <= 65535, "BackendPort must be a port number, not %q", c.BackendPort)
+	} else {
+		check(c.BackendPort == "", "BackendPort and BackendSocket must not both be set")
+	}
+	check(c.BackendResolveTtl >= 0, "BackendResolveTtl must be >= 0")
+	check(c.BackendResolveTtl == 0 || c.BackendSocket == "", "BackendResolveTtl and BackendSocket must not both be set")
+	check(c.DefaultTtl >= 0, "DefaultTtl must be >= 0")
+	check(c.DefaultGrace >= 0, "DefaultGrace must be >= 0")
+	check(c.DefaultKeep >= 0, "DefaultKeep must be >= 0")
+	check(c.ConnectTimeout >= 0, "ConnectTimeout must be >= 0")
+	check(c.FirstByteTimeout >= 0, "FirstByteTimeout must be >= 0")
+	check(c.BetweenBytesTimeout >= 0, "BetweenBytesTimeout must be >= 0")
+	check(c.SendTimeout >= 0, "SendTimeout must be >= 0")
+	check(c.IdleSendTimeout >= 0, "IdleSendTimeout must be >= 0")
+	for _, limit := range limitParams(c) {
+		check(limit.value == 0 || limit.value >= limit.minimum, "%s must be 0 or at least %d bytes, not %d", limit.field, limit.minimum, limit.value)
+		_, param := c.Params[limit.param]
+		check(limit.value == 0 || !param, "%s and Params[%s] must not both be set", limit.field, limit.param)
+	}
+	check(c.UncacheableTtl >= 0, "UncacheableTtl must be >= 0")
+	check(c.MaxConnections >= 0, "MaxConnections must be >= 0")
+	check(c.StorageSize == "" || storageSizeRegexp.MatchString(c.StorageSize), "StorageSize must be a size like 1M, not %q", c.StorageSize)
+	check(c.MemoryLimit == 0 || c.MemoryLimit >= 6<<20, "MemoryLimit must be 0 or at least 6 MiB, not %d", c.MemoryLimit)
+	check(c.CPUs >= 0, "CPUs must be >= 0")
+	check(!strings.ContainsAny(c.FileStorage, ",= "), "FileStorage must be the name of a stevedore like file, not %q", c.FileStorage)
+	for _, feature := range c.Features {
+		check(featureRegexp.MatchString(feature), "Features must be flags like +esi_include_onerror, not %q", feature)
+	}
+	_, featureParam := c.Params["feature"]
+	check(len(c.Features) == 0 || !featureParam, "Features and Params[feature] must not both be set")
+	check(c.GeoIPDatabase == "" || filepath.IsAbs(c.GeoIPDatabase), "GeoIPDatabase must be an absolute path, not %q", c.GeoIPDatabase)
+	check(!c.VaryOnCountry || c.GeoIPDatabase != "", "VaryOnCountry requires a GeoIPDatabase")
+	vclBytes("CacheRequestBody", c.CacheRequestBody)
+	vclBytes("CacheQueryMethod", c.CacheQueryMethod)
+	for _, method := range c.CacheableMethods {
+		check(methodRegexp.MatchString(method), "CacheableMethods must be methods like OPTIONS, not %q", method)
+	}
+	check(c.MaxRetries >= 0, "MaxRetries must be >= 0")
+	for _, s := range c.RetryStatuses {
+		status("RetryStatuses", s)
+	}
+	for _, s := range c.UncacheableStatuses {
+		status("UncacheableStatuses", s)
+	}
+	statuses := make([]int, 0, len(c.StatusTTLs))
+	for s := range c.StatusTTLs {
+		statuses = append(statuses, s)
+	}
+	slices.Sort(statuses)
+	for _, s := range statuses {
+		status("StatusTTLs", s)
+		check(c.StatusTTLs[s] >= 0, "StatusTTLs[%d] must be >= 0", s)
+	}
+	for i, synthetic := range c.Synthetics {
+		status("Synthetics", synthetic.Status)
+		check(synthetic.Ttl >= 0, "Synthetics[%d].Ttl must be >= 0", i)
+		longString(fmt.Sprintf("Synthetics[%d].Body", i), synthetic.Body)
+		names := make([]string, 0, len(synthetic.Headers))
+		for name := range synthetic.Headers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			longString(fmt.Sprintf("Synthetics[%d].Headers[%s]", i, name), synthetic.Headers[name])
+		}
+	}
+	for _, header := range c.HashOn.Headers {
+		check(headerNameRegexp.MatchString(header), "HashOn.Headers must be header names, not %q", header)
+	}
+	for _, cookie := range c.HashOn.Cookies {
+		check(cookieNameRegexp.MatchString(cookie), "HashOn.Cookies must be cookie names, not %q", cookie)
+	}
+	headers := make([]string, 0, len(c.BackendRequestHeaders))
+	for header := range c.BackendRequestHeaders {
+		headers = append(headers, header)
+	}
+	slices.Sort(headers)
+	for _, header := range headers {
+		check(headerNameRegexp.MatchString(header), "BackendRequestHeaders must map header names, not %q", header)
+		longString(fmt.Sprintf("BackendRequestHeaders[%s]", header), c.BackendRequestHeaders[header])
+	}
+	cookies := make([]string, 0, len(c.VaryOnCookies))
+	for cookie := range c.VaryOnCookies {
+		cookies = append(cookies, cookie)
+	}
+	slices.Sort(cookies)
+	for _, cookie := range cookies {
+		check(cookieNameRegexp.MatchString(cookie), "VaryOnCookies must map cookie names, not %q", cookie)
+		check(headerNameRegexp.MatchString(c.VaryOnCookies[cookie]), "VaryOnCookies[%s] must be a header name, not %q", cookie, c.VaryOnCookies[cookie])
+	}
+	if c.RateLimit != nil {
+		check(c.RateLimit.Limit > 0, "RateLimit.Limit must be > 0")
+		check(c.RateLimit.Period > 0, "RateLimit.Period must be > 0")
+	}
+	if c.Canary != nil {
+		port, err := strconv.Atoi(c.Canary.BackendPort)
+		check(err == nil && port > 0 && port <= 65535, "Canary.BackendPort must be a port number, not %q", c.Canary.BackendPort)
+		check(c.Canary.Percent >= 0 && c.Canary.Percent <= 100, "Canary.Percent must be between 0 and 100, not %d", c.Canary.Percent)
+		check(c.Canary.Header == "" || headerNameRegexp.MatchString(c.Canary.Header), "Canary.Header must be a header name, not %q", c.Canary.Header)
+		check(c.Canary.Cookie == "" || cookieNameRegexp.MatchString(c.Canary.Cookie), "Canary.Cookie must be a cookie name, not %q", c.Canary.Cookie)
+		// VaryOnCookies removes the Cookie header before the variant is selected
+		check(c.Canary.Cookie == "" || len(c.VaryOnCookies) == 0, "Canary.Cookie and VaryOnCookies must not both be set")
+	}
+	for _, language := range c.Languages {
+		check(languageRegexp.MatchString(language), "Languages must be language codes like en, not %q", language)
+	}
+	hosts := map[string]bool{}
+	for i, tenant := range c.Tenants {
+		host := strings.ToLower(tenant.Host)
+		check(tenantHostRegexp.MatchString(host), "Tenants[%d].Host must be a host like example.com, not %q", i, tenant.Host)
+		check(!hosts[host], "Tenants[%d].Host %q is not unique", i, tenant.Host)
+		hosts[host] = true
+		check(tenant.Ttl >= 0, "Tenants[%d].Ttl must be >= 0", i)
+		check(tenant.Grace >= 0, "Tenants[%d].Grace must be >= 0", i)
+		longString(fmt.Sprintf("Tenants[%d].PurgeSecret", i), tenant.PurgeSecret)
+	}
+	names := map[string]bool{}
+	for i, listener := range c.Listeners {
+		check(listenerNameRegexp.MatchString(listener.Name), "Listeners[%d].Name must be a name like plain or socket, not %q", i, listener.Name)
+		check(!slices.Contains(reservedListenerNames, listener.Name), "Listeners[%d].Name %q is reserved", i, listener.Name)
+		check(!names[listener.Name], "Listeners[%d].Name %q is not unique", i, listener.Name)
+		names[listener.Name] = true
+	}
+	if c.JwtAuth != nil {
+		check(c.JwtAuth.Secret != "", "JwtAuth.Secret must not be empty")
+		longString("JwtAuth.Secret", c.JwtAuth.Secret)
+	}
+	if c.ForcedRevalidation != nil {
+		longString("ForcedRevalidation.Secret", c.ForcedRevalidation.Secret)
+	}
+	if _, err := parsePlatform(c.Platform); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := resolvePullPolicy(c.PullPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
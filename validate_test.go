@@ -0,0 +1,55 @@
+// Contains tests for validating the config of Varnish before starting it
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// TestVclDuration tests that durations are rendered as VCL durations in the largest exact unit of s and ms.
+func TestVclDuration(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "0s", caching.VclDuration(0))
+	assert.Equal(t, "10s", caching.VclDuration(10*time.Second))
+	assert.Equal(t, "120s", caching.VclDuration(2*time.Minute))
+	assert.Equal(t, "1500ms", caching.VclDuration(1500*time.Millisecond))
+	assert.Equal(t, "0.0005s", caching.VclDuration(500*time.Microsecond))
+}
+
+// TestInvalidConfig tests that an invalid config is rejected with descriptive errors for all mistakes
+// before starting a container.
+func TestInvalidConfig(t *testing.T) {
+	t.Parallel()
+	_, _, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      "http",
+		DefaultGrace:     -time.Second,
+		FirstByteTimeout: -time.Second,
+		IdleSendTimeout:  -time.Second,
+		CacheRequestBody: "1M",
+		MaxRetries:       -1,
+		StatusTTLs:       map[int]time.Duration{404: -time.Second},
+		RateLimit:        &caching.RateLimit{Limit: 10},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, `BackendPort must be a port number, not "http"
+DefaultGrace must be >= 0
+FirstByteTimeout must be >= 0
+IdleSendTimeout must be >= 0
+CacheRequestBody must be a VCL byte size like 64KB or 1MB, not "1M"
+MaxRetries must be >= 0
+StatusTTLs[404] must be >= 0
+RateLimit.Period must be > 0`, err.Error())
+	}
+}
+
+// TestInvalidClusterConfig tests that the config of a cluster is validated before starting any node.
+func TestInvalidClusterConfig(t *testing.T) {
+	t.Parallel()
+	_, _, err := caching.StartVarnishClusterInDocker(caching.VarnishConfig{
+		BackendPort: "8080",
+		DefaultTtl:  -time.Second,
+	}, 2)
+	assert.EqualError(t, err, "DefaultTtl must be >= 0")
+}
@@ -2,169 +2,763 @@ package caching
 
 import (
 	"context"
-	"encoding/binary"
-	"fmt"
-	"github.com/docker/docker/api/types"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/go-connections/nat"
-	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var cli *client.Client
-
 const varnishImage = "varnish:7.5.0-alpine"
 
+// backendSocketDir is the directory in the Varnish container the directory of the BackendSocket is mounted to.
+const backendSocketDir = "/var/run/backend"
+
 type VarnishConfig struct {
-	BackendPort  string
-	Vcl          string
-	DefaultTtl   string
-	DefaultGrace string
-	DefaultKeep  string
+	BackendPort string
+	Vcl         string
+
+	// DefaultTtl, DefaultGrace and DefaultKeep set the default_ttl, default_grace and default_keep parameters,
+	// which apply to responses without explicit expiration and stale-while-revalidate. Unlike the defaults of
+	// varnishd, they default to 0, such that such responses are not cached at all.
+	DefaultTtl   time.Duration
+	DefaultGrace time.Duration
+	DefaultKeep  time.Duration
+
+	// ConnectTimeout, FirstByteTimeout and BetweenBytesTimeout are rendered as the corresponding
+	// timeouts of the backend definition. Varnish uses its defaults when they are 0.
+	ConnectTimeout      time.Duration
+	FirstByteTimeout    time.Duration
+	BetweenBytesTimeout time.Duration
+
+	// MaxConnections is rendered as the .max_connections of the backend definition, which limits the number of
+	// concurrent connections to the backend, unless 0. Varnish does not queue fetches exceeding the limit,
+	// but fails them right away, such that clients receive a 503 response.
+	MaxConnections int
+
+	// SendTimeout and IdleSendTimeout set the send_timeout and idle_send_timeout parameters,
+	// which limit the total time and the time between two successful writes of a response to a client.
+	// Varnish uses its defaults when they are 0.
+	SendTimeout     time.Duration
+	IdleSendTimeout time.Duration
+
+	// HttpReqHdrLen, HttpReqSize and HttpRespHdrLen set the http_req_hdr_len, http_req_size and http_resp_hdr_len
+	// parameters in bytes: the maximum length of a single request header line, of the whole request head and of
+	// a single response header line. Varnish answers requests with a longer header line with 400 and closes
+	// connections with a larger request head without a response, while backend responses with a longer header line
+	// fail the fetch, such that clients receive a 503 response. Varnish uses its defaults (8k, 32k and 8k) if 0.
+	// RawRequestOfSize, HeaderValueOfLength and PaddedHeadersHandler generate requests and responses of given sizes.
+	HttpReqHdrLen  int
+	HttpReqSize    int
+	HttpRespHdrLen int
+	// WorkspaceClient and WorkspaceBackend set the workspace_client and workspace_backend parameters in bytes,
+	// i.e. the memory of a client request and of a backend fetch for headers and VCL strings. Running out of
+	// the client workspace fails the request, running out of the backend workspace fails the fetch.
+	// Varnish uses its defaults (96k each) if 0.
+	WorkspaceClient  int
+	WorkspaceBackend int
+
+	// StorageSize is the size of the cache storage. It defaults to 1M,
+	// which is too small for objects larger than that to be cached.
+	StorageSize string
+	// FileStorage stores cacheable objects in a file of StorageSize instead of memory, using the given stevedore
+	// of varnishd: "file" for the classic file storage, or "deprecated_persistent" for the experimental persistent
+	// storage. The file is kept in a directory of the host, which survives VarnishInstance.Restart and is removed
+	// when Varnish is stopped. Short-lived objects still go to the transient storage in memory.
+	FileStorage string
+	// MemoryLimit limits the memory of the container in bytes, e.g. 64 << 20, without any swap, such that
+	// the kernel kills the varnishd child once the storage, the transient storage and the overhead, including
+	// the shared memory log in the tmpfs, exceed it.
+	// Docker requires at least 6 MiB. The memory is unlimited if 0.
+	MemoryLimit int64
+	// CPUs limits the CPU time of the container to the given number of CPUs, e.g. 0.5, such that varnishd is
+	// throttled once it used up its quota of a scheduling period. The CPU time is unlimited if 0.
+	CPUs float64
+
+	// EnforceMustRevalidate injects VCL that disables grace for backend responses
+	// carrying a "must-revalidate" or "proxy-revalidate" Cache-Control directive,
+	// which the built-in VCL does not honor.
+	EnforceMustRevalidate bool
+
+	// HonorImmutable injects VCL that always delivers fresh cached objects with an "immutable"
+	// Cache-Control directive, even when later VCL would force a refresh on behalf of the client.
+	HonorImmutable bool
+
+	// RespectNoTransform injects VCL that disables gzip compression by Varnish (beresp.do_gzip)
+	// for backend responses carrying a "no-transform" Cache-Control directive. It is rendered after Vcl to
+	// override do_gzip set there, thus custom VCL returning from vcl_backend_response skips it.
+	RespectNoTransform bool
+
+	// StripQualifiedFields injects VCL implementing the qualified forms private="..." and no-cache="..."
+	// of the Cache-Control directives for the given header names: these headers are removed before
+	// storing the response, after which the qualified directive no longer makes it uncacheable.
+	// Qualified directives listing any other header are left to the built-in VCL.
+	StripQualifiedFields []string
+
+	// StripSetCookieOnHit injects VCL that caches otherwise cacheable responses despite Set-Cookie headers,
+	// which the built-in VCL refuses to cache, but only delivers the Set-Cookie headers with the response
+	// to the request which fetched it. They are stripped from all hits, so that cookies never leak to other clients.
+	StripSetCookieOnHit bool
+
+	// EnableXCacheHeader injects VCL reporting "hit" or "miss" in an X-Cache response header.
+	EnableXCacheHeader bool
+
+	// EnableCacheStatus injects VCL reporting hits and misses in a Cache-Status response header (RFC 9211).
+	EnableCacheStatus bool
+
+	// EchoRequestID injects VCL which echoes the X-Request-ID request header in the response, such that clients
+	// can correlate responses with the transactions in the log of Varnish (see VarnishInstance.Transaction).
+	EchoRequestID bool
+
+	// DoGzip, DisableStream and DoEsi inject VCL setting beresp.do_gzip to true, beresp.do_stream to false
+	// (it is true by default) and beresp.do_esi to true respectively, for all backend responses.
+	// The custom VCL can still override them. Varnish only processes ESI in bodies starting with '<'.
+	// With DoEsi, it assembles a page and its fragments into a single gzip member for clients accepting gzip
+	// if the page is compressed, by DoGzip or by the backend (see GzipHandler and GzipMembers).
+	DoGzip        bool
+	DisableStream bool
+	DoEsi         bool
+
+	// HashOn adds further inputs to the cache key, in addition to the URL and host of the built-in VCL.
+	HashOn HashOn
+
+	// VaryOnCookies injects VCL which extracts the cookies with the given names into the given request headers
+	// with vmod cookie, e.g. "session-language": "X-Language", and adds the headers to the Vary header of all
+	// backend responses, such that the cache splits by the values of these cookies only. The header is removed
+	// from requests without the cookie, so that clients cannot set it themselves. The Cookie header is removed
+	// afterwards, such that requests with any other cookies are looked up as well (but HashOn.Cookies sees no
+	// cookies anymore). Towards clients, the headers in Vary are replaced with Cookie.
+	VaryOnCookies map[string]string
+
+	// DeviceDetection injects VCL which classifies the User-Agent of requests as "mobile" (phones and tablets)
+	// or "desktop" (everything else, including bots) into an X-Device request header, overwriting one sent by the
+	// client, and adds X-Device to the Vary header of all backend responses, such that the cache holds at most
+	// two variants per URL instead of one per User-Agent. Towards clients, X-Device in Vary is replaced with
+	// User-Agent. UserAgentCorpus lists User-Agents with their expected class.
+	DeviceDetection bool
+
+	// Languages injects VCL which normalizes the Accept-Language request header to one of the given language codes,
+	// e.g. "en", "de" and "fr", such that backends varying on Accept-Language create at most one variant per language
+	// instead of one per spelling of the header. The first listed language of the header (browsers list them by
+	// preference) which is one of the given languages or a regional variant of one is taken, e.g. "de" for "de-AT",
+	// ignoring languages with q=0. Otherwise, including requests without the header, it is the first given language.
+	// AcceptLanguageCorpus lists real-world values of the header.
+	Languages []string
+
+	// GeoIPDatabase is the path of a MaxMind DB on the host, e.g. a GeoLite2 Country database or one written by
+	// WriteCountryDatabase, which is mounted into the container and opened by vmod geoip2 as the object geoip in
+	// vcl_init, such that the custom VCL can look up e.g. geoip.lookup("country/iso_code", client.ip).
+	// Unless Image is set, an image with vmod geoip2 and vmod digest is built from the official one on first use.
+	// Client IPs can be injected via the PROXY protocol (see EnableProxyProtocol).
+	GeoIPDatabase string
+	// VaryOnCountry injects VCL which looks up the country of client.ip in the GeoIPDatabase into an X-Country
+	// request header ("unknown" if not found), overwriting one sent by the client, and adds X-Country to the Vary
+	// header of all backend responses, such that the cache splits by country. Since downstream caches cannot know
+	// the country of a client, X-Country is removed from the Vary header delivered to clients.
+	VaryOnCountry bool
+
+	// IgnoredQueryParams injects VCL removing the given query parameters from the URL, such that requests differing
+	// only in these parameters share one object. A trailing "*" matches any suffix, e.g. "utm_*".
+	// The parameters are removed before the custom VCL runs, and the backend does not receive them either.
+	IgnoredQueryParams []string
+
+	// NormalizeHost injects VCL which lowercases the Host header and strips any port from it before the custom VCL
+	// runs, such that requests for example.com, EXAMPLE.COM and example.com:8080 share one object.
+	NormalizeHost bool
+
+	// EnableWebSockets injects VCL which pipes requests with a WebSocket upgrade to the backend, preserving
+	// the Upgrade and Connection headers that Varnish otherwise removes as hop-by-hop headers.
+	EnableWebSockets bool
+	// PipeCondition is a VCL expression which, when true in vcl_recv, makes Varnish pipe the request to the backend,
+	// e.g. req.url ~ "^/stream/". The connection is then handed over to the backend, such that long-lived streams in
+	// both directions pass, neither bound by the timeouts of the backend nor by timeout_idle, but only by the
+	// "pipe_timeout" parameter for the time without traffic. Piped requests are never cached.
+	PipeCondition string
+
+	// CachePreflights injects VCL which caches responses to CORS preflight requests (OPTIONS requests with Origin
+	// and Access-Control-Request-Method), which the built-in VCL passes. The cache key contains the Origin and the
+	// requested method and headers, and the TTL is taken from Access-Control-Max-Age if present.
+	CachePreflights bool
+
+	// DisableCoalescing injects VCL which sets req.hash_ignore_busy, such that requests for an object which is
+	// still being fetched do not wait for the fetch on the waiting list, but fetch it from the backend themselves.
+	// All fetched responses are stored, and the one stored last is delivered by later hits.
+	DisableCoalescing bool
+
+	// CacheableMethods injects VCL which looks up requests with the given methods in the cache, in addition to GET and
+	// HEAD requests, which the built-in VCL looks up already, e.g. "OPTIONS" or "PROPFIND". The method is added to
+	// the cache key, such that the methods do not share objects, and the backend fetch restores it, since Varnish
+	// fetches misses with GET otherwise. Listing HEAD caches the responses to HEAD requests separately.
+	// Like the built-in VCL, requests with an Authorization or Cookie header are not looked up, and request bodies
+	// are not sent to the backend, so unsafe methods like POST must not be listed.
+	CacheableMethods []string
+
+	// CacheQueryMethod injects VCL which caches responses to requests with the QUERY method (a draft for safe requests
+	// carrying the query in the request body), unless empty. It is the maximum size of their bodies (e.g. "64KB"),
+	// which are buffered with std.cache_req_body and hashed into the cache key together with the Content-Type by
+	// vmod bodyaccess of the varnish-modules. Requests with larger bodies are responded to with 413.
+	CacheQueryMethod string
+
+	// Synthetics are synthetic responses which Varnish generates instead of fetching from the backend,
+	// such as maintenance pages or custom error pages.
+	Synthetics []Synthetic
+
+	// MaxRetries sets the max_retries parameter, i.e. how often a backend fetch may be retried via return (retry),
+	// unless 0. The default of Varnish is 4.
+	MaxRetries int
+
+	// RetryStatuses injects VCL which retries backend fetches whose response has one of the given status codes,
+	// and RetryBackendErrors injects VCL which retries backend fetches failing without a usable response.
+	// Once MaxRetries is exhausted, the client receives a 503 response.
+	RetryStatuses      []int
+	RetryBackendErrors bool
+
+	// CacheRequestBody injects VCL which buffers the bodies of POST, PUT and PATCH requests of up to the given size
+	// (e.g. "1MB") with std.cache_req_body before they are sent to the backend, e.g. for retries, and responds to
+	// requests with larger bodies with 413. Otherwise, Varnish streams request bodies to the backend.
+	CacheRequestBody string
+
+	// BackendRequestHeaders injects VCL which sets the given headers on every backend request after the custom VCL
+	// has run (unless it returns from vcl_backend_fetch), e.g. to always send Accept-Encoding: gzip.
+	// Headers with an empty value are removed instead. The values are rendered as VCL long strings, so they must not
+	// contain "} (a quote followed by a brace).
+	BackendRequestHeaders map[string]string
+
+	// EnableProxyProtocol adds a listener accepting the PROXY protocol (version 1 or 2), whose host port
+	// is the ProxyPort of the VarnishInstance. Varnish takes client.ip from the PROXY header.
+	EnableProxyProtocol bool
+
+	// Listeners adds further endpoints accepting client requests, e.g. one with the PROXY protocol and one on
+	// a Unix domain socket, whose host ports or socket paths are the Listeners of the VarnishInstance (see Listener).
+	Listeners []Listener
+
+	// EnableAdmin exposes the CLI of Varnish, which is protected by a random secret in a file of the host, whose
+	// host port and path are the AdminPort and the AdminSecretFile of the VarnishInstance. Any client knowing both
+	// can administer Varnish remotely like varnishadm -T -S does, e.g. an AdminClient. Only the current user of the
+	// host and the varnish user of the container can read the secret.
+	EnableAdmin bool
+
+	// TrustedProxies injects VCL which only keeps the X-Forwarded-For and Forwarded request headers
+	// if the peer of the connection (remote.ip) matches one of the given IP addresses or CIDR ranges.
+	// Otherwise, X-Forwarded-For is replaced with client.ip and Forwarded is removed.
+	TrustedProxies []string
+
+	// PurgeAllowed injects VCL which handles PURGE and BAN requests from clients whose client.ip matches one of the
+	// given IP addresses or CIDR ranges, and responds to those of other clients with 403. PURGE removes the object
+	// for the URL of the request, while BAN bans all objects whose URL matches the URL of the request as a regular
+	// expression. For PROXY protocol connections, client.ip is the client IP of the PROXY header.
+	PurgeAllowed []string
+
+	// Canary injects VCL which routes a share of the requests to a second backend, unless nil (see Canary).
+	Canary *Canary
+
+	// JwtAuth injects VCL which validates a JSON Web Token signed with HS256 for protected requests before they are
+	// looked up, unless nil (see JwtAuth).
+	JwtAuth *JwtAuth
+
+	// Tenants injects VCL applying caching policies per Host header, e.g. for several sites sharing one cache.
+	// Objects of different hosts are separate, since the built-in VCL hashes the Host header.
+	Tenants []Tenant
+
+	// RateLimit injects VCL which limits the number of requests per client with vsthrottle, unless nil.
+	RateLimit *RateLimit
+
+	// ForcedRevalidation injects VCL which honors forced revalidations (Cache-Control: no-cache or Pragma: no-cache)
+	// of trusted clients, unless nil. The built-in VCL ignores them, so that clients cannot bypass the cache.
+	ForcedRevalidation *ForcedRevalidation
+
+	// WarnStale injects VCL which adds a Warning header to stale responses delivered from the cache:
+	// 110 (Response is Stale) or, if the backend is sick, 111 (Revalidation Failed).
+	// RFC 9111 obsoleted Warning, but downstream caches and clients may still interpret it.
+	WarnStale bool
+
+	// StatusTTLs injects VCL which assigns the given TTLs to backend responses with the given statuses,
+	// e.g. to cache 404 responses for a short time (negative caching). The TTLs override those derived from
+	// Cache-Control or Expires, but the built-in VCL still refuses to cache e.g. Cache-Control: private.
+	// Responses with statuses which Varnish does not cache by default, like 500, become cacheable as well.
+	// The grace period still applies, such that expired responses are served stale while being refetched.
+	StatusTTLs map[int]time.Duration
+
+	// UncacheableStatuses injects VCL which marks backend responses with the given statuses as uncacheable
+	// after the custom VCL has run, creating a hit-for-miss object which lives for UncacheableTtl (120s if 0,
+	// like the built-in VCL). Requests hitting it are fetched from the backend without waiting for each other.
+	UncacheableStatuses []int
+	UncacheableTtl      time.Duration
+
+	// HitForPass injects VCL which creates hit-for-pass instead of hit-for-miss objects, both for
+	// UncacheableStatuses and for the responses which the built-in VCL considers uncacheable, living for
+	// UncacheableTtl (120s if 0). Unlike hit-for-miss, requests hitting a hit-for-pass object are passed:
+	// their conditional headers reach the backend, and a cacheable response does not replace the object.
+	HitForPass bool
+
+	// HitForMissTtl overrides the TTL of the hit-for-miss objects which the built-in VCL creates for uncacheable
+	// responses (120s) unless 0, by overriding its vcl_beresp_hitmiss subroutine. While such an object lives,
+	// requests are fetched from the backend without waiting for each other, i.e. they are not coalesced.
+	// A negative duration sets a TTL of 0s, which creates no usable hit-for-miss object and thus serializes
+	// concurrent requests for uncacheable responses on the waiting list. It has no effect with HitForPass.
+	HitForMissTtl time.Duration
+
+	// BakeVcl builds an image with the rendered VCL as /etc/varnish/default.vcl instead of mounting it from
+	// a temporary file. The image is tagged with the digest of the VCL and kept by Docker, such that later
+	// runs of the same config start from the image without building it again.
+	BakeVcl bool
+
+	// Image is the Varnish image to run instead of the official one, e.g. an in-house image with custom vmods.
+	// It must be based on the official image, whose entrypoint script and tools the tests rely on.
+	Image string
+	// RegistryAuth are the credentials for pulling the image from a private registry, e.g. the ones returned by
+	// DockerConfigRegistryAuth. The registry is accessed anonymously if nil.
+	RegistryAuth *RegistryAuth
+	// Platform is the platform of the Varnish image as os/arch or os/arch/variant, e.g. "linux/arm64".
+	// The image is pulled for it, and the container fails to start rather than running another platform
+	// in emulation. It defaults to the choice of the Docker daemon, usually its native platform.
+	// Unless Docker uses the containerd image store, it keeps a single platform per image, so all tests
+	// of a run should use the same platform.
+	Platform string
+	// PullPolicy decides whether the Varnish image is pulled before the container is started.
+	// It defaults to the policy of PullPolicyEnv.
+	PullPolicy PullPolicy
+
+	// Params sets further parameters of varnishd by name, e.g. "rush_exponent": "2".
+	Params map[string]string
+	// Features raises or lowers feature flags of varnishd, e.g. "+esi_include_onerror" or "-esi_ignore_https",
+	// which are rendered as the "feature" parameter, so Params must not set it as well. The flags for ESI are
+	// esi_include_onerror (honor onerror="continue" and abort the delivery of a page if another include fails),
+	// esi_disable_xml_check (process bodies not starting with '<'), esi_ignore_https (include https:// URLs
+	// as http://), esi_ignore_other_elements and esi_remove_bom.
+	Features []string
+
+	// Network attaches the Varnish container to a network of its own instead of the default bridge network,
+	// where the backend is a container as well, e.g. one started by StartEchoBackendInDocker. BackendHost must
+	// then be the alias of the backend container, since the test servers on the host are not reachable.
+	// StartVarnishClusterInDocker does not support it.
+	Network *Network
+	// BackendHost is the host name or IP address of the backend, which defaults to host.docker.internal, i.e. the host.
+	// Varnish resolves it when compiling the VCL, so a backend container must have been started before,
+	// and keeps using the resolved address until the VCL is compiled again by VarnishInstance.ReloadVCL,
+	// unless BackendResolveTtl is set. If the name resolves to both an IPv4 and an IPv6 address, the "prefer_ipv6"
+	// parameter selects one of them.
+	BackendHost string
+	// BackendResolveTtl makes Varnish resolve BackendHost at runtime with a director of vmod dynamic, unless 0.
+	// It resolves the name again once the given duration has passed since the previous lookup and spreads
+	// fetches over all addresses, like for a backend behind autoscaling. Neither a backend container nor
+	// the name have to exist when Varnish starts, fetches fail with 503 until they do.
+	// StartVarnishClusterInDocker does not support it.
+	BackendResolveTtl time.Duration
+	// BackendSocket is the path of a Unix domain socket on the host the backend listens on, e.g. one of a server
+	// started by StartTestServerOnSocket. Its directory is bind-mounted into the container, and Varnish connects
+	// to the socket by the .path of the backend definition instead of BackendHost and BackendPort.
+	// Docker Desktop cannot share sockets between the host and its VM, so it only works with a native Docker engine.
+	BackendSocket string
+
+	// ListenIPv6 binds the published ports to the IPv6 loopback interface ::1 instead of 127.0.0.1,
+	// such that clients must connect over IPv6.
+	ListenIPv6 bool
+}
+
+// RateLimit limits the number of requests per key in a sliding period. Requests exceeding
+// the limit are responded to with 429 and a Retry-After header of the whole period.
+type RateLimit struct {
+	// Limit is the number of requests allowed per Period.
+	Limit int
+	// Period is the duration over which requests are counted.
+	Period time.Duration
+	// Key is a VCL string expression identifying the client, client.ip if empty.
+	Key string
+	// CountHits counts cache hits against the limit as well.
+	// Otherwise, only requests which reach the backend (misses and passes) are counted.
+	CountHits bool
+}
+
+// ForcedRevalidation honors forced revalidations of trusted clients by fetching a fresh response from the backend,
+// which replaces the cached object (unless HonorImmutable delivers it). Forced revalidations of other clients
+// are ignored like by the built-in VCL. If neither Allowed nor Secret is set, all clients are trusted.
+type ForcedRevalidation struct {
+	// Allowed are the IP addresses or CIDR ranges of trusted clients, which are matched against client.ip.
+	Allowed []string
+	// Secret trusts clients sending it in an X-Revalidation-Secret request header, which never reaches the backend.
+	// It is rendered as a VCL long string, so it must not contain "} (a quote followed by a brace).
+	Secret string
+}
+
+// Canary splits the requests into the variants "control", fetched from the default backend, and "canary",
+// fetched from a second backend, e.g. for A/B tests or canary releases. The variant is added to the cache key,
+// such that each variant only ever delivers objects of its own backend, and passed to the backend and the client
+// in an X-Variant header. A variant requested by Header or Cookie is taken, and the others are assigned at random.
+type Canary struct {
+	// BackendPort is the port of the second backend on the same host as the default backend.
+	BackendPort string
+	// Percent is the share of the randomly assigned requests which go to the canary, from 0 to 100.
+	Percent int
+	// Header is the name of a request header selecting the variant by the value "canary" or "control", if set,
+	// e.g. for testers.
+	Header string
+	// Cookie is the name of a cookie selecting the variant like Header, if set. Randomly assigned clients receive
+	// the cookie with their variant, such that they stick to it. The cookie is removed before the lookup, so it does
+	// not make the built-in VCL pass the request.
+	Cookie string
+}
+
+// Tenant is the caching policy of the requests for one host, which applies to requests whose Host header equals Host
+// in lower case. Its PURGE and BAN requests are handled before PurgeAllowed and only affect its own objects.
+type Tenant struct {
+	// Host is the Host header of the tenant, including the port if clients send one, e.g. "shop.example.com".
+	Host string
+	// Ttl and Grace override the TTL and grace period of the responses for the host which are cacheable,
+	// i.e. whose TTL is positive, unless 0. Uncacheable responses stay uncacheable.
+	Ttl   time.Duration
+	Grace time.Duration
+	// PurgeSecret allows PURGE and BAN requests for the host which carry it in an X-Purge-Secret header,
+	// and rejects all others with 403. A BAN request only bans the objects of the host whose URL matches.
+	// It is rendered as a VCL long string, so it must not contain "} (a quote followed by a brace).
+	PurgeSecret string
+}
+
+// JwtAuth authenticates requests at the edge by a JSON Web Token in an "Authorization: Bearer" header, whose HS256
+// signature is verified with vmod digest and whose "exp" claim must be in the future. Requests without a valid token
+// are responded to with 401 and a WWW-Authenticate header, whether the content is cached or not. The Authorization
+// header is removed from valid requests, such that the built-in VCL looks them up and all clients with a valid token
+// share the cached objects, and the backend receives the claims in an X-Jwt-Claims header instead.
+type JwtAuth struct {
+	// Secret is the key of the HMAC, e.g. the one passed to SignJwt.
+	// It is rendered as a VCL long string, so it must not contain "} (a quote followed by a brace).
+	Secret string
+	// Condition is a VCL expression selecting the protected requests, e.g. req.url ~ "^/private/".
+	// All requests are protected if empty.
+	Condition string
+}
+
+// Synthetic is a synthetic response generated in vcl_synth or, for failed backend fetches, in vcl_backend_error.
+// Body and header values are rendered as VCL long strings, so they must not contain "} (a quote followed by a brace).
+type Synthetic struct {
+	// Status is the status code of the synthetic response. Synthetic responses with this status,
+	// including those created by return (synth(...)) in the custom VCL, get the Body and Headers.
+	Status int
+	// Condition is a VCL expression which, when true in vcl_recv, makes Varnish respond with this synthetic
+	// response without looking up the cache or contacting the backend, e.g. req.url ~ "^/maintenance".
+	Condition string
+	// OnBackendError replaces the response to a failed backend fetch with this synthetic response.
+	// Only the first synthetic response with OnBackendError is used.
+	OnBackendError bool
+	// Ttl is how long the synthetic response to a failed backend fetch is cached.
+	// It is not cached if 0. Synthetic responses created in vcl_synth are never cached.
+	Ttl     time.Duration
+	Body    string
+	Headers map[string]string
+}
+
+// HashOn lists inputs which are added to the cache key, such that requests differing in any of them
+// are served by different objects.
+type HashOn struct {
+	// Headers are the names of request headers whose values are added to the cache key.
+	Headers []string
+	// Cookies are the names of cookies whose values are added to the cache key.
+	// Note that the built-in VCL passes all requests with a Cookie header,
+	// so custom VCL must return (hash) for requests carrying these cookies.
+	Cookies []string
+	// Protocol adds the protocol of the request (e.g. HTTP/1.1) to the cache key.
+	Protocol bool
+}
+
+func StartVarnishInDocker(config VarnishConfig) (string, func() error, error) {
+	return StartVarnishInDockerContext(context.Background(), config)
+}
+
+// StartVarnishInDockerContext starts Varnish like StartVarnishInDocker, but gives up when the context is done
+// before Varnish has been started, e.g. by a deadline for a hanging Docker daemon. Any image pull or container
+// start in progress is aborted and a created container is removed. Varnish keeps running once it has been started.
+func StartVarnishInDockerContext(ctx context.Context, config VarnishConfig) (string, func() error, error) {
+	instance, err := StartVarnishInstanceInDockerContext(ctx, config)
+	if err != nil {
+		return "", nil, err
+	}
+	return instance.Port, instance.Stop, nil
 }
 
-func init() {
-	var err error
-	// create a Docker client
-	cli, err = client.NewClientWithOpts(client.FromEnv)
+// startVarnish starts a Varnish container running the given VCL. Unless nil, the given port binding
+// replaces the default binding to a random port on the loopback interface of the host.
+// The returned instance has no probe secret, which is up to the caller.
+// It waits for a free slot of the Varnish containers (see MaxVarnishContainersEnv) and releases it when stopped.
+func startVarnish(ctx context.Context, config VarnishConfig, vcl string, portBinding *nat.PortBinding) (*VarnishInstance, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	release, err := varnishSlots.acquire(ctx, 1)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	var hostStorageDir string
+	if config.FileStorage != "" {
+		hostStorageDir, err = newWritableDir("varnish-storage")
+		if err != nil {
+			release()
+			return nil, err
+		}
 	}
-	reader, err := cli.ImagePull(context.Background(), varnishImage, types.ImagePullOptions{})
+	instance, err := startVarnishContainer(ctx, config, vcl, portBinding, hostStorageDir)
 	if err != nil {
-		panic(err)
+		os.RemoveAll(hostStorageDir)
+		release()
+		return nil, err
 	}
-	defer reader.Close()
-	io.Copy(os.Stdout, reader)
+	instance.stop = func() error {
+		defer release()
+		defer os.RemoveAll(hostStorageDir)
+		// the container may have been replaced by Restart
+		return instance.stopContainer()
+	}
+	return instance, nil
 }
 
-func StartVarnishInDocker(config VarnishConfig) (string, func(), error) {
-	// write vcl as default.vcl file in a temporary directory
-	tmpDir, err := os.MkdirTemp("", "varnish")
+// bakeVcl returns an image based on the given image with the given VCL as /etc/varnish/default.vcl
+// for the given platform, building it unless Docker has it already.
+func bakeVcl(ctx context.Context, image string, vcl string, platform string) (string, error) {
+	digest := sha256.Sum256([]byte(image + "\n" + platform + "\n" + vcl))
+	tag := "caching-varnish-vcl:" + hex.EncodeToString(digest[:8])
+	present, err := imagePresent(ctx, tag, platform)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-	defer os.RemoveAll(tmpDir)
-
-	vclFileName := path.Join(tmpDir, "default.vcl")
-	err = os.WriteFile(vclFileName, []byte(`vcl 4.1;
-backend default {
-	.host = "host.docker.internal";
-	.port = "`+config.BackendPort+`";
+	if present {
+		return tag, nil
+	}
+	err = buildImage(ctx, tag, platform, map[string]string{
+		"Dockerfile":  "FROM " + image + "\nCOPY default.vcl /etc/varnish/default.vcl\n",
+		"default.vcl": vcl,
+	})
+	return tag, err
 }
-`+config.Vcl), 0644)
+
+// storageDir is the directory of the container where the file of VarnishConfig.FileStorage is kept.
+const storageDir = "/var/lib/varnish-storage"
+
+// newWritableDir creates a directory on the host with the given name pattern to be mounted into the container,
+// e.g. for the file of VarnishConfig.FileStorage, which the varnish user of the container can write to.
+func newWritableDir(pattern string) (string, error) {
+	dir, err := os.MkdirTemp("", pattern)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-
-	// create a Varnish container
-	containerResponse, err := cli.ContainerCreate(context.Background(), &container.Config{
-		Image: varnishImage,
-		ExposedPorts: nat.PortSet{
-			// Expose an unprivileged port (we use 8080).
-			// The image only exposes the privileged port 80 and 8443 by default.
-			// We also must expose any port other than the image-declared ports
-			// if we want to map these ports to the host.
-			"8080/tcp": struct{}{},
-		},
-		Cmd: []string{
-			"-n",
-			"/tmp/varnish_workdir",
-			"-t",
-			withDefault(config.DefaultTtl, "0s"),
-			"-p",
-			"default_grace=" + withDefault(config.DefaultGrace, "0s"),
-			"-p",
-			"default_keep=" + withDefault(config.DefaultKeep, "0s"),
-		},
-		Env: []string{
-			// The entrypoint script of the image uses environment variables
-			// to override the bind port (we use 8080) and the cache size (we use 1M).
-			"VARNISH_HTTP_PORT=8080",
-			"VARNISH_SIZE=1M",
-		},
-	}, &container.HostConfig{
-		CapDrop:        []string{"ALL"}, // <- drop all capabilities
-		Privileged:     false,           // <- run as unprivileged user
-		ReadonlyRootfs: true,            // <- mount the root filesystem as read-only
-		AutoRemove:     true,            // <- automatically remove the container when it exits
-		ExtraHosts: []string{
-			// Make the host's network available to the container
-			// via the special DNS name host.docker.internal.
-			"host.docker.internal:host-gateway",
-		},
-		Tmpfs: map[string]string{
-			// Mount a tmpfs volume to /tmp for the Varnish workdir.
-			"/tmp": "exec,mode=700,uid=1000,gid=1000",
-		},
-		// Mount the default.vcl file we created above as /etc/varnish/default.vcl
-		Binds: []string{vclFileName + ":/etc/varnish/default.vcl"},
-		PortBindings: nat.PortMap{
-			// Map the container's port 8080 to a random port on the host.
-			// We will later figure out the allocated host port.
-			"8080/tcp": []nat.PortBinding{{
-				HostIP:   "127.0.0.1", // <- bind to loopback interface
-				HostPort: "0",         // <- use random host port
-			}},
-		},
-	}, nil, nil, "")
+	// MkdirTemp creates the directory for the current user only
+	err = os.Chmod(dir, 0777)
 	if err != nil {
-		return "", nil, err
+		os.RemoveAll(dir)
+		return "", err
 	}
+	return dir, nil
+}
 
-	// start the container
-	err = cli.ContainerStart(context.Background(), containerResponse.ID, container.StartOptions{})
+// startVarnishContainer starts a Varnish container like startVarnish without waiting for a free slot.
+// The given directory of the host is mounted for the file of VarnishConfig.FileStorage, if set.
+// Stopping the returned instance only stops the container.
+func startVarnishContainer(ctx context.Context, config VarnishConfig, vcl string, portBinding *nat.PortBinding, hostStorageDir string) (instance *VarnishInstance, err error) {
+	platform, err := parsePlatform(config.Platform)
 	if err != nil {
-		return "", nil, err
+		return nil, err
+	}
+	image := withDefault(config.Image, varnishImage)
+	if needsVmodsImage(config) && config.Image == "" {
+		image = vmodsImage
+		err = buildImage(ctx, image, config.Platform, map[string]string{"Dockerfile": vmodsDockerfile})
+	} else {
+		err = pullImage(ctx, image, config.Platform, config.PullPolicy, config.RegistryAuth)
 	}
-
-	// tail logs of container
-	i, err := cli.ContainerLogs(context.Background(), containerResponse.ID, container.LogsOptions{
-		ShowStderr: true,
-		ShowStdout: true,
-		Timestamps: false,
-		Follow:     true,
-		Tail:       "40",
-	})
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
-	hdr := make([]byte, 8)
-	go func() {
-		fmt.Printf("Start tailing logs for container %s\n", containerResponse.ID)
-		for {
-			_, err := i.Read(hdr)
+	hostConfig := newHostConfig("8080/tcp")
+	hostConfig.Memory = config.MemoryLimit
+	// a swap limit equal to the memory limit disables swapping, which would hide memory pressure
+	hostConfig.MemorySwap = config.MemoryLimit
+	hostConfig.NanoCPUs = int64(config.CPUs * 1e9)
+	var tmpDir string
+	if config.BakeVcl {
+		image, err = bakeVcl(ctx, image, vcl, config.Platform)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// write vcl as default.vcl file in a temporary directory,
+		// which is kept until the container is stopped
+		tmpDir, err = os.MkdirTemp("", "varnish")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
 			if err != nil {
-				break
+				os.RemoveAll(tmpDir)
 			}
-			var w io.Writer
-			switch hdr[0] {
-			case 1:
-				w = os.Stdout
-			default:
-				w = os.Stderr
-			}
-			count := binary.BigEndian.Uint32(hdr[4:])
-			dat := make([]byte, count)
-			_, err = i.Read(dat)
-			fmt.Fprint(w, string(dat))
+		}()
+
+		vclFileName := path.Join(tmpDir, "default.vcl")
+		err = os.WriteFile(vclFileName, []byte(vcl), 0644)
+		if err != nil {
+			return nil, err
+		}
+		// Mount the default.vcl file we created above as /etc/varnish/default.vcl
+		hostConfig.Binds = append(hostConfig.Binds, vclFileName+":/etc/varnish/default.vcl")
+	}
+	if config.BackendSocket != "" {
+		hostConfig.Binds = append(hostConfig.Binds, filepath.Dir(config.BackendSocket)+":"+backendSocketDir)
+	}
+	if config.GeoIPDatabase != "" {
+		hostConfig.Binds = append(hostConfig.Binds, config.GeoIPDatabase+":"+geoipDatabase+":ro")
+	}
+	if config.FileStorage != "" {
+		hostConfig.Binds = append(hostConfig.Binds, hostStorageDir+":"+storageDir)
+	}
+	loopback := "127.0.0.1"
+	if config.ListenIPv6 {
+		loopback = "::1"
+	}
+	if portBinding != nil {
+		hostConfig.PortBindings["8080/tcp"] = []nat.PortBinding{*portBinding}
+	} else if config.ListenIPv6 {
+		hostConfig.PortBindings["8080/tcp"] = []nat.PortBinding{{HostIP: loopback, HostPort: "0"}}
+	}
+	exposedPorts := nat.PortSet{
+		// Expose an unprivileged port (we use 8080).
+		// The image only exposes the privileged port 80 and 8443 by default.
+		// We also must expose any port other than the image-declared ports
+		// if we want to map these ports to the host.
+		"8080/tcp": struct{}{},
+	}
+	var proxyPort string
+	if config.EnableProxyProtocol {
+		// startContainer only reports the host port of a single container port,
+		// so the host port of the PROXY listener is allocated in advance
+		proxyPort, err = freePort()
+		if err != nil {
+			return nil, err
+		}
+		exposedPorts["8444/tcp"] = struct{}{}
+		hostConfig.PortBindings["8444/tcp"] = []nat.PortBinding{{HostIP: loopback, HostPort: proxyPort}}
+	}
+	listeners, socketDir, err := bindListeners(config, hostConfig, exposedPorts, loopback)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(socketDir)
 		}
-		fmt.Printf("Stop tailing logs for container %s\n", containerResponse.ID)
 	}()
+	var adminPort, adminDir, hostAdminSecretFile string
+	var privateFiles map[string]string
+	if config.EnableAdmin {
+		var adminSecret string
+		adminDir, hostAdminSecretFile, adminSecret, err = newAdminSecret()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				os.RemoveAll(adminDir)
+			}
+		}()
+		hostConfig.Mounts = append(hostConfig.Mounts, privateVolume(adminSecretDir))
+		privateFiles = map[string]string{adminSecretFile: adminSecret}
+		// allocated in advance like the host port of the PROXY listener
+		adminPort, err = freePort()
+		if err != nil {
+			return nil, err
+		}
+		exposedPorts["6082/tcp"] = struct{}{}
+		hostConfig.PortBindings["6082/tcp"] = []nat.PortBinding{{HostIP: loopback, HostPort: adminPort}}
+	}
+
+	var networkingConfig *network.NetworkingConfig
+	if config.Network != nil {
+		networkingConfig = config.Network.attach(hostConfig)
+	}
 
-	// figure out the allocated host port (note: we used "0" as port above)
-	containerInspect, err := cli.ContainerInspect(context.Background(), containerResponse.ID)
+	// create and start a Varnish container
+	c, err := runContainer(ctx, &container.Config{
+		Image:        image,
+		ExposedPorts: exposedPorts,
+		Cmd:          varnishCmd(config),
+		Env: []string{
+			// The entrypoint script of the image uses environment variables
+			// to override the bind port (we use 8080) and the cache size (we use 1M by default).
+			"VARNISH_HTTP_PORT=8080",
+			"VARNISH_SIZE=" + withDefault(config.StorageSize, "1M"),
+		},
+	}, hostConfig, networkingConfig, platform, privateFiles, "8080/tcp", varnishCrashPattern)
 	if err != nil {
-		return "", nil, err
+		return nil, err
+	}
+	stop := func() error {
+		defer os.RemoveAll(tmpDir)
+		defer os.RemoveAll(socketDir)
+		defer os.RemoveAll(adminDir)
+		return c.stop()
 	}
-	varnishPort := containerInspect.NetworkSettings.Ports["8080/tcp"][0].HostPort
+	return &VarnishInstance{Port: c.hostPort, ProxyPort: proxyPort, Listeners: listeners, AdminPort: adminPort,
+		AdminSecretFile: hostAdminSecretFile, stop: stop, stopContainer: stop, containerID: c.id, log: c.log,
+		config: config, vcl: vcl, storageDir: hostStorageDir}, nil
+}
 
-	// return a function that will stop the container
-	return varnishPort, func() {
-		err = cli.ContainerStop(context.Background(), containerResponse.ID, container.StopOptions{})
-	}, nil
+// varnishCmd returns the arguments for varnishd, which the entrypoint script of the image passes on.
+func varnishCmd(config VarnishConfig) []string {
+	cmd := []string{
+		"-n",
+		"/tmp/varnish_workdir",
+		"-t",
+		VclDuration(config.DefaultTtl),
+		"-p",
+		"default_grace=" + VclDuration(config.DefaultGrace),
+		"-p",
+		"default_keep=" + VclDuration(config.DefaultKeep),
+	}
+	if config.SendTimeout != 0 {
+		cmd = append(cmd, "-p", "send_timeout="+VclDuration(config.SendTimeout))
+	}
+	if config.IdleSendTimeout != 0 {
+		cmd = append(cmd, "-p", "idle_send_timeout="+VclDuration(config.IdleSendTimeout))
+	}
+	for _, limit := range limitParams(config) {
+		if limit.value != 0 {
+			cmd = append(cmd, "-p", limit.param+"="+strconv.Itoa(limit.value))
+		}
+	}
+	if config.EnableProxyProtocol {
+		cmd = append(cmd, "-a", "proxyprotocol=:8444,PROXY")
+	}
+	cmd = append(cmd, listenerArgs(config)...)
+	if config.EnableAdmin {
+		// listen on all interfaces of the container instead of localhost only, such that the port can be published
+		cmd = append(cmd, "-T", ":6082", "-S", adminSecretFile)
+	}
+	if config.MaxRetries != 0 {
+		cmd = append(cmd, "-p", "max_retries="+strconv.Itoa(config.MaxRetries))
+	}
+	// log objects leaving the cache for ListObjects
+	cmd = append(cmd, "-p", "vsl_mask=+ExpKill")
+	if config.FileStorage != "" {
+		// in addition to the malloc storage of the entrypoint script, which fileStorageVcl bypasses
+		cmd = append(cmd, "-s", "file="+config.FileStorage+","+storageDir+"/storage.bin,"+withDefault(config.StorageSize, "1M"))
+	}
+	if len(config.Features) > 0 {
+		cmd = append(cmd, "-p", "feature="+strings.Join(config.Features, ","))
+	}
+	// sort the parameters to start varnishd with stable arguments
+	names := make([]string, 0, len(config.Params))
+	for name := range config.Params {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		cmd = append(cmd, "-p", name+"="+config.Params[name])
+	}
+	return cmd
 }
 
 func withDefault(s string, defaultValue string) string {
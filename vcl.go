@@ -0,0 +1,1141 @@
+package caching
+
+import (
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mustRevalidateVcl sets the grace period to zero for responses which must not be served
+// stale without successful revalidation with the backend.
+// See: https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.2
+const mustRevalidateVcl = `
+sub vcl_backend_response {
+  if (beresp.http.Cache-Control ~ "(?i)(^|,)\s*(must|proxy)-revalidate\s*(,|$)") {
+    set beresp.grace = 0s;
+  }
+}
+`
+
+// honorImmutableVcl delivers fresh immutable objects before any later vcl_hit logic
+// (e.g. honoring a client's forced revalidation) gets a chance to refresh them.
+// See: https://www.rfc-editor.org/rfc/rfc8246
+const honorImmutableVcl = `
+sub vcl_hit {
+  if (obj.ttl > 0s && obj.http.Cache-Control ~ "(?i)(^|,)\s*immutable\s*(,|$)") {
+    return (deliver);
+  }
+}
+`
+
+// respectNoTransformVcl disables compression for responses which must not be transformed.
+// It must run after any VCL that might enable beresp.do_gzip.
+// See: https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.6
+const respectNoTransformVcl = `
+sub vcl_backend_response {
+  if (beresp.http.Cache-Control ~ "(?i)(^|,)\s*no-transform\s*(,|$)") {
+    set beresp.do_gzip = false;
+  }
+}
+`
+
+// stripQualifiedFieldsVcl renders VCL which removes the given headers when a qualified private="..."
+// or no-cache="..." directive lists them, and then removes all qualified directives listing only
+// these headers, such that the built-in VCL does not consider the response uncacheable anymore.
+// See: https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4
+func stripQualifiedFieldsVcl(headers []string) string {
+	var sb strings.Builder
+	quoted := make([]string, len(headers))
+	sb.WriteString("\nsub vcl_backend_response {\n")
+	for i, header := range headers {
+		quoted[i] = regexp.QuoteMeta(header)
+		sb.WriteString(`  if (beresp.http.Cache-Control ~ {"(?i)(private|no-cache)\s*=\s*"([^"]*,)?\s*` + quoted[i] + `\s*(,[^"]*)?""}) {
+    unset beresp.http.` + header + `;
+  }
+`)
+	}
+	names := "(" + strings.Join(quoted, "|") + ")"
+	sb.WriteString(`  set beresp.http.Cache-Control = regsuball(beresp.http.Cache-Control,
+    {"(?i)\s*(private|no-cache)\s*=\s*"\s*` + names + `(\s*,\s*` + names + `)*\s*"\s*(,|$)"}, "");
+  set beresp.http.Cache-Control = regsuball(beresp.http.Cache-Control, "^[\s,]+|[\s,]+$", "");
+  if (beresp.http.Cache-Control == "") {
+    unset beresp.http.Cache-Control;
+  }
+}
+`)
+	return sb.String()
+}
+
+// stripSetCookieOnHitVcl hides the Set-Cookie headers of cacheable responses from the built-in VCL
+// and restores them only when delivering the object to the request which fetched it (obj.hits is 0).
+// The header vmod copies all Set-Cookie headers, where reading beresp.http.Set-Cookie would only get the first.
+const stripSetCookieOnHitVcl = `
+import header;
+sub vcl_backend_response {
+  if (beresp.http.Set-Cookie && beresp.ttl > 0s) {
+    header.copy(beresp.http.Set-Cookie, beresp.http.X-Stripped-Set-Cookie);
+    unset beresp.http.Set-Cookie;
+  }
+}
+sub vcl_deliver {
+  if (resp.http.X-Stripped-Set-Cookie) {
+    if (obj.hits == 0) {
+      header.copy(resp.http.X-Stripped-Set-Cookie, resp.http.Set-Cookie);
+    }
+    unset resp.http.X-Stripped-Set-Cookie;
+  }
+}
+`
+
+// xCacheHeaderVcl reports hits and misses in an X-Cache response header.
+const xCacheHeaderVcl = `
+sub vcl_hit {
+  set req.http.X-Cache = "hit";
+}
+sub vcl_miss {
+  set req.http.X-Cache = "miss";
+}
+sub vcl_pass {
+  set req.http.X-Cache = "miss";
+}
+sub vcl_deliver {
+  set resp.http.X-Cache = req.http.X-Cache;
+}
+`
+
+// cacheStatusVcl reports hits and misses in a Cache-Status response header (RFC 9211).
+// The remaining TTL of hits is negative for stale objects.
+const cacheStatusVcl = `
+import std;
+sub vcl_hit {
+  set req.http.X-Cache-Status = "varnish; hit; ttl=" + std.integer(duration=obj.ttl, fallback=0);
+}
+sub vcl_miss {
+  set req.http.X-Cache-Status = "varnish; fwd=uri-miss";
+}
+sub vcl_pass {
+  set req.http.X-Cache-Status = "varnish; fwd=bypass";
+}
+sub vcl_deliver {
+  set resp.http.Cache-Status = req.http.X-Cache-Status;
+  unset req.http.X-Cache-Status;
+}
+`
+
+// echoRequestIDVcl echoes the X-Request-ID request header in the response.
+const echoRequestIDVcl = `
+sub vcl_deliver {
+  if (req.http.X-Request-ID) {
+    set resp.http.X-Request-ID = req.http.X-Request-ID;
+  }
+}
+`
+
+// doGzipVcl makes Varnish compress all backend responses before storing them.
+const doGzipVcl = `
+sub vcl_backend_response {
+  set beresp.do_gzip = true;
+}
+`
+
+// fileStorageVcl stores objects in the file storage (see VarnishConfig.FileStorage). Otherwise, Varnish would
+// alternate between it and the malloc storage. Short-lived objects are stored in the transient storage anyway.
+const fileStorageVcl = `
+sub vcl_backend_response {
+  set beresp.storage = storage.file;
+}
+`
+
+// disableStreamVcl makes Varnish fetch the complete backend response before delivering it.
+const disableStreamVcl = `
+sub vcl_backend_response {
+  set beresp.do_stream = false;
+}
+`
+
+// doEsiVcl makes Varnish process ESI instructions in all backend responses.
+const doEsiVcl = `
+sub vcl_backend_response {
+  set beresp.do_esi = true;
+}
+`
+
+// hashOnVcl renders VCL which adds the inputs of the given HashOn to the cache key before the built-in vcl_hash
+// adds the URL and host. Every input is prefixed with its name, such that different inputs with the same value
+// and missing inputs yield different keys.
+func hashOnVcl(hashOn HashOn) string {
+	var sb strings.Builder
+	sb.WriteString("\nsub vcl_hash {\n")
+	for _, header := range hashOn.Headers {
+		sb.WriteString(`  if (req.http.` + header + `) {
+    hash_data("header:` + header + `=" + req.http.` + header + `);
+  }
+`)
+	}
+	for _, cookie := range hashOn.Cookies {
+		quoted := regexp.QuoteMeta(cookie)
+		sb.WriteString(`  if (req.http.Cookie ~ "(^|;)\s*` + quoted + `=") {
+    hash_data("cookie:` + cookie + `=" + regsub(req.http.Cookie, "^(.*;)?\s*` + quoted + `=([^;]*).*$", "\2"));
+  }
+`)
+	}
+	if hashOn.Protocol {
+		sb.WriteString("  hash_data(\"protocol:\" + req.proto);\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// varyOnCookiesVcl renders VCL which extracts the given cookies into request headers in vcl_recv and varies
+// on these headers, removing the Cookie header for the built-in VCL to look the request up.
+func varyOnCookiesVcl(cookies map[string]string) string {
+	names := make([]string, 0, len(cookies))
+	for name := range cookies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var sb strings.Builder
+	sb.WriteString("\nimport cookie;\nsub vcl_recv {\n  cookie.parse(req.http.Cookie);\n")
+	for _, name := range names {
+		header := cookies[name]
+		sb.WriteString(`  if (cookie.isset("` + name + `")) {
+    set req.http.` + header + ` = cookie.get("` + name + `");
+  } else {
+    unset req.http.` + header + `;
+  }
+`)
+	}
+	sb.WriteString("  unset req.http.Cookie;\n}\n")
+	for _, name := range names {
+		sb.WriteString(varyOnVcl(cookies[name], "Cookie"))
+	}
+	return sb.String()
+}
+
+// varyOnVcl renders VCL which adds the given request header to the Vary header of all backend responses,
+// and replaces it with clientVary in the Vary header delivered to clients, who do not know the header,
+// or removes it if clientVary is empty.
+func varyOnVcl(header string, clientVary string) string {
+	quoted := regexp.QuoteMeta(header)
+	deliver := `    set resp.http.Vary = regsub(resp.http.Vary, "(?i)(^|,\s*)` + quoted + `(?=\s*,|\s*$)", "\1` + clientVary + `");
+`
+	if clientVary == "" {
+		deliver = `    set resp.http.Vary = regsub(resp.http.Vary, "(?i)(^|,)\s*` + quoted + `\s*(?=,|$)", "");
+    set resp.http.Vary = regsub(resp.http.Vary, "^\s*,\s*", "");
+    if (resp.http.Vary == "") {
+      unset resp.http.Vary;
+    }
+`
+	}
+	return `sub vcl_backend_response {
+  if (!beresp.http.Vary) {
+    set beresp.http.Vary = "` + header + `";
+  } elsif (beresp.http.Vary !~ "(?i)(^|,)\s*` + quoted + `\s*(,|$)") {
+    set beresp.http.Vary = beresp.http.Vary + ", ` + header + `";
+  }
+}
+sub vcl_deliver {
+  if (resp.http.Vary) {
+` + deliver + `  }
+}
+`
+}
+
+// deviceDetectionVcl classifies the User-Agent into the X-Device request header, which clients cannot set themselves.
+const deviceDetectionVcl = `
+sub vcl_recv {
+  if (req.http.User-Agent ~ "(?i)mobile|android|iphone|ipod|ipad|blackberry|opera mini|windows phone|kindle|silk") {
+    set req.http.X-Device = "mobile";
+  } else {
+    set req.http.X-Device = "desktop";
+  }
+}
+`
+
+// languagesVcl renders VCL which replaces the Accept-Language header with the first supported language it lists.
+// The lazy prefix makes the regular expression match the earliest element of the list with a supported language
+// and a quality other than 0.
+func languagesVcl(languages []string) string {
+	quoted := make([]string, len(languages))
+	for i, language := range languages {
+		quoted[i] = regexp.QuoteMeta(strings.ToLower(language))
+	}
+	supported := `(?i)^(?:.*?,)?\s*(` + strings.Join(quoted, "|") + `)(?:-[a-z0-9]+)*\s*(?:;\s*q\s*=\s*(?!0(?:\.0*)?\s*(?:,|$))[0-9.]+)?\s*(?:,|$)`
+	return `import std;
+sub vcl_recv {
+  if (req.http.Accept-Language ~ "` + supported + `") {
+    set req.http.Accept-Language = std.tolower(regsub(req.http.Accept-Language, "` + supported + `.*$", "\1"));
+  } else {
+    set req.http.Accept-Language = "` + strings.ToLower(languages[0]) + `";
+  }
+}
+`
+}
+
+// geoipVcl opens the mounted GeoIP database as the object geoip.
+const geoipVcl = `
+import geoip2;
+sub vcl_init {
+  new geoip = geoip2.geoip2("` + geoipDatabase + `");
+}
+`
+
+// varyOnCountryVcl looks up the country of the client into the X-Country request header.
+const varyOnCountryVcl = `
+sub vcl_recv {
+  set req.http.X-Country = geoip.lookup("country/iso_code", client.ip);
+  if (req.http.X-Country == "") {
+    set req.http.X-Country = "unknown";
+  }
+}
+`
+
+// ignoredQueryParamsVcl renders VCL which removes the given query parameters from req.url
+// and then cleans up the separators left behind.
+func ignoredQueryParamsVcl(params []string) string {
+	quoted := make([]string, len(params))
+	for i, param := range params {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			quoted[i] = regexp.QuoteMeta(prefix) + "[^=&]*"
+		} else {
+			quoted[i] = regexp.QuoteMeta(param)
+		}
+	}
+	return `
+sub vcl_recv {
+  if (req.url ~ "\?") {
+    set req.url = regsuball(req.url, "([?&])(` + strings.Join(quoted, "|") + `)(=[^&]*)?(?=&|$)", "\1");
+    set req.url = regsub(req.url, "\?&+", "?");
+    set req.url = regsuball(req.url, "&&+", "&");
+    set req.url = regsub(req.url, "[?&]+$", "");
+  }
+}
+`
+}
+
+// normalizeHostVcl lowercases the Host header and strips the port from it.
+const normalizeHostVcl = `
+import std;
+sub vcl_recv {
+  if (req.http.Host) {
+    set req.http.Host = regsub(std.tolower(req.http.Host), ":[0-9]+$", "");
+  }
+}
+`
+
+// disableCoalescingVcl makes requests ignore busy objects instead of waiting for them.
+const disableCoalescingVcl = `
+sub vcl_recv {
+  set req.hash_ignore_busy = true;
+}
+`
+
+// cacheableMethodsVcl renders VCL which looks up requests with the given methods in the cache, with the method
+// in the cache key. The method is passed to the backend fetch in a request header.
+func cacheableMethodsVcl(methods []string) string {
+	var conditions []string
+	for _, method := range methods {
+		if method != "GET" {
+			conditions = append(conditions, `req.method == "`+method+`"`)
+		}
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	return `
+sub vcl_recv {
+  unset req.http.X-Cacheable-Method;
+  if ((` + strings.Join(conditions, " || ") + `) && !req.http.Authorization && !req.http.Cookie) {
+    set req.http.X-Cacheable-Method = req.method;
+    return (hash);
+  }
+}
+sub vcl_hash {
+  if (req.http.X-Cacheable-Method) {
+    hash_data(req.http.X-Cacheable-Method);
+  }
+}
+sub vcl_backend_fetch {
+  if (bereq.http.X-Cacheable-Method) {
+    set bereq.method = bereq.http.X-Cacheable-Method;
+    unset bereq.http.X-Cacheable-Method;
+  }
+}
+`
+}
+
+// queryMethodVcl renders VCL which caches responses to QUERY requests with bodies of up to the given size,
+// whose body and Content-Type are added to the cache key. The buffered body is sent with the backend fetch.
+func queryMethodVcl(size string) string {
+	return `import std;
+import bodyaccess;
+sub vcl_recv {
+  unset req.http.X-Query-Method;
+  if (req.method == "QUERY") {
+    if (!std.cache_req_body(` + size + `)) {
+      return (synth(413, "Payload Too Large"));
+    }
+    set req.http.X-Query-Method = "1";
+    return (hash);
+  }
+}
+sub vcl_hash {
+  if (req.http.X-Query-Method) {
+    hash_data("QUERY");
+    hash_data(req.http.Content-Type);
+    bodyaccess.hash_req_body();
+  }
+}
+sub vcl_backend_fetch {
+  if (bereq.http.X-Query-Method) {
+    set bereq.method = "QUERY";
+    unset bereq.http.X-Query-Method;
+  }
+}
+`
+}
+
+// webSocketsVcl pipes WebSocket upgrades, such that the connection is handed over to the backend.
+const webSocketsVcl = `
+sub vcl_recv {
+  if (req.http.Upgrade ~ "(?i)^websocket$") {
+    return (pipe);
+  }
+}
+sub vcl_pipe {
+  if (req.http.Upgrade) {
+    set bereq.http.Upgrade = req.http.Upgrade;
+    set bereq.http.Connection = req.http.Connection;
+  }
+}
+`
+
+// pipeConditionVcl pipes the requests for which the given VCL expression is true.
+func pipeConditionVcl(condition string) string {
+	return `
+sub vcl_recv {
+  if (` + condition + `) {
+    return (pipe);
+  }
+}
+`
+}
+
+// cachePreflightsVcl looks up CORS preflight requests in the cache with the Origin and the requested method and
+// headers in the cache key. Varnish fetches misses with GET, so the backend fetch restores the OPTIONS method.
+const cachePreflightsVcl = `
+import std;
+sub vcl_recv {
+  if (req.method == "OPTIONS" && req.http.Origin && req.http.Access-Control-Request-Method) {
+    set req.http.X-Preflight = "1";
+    return (hash);
+  }
+}
+sub vcl_hash {
+  if (req.http.X-Preflight) {
+    hash_data("preflight");
+    hash_data(req.http.Origin);
+    hash_data(req.http.Access-Control-Request-Method);
+    hash_data(req.http.Access-Control-Request-Headers);
+  }
+}
+sub vcl_backend_fetch {
+  if (bereq.http.X-Preflight) {
+    set bereq.method = "OPTIONS";
+    unset bereq.http.X-Preflight;
+  }
+}
+sub vcl_backend_response {
+  if (bereq.method == "OPTIONS" && beresp.http.Access-Control-Max-Age) {
+    set beresp.ttl = std.duration(beresp.http.Access-Control-Max-Age + "s", 0s);
+  }
+}
+`
+
+// syntheticsVcl renders VCL which delivers the given synthetic responses.
+func syntheticsVcl(synthetics []Synthetic) string {
+	var sb strings.Builder
+	for _, synthetic := range synthetics {
+		status := strconv.Itoa(synthetic.Status)
+		if synthetic.Condition != "" {
+			sb.WriteString("sub vcl_recv {\n  if (" + synthetic.Condition + ") {\n    return (synth(" + status + "));\n  }\n}\n")
+		}
+		sb.WriteString("sub vcl_synth {\n  if (resp.status == " + status + ") {\n")
+		writeSyntheticResponse(&sb, "    ", "resp", synthetic)
+		sb.WriteString("    return (deliver);\n  }\n}\n")
+	}
+	for _, synthetic := range synthetics {
+		if !synthetic.OnBackendError {
+			continue
+		}
+		sb.WriteString("sub vcl_backend_error {\n  set beresp.status = " + strconv.Itoa(synthetic.Status) + ";\n")
+		if synthetic.Ttl != 0 {
+			sb.WriteString("  set beresp.ttl = " + VclDuration(synthetic.Ttl) + ";\n")
+		}
+		writeSyntheticResponse(&sb, "  ", "beresp", synthetic)
+		sb.WriteString("  return (deliver);\n}\n")
+		break
+	}
+	return sb.String()
+}
+
+// writeSyntheticResponse writes the statements setting the headers and the body of the given synthetic response
+// to the given VCL object (resp or beresp) with the given indentation. Headers are sorted to render stable VCL.
+func writeSyntheticResponse(sb *strings.Builder, indent string, object string, synthetic Synthetic) {
+	names := make([]string, 0, len(synthetic.Headers))
+	for name := range synthetic.Headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		sb.WriteString(indent + "set " + object + ".http." + name + " = {\"" + synthetic.Headers[name] + "\"};\n")
+	}
+	sb.WriteString(indent + "synthetic({\"" + synthetic.Body + "\"});\n")
+}
+
+// retryStatusesVcl renders VCL which retries backend fetches whose response has one of the given status codes.
+func retryStatusesVcl(statuses []int) string {
+	conditions := make([]string, len(statuses))
+	for i, status := range statuses {
+		conditions[i] = "beresp.status == " + strconv.Itoa(status)
+	}
+	return `
+sub vcl_backend_response {
+  if (` + strings.Join(conditions, " || ") + `) {
+    return (retry);
+  }
+}
+`
+}
+
+// retryBackendErrorsVcl retries backend fetches which fail without a usable response.
+const retryBackendErrorsVcl = `
+sub vcl_backend_error {
+  return (retry);
+}
+`
+
+// backendRequestHeadersVcl renders VCL which sets or, for empty values, removes the given backend request headers.
+// Headers are sorted to render stable VCL.
+func backendRequestHeadersVcl(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var sb strings.Builder
+	sb.WriteString("sub vcl_backend_fetch {\n")
+	for _, name := range names {
+		if headers[name] == "" {
+			sb.WriteString("  unset bereq.http." + name + ";\n")
+		} else {
+			sb.WriteString("  set bereq.http." + name + " = {\"" + headers[name] + "\"};\n")
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// aclVcl renders an ACL with the given name matching the given IP addresses or CIDR ranges.
+func aclVcl(name string, entries []string) string {
+	var sb strings.Builder
+	sb.WriteString("acl " + name + " {\n")
+	for _, entry := range entries {
+		if ip, bits, ok := strings.Cut(entry, "/"); ok {
+			sb.WriteString("  \"" + ip + "\"/" + bits + ";\n")
+		} else {
+			sb.WriteString("  \"" + entry + "\";\n")
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// trustedProxiesVcl renders VCL which discards the forwarding headers of requests from untrusted peers.
+// Varnish has already appended client.ip to X-Forwarded-For, which is all that is kept.
+func trustedProxiesVcl(proxies []string) string {
+	return aclVcl("trusted_proxies", proxies) + `sub vcl_recv {
+  if (remote.ip !~ trusted_proxies) {
+    set req.http.X-Forwarded-For = client.ip;
+    unset req.http.Forwarded;
+  }
+}
+`
+}
+
+// purgeVcl renders VCL which handles PURGE and BAN requests from the given clients.
+func purgeVcl(allowed []string) string {
+	return aclVcl("purge_allowed", allowed) + `import std;
+sub vcl_recv {
+  if (req.method == "PURGE" || req.method == "BAN") {
+    if (client.ip !~ purge_allowed) {
+      return (synth(403, "Forbidden"));
+    }
+    if (req.method == "BAN") {
+      if (std.ban("req.url ~ " + req.url)) {
+        return (synth(200, "Banned"));
+      }
+      return (synth(400, std.ban_error()));
+    }
+    return (purge);
+  }
+}
+`
+}
+
+// tenantsVcl renders VCL which handles the PURGE and BAN requests of tenants with a purge secret,
+// and overrides the TTL and grace of the cacheable responses of tenants. Objects keep the lowercased host
+// they were fetched for in an X-Tenant-Host header, which bans of a tenant compare with its configured host,
+// however clients spell the Host header.
+func tenantsVcl(tenants []Tenant) string {
+	var recv, backendResponse strings.Builder
+	for _, tenant := range tenants {
+		host := strings.ToLower(tenant.Host)
+		if tenant.PurgeSecret != "" {
+			recv.WriteString(`  if ((req.method == "PURGE" || req.method == "BAN") && std.tolower(req.http.Host) == "` + host + `") {
+    if (req.http.X-Purge-Secret != {"` + tenant.PurgeSecret + `"}) {
+      return (synth(403, "Forbidden"));
+    }
+    if (req.method == "BAN") {
+      if (std.ban("obj.http.X-Tenant-Host == ` + host + ` && req.url ~ " + req.url)) {
+        return (synth(200, "Banned"));
+      }
+      return (synth(400, std.ban_error()));
+    }
+    return (purge);
+  }
+`)
+		}
+		if tenant.Ttl != 0 || tenant.Grace != 0 {
+			backendResponse.WriteString(`  if (std.tolower(bereq.http.Host) == "` + host + `" && beresp.ttl > 0s) {
+`)
+			if tenant.Ttl != 0 {
+				backendResponse.WriteString("    set beresp.ttl = " + VclDuration(tenant.Ttl) + ";\n")
+			}
+			if tenant.Grace != 0 {
+				backendResponse.WriteString("    set beresp.grace = " + VclDuration(tenant.Grace) + ";\n")
+			}
+			backendResponse.WriteString("  }\n")
+		}
+	}
+	return `import std;
+sub vcl_recv {
+` + recv.String() + `  unset req.http.X-Purge-Secret;
+}
+sub vcl_backend_response {
+  set beresp.http.X-Tenant-Host = std.tolower(bereq.http.Host);
+` + backendResponse.String() + `}
+sub vcl_deliver {
+  unset resp.http.X-Tenant-Host;
+}
+`
+}
+
+// forcedRevalidationVcl renders VCL which marks forced revalidations of trusted clients in vcl_recv and restarts
+// them with a forced cache miss on a hit, such that HonorImmutable can still deliver immutable objects in vcl_hit.
+// The marker and the secret are removed before the backend request.
+func forcedRevalidationVcl(forcedRevalidation ForcedRevalidation) string {
+	var sb strings.Builder
+	var trusted []string
+	if len(forcedRevalidation.Allowed) > 0 {
+		sb.WriteString(aclVcl("forced_revalidation_allowed", forcedRevalidation.Allowed))
+		trusted = append(trusted, "client.ip ~ forced_revalidation_allowed")
+	}
+	if forcedRevalidation.Secret != "" {
+		trusted = append(trusted, `req.http.X-Revalidation-Secret == {"`+forcedRevalidation.Secret+`"}`)
+	}
+	condition := `(req.http.Cache-Control ~ "(?i)no-cache" || req.http.Pragma ~ "(?i)no-cache")`
+	if len(trusted) > 0 {
+		condition += " && (" + strings.Join(trusted, " || ") + ")"
+	}
+	sb.WriteString(`sub vcl_recv {
+  if (req.restarts == 0) {
+    unset req.http.X-Forced-Revalidation;
+    if (` + condition + `) {
+      set req.http.X-Forced-Revalidation = "1";
+    }
+    unset req.http.X-Revalidation-Secret;
+  }
+}
+sub vcl_hit {
+  if (req.http.X-Forced-Revalidation && req.restarts == 0) {
+    set req.hash_always_miss = true;
+    return (restart);
+  }
+}
+sub vcl_backend_fetch {
+  unset bereq.http.X-Forced-Revalidation;
+}
+`)
+	return sb.String()
+}
+
+// canaryVcl renders VCL which defines the canary backend on the given host, selects the variant of the request
+// in vcl_recv, hashes it and routes the fetches of the canary to its backend.
+func canaryVcl(canary Canary, host string) string {
+	var sb strings.Builder
+	sb.WriteString(`import std;
+import cookie;
+backend canary {
+  .host = "` + host + `";
+  .port = "` + canary.BackendPort + `";
+}
+sub vcl_recv {
+  unset req.http.X-Variant;
+  unset req.http.X-Variant-Assigned;
+`)
+	if canary.Header != "" {
+		sb.WriteString(`  if (req.http.` + canary.Header + ` == "canary" || req.http.` + canary.Header + ` == "control") {
+    set req.http.X-Variant = req.http.` + canary.Header + `;
+  }
+`)
+	}
+	if canary.Cookie != "" {
+		sb.WriteString(`  cookie.parse(req.http.Cookie);
+  if (!req.http.X-Variant && (cookie.get("` + canary.Cookie + `") == "canary" || cookie.get("` + canary.Cookie + `") == "control")) {
+    set req.http.X-Variant = cookie.get("` + canary.Cookie + `");
+  }
+  cookie.delete("` + canary.Cookie + `");
+  set req.http.Cookie = cookie.get_string();
+  if (req.http.Cookie == "") {
+    unset req.http.Cookie;
+  }
+`)
+	}
+	sb.WriteString(`  if (!req.http.X-Variant) {
+    set req.http.X-Variant-Assigned = "1";
+    if (std.random(0, 100) < ` + strconv.Itoa(canary.Percent) + `) {
+      set req.http.X-Variant = "canary";
+    } else {
+      set req.http.X-Variant = "control";
+    }
+  }
+}
+sub vcl_hash {
+  hash_data("variant:" + req.http.X-Variant);
+}
+sub vcl_backend_fetch {
+  unset bereq.http.X-Variant-Assigned;
+  if (bereq.http.X-Variant == "canary") {
+    set bereq.backend = canary;
+  }
+}
+sub vcl_deliver {
+  set resp.http.X-Variant = req.http.X-Variant;
+`)
+	if canary.Cookie != "" {
+		sb.WriteString(`  if (req.http.X-Variant-Assigned) {
+    add resp.http.Set-Cookie = "` + canary.Cookie + `=" + req.http.X-Variant + "; Path=/";
+  }
+`)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// jwtAuthVcl renders VCL which verifies the signature and the expiry of the token of protected requests.
+// vmod digest returns the HMAC in standard base64 with padding, which is converted to base64url without padding
+// to compare it with the signature of the token.
+func jwtAuthVcl(jwtAuth JwtAuth) string {
+	condition := "true"
+	if jwtAuth.Condition != "" {
+		condition = jwtAuth.Condition
+	}
+	return `import std;
+import digest;
+sub vcl_recv {
+  unset req.http.X-Jwt-Claims;
+  if (` + condition + `) {
+    if (req.http.Authorization !~ "^Bearer [A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+$") {
+      return (synth(401, "Missing Token"));
+    }
+    set req.http.X-Jwt = regsub(req.http.Authorization, "^Bearer ", "");
+    set req.http.X-Jwt-Signature = digest.hmac_sha256_base64({"` + jwtAuth.Secret + `"}, regsub(req.http.X-Jwt, "\.[^.]*$", ""));
+    set req.http.X-Jwt-Signature = regsuball(regsuball(regsub(req.http.X-Jwt-Signature, "=+$", ""), "\+", "-"), "/", "_");
+    if (req.http.X-Jwt-Signature != regsub(req.http.X-Jwt, "^.*\.", "")) {
+      unset req.http.X-Jwt;
+      unset req.http.X-Jwt-Signature;
+      return (synth(401, "Invalid Token"));
+    }
+    set req.http.X-Jwt-Claims = digest.base64url_nopad_decode(regsub(req.http.X-Jwt, "^[^.]*\.([^.]*)\..*$", "\1"));
+    unset req.http.X-Jwt;
+    unset req.http.X-Jwt-Signature;
+    if (req.http.X-Jwt-Claims !~ {""exp"\s*:\s*\d+"} ||
+        std.integer(regsub(req.http.X-Jwt-Claims, {"^.*"exp"\s*:\s*(\d+).*$"}, "\1"), 0) <= std.integer(time=now)) {
+      unset req.http.X-Jwt-Claims;
+      return (synth(401, "Expired Token"));
+    }
+    unset req.http.Authorization;
+  }
+}
+sub vcl_synth {
+  if (resp.status == 401) {
+    set resp.http.WWW-Authenticate = "Bearer";
+  }
+}
+`
+}
+
+// cacheRequestBodyVcl renders VCL which buffers request bodies of up to the given size.
+func cacheRequestBodyVcl(size string) string {
+	return `import std;
+sub vcl_recv {
+  if (req.method == "POST" || req.method == "PUT" || req.method == "PATCH") {
+    if (!std.cache_req_body(` + size + `)) {
+      return (synth(413, "Payload Too Large"));
+    }
+  }
+}
+`
+}
+
+// rateLimitVcl renders VCL which limits the rate of requests with vsthrottle.
+func rateLimitVcl(rateLimit RateLimit) string {
+	key := rateLimit.Key
+	if key == "" {
+		key = "client.ip"
+	}
+	check := `
+  if (vsthrottle.is_denied(` + key + `, ` + strconv.Itoa(rateLimit.Limit) + `, ` + VclDuration(rateLimit.Period) + `)) {
+    return (synth(429, "Too Many Requests"));
+  }
+`
+	var sb strings.Builder
+	sb.WriteString("import std;\nimport vsthrottle;\n")
+	if rateLimit.CountHits {
+		sb.WriteString("sub vcl_recv {" + check + "}\n")
+	} else {
+		sb.WriteString("sub vcl_miss {" + check + "}\nsub vcl_pass {" + check + "}\n")
+	}
+	sb.WriteString(`sub vcl_synth {
+  if (resp.status == 429) {
+    set resp.http.Retry-After = std.integer(duration=` + VclDuration(rateLimit.Period) + `);
+  }
+}
+`)
+	return sb.String()
+}
+
+// warnStaleVcl adds a Warning header to stale hits (RFC 7234, section 5.5).
+const warnStaleVcl = `
+import std;
+sub vcl_hit {
+  if (obj.ttl <= 0s) {
+    set req.http.X-Stale = "1";
+  }
+}
+sub vcl_deliver {
+  if (req.http.X-Stale) {
+    if (std.healthy(req.backend_hint)) {
+      set resp.http.Warning = {"110 - "Response is Stale""};
+    } else {
+      set resp.http.Warning = {"111 - "Revalidation Failed""};
+    }
+    unset req.http.X-Stale;
+  }
+}
+`
+
+// statusTtlsVcl renders VCL which assigns the given TTLs to backend responses by status.
+// Statuses are sorted to render stable VCL.
+func statusTtlsVcl(ttls map[int]time.Duration) string {
+	statuses := make([]int, 0, len(ttls))
+	for status := range ttls {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	var sb strings.Builder
+	sb.WriteString("sub vcl_backend_response {\n")
+	for _, status := range statuses {
+		sb.WriteString("  if (beresp.status == " + strconv.Itoa(status) + ") {\n    set beresp.ttl = " + VclDuration(ttls[status]) + ";\n  }\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// uncacheableStatusesVcl renders VCL which creates hit-for-miss or, with hitForPass, hit-for-pass objects
+// with the given TTL for backend responses with one of the given statuses.
+func uncacheableStatusesVcl(statuses []int, ttl time.Duration, hitForPass bool) string {
+	conditions := make([]string, len(statuses))
+	for i, status := range statuses {
+		conditions[i] = "beresp.status == " + strconv.Itoa(status)
+	}
+	return `
+sub vcl_backend_response {
+  if (` + strings.Join(conditions, " || ") + `) {
+` + uncacheableVcl(ttl, hitForPass) + `  }
+}
+`
+}
+
+// hitForPassVcl renders VCL which creates hit-for-pass objects with the given TTL for the backend responses
+// which the built-in VCL would create hit-for-miss objects for.
+func hitForPassVcl(ttl time.Duration) string {
+	return `
+sub vcl_backend_response {
+  if (!bereq.uncacheable && (beresp.ttl <= 0s ||
+      beresp.http.Set-Cookie ||
+      beresp.http.Surrogate-control ~ "(?i)no-store" ||
+      (!beresp.http.Surrogate-Control &&
+        beresp.http.Cache-Control ~ "(?i:no-cache|no-store|private)") ||
+      beresp.http.Vary == "*")) {
+` + uncacheableVcl(ttl, true) + `  }
+}
+`
+}
+
+// hitMissVcl renders VCL overriding the TTL of the hit-for-miss objects created by the built-in VCL,
+// whose vcl_beresp_hitmiss subroutine only runs if the one rendered here does not return. A negative TTL is 0s.
+func hitMissVcl(ttl time.Duration) string {
+	return `
+sub vcl_beresp_hitmiss {
+  set beresp.ttl = ` + VclDuration(max(ttl, 0)) + `;
+  set beresp.uncacheable = true;
+  return (deliver);
+}
+`
+}
+
+// uncacheableVcl renders the statements of vcl_backend_response creating a hit-for-miss
+// or hit-for-pass object with the given TTL, or 120s if 0.
+func uncacheableVcl(ttl time.Duration, hitForPass bool) string {
+	ttl = withDefaultDuration(ttl, 120*time.Second)
+	if hitForPass {
+		return "    return (pass(" + VclDuration(ttl) + "));\n"
+	}
+	return "    set beresp.ttl = " + VclDuration(ttl) + ";\n    set beresp.uncacheable = true;\n    return (deliver);\n"
+}
+
+// backendVcl renders the definition of the default backend for the given config at the given host.
+func backendVcl(config VarnishConfig, host string) string {
+	var sb strings.Builder
+	sb.WriteString("backend default {\n")
+	if config.BackendSocket != "" {
+		sb.WriteString("\t.path = \"" + backendSocketDir + "/" + filepath.Base(config.BackendSocket) + "\";\n")
+	} else {
+		sb.WriteString("\t.host = \"" + host + "\";\n\t.port = \"" + config.BackendPort + "\";\n")
+	}
+	if config.ConnectTimeout != 0 {
+		sb.WriteString("\t.connect_timeout = " + VclDuration(config.ConnectTimeout) + ";\n")
+	}
+	if config.FirstByteTimeout != 0 {
+		sb.WriteString("\t.first_byte_timeout = " + VclDuration(config.FirstByteTimeout) + ";\n")
+	}
+	if config.BetweenBytesTimeout != 0 {
+		sb.WriteString("\t.between_bytes_timeout = " + VclDuration(config.BetweenBytesTimeout) + ";\n")
+	}
+	if config.MaxConnections > 0 {
+		sb.WriteString("\t.max_connections = " + strconv.Itoa(config.MaxConnections) + ";\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// dynamicBackendVcl renders VCL which resolves the backend host of the given config at runtime with a director
+// of vmod dynamic (see VarnishConfig.BackendResolveTtl). It runs before the VCL of the instance and the custom VCL,
+// which can still pick another backend.
+func dynamicBackendVcl(config VarnishConfig) string {
+	var args strings.Builder
+	args.WriteString(`port = "` + config.BackendPort + `", ttl = ` + VclDuration(config.BackendResolveTtl))
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"connect_timeout", config.ConnectTimeout},
+		{"first_byte_timeout", config.FirstByteTimeout},
+		{"between_bytes_timeout", config.BetweenBytesTimeout},
+	} {
+		if timeout.value != 0 {
+			args.WriteString(", " + timeout.name + " = " + VclDuration(timeout.value))
+		}
+	}
+	if config.MaxConnections > 0 {
+		args.WriteString(", max_connections = " + strconv.Itoa(config.MaxConnections))
+	}
+	return `
+import dynamic;
+sub vcl_init {
+  new dynamic_backend = dynamic.director(` + args.String() + `);
+}
+sub vcl_recv {
+  set req.backend_hint = dynamic_backend.backend("` + withDefault(config.BackendHost, "host.docker.internal") + `");
+}
+`
+}
+
+// renderVcl renders the complete VCL for the given config: the backend definition, the given VCL
+// specific to the started instance (such as the backends and directors of a cluster node),
+// the snippets of all enabled features, the custom VCL of the config and finally the
+// snippets which must see the decisions of the custom VCL.
+// Varnish concatenates multiple definitions of the same subroutine, so the snippets
+// run in the order they are rendered.
+func renderVcl(config VarnishConfig, instanceVcl string) string {
+	host := withDefault(config.BackendHost, "host.docker.internal")
+	if strings.Contains(host, ":") {
+		// an IPv6 address
+		host = "[" + host + "]"
+	}
+	var sb strings.Builder
+	sb.WriteString("vcl 4.1;\n")
+	if config.BackendResolveTtl != 0 {
+		sb.WriteString("backend default none;\n")
+		sb.WriteString(dynamicBackendVcl(config))
+	} else {
+		sb.WriteString(backendVcl(config, host))
+	}
+	sb.WriteString(instanceVcl)
+	if config.EnforceMustRevalidate {
+		sb.WriteString(mustRevalidateVcl)
+	}
+	if config.HonorImmutable {
+		sb.WriteString(honorImmutableVcl)
+	}
+	if len(config.StripQualifiedFields) > 0 {
+		sb.WriteString(stripQualifiedFieldsVcl(config.StripQualifiedFields))
+	}
+	if config.StripSetCookieOnHit {
+		sb.WriteString(stripSetCookieOnHitVcl)
+	}
+	if config.EnableXCacheHeader {
+		sb.WriteString(xCacheHeaderVcl)
+	}
+	if config.EnableCacheStatus {
+		sb.WriteString(cacheStatusVcl)
+	}
+	if config.EchoRequestID {
+		sb.WriteString(echoRequestIDVcl)
+	}
+	if config.DoGzip {
+		sb.WriteString(doGzipVcl)
+	}
+	if config.DisableStream {
+		sb.WriteString(disableStreamVcl)
+	}
+	if config.DoEsi {
+		sb.WriteString(doEsiVcl)
+	}
+	if config.FileStorage != "" {
+		sb.WriteString(fileStorageVcl)
+	}
+	if len(config.HashOn.Headers) > 0 || len(config.HashOn.Cookies) > 0 || config.HashOn.Protocol {
+		sb.WriteString(hashOnVcl(config.HashOn))
+	}
+	if len(config.VaryOnCookies) > 0 {
+		sb.WriteString(varyOnCookiesVcl(config.VaryOnCookies))
+	}
+	if config.DeviceDetection {
+		sb.WriteString(deviceDetectionVcl + varyOnVcl("X-Device", "User-Agent"))
+	}
+	if len(config.Languages) > 0 {
+		sb.WriteString(languagesVcl(config.Languages))
+	}
+	if config.GeoIPDatabase != "" {
+		sb.WriteString(geoipVcl)
+	}
+	if config.VaryOnCountry {
+		sb.WriteString(varyOnCountryVcl + varyOnVcl("X-Country", ""))
+	}
+	if len(config.IgnoredQueryParams) > 0 {
+		sb.WriteString(ignoredQueryParamsVcl(config.IgnoredQueryParams))
+	}
+	if config.NormalizeHost {
+		sb.WriteString(normalizeHostVcl)
+	}
+	if config.EnableWebSockets {
+		sb.WriteString(webSocketsVcl)
+	}
+	if config.PipeCondition != "" {
+		sb.WriteString(pipeConditionVcl(config.PipeCondition))
+	}
+	if config.CachePreflights {
+		sb.WriteString(cachePreflightsVcl)
+	}
+	if len(config.CacheableMethods) > 0 {
+		sb.WriteString(cacheableMethodsVcl(config.CacheableMethods))
+	}
+	if config.CacheQueryMethod != "" {
+		sb.WriteString(queryMethodVcl(config.CacheQueryMethod))
+	}
+	if config.DisableCoalescing {
+		sb.WriteString(disableCoalescingVcl)
+	}
+	if len(config.RetryStatuses) > 0 {
+		sb.WriteString(retryStatusesVcl(config.RetryStatuses))
+	}
+	if config.RetryBackendErrors {
+		sb.WriteString(retryBackendErrorsVcl)
+	}
+	if len(config.TrustedProxies) > 0 {
+		sb.WriteString(trustedProxiesVcl(config.TrustedProxies))
+	}
+	if len(config.Tenants) > 0 {
+		sb.WriteString(tenantsVcl(config.Tenants))
+	}
+	if len(config.PurgeAllowed) > 0 {
+		sb.WriteString(purgeVcl(config.PurgeAllowed))
+	}
+	if config.RateLimit != nil {
+		sb.WriteString(rateLimitVcl(*config.RateLimit))
+	}
+	if config.CacheRequestBody != "" {
+		sb.WriteString(cacheRequestBodyVcl(config.CacheRequestBody))
+	}
+	if config.Canary != nil {
+		sb.WriteString(canaryVcl(*config.Canary, host))
+	}
+	if config.JwtAuth != nil {
+		sb.WriteString(jwtAuthVcl(*config.JwtAuth))
+	}
+	if config.ForcedRevalidation != nil {
+		sb.WriteString(forcedRevalidationVcl(*config.ForcedRevalidation))
+	}
+	if len(config.StatusTTLs) > 0 {
+		sb.WriteString(statusTtlsVcl(config.StatusTTLs))
+	}
+	if config.WarnStale {
+		sb.WriteString(warnStaleVcl)
+	}
+	if len(config.Synthetics) > 0 {
+		sb.WriteString(syntheticsVcl(config.Synthetics))
+	}
+	sb.WriteString(config.Vcl)
+	if config.RespectNoTransform {
+		sb.WriteString(respectNoTransformVcl)
+	}
+	if len(config.UncacheableStatuses) > 0 {
+		sb.WriteString(uncacheableStatusesVcl(config.UncacheableStatuses, config.UncacheableTtl, config.HitForPass))
+	}
+	if config.HitForPass {
+		sb.WriteString(hitForPassVcl(config.UncacheableTtl))
+	}
+	if config.HitForMissTtl != 0 {
+		sb.WriteString(hitMissVcl(config.HitForMissTtl))
+	}
+	if len(config.BackendRequestHeaders) > 0 {
+		sb.WriteString(backendRequestHeadersVcl(config.BackendRequestHeaders))
+	}
+	return hoistImports(sb.String())
+}
+
+var importRegexp = regexp.MustCompile(`(?m)^[ \t]*import\s+[^;]+;[ \t]*\n?`)
+
+// hoistImports moves all imports of vmods right after the VCL version declaration, keeping only the first
+// of identical imports, such that snippets and the custom VCL can import the same vmod independently.
+func hoistImports(vcl string) string {
+	var imports []string
+	body := importRegexp.ReplaceAllStringFunc(vcl, func(imp string) string {
+		imp = strings.TrimSpace(imp)
+		if !slices.Contains(imports, imp) {
+			imports = append(imports, imp)
+		}
+		return ""
+	})
+	if len(imports) == 0 {
+		return vcl
+	}
+	version, rest, _ := strings.Cut(body, "\n")
+	return version + "\n" + strings.Join(imports, "\n") + "\n" + rest
+}
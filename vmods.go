@@ -0,0 +1,35 @@
+package caching
+
+const (
+	geoip2Version = "1.3.0"
+	digestVersion = "1.0.3"
+	// dynamicBranch is the branch of vmod dynamic for the Varnish version of varnishImage,
+	// which does not tag releases for each Varnish version.
+	dynamicBranch = "7.5"
+)
+
+// vmodsImage is built locally, because the official Varnish image does not contain the vmods for GeoIP lookups,
+// HMAC signatures and resolving backends at runtime.
+const vmodsImage = "http-caching-tests/varnish-vmods:geoip2-" + geoip2Version + "-digest-" + digestVersion +
+	"-dynamic-" + dynamicBranch
+
+// vmodsDockerfile adds vmod geoip2, vmod digest and vmod dynamic to the official image with the install-vmod script
+// of the image, which needs the build dependencies listed in VMOD_DEPS.
+// See: https://github.com/fgsch/libvmod-geoip2, https://github.com/varnish/libvmod-digest
+// and https://github.com/nigoroll/libvmod-dynamic
+const vmodsDockerfile = `FROM ` + varnishImage + `
+USER root
+RUN set -e; \
+    apk add --no-cache libmaxminddb mhash; \
+    apk add --no-cache --virtual .vmod-deps $VMOD_DEPS libmaxminddb-dev mhash-dev; \
+    install-vmod https://github.com/fgsch/libvmod-geoip2/archive/refs/tags/v` + geoip2Version + `.tar.gz; \
+    install-vmod https://github.com/varnish/libvmod-digest/archive/refs/tags/libvmod-digest-` + digestVersion + `.tar.gz; \
+    install-vmod https://github.com/nigoroll/libvmod-dynamic/archive/refs/heads/` + dynamicBranch + `.tar.gz; \
+    apk del --no-network .vmod-deps
+USER varnish
+`
+
+// needsVmodsImage returns whether the config uses vmods which are only contained in the vmodsImage.
+func needsVmodsImage(config VarnishConfig) bool {
+	return config.GeoIPDatabase != "" || config.JwtAuth != nil || config.BackendResolveTtl != 0
+}
@@ -0,0 +1,92 @@
+// Contains tests for requests waiting on the waiting list for a backend fetch
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWaitingListServedByFetch tests that clients queued behind a backend fetch all wait for it
+// and are then served its response.
+func TestWaitingListServedByFetch(t *testing.T) {
+	t.Parallel()
+	var backendRequests atomic.Int32
+	holdTime := 1 * time.Second
+
+	// start a test server which holds requests open until released
+	release := make(chan struct{})
+	testServerPort, testServer := startTestServer(holdingHandler(&backendRequests, release))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+		Params:      map[string]string{"rush_exponent": "2"},
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// release the backend fetch after holdTime
+	time.AfterFunc(holdTime, func() { close(release) })
+
+	const K = 5
+
+	// queue K clients
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(300)}
+	responses, waited := queueClients(t, port, K, withXCacheControl(cacheControl))
+
+	// expect all clients to have waited for the fetch and to have been served its response
+	for i := 0; i < K; i++ {
+		assert.Equal(t, mkResp(http.StatusOK, responses[0].xResponse, withResponseCacheControl(cacheControl)), responses[i])
+		assert.Greater(t, waited[i], holdTime-100*time.Millisecond)
+		assert.Less(t, waited[i], holdTime+500*time.Millisecond)
+	}
+
+	// expect 1 backend request
+	assert.Equal(t, int32(1), backendRequests.Load())
+}
+
+// TestWaitingListFetchNeverCompletes tests that clients queued behind a backend fetch which never completes
+// wait until the fetch times out and are then all served the 503 response of the failed fetch,
+// which Varnish briefly caches to drain the waiting list instead of starting further fetches.
+func TestWaitingListFetchNeverCompletes(t *testing.T) {
+	t.Parallel()
+	var backendRequests atomic.Int32
+	firstByteTimeout := 2 * time.Second
+
+	// start a test server which holds requests open until the test ends
+	release := make(chan struct{})
+	defer close(release)
+	testServerPort, testServer := startTestServer(holdingHandler(&backendRequests, release))
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		FirstByteTimeout: firstByteTimeout,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	const K = 5
+
+	// queue K clients
+	responses, waited := queueClients(t, port, K, withXCacheControl(caching.CacheControl{MaxAge: caching.Seconds(300)}))
+
+	// expect all clients to have waited for the first byte timeout and to have been served a 503
+	for i := 0; i < K; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, responses[i].statusCode)
+		assert.Greater(t, waited[i], firstByteTimeout-100*time.Millisecond)
+		assert.Less(t, waited[i], firstByteTimeout+time.Second)
+	}
+
+	// expect 1 backend request
+	assert.Equal(t, int32(1), backendRequests.Load())
+}
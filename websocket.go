@@ -0,0 +1,192 @@
+package caching
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// This file contains a minimal implementation of WebSockets (RFC 6455), which only supports
+// unfragmented text messages. It suffices to verify that WebSocket traffic passes through a cache.
+
+// webSocketGuid is appended to the key of the client to compute the accept key of the server.
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func webSocketAccept(key string) string {
+	digest := sha1.Sum([]byte(key + webSocketGuid))
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// WebSocketEchoHandler is a backend handler which accepts WebSocket upgrades and echoes all text messages.
+// Requests without a WebSocket upgrade are responded to with 400.
+func WebSocketEchoHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+	if rw.Flush() != nil {
+		return
+	}
+	for {
+		message, err := readWebSocketFrame(rw.Reader)
+		if err != nil {
+			return
+		}
+		// servers must not mask their frames
+		if writeWebSocketFrame(conn, message, false) != nil {
+			return
+		}
+	}
+}
+
+// WebSocketConn is the client side of a WebSocket connection.
+type WebSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// DialWebSocket opens a WebSocket connection to the given path on localhost at the given port.
+func DialWebSocket(port string, path string) (*WebSocketConn, error) {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost:%s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, port, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected status %d of WebSocket upgrade", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, errors.New("invalid Sec-WebSocket-Accept of WebSocket upgrade")
+	}
+	return &WebSocketConn{conn: conn, reader: reader}, nil
+}
+
+// WriteText sends a text message.
+func (c *WebSocketConn) WriteText(message string) error {
+	// clients must mask their frames
+	return writeWebSocketFrame(c.conn, message, true)
+}
+
+// ReadText receives a text message.
+func (c *WebSocketConn) ReadText() (string, error) {
+	return readWebSocketFrame(c.reader)
+}
+
+// Close closes the connection without a closing handshake.
+func (c *WebSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// writeWebSocketFrame writes the message as a single text frame.
+func writeWebSocketFrame(w io.Writer, message string, mask bool) error {
+	frame := []byte{0x81} // FIN and text opcode
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(message) < 126:
+		frame = append(frame, maskBit|byte(len(message)))
+	case len(message) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(message)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(message)))
+	}
+	payload := []byte(message)
+	if mask {
+		key := make([]byte, 4)
+		_, err := rand.Read(key)
+		if err != nil {
+			return err
+		}
+		frame = append(frame, key...)
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readWebSocketFrame reads a single text frame and returns its message.
+func readWebSocketFrame(r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != 0x81 {
+		return "", fmt.Errorf("unsupported WebSocket frame 0x%02x", header[0])
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(r, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(r, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return "", err
+	}
+	var key []byte
+	if header[1]&0x80 != 0 {
+		key = make([]byte, 4)
+		_, err = io.ReadFull(r, key)
+		if err != nil {
+			return "", err
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return string(payload), nil
+}
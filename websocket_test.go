@@ -0,0 +1,87 @@
+// Contains tests for WebSocket connections through Varnish
+package caching_test
+
+import (
+	"caching"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// TestWebSocketsArePiped tests that with EnableWebSockets, a WebSocket connection is piped to the backend
+// and survives the proxy, while other requests are still cached.
+func TestWebSocketsArePiped(t *testing.T) {
+	t.Parallel()
+	var webSocketRequests, backendRequests int
+
+	// start a test server with a WebSocket endpoint
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/ws": func(w http.ResponseWriter, r *http.Request) {
+			webSocketRequests++
+			caching.WebSocketEchoHandler(w, r)
+		},
+		"/": echoCacheControlHandler(&backendRequests),
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort:      testServerPort,
+		EnableWebSockets: true,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// open a WebSocket connection and expect the messages to be echoed
+	conn, err := caching.DialWebSocket(port, "/ws")
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, message := range []string{"hello", "world"} {
+		require.NoError(t, conn.WriteText(message))
+		echo, err := conn.ReadText()
+		require.NoError(t, err)
+		assert.Equal(t, message, echo)
+	}
+
+	// send two other requests and expect the second one to be a cached response
+	cacheControl := caching.CacheControl{MaxAge: caching.Seconds(10)}
+	assert.Equal(t, "1", mkReq(t, port, "1", withXCacheControl(cacheControl)).xResponse)
+	assert.Equal(t, "1", mkReq(t, port, "2", withXCacheControl(cacheControl)).xResponse)
+
+	// expect one WebSocket request and one other backend request
+	assert.Equal(t, 1, webSocketRequests)
+	assert.Equal(t, 1, backendRequests)
+}
+
+// TestWebSocketsFailWithoutPipe tests that the built-in VCL does not support WebSockets,
+// because Varnish removes the Upgrade header as a hop-by-hop header when fetching from the backend.
+func TestWebSocketsFailWithoutPipe(t *testing.T) {
+	t.Parallel()
+	var webSocketRequests int
+
+	// start a test server with a WebSocket endpoint
+	testServerPort, testServer := startTestServerWithRoutes(caching.Routes{
+		"/ws": func(w http.ResponseWriter, r *http.Request) {
+			webSocketRequests++
+			caching.WebSocketEchoHandler(w, r)
+		},
+	})
+	defer testServer.Close()
+
+	// start varnish container
+	port, stopFunc, err := caching.StartVarnishInDocker(caching.VarnishConfig{
+		BackendPort: testServerPort,
+	})
+	require.NoError(t, err)
+	defer stopFunc()
+	waitForHealthy(t, port)
+
+	// try to open a WebSocket connection and expect the upgrade to be rejected by the backend
+	_, err = caching.DialWebSocket(port, "/ws")
+	assert.ErrorContains(t, err, "unexpected status 400")
+
+	// expect one WebSocket request
+	assert.Equal(t, 1, webSocketRequests)
+}